@@ -12,52 +12,234 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 const (
 	// ConfFileName defines a name of ipp-usb configuration file
 	ConfFileName = "ipp-usb.conf"
+
+	// ConfDropInDirName defines a name of the drop-in directory,
+	// which is searched for additional configuration files
+	ConfDropInDirName = "ipp-usb.conf.d"
 )
 
 // Configuration represents a program configuration
 type Configuration struct {
-	HTTPMinPort       int       // Starting port number for HTTP to bind to
-	HTTPMaxPort       int       // Ending port number for HTTP to bind to
-	DNSSdEnable       bool      // Enable DNS-SD advertising
-	LoopbackOnly      bool      // Use only loopback interface
-	IPV6Enable        bool      // Enable IPv6 advertising
-	LogDevice         LogLevel  // Per-device LogLevel mask
-	LogMain           LogLevel  // Main log LogLevel mask
-	LogConsole        LogLevel  // Console  LogLevel mask
-	LogMaxFileSize    int64     // Maximum log file size
-	LogMaxBackupFiles uint      // Count of files preserved during rotation
-	ColorConsole      bool      // Enable ANSI colors on console
-	Quirks            QuirksSet // Device quirks
+	HTTPMinPort       int               // Starting port number for HTTP to bind to
+	HTTPMaxPort       int               // Ending port number for HTTP to bind to
+	HTTPBacklog       uint              // HTTP listen backlog, 0 - default
+	HTTPAcceptRate    uint              // Max accepts per second, 0 - any
+	HTTPUnixDir       string            // Directory for Unix sockets, "" - TCP
+	DNSSdEnable       bool              // Enable DNS-SD advertising
+	DNSSdRetry        time.Duration     // DNS-SD publishing retry interval
+	DNSSdFatal        bool              // DNS-SD failure is fatal for device
+	DNSSdRefresh      time.Duration     // TXT refresh interval, 0 - off
+	DNSSdTruncate     DNSSdTruncate     // DNS-SD name truncation strategy
+	DNSSdNamePrefix   string            // Prepended to DNS-SD names
+	DNSSdNameSuffix   string            // Appended to DNS-SD names
+	DNSSdHook         string            // DNS-SD TXT post-processing hook
+	DNSSdTxtOrder     []string          // Keys to put first into TXT
+	DNSSdDomain       string            // DNS-SD domain, "" for default
+	DNSSdBackend      string            // DNS-SD backend or "auto"
+	DNSSdPseudoMAC    bool              // Advertise pseudo MAC as "mac" TXT
+	DNSSdScanLabel    string            // Label to distinguish scanner
+	DNSSdWebLabel     string            // Label to distinguish web UI
+	DNSSdWebPath      string            // Web UI path, "auto" or ""
+	DNSSdWebUUID      bool              // Add UUID and ty to web UI TXT
+	DNSSdExportDir    string            // Dir for .service files, "" - off
+	LoopbackOnly      bool              // Use only loopback interface
+	IPV6Enable        bool              // Enable IPv6 advertising
+	HTTP10KeepAlive   bool              // Allow keep-alive for HTTP/1.0
+	LogDevice         LogLevel          // Per-device LogLevel mask
+	LogMain           LogLevel          // Main log LogLevel mask
+	LogConsole        LogLevel          // Console  LogLevel mask
+	LogSubsys         LogSubsysLevels   // Per-subsystem LogLevel masks
+	LogMaxFileSize    int64             // Maximum log file size
+	LogMaxBackupFiles uint              // Count of files preserved during rotation
+	LogCaptureSize    int64             // Max size of captured print job
+	LogCaptureFiles   uint              // Max count of captured print jobs
+	ColorConsole      bool              // Enable ANSI colors on console
+	LogFailedRequests bool              // Log diagnostics of failed requests
+	UsbIdleTimeout    time.Duration     // Release idle device after timeout
+	UsbReenumGrace    time.Duration     // Wait for re-enumerated device
+	UsbMaxDevices     uint              // Max devices to serve, 0 - unlimited
+	UsbMaxInits       uint              // Max concurrent device initializations
+	UsbRqTimeout      time.Duration     // Proxy request timeout, 0 - none
+	UsbScanRqTimeout  time.Duration     // Same, for eSCL requests
+	UsbMaxScanJobs    uint              // Max concurrent scan jobs, 0 - any
+	UsbWriteRate      uint              // USB write rate limit, 0 - none
+	UsbWdFailures     uint              // Watchdog failures limit, 0 - off
+	UsbWdWindow       time.Duration     // Watchdog window, 0 - unlimited
+	CtrlTokenFile     string            // Control socket token file
+	CtrlAPISocket     string            // JSON API socket path, "" - none
+	CtrlAPIMode       os.FileMode       // JSON API socket file mode
+	HealthProbe       IppProbeOp        // Operation for liveness probe
+	ExtraTxt          map[string]string // Extra TXT items for all devices
+	AdvertisedPorts   map[string]int    // Advertised ports, by service type
+	DevicePorts       map[string]int    // Pinned HTTP ports, by device ident
+	ModelNames        ModelNames        // Friendly model names
+	IppLanguage       string            // Natural language or "auto"
+	IppVersion        goipp.Version     // Forced IPP version, 0 - auto
+	IppDNSSdNameAttrs []string          // Attributes to take DNS-SD name from
+	IppProductNorm    bool              // Normalize "product" TXT item
+	IppPreferPDF      bool              // Put PDF first into "pdl" TXT item
+	IppURFFixRes      bool              // Add missed resolution into URF
+	IppAirOverride    string            // Forced "air" TXT value, "" - auto
+	IppMediaSrcTxt    bool              // Advertise "media-source" TXT
+	IppQualityTxt     bool              // Advertise "print-quality" TXT
+	IppMediaTypeTxt   bool              // Advertise "media-type" TXT
+	IppEmptyNote      bool              // Advertise "note" even if empty
+	IppJobName        string            // job-name of ipp-usb own jobs
+	IppRpSlash        bool              // Leading slash in "rp" TXT item
+	IppSupportedVals  bool              // Query Get-Printer-Supported-Values
+	IppEmptyRetries   uint              // Retries on empty IPP response
+	IppEmptyDelay     time.Duration     // Delay between these retries
+	IppDupLastWins    bool              // Last of duplicated attrs wins
+	IppCheckOps       bool              // Reject unsupported operations
+	IppMaintStatus    goipp.Status      // Status of jobs rejected in maintenance
+	Quirks            QuirksSet         // Device quirks
+	Settings          ConfSettings      // Explicitly set parameters
 }
 
-// Conf contains a global instance of program configuration
-var Conf = Configuration{
+// ConfSetting represents explicitly set configuration parameter,
+// together with its origin. Used for diagnostics
+type ConfSetting struct {
+	Section   string   `json:"section"`             // Section name
+	Key       string   `json:"key"`                 // Parameter name
+	Value     string   `json:"value"`               // Parameter value
+	Origin    string   `json:"origin"`              // file:line
+	Overrides []string `json:"overrides,omitempty"` // Overridden origins
+}
+
+// ConfSettings contains explicitly set configuration parameters
+type ConfSettings []ConfSetting
+
+// set records parameter, loaded from the IniRecord. If parameter
+// was already set, the previous setting is replaced and its origin
+// is added to the list of overridden origins
+func (settings *ConfSettings) set(rec *IniRecord) {
+	setting := ConfSetting{
+		Section: rec.Section,
+		Key:     rec.Key,
+		Value:   rec.Value,
+		Origin:  fmt.Sprintf("%s:%d", rec.File, rec.Line),
+	}
+
+	for i, prev := range *settings {
+		if prev.Section == rec.Section && prev.Key == rec.Key {
+			setting.Overrides = append(setting.Overrides,
+				prev.Overrides...)
+			setting.Overrides = append(setting.Overrides,
+				prev.Origin)
+			*settings = append((*settings)[:i], (*settings)[i+1:]...)
+			break
+		}
+	}
+
+	*settings = append(*settings, setting)
+}
+
+// confDefault contains the default configuration
+var confDefault = Configuration{
 	HTTPMinPort:       60000,
 	HTTPMaxPort:       65535,
 	DNSSdEnable:       true,
+	DNSSdRetry:        DNSSdRetryInterval,
+	DNSSdFatal:        true,
+	DNSSdTxtOrder:     []string{"txtvers"},
+	DNSSdBackend:      "auto",
 	LoopbackOnly:      true,
 	IPV6Enable:        true,
 	LogDevice:         LogDebug,
 	LogMain:           LogDebug,
 	LogConsole:        LogDebug,
+	LogSubsys:         MakeLogSubsysLevels(LogAll),
 	LogMaxFileSize:    256 * 1024,
 	LogMaxBackupFiles: 5,
+	LogCaptureSize:    16 * 1024 * 1024,
+	LogCaptureFiles:   5,
 	ColorConsole:      true,
+	UsbMaxScanJobs:    1,
+	UsbMaxInits:       2,
+	CtrlAPIMode:       0660,
+	UsbWdWindow:       WatchdogWindow,
+	IppLanguage:       ippDefaultLanguage,
+	IppDNSSdNameAttrs: ippDNSSdNameAttrsDefault,
+	IppMaintStatus:    goipp.StatusErrorNotAcceptingJobs,
+	IppEmptyRetries:   2,
+	IppEmptyDelay:     IppEmptyRetryDelay,
+	IppJobName:        ippDefaultJobName,
 }
 
+// Conf contains a global instance of program configuration
+var Conf = confDefault
+
+// ConfLock protects parameters, changed by ConfReload, from
+// concurrent access
+//
+// ConfReload is called by the PnP manager, so PnP manager and
+// device initialization, that it waits for, may read them without
+// lock. Other goroutines must hold ConfLock for reading
+var ConfLock sync.RWMutex
+
 // ConfLoad loads the program configuration
 func ConfLoad() error {
+	return confLoad(&Conf)
+}
+
+// ConfReload reloads the program configuration, when daemon is
+// running. Only the following parameters are applied, others
+// require restart:
+//   - log levels (device, main, console and per-subsystem)
+//   - extra TXT items ([extra-txt] section and extra-txt-* quirks)
+//   - dns-sd-txt-order, dns-sd-pseudo-mac and dns-sd-hook
+//   - quirks; besides of extra-txt-*, they are applied to devices
+//     when they are initialized next time
+//
+// Origins of explicitly set parameters (see ConfSettings) are
+// replaced as well, so they describe the reloaded files
+//
+// If new configuration is invalid, error is returned and
+// current configuration remains unchanged
+//
+// Parameters are changed under the ConfLock
+func ConfReload() error {
+	conf := confDefault
+	err := confLoad(&conf)
+	if err != nil {
+		return err
+	}
+
+	ConfLock.Lock()
+	defer ConfLock.Unlock()
+
+	Conf.LogDevice = conf.LogDevice
+	Conf.LogMain = conf.LogMain
+	Conf.LogConsole = conf.LogConsole
+	Conf.LogSubsys = conf.LogSubsys
+	Conf.ExtraTxt = conf.ExtraTxt
+	Conf.DNSSdTxtOrder = conf.DNSSdTxtOrder
+	Conf.DNSSdPseudoMAC = conf.DNSSdPseudoMAC
+	Conf.DNSSdHook = conf.DNSSdHook
+	Conf.Quirks = conf.Quirks
+	Conf.Settings = conf.Settings
+
+	return nil
+}
+
+// confLoad loads the program configuration into conf
+func confLoad(conf *Configuration) error {
 	// Obtain path to executable directory
 	exepath, err := os.Executable()
 	if err != nil {
@@ -66,18 +248,26 @@ func ConfLoad() error {
 
 	exepath = filepath.Dir(exepath)
 
-	// Build list of configuration files
-	files := []string{
-		filepath.Join(PathConfDir, ConfFileName),
-		filepath.Join(exepath, ConfFileName),
-	}
+	// Build list of configuration files. Each main file is
+	// followed by the content of its drop-in directory, so
+	// drop-in files may override the main file
+	var files []string
+	for _, dir := range []string{PathConfDir, exepath} {
+		files = append(files, filepath.Join(dir, ConfFileName))
 
-	// Load file by file
-	for _, file := range files {
-		err = confLoadInternal(file)
+		var dropin []string
+		dropin, err = confDropInFiles(filepath.Join(dir, ConfDropInDirName))
 		if err != nil {
 			return fmt.Errorf("conf: %s", err)
 		}
+
+		files = append(files, dropin...)
+	}
+
+	// Load file by file
+	err = confLoadFiles(conf, files...)
+	if err != nil {
+		return fmt.Errorf("conf: %s", err)
 	}
 
 	// Load quirks
@@ -88,7 +278,7 @@ func ConfLoad() error {
 	}
 
 	if err == nil {
-		Conf.Quirks, err = LoadQuirksSet(quirksDirs...)
+		conf.Quirks, err = LoadQuirksSet(quirksDirs...)
 	}
 
 	return err
@@ -99,8 +289,83 @@ func confBadValue(rec *IniRecord, format string, args ...interface{}) error {
 	return fmt.Errorf(rec.Key+": "+format, args...)
 }
 
+// confDropInFiles returns list of *.conf files in the drop-in
+// directory, in lexical order. Missed directory is not an error
+func confDropInFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	// Note, ioutil.ReadDir returns entries sorted by name
+	var files []string
+	for _, ent := range entries {
+		if ent.Mode().IsRegular() &&
+			strings.HasSuffix(ent.Name(), ".conf") {
+			files = append(files, filepath.Join(dir, ent.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+// confLoadFiles loads configuration files in order and validates
+// the resulting configuration
+//
+// Files are merged in order of loading:
+//   - if some parameter is set in multiple files, the last file
+//     wins. Parameters that contain a list of values (i.e.,
+//     dns-sd-name) are replaced as a whole, not appended
+//   - sections, where keys are names of items ([extra-txt],
+//     [advertised-port], [http-port]), are merged per key. Items
+//     from all files are used, and if the same item is set in
+//     multiple files, the last file wins
+//   - [model-names] entries from all files are used in order of
+//     loading. If the same pattern is set again, the new name
+//     replaces the old one in place
+func confLoadFiles(conf *Configuration, files ...string) error {
+	for _, file := range files {
+		err := confLoadInternal(conf, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Validate configuration
+	if conf.HTTPMinPort >= conf.HTTPMaxPort {
+		return errors.New("http-min-port must be less that http-max-port")
+	}
+
+	return confCheckDevicePorts(conf.DevicePorts)
+}
+
+// confCheckDevicePorts checks that the same HTTP port is not
+// pinned to the different devices
+func confCheckDevicePorts(ports map[string]int) error {
+	idents := make([]string, 0, len(ports))
+	for ident := range ports {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+
+	owners := make(map[int]string)
+	for _, ident := range idents {
+		port := ports[ident]
+		if owner, found := owners[port]; found {
+			return fmt.Errorf("http-port %d: pinned to both %s and %s",
+				port, owner, ident)
+		}
+		owners[port] = ident
+	}
+
+	return nil
+}
+
 // Load the program configuration -- internal version
-func confLoadInternal(path string) error {
+func confLoadInternal(conf *Configuration, path string) error {
 	// Open configuration file
 	ini, err := OpenIniFile(path)
 	if err != nil {
@@ -124,31 +389,173 @@ func confLoadInternal(path string) error {
 		case "network":
 			switch rec.Key {
 			case "http-min-port":
-				err = confLoadIPPortKey(&Conf.HTTPMinPort, rec)
+				err = confLoadIPPortKey(&conf.HTTPMinPort, rec)
 			case "http-max-port":
-				err = confLoadIPPortKey(&Conf.HTTPMaxPort, rec)
+				err = confLoadIPPortKey(&conf.HTTPMaxPort, rec)
+			case "unix-socket-dir":
+				conf.HTTPUnixDir = rec.Value
+			case "http-listen-backlog":
+				err = confLoadUintKey(&conf.HTTPBacklog, rec)
+			case "http-accept-rate":
+				err = confLoadUintKey(&conf.HTTPAcceptRate, rec)
+			case "http10-keep-alive":
+				err = confLoadBinaryKey(&conf.HTTP10KeepAlive, rec, "disable", "enable")
 			case "dns-sd":
-				err = confLoadBinaryKey(&Conf.DNSSdEnable, rec, "disable", "enable")
+				err = confLoadBinaryKey(&conf.DNSSdEnable, rec, "disable", "enable")
+			case "dns-sd-hook":
+				conf.DNSSdHook = rec.Value
+			case "dns-sd-name-truncate":
+				err = confLoadDNSSdTruncateKey(&conf.DNSSdTruncate, rec)
+			case "dns-sd-name-prefix":
+				conf.DNSSdNamePrefix = rec.Value
+			case "dns-sd-name-suffix":
+				conf.DNSSdNameSuffix = rec.Value
+			case "dns-sd-backend":
+				err = confLoadDNSSdBackendKey(&conf.DNSSdBackend, rec)
+			case "dns-sd-domain":
+				err = confLoadDNSSdDomainKey(&conf.DNSSdDomain, rec)
+			case "dns-sd-scanner-label":
+				conf.DNSSdScanLabel = rec.Value
+			case "dns-sd-export-dir":
+				conf.DNSSdExportDir = rec.Value
+			case "dns-sd-web-label":
+				conf.DNSSdWebLabel = rec.Value
+			case "dns-sd-web-path":
+				err = confLoadDNSSdWebPathKey(&conf.DNSSdWebPath, rec)
+			case "dns-sd-web-uuid":
+				err = confLoadBinaryKey(&conf.DNSSdWebUUID, rec, "disable", "enable")
+			case "dns-sd-pseudo-mac":
+				err = confLoadBinaryKey(&conf.DNSSdPseudoMAC, rec, "disable", "enable")
+			case "dns-sd-txt-order":
+				err = confLoadDNSSdTxtOrderKey(&conf.DNSSdTxtOrder, rec)
+			case "dns-sd-refresh-interval":
+				err = confLoadSecondsKey(&conf.DNSSdRefresh, rec)
+			case "dns-sd-failure":
+				err = confLoadBinaryKey(&conf.DNSSdFatal, rec, "degraded", "fatal")
+			case "dns-sd-retry-interval":
+				err = confLoadSecondsKey(&conf.DNSSdRetry, rec)
+				if err == nil && conf.DNSSdRetry == 0 {
+					err = confBadValue(rec, "must be at least 1")
+				}
 			case "interface":
-				err = confLoadBinaryKey(&Conf.LoopbackOnly, rec, "all", "loopback")
+				err = confLoadBinaryKey(&conf.LoopbackOnly, rec, "all", "loopback")
 			case "ipv6":
-				err = confLoadBinaryKey(&Conf.IPV6Enable, rec, "disable", "enable")
+				err = confLoadBinaryKey(&conf.IPV6Enable, rec, "disable", "enable")
 			}
 		case "logging":
 			switch rec.Key {
 			case "device-log":
-				err = confLoadLogLevelKey(&Conf.LogDevice, rec)
+				err = confLoadLogLevelKey(&conf.LogDevice, rec)
 			case "main-log":
-				err = confLoadLogLevelKey(&Conf.LogMain, rec)
+				err = confLoadLogLevelKey(&conf.LogMain, rec)
 			case "console-log":
-				err = confLoadLogLevelKey(&Conf.LogConsole, rec)
+				err = confLoadLogLevelKey(&conf.LogConsole, rec)
 			case "console-color":
-				err = confLoadBinaryKey(&Conf.ColorConsole, rec, "disable", "enable")
+				err = confLoadBinaryKey(&conf.ColorConsole, rec, "disable", "enable")
 			case "max-file-size":
-				err = confLoadSizeKey(&Conf.LogMaxFileSize, rec)
+				err = confLoadSizeKey(&conf.LogMaxFileSize, rec)
 			case "max-backup-files":
-				err = confLoadUintKey(&Conf.LogMaxBackupFiles, rec)
+				err = confLoadUintKey(&conf.LogMaxBackupFiles, rec)
+			case "capture-max-size":
+				err = confLoadSizeKey(&conf.LogCaptureSize, rec)
+			case "capture-max-files":
+				err = confLoadUintKeyRange(&conf.LogCaptureFiles, rec,
+					1, math.MaxUint32)
+			case "failed-requests":
+				err = confLoadBinaryKey(&conf.LogFailedRequests, rec, "disable", "enable")
+			default:
+				err = confLoadLogSubsysKey(&conf.LogSubsys, rec)
+			}
+		case "usb":
+			switch rec.Key {
+			case "idle-timeout":
+				err = confLoadSecondsKey(&conf.UsbIdleTimeout, rec)
+			case "reenumeration-grace":
+				err = confLoadSecondsKey(&conf.UsbReenumGrace, rec)
+			case "max-devices":
+				err = confLoadUintKey(&conf.UsbMaxDevices, rec)
+			case "max-inits":
+				err = confLoadUintKeyRange(&conf.UsbMaxInits, rec, 1, 64)
+			case "request-timeout":
+				err = confLoadSecondsKey(&conf.UsbRqTimeout, rec)
+			case "scan-request-timeout":
+				err = confLoadSecondsKey(&conf.UsbScanRqTimeout, rec)
+			case "max-scan-jobs":
+				err = confLoadUintKey(&conf.UsbMaxScanJobs, rec)
+			case "write-rate":
+				err = confLoadUintKey(&conf.UsbWriteRate, rec)
+			case "watchdog-failures":
+				err = confLoadUintKey(&conf.UsbWdFailures, rec)
+			case "watchdog-window":
+				err = confLoadSecondsKey(&conf.UsbWdWindow, rec)
+			case "health-probe":
+				err = confLoadIppProbeOpKey(&conf.HealthProbe, rec)
+			}
+		case "ipp":
+			switch rec.Key {
+			case "natural-language":
+				err = confLoadLanguageKey(&conf.IppLanguage, rec)
+			case "ipp-version":
+				err = confLoadIppVersionKey(&conf.IppVersion, rec)
+			case "dns-sd-name":
+				err = confLoadIppDNSSdNameKey(&conf.IppDNSSdNameAttrs, rec)
+			case "product-normalize":
+				err = confLoadBinaryKey(&conf.IppProductNorm, rec, "disable", "enable")
+			case "prefer-pdf":
+				err = confLoadBinaryKey(&conf.IppPreferPDF, rec, "disable", "enable")
+			case "urf-fix-resolution":
+				err = confLoadBinaryKey(&conf.IppURFFixRes, rec, "disable", "enable")
+			case "air-override":
+				conf.IppAirOverride = confAirOverride(rec.Value)
+			case "media-source-txt":
+				err = confLoadBinaryKey(&conf.IppMediaSrcTxt, rec, "disable", "enable")
+			case "rp-leading-slash":
+				err = confLoadBinaryKey(&conf.IppRpSlash, rec, "disable", "enable")
+			case "job-name":
+				err = confLoadJobNameKey(&conf.IppJobName, rec)
+			case "empty-note":
+				err = confLoadBinaryKey(&conf.IppEmptyNote, rec, "disable", "enable")
+			case "media-type-txt":
+				err = confLoadBinaryKey(&conf.IppMediaTypeTxt, rec, "disable", "enable")
+			case "print-quality-txt":
+				err = confLoadBinaryKey(&conf.IppQualityTxt, rec, "disable", "enable")
+			case "supported-values":
+				err = confLoadBinaryKey(&conf.IppSupportedVals, rec, "disable", "enable")
+			case "empty-response-retries":
+				err = confLoadUintKey(&conf.IppEmptyRetries, rec)
+			case "empty-response-delay":
+				err = confLoadSecondsKey(&conf.IppEmptyDelay, rec)
+			case "check-operations":
+				err = confLoadBinaryKey(&conf.IppCheckOps, rec, "disable", "enable")
+			case "duplicate-attributes":
+				err = confLoadBinaryKey(&conf.IppDupLastWins, rec, "first", "last")
+			case "maintenance-status":
+				err = confLoadIppStatusKey(&conf.IppMaintStatus, rec)
+			}
+		case "control":
+			switch rec.Key {
+			case "token-file":
+				conf.CtrlTokenFile = rec.Value
+			case "api-socket":
+				conf.CtrlAPISocket = rec.Value
+			case "api-socket-mode":
+				err = confLoadFileModeKey(&conf.CtrlAPIMode, rec)
+			}
+		case "extra-txt":
+			if conf.ExtraTxt == nil {
+				conf.ExtraTxt = make(map[string]string)
 			}
+			conf.ExtraTxt[rec.Key] = rec.Value
+		case "advertised-port":
+			err = confLoadAdvertisedPortKey(&conf.AdvertisedPorts, rec)
+		case "model-names":
+			err = confLoadModelNameKey(&conf.ModelNames, rec)
+		case "http-port":
+			err = confLoadDevicePortKey(&conf.DevicePorts, rec)
+		}
+
+		if err == nil {
+			conf.Settings.set(rec)
 		}
 	}
 
@@ -156,11 +563,6 @@ func confLoadInternal(path string) error {
 		return err
 	}
 
-	// Validate configuration
-	if Conf.HTTPMinPort >= Conf.HTTPMaxPort {
-		return errors.New("http-min-port must be less that http-max-port")
-	}
-
 	return nil
 }
 
@@ -178,6 +580,81 @@ func confLoadIPPortKey(out *int, rec *IniRecord) error {
 	return nil
 }
 
+// Load the advertised port key. Key is the DNS-SD service type
+// (i.e., "_ipp._tcp"), value is the port number
+func confLoadAdvertisedPortKey(out *map[string]int, rec *IniRecord) error {
+	if !strings.HasPrefix(rec.Key, "_") ||
+		!(strings.HasSuffix(rec.Key, "._tcp") ||
+			strings.HasSuffix(rec.Key, "._udp")) {
+		return confBadValue(rec, "invalid DNS-SD service type")
+	}
+
+	var port int
+	err := confLoadIPPortKey(&port, rec)
+	if err != nil {
+		return err
+	}
+
+	if *out == nil {
+		*out = make(map[string]int)
+	}
+	(*out)[rec.Key] = port
+
+	return nil
+}
+
+// Load the pinned HTTP port key. Key is the device ident (the
+// name of the device state and log files), value is the port number
+func confLoadDevicePortKey(out *map[string]int, rec *IniRecord) error {
+	var port int
+	err := confLoadIPPortKey(&port, rec)
+	if err != nil {
+		return err
+	}
+
+	if *out == nil {
+		*out = make(map[string]int)
+	}
+	(*out)[rec.Key] = port
+
+	return nil
+}
+
+// Load the model name key. Key is the model pattern, value is the
+// friendly name
+func confLoadModelNameKey(out *ModelNames, rec *IniRecord) error {
+	if rec.Value == "" {
+		return confBadValue(rec, "friendly name missed")
+	}
+
+	mn, err := NewModelName(rec.Key, rec.Value)
+	if err != nil {
+		return confBadValue(rec, "%s", err)
+	}
+
+	for i := range *out {
+		if (*out)[i].Pattern == mn.Pattern {
+			(*out)[i] = mn
+			return nil
+		}
+	}
+
+	*out = append(*out, mn)
+	return nil
+}
+
+// Load the per-subsystem log level key (i.e., "usb-log").
+// Keys, not related to any subsystem, are ignored
+func confLoadLogSubsysKey(out *LogSubsysLevels, rec *IniRecord) error {
+	for subsys, name := range logSubsysNames {
+		if name != "" && rec.Key == name+"-log" {
+			return confLoadLogLevelKey(&out[subsys], rec)
+		}
+	}
+
+	return nil
+}
+
 // Load the binary key
 func confLoadBinaryKey(out *bool, rec *IniRecord, vFalse, vTrue string) error {
 	switch rec.Value {
@@ -241,6 +718,267 @@ func confLoadQuirksResetMethodKey(out *QuirksResetMethod, rec *IniRecord) error
 	}
 }
 
+// Load list of USB interface classes
+func confLoadUsbClassListKey(out *[]int, rec *IniRecord) error {
+	classes := []int{}
+
+	if rec.Value != "none" {
+		for _, s := range strings.Split(rec.Value, ",") {
+			s = strings.TrimSpace(s)
+			class, err := strconv.ParseUint(s, 10, 8)
+			if err != nil {
+				return confBadValue(rec,
+					"%q: invalid USB interface class", s)
+			}
+
+			classes = append(classes, int(class))
+		}
+	}
+
+	*out = classes
+	return nil
+}
+
+// Load job-name key. IPP limits names to 255 octets
+func confLoadJobNameKey(out *string, rec *IniRecord) error {
+	switch {
+	case rec.Value == "":
+		return confBadValue(rec, "must not be empty")
+	case len(rec.Value) > 255:
+		return confBadValue(rec, "too long (max is 255 bytes)")
+	}
+
+	*out = rec.Value
+	return nil
+}
+
+// Load list of HTTP resource paths (comma-separated, each path
+// must be absolute)
+func confLoadHTTPPathListKey(out *[]string, rec *IniRecord) error {
+	paths := []string{}
+
+	for _, s := range strings.Split(rec.Value, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+			continue
+		case !strings.HasPrefix(s, "/"):
+			return confBadValue(rec, "%q: path must start with /", s)
+		}
+
+		paths = append(paths, s)
+	}
+
+	*out = paths
+	return nil
+}
+
+// Load list of IPP attributes, DNS-SD name is taken from
+func confLoadIppDNSSdNameKey(out *[]string, rec *IniRecord) error {
+	attrs := []string{}
+
+	for _, s := range strings.Split(rec.Value, ",") {
+		s = strings.TrimSpace(s)
+		found := false
+		for _, name := range ippDNSSdNameAttrsAll {
+			if s == name {
+				found = true
+			}
+		}
+
+		if !found {
+			return confBadValue(rec, "%q: unsupported attribute", s)
+		}
+
+		attrs = append(attrs, s)
+	}
+
+	*out = attrs
+	return nil
+}
+
+// Load natural language key (language tag or "auto")
+func confLoadLanguageKey(out *string, rec *IniRecord) error {
+	if rec.Value != "auto" {
+		if len(rec.Value) == 0 || len(rec.Value) > 63 {
+			return confBadValue(rec, "%q: invalid language", rec.Value)
+		}
+
+		for _, c := range rec.Value {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '-') {
+				return confBadValue(rec, "%q: invalid language",
+					rec.Value)
+			}
+		}
+	}
+
+	*out = rec.Value
+	return nil
+}
+
+// confAirOverride converts value of the air-override key:
+// "auto" is the same as empty value, i.e., no override
+func confAirOverride(value string) string {
+	if value == "auto" {
+		return ""
+	}
+	return value
+}
+
+// Load DNSSdTruncate key
+func confLoadDNSSdTruncateKey(out *DNSSdTruncate, rec *IniRecord) error {
+	switch rec.Value {
+	case "end":
+		*out = DNSSdTruncateEnd
+		return nil
+	case "middle":
+		*out = DNSSdTruncateMiddle
+		return nil
+	default:
+		return confBadValue(rec, "must be end or middle")
+	}
+}
+
+// Load DNS-SD backend key
+func confLoadDNSSdBackendKey(out *string, rec *IniRecord) error {
+	if err := dnssdBackendAvailable(rec.Value); err != nil {
+		return confBadValue(rec, "%s", err)
+	}
+
+	*out = rec.Value
+	return nil
+}
+
+// Load DNS-SD domain key
+func confLoadDNSSdDomainKey(out *string, rec *IniRecord) error {
+	domain := strings.TrimSuffix(rec.Value, ".")
+	if strings.EqualFold(domain, "local") {
+		*out = ""
+		return nil
+	}
+
+	if err := dnssdCheckDomain(domain); err != nil {
+		return confBadValue(rec, "%q: %s", rec.Value, err)
+	}
+
+	*out = domain
+	return nil
+}
+
+// Load DNS-SD web path key (none, auto or absolute path)
+func confLoadDNSSdWebPathKey(out *string, rec *IniRecord) error {
+	switch {
+	case rec.Value == "none":
+		*out = ""
+	case rec.Value == "auto" || strings.HasPrefix(rec.Value, "/"):
+		*out = rec.Value
+	default:
+		return confBadValue(rec, "must be none, auto or /path")
+	}
+
+	return nil
+}
+
+// Load DNS-SD TXT order key (comma-separated list of keys)
+func confLoadDNSSdTxtOrderKey(out *[]string, rec *IniRecord) error {
+	keys := []string{}
+
+	for _, s := range strings.Split(rec.Value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if err := dnssdCheckTxtItem(s, ""); err != nil {
+			return confBadValue(rec, "%q: %s", s, err)
+		}
+
+		keys = append(keys, s)
+	}
+
+	*out = keys
+	return nil
+}
+
+// Load IppProbeOp key
+func confLoadIppProbeOpKey(out *IppProbeOp, rec *IniRecord) error {
+	switch rec.Value {
+	case "printer-state":
+		*out = IppProbeGetPrinterState
+		return nil
+	case "validate-job":
+		*out = IppProbeValidateJob
+		return nil
+	default:
+		return confBadValue(rec, "must be printer-state or validate-job")
+	}
+}
+
+// Load IPP version key. "auto" is loaded as 0
+func confLoadIppVersionKey(out *goipp.Version, rec *IniRecord) error {
+	if rec.Value == "auto" {
+		*out = 0
+		return nil
+	}
+
+	ver, ok := ippParseVersion(rec.Value)
+	if !ok || ver > ippVersionMax {
+		return confBadValue(rec, "%q: must be auto or %s max",
+			rec.Value, ippVersionMax)
+	}
+
+	*out = ver
+	return nil
+}
+
+// Load file mode key (octal permission bits)
+func confLoadFileModeKey(out *os.FileMode, rec *IniRecord) error {
+	mode, err := strconv.ParseUint(rec.Value, 8, 32)
+	if err != nil || mode > 0777 {
+		return confBadValue(rec, "%q: invalid file mode", rec.Value)
+	}
+
+	*out = os.FileMode(mode)
+	return nil
+}
+
+// Load IPP error status key. Status is specified either by
+// name (i.e., "server-error-not-accepting-jobs") or numerically
+func confLoadIppStatusKey(out *goipp.Status, rec *IniRecord) error {
+	for status := goipp.Status(0x0400); status < 0x0600; status++ {
+		if rec.Value == status.String() {
+			*out = status
+			return nil
+		}
+	}
+
+	code, err := strconv.ParseUint(rec.Value, 0, 16)
+	if err != nil || code < 0x0400 {
+		return confBadValue(rec, "%q: not an IPP error status", rec.Value)
+	}
+
+	*out = goipp.Status(code)
+	return nil
+}
+
+// Load QuirksUsbAlt key
+func confLoadQuirksUsbAltKey(out *QuirksUsbAlt, rec *IniRecord) error {
+	if rec.Value == "auto" {
+		*out = QuirksUsbAltAuto
+		return nil
+	}
+
+	var alt uint
+	err := confLoadUintKeyRange(&alt, rec, 0, 255)
+	if err != nil {
+		return confBadValue(rec, "must be auto or 0...255")
+	}
+
+	*out = QuirksUsbAlt(alt + 1)
+	return nil
+}
+
 // Load time.Duration key
 func confLoadDurationKey(out *time.Duration, rec *IniRecord) error {
 	var ms uint
@@ -251,12 +989,26 @@ func confLoadDurationKey(out *time.Duration, rec *IniRecord) error {
 	return err
 }
 
+// Load time.Duration key, specified in seconds
+func confLoadSecondsKey(out *time.Duration, rec *IniRecord) error {
+	var sec uint
+	err := confLoadUintKey(&sec, rec)
+	if err == nil {
+		*out = time.Second * time.Duration(sec)
+	}
+	return err
+}
+
 // Load size key
+//
+// Note, rec is not modified, so the value is tracked
+// in ConfSettings as written in file, with units
 func confLoadSizeKey(out *int64, rec *IniRecord) error {
 	units := uint64(1)
+	value := rec.Value
 
-	if l := len(rec.Value); l > 0 {
-		switch rec.Value[l-1] {
+	if l := len(value); l > 0 {
+		switch value[l-1] {
 		case 'k', 'K':
 			units = 1024
 		case 'm', 'M':
@@ -264,13 +1016,13 @@ func confLoadSizeKey(out *int64, rec *IniRecord) error {
 		}
 
 		if units != 1 {
-			rec.Value = rec.Value[:l-1]
+			value = value[:l-1]
 		}
 	}
 
-	sz, err := strconv.ParseUint(rec.Value, 10, 64)
+	sz, err := strconv.ParseUint(value, 10, 64)
 	if err != nil {
-		return confBadValue(rec, "%q: invalid size", rec.Value)
+		return confBadValue(rec, "%q: invalid size", value)
 	}
 
 	if sz > uint64(math.MaxInt64/units) {
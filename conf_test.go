@@ -0,0 +1,360 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for configuration loading
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Test loading of the main configuration file with drop-in files
+func TestConfLoadDropIn(t *testing.T) {
+	const dir = "testdata/" + ConfDropInDirName
+
+	saved := Conf
+	defer func() { Conf = saved }()
+
+	// Check list of drop-in files
+	dropin, err := confDropInFiles(dir)
+	if err != nil {
+		t.Fatalf("confDropInFiles(%q): %s", dir, err)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "10-network.conf"),
+		filepath.Join(dir, "20-network.conf"),
+	}
+
+	if len(dropin) != len(expected) {
+		t.Fatalf("confDropInFiles(%q): expected %d files, got %d",
+			dir, len(expected), len(dropin))
+	}
+
+	for i := range expected {
+		if dropin[i] != expected[i] {
+			t.Errorf("confDropInFiles(%q): file %d: expected %q, got %q",
+				dir, i, expected[i], dropin[i])
+		}
+	}
+
+	// Missed drop-in directory is not an error
+	_, err = confDropInFiles(dir + "-not-exist")
+	if err != nil {
+		t.Errorf("confDropInFiles(%q): %s", dir+"-not-exist", err)
+	}
+
+	// Load and merge
+	files := append([]string{"testdata/ipp-usb.conf"}, dropin...)
+	err = confLoadFiles(&Conf, files...)
+	if err != nil {
+		t.Fatalf("confLoadFiles: %s", err)
+	}
+
+	if Conf.HTTPMinPort != 51000 {
+		t.Errorf("http-min-port: expected %d, got %d",
+			51000, Conf.HTTPMinPort)
+	}
+
+	if Conf.HTTPMaxPort != 65535 {
+		t.Errorf("http-max-port: expected %d, got %d",
+			65535, Conf.HTTPMaxPort)
+	}
+
+	if Conf.IPV6Enable {
+		t.Errorf("ipv6: expected disable, got enable")
+	}
+}
+
+// Test merging of list parameters and sections from multiple files
+func TestConfLoadMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file1 := filepath.Join(dir, "10-first.conf")
+	ioutil.WriteFile(file1, []byte(
+		"[ipp]\n"+
+			"  dns-sd-name = printer-info, printer-make-and-model\n"+
+			"[extra-txt]\n"+
+			"  note = first\n"+
+			"  adminurl = http://example.com/\n"+
+			"[model-names]\n"+
+			"  HP = First\n"+
+			"  Canon = Canon\n"), 0644)
+
+	file2 := filepath.Join(dir, "20-second.conf")
+	ioutil.WriteFile(file2, []byte(
+		"[ipp]\n"+
+			"  dns-sd-name = printer-dns-sd-name\n"+
+			"[extra-txt]\n"+
+			"  note = second\n"+
+			"[model-names]\n"+
+			"  HP = Second\n"), 0644)
+
+	conf := confDefault
+	err = confLoadFiles(&conf, file1, file2)
+	if err != nil {
+		t.Fatalf("confLoadFiles: %s", err)
+	}
+
+	// List parameter is replaced as a whole
+	expectedAttrs := []string{"printer-dns-sd-name"}
+	if !reflect.DeepEqual(conf.IppDNSSdNameAttrs, expectedAttrs) {
+		t.Errorf("dns-sd-name: expected %q, got %q",
+			expectedAttrs, conf.IppDNSSdNameAttrs)
+	}
+
+	// Sections are merged per key
+	expectedTxt := map[string]string{
+		"note":     "second",
+		"adminurl": "http://example.com/",
+	}
+	if !reflect.DeepEqual(conf.ExtraTxt, expectedTxt) {
+		t.Errorf("[extra-txt]: expected %v, got %v",
+			expectedTxt, conf.ExtraTxt)
+	}
+
+	// Model names are merged per pattern
+	if len(conf.ModelNames) != 2 {
+		t.Errorf("[model-names]: expected 2 entries, got %d",
+			len(conf.ModelNames))
+	}
+
+	for model, name := range map[string]string{
+		"HP LaserJet": "Second",
+		"Canon G3010": "Canon",
+	} {
+		if present := conf.ModelNames.Lookup(model); present != name {
+			t.Errorf("[model-names]: %q: expected %q, got %q",
+				model, name, present)
+		}
+	}
+}
+
+// Test tracking of origins of explicitly set parameters
+func TestConfSettings(t *testing.T) {
+	const dir = "testdata/" + ConfDropInDirName
+
+	conf := confDefault
+	err := confLoadFiles(&conf, "testdata/ipp-usb.conf",
+		filepath.Join(dir, "10-network.conf"),
+		filepath.Join(dir, "20-network.conf"))
+	if err != nil {
+		t.Fatalf("confLoadFiles: %s", err)
+	}
+
+	var found *ConfSetting
+	for i := range conf.Settings {
+		setting := &conf.Settings[i]
+		if setting.Section == "network" && setting.Key == "http-min-port" {
+			if found != nil {
+				t.Errorf("http-min-port: duplicated setting")
+			}
+			found = setting
+		}
+	}
+
+	if found == nil {
+		t.Fatalf("http-min-port: setting not found")
+	}
+
+	expected := ConfSetting{
+		Section: "network",
+		Key:     "http-min-port",
+		Value:   "51000",
+		Origin:  filepath.Join(dir, "20-network.conf") + ":3",
+		Overrides: []string{
+			"testdata/ipp-usb.conf:6",
+			filepath.Join(dir, "10-network.conf") + ":3",
+		},
+	}
+
+	if !reflect.DeepEqual(*found, expected) {
+		t.Errorf("http-min-port:\nexpected %+v\npresent  %+v",
+			expected, *found)
+	}
+
+	// Values are tracked as written in file, with units
+	size := ""
+	for _, setting := range conf.Settings {
+		if setting.Section == "logging" &&
+			setting.Key == "max-file-size" {
+			size = setting.Value
+		}
+	}
+
+	if size != "256K" {
+		t.Errorf("max-file-size: expected %q, present %q", "256K", size)
+	}
+}
+
+// Test that configuration reload only affects reloadable parameters
+func TestConfReload(t *testing.T) {
+	saved := Conf
+	defer func() { Conf = saved }()
+
+	Conf.HTTPMinPort = 12345
+	Conf.DNSSdHook = "/bin/false"
+	Conf.ExtraTxt = map[string]string{"note": "reload test"}
+
+	err := ConfReload()
+	if err != nil {
+		t.Skipf("ConfReload: %s", err)
+	}
+
+	if Conf.HTTPMinPort != 12345 {
+		t.Errorf("http-min-port must not be reloaded")
+	}
+
+	if Conf.DNSSdHook == "/bin/false" {
+		t.Errorf("dns-sd-hook must be reloaded")
+	}
+
+	if Conf.ExtraTxt["note"] == "reload test" {
+		t.Errorf("extra-txt must be reloaded")
+	}
+}
+
+// Test loading of the [advertised-port] section
+func TestConfLoadAdvertisedPort(t *testing.T) {
+	tests := []struct {
+		data  string
+		ports map[string]int
+		ok    bool
+	}{
+		{"[advertised-port]\n_ipp._tcp = 8631\n_uscan._tcp = 8632\n",
+			map[string]int{"_ipp._tcp": 8631, "_uscan._tcp": 8632}, true},
+		{"[advertised-port]\n_ipp._tcp = 0\n", nil, false},
+		{"[advertised-port]\n_ipp._tcp = 65536\n", nil, false},
+		{"[advertised-port]\nipp = 8631\n", nil, false},
+	}
+
+	for _, test := range tests {
+		file, err := ioutil.TempFile("", "ipp-usb-conf")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		file.WriteString(test.data)
+		file.Close()
+
+		conf := confDefault
+		err = confLoadInternal(&conf, file.Name())
+		os.Remove(file.Name())
+
+		if (err == nil) != test.ok {
+			t.Errorf("%q: unexpected error status: %v", test.data, err)
+			continue
+		}
+
+		if !test.ok {
+			continue
+		}
+
+		if len(conf.AdvertisedPorts) != len(test.ports) {
+			t.Errorf("%q: expected %v, got %v",
+				test.data, test.ports, conf.AdvertisedPorts)
+			continue
+		}
+
+		for svc, port := range test.ports {
+			if conf.AdvertisedPorts[svc] != port {
+				t.Errorf("%q: %s: expected %d, got %d", test.data,
+					svc, port, conf.AdvertisedPorts[svc])
+			}
+		}
+	}
+}
+
+// Test loading of the [http-port] section
+func TestConfLoadDevicePort(t *testing.T) {
+	tests := []struct {
+		data  string
+		ports map[string]int
+		ok    bool
+	}{
+		{"[http-port]\ndev-1 = 60100\ndev-2 = 60101\n",
+			map[string]int{"dev-1": 60100, "dev-2": 60101}, true},
+		{"[http-port]\ndev-1 = 60100\ndev-1 = 60101\n",
+			map[string]int{"dev-1": 60101}, true},
+		{"[http-port]\ndev-1 = 0\n", nil, false},
+		{"[http-port]\ndev-1 = 65536\n", nil, false},
+		{"[http-port]\ndev-1 = 60100\ndev-2 = 60100\n", nil, false},
+	}
+
+	for _, test := range tests {
+		file, err := ioutil.TempFile("", "ipp-usb-conf")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		file.WriteString(test.data)
+		file.Close()
+
+		conf := confDefault
+		err = confLoadFiles(&conf, file.Name())
+		os.Remove(file.Name())
+
+		if (err == nil) != test.ok {
+			t.Errorf("%q: unexpected error status: %v", test.data, err)
+			continue
+		}
+
+		if test.ok && !reflect.DeepEqual(conf.DevicePorts, test.ports) {
+			t.Errorf("%q: expected %v, got %v",
+				test.data, test.ports, conf.DevicePorts)
+		}
+	}
+}
+
+// Test the dns-sd-failure parameter. DNS-SD failure is fatal
+// by default, and shipped configuration keeps it so
+func TestConfLoadDNSSdFailure(t *testing.T) {
+	tests := []struct {
+		file  string
+		fatal bool
+	}{
+		{"ipp-usb.conf", true},
+		{"testdata/ipp-usb.conf", true},
+	}
+
+	for _, test := range tests {
+		conf := confDefault
+		err := confLoadFiles(&conf, test.file)
+		if err != nil {
+			t.Fatalf("%s: %s", test.file, err)
+		}
+
+		if conf.DNSSdFatal != test.fatal {
+			t.Errorf("%s: expected fatal=%v, got %v",
+				test.file, test.fatal, conf.DNSSdFatal)
+		}
+	}
+
+	file, err := ioutil.TempFile("", "ipp-usb-conf")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("[network]\ndns-sd-failure = degraded\n")
+	file.Close()
+
+	conf := confDefault
+	err = confLoadFiles(&conf, file.Name())
+	if err != nil || conf.DNSSdFatal {
+		t.Errorf("degraded: expected fatal=false, got %v (%v)",
+			conf.DNSSdFatal, err)
+	}
+}
@@ -0,0 +1,135 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Dump of the effective configuration
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfDump is the effective configuration, as returned by the
+// GET /config request to the control socket
+//
+// Only explicitly set parameters are included, all others have
+// their default values
+type ConfDump struct {
+	Settings ConfSettings    `json:"settings"`         // Set parameters
+	Device   *ConfDumpDevice `json:"device,omitempty"` // Per-device part
+}
+
+// ConfDumpDevice represents the effective per-device settings
+type ConfDumpDevice struct {
+	Device    string            `json:"device"`    // BUS/ADDR
+	Model     string            `json:"model"`     // Quirks matched against
+	Quirks    []ConfDumpQuirks  `json:"quirks"`    // Most prioritized first
+	Effective map[string]string `json:"effective"` // Effective parameters
+}
+
+// ConfDumpQuirks represents the quirks section, matched by device
+type ConfDumpQuirks struct {
+	Model  string            `json:"model"`  // Model name pattern
+	Origin string            `json:"origin"` // file:line of definition
+	Params map[string]string `json:"params"` // Parameters, as in file
+}
+
+// ConfDumpMake makes ConfDump of the current configuration. If dev
+// is not nil, its per-device settings are included
+func ConfDumpMake(dev *DevQuery) ConfDump {
+	ConfLock.RLock()
+	dump := ConfDump{Settings: Conf.Settings}
+	ConfLock.RUnlock()
+
+	if dump.Settings == nil {
+		dump.Settings = ConfSettings{}
+	}
+
+	if dev != nil {
+		dump.Device = confDumpDevice(dev.info.MfgAndProduct,
+			dev.port, dev.quirks, dev.extraTxt)
+		dump.Device.Device = fmt.Sprintf("%d/%d",
+			dev.UsbAddr.Bus, dev.UsbAddr.Address)
+	}
+
+	return dump
+}
+
+// confDumpDevice makes ConfDumpDevice out of quirks, matched
+// by device model, HTTP port and effective extra TXT items
+func confDumpDevice(model string, port int, quirks QuirksSet,
+	extraTxt map[string]string) *ConfDumpDevice {
+
+	dump := &ConfDumpDevice{
+		Model:     model,
+		Quirks:    []ConfDumpQuirks{},
+		Effective: make(map[string]string),
+	}
+
+	eff := dump.Effective
+	eff["blacklist"] = fmt.Sprint(quirks.GetBlacklist())
+	eff["capture-jobs"] = fmt.Sprint(quirks.GetCaptureJobs())
+	eff["disable-fax"] = fmt.Sprint(quirks.GetDisableFax())
+	eff["force-content-length"] = fmt.Sprint(quirks.GetForceContentLength())
+	eff["init-delay"] = quirks.GetInitDelay().String()
+	eff["init-reset"] = quirks.GetResetMethod().String()
+	eff["request-delay"] = quirks.GetRequestDelay().String()
+	eff["short-read-timeout"] = quirks.GetShortReadTimeout().String()
+	eff["usb-alt-setting"] = quirks.GetUsbAltSetting().String()
+	eff["usb-write-rate"] = fmt.Sprint(quirks.GetUsbWriteRate())
+
+	if n := quirks.GetUsbMaxInterfaces(); n != 0 {
+		eff["usb-max-interfaces"] = fmt.Sprint(n)
+	}
+
+	if classes := quirks.GetKeepKernelDriver(); classes != nil {
+		strs := []string{}
+		for _, class := range classes {
+			strs = append(strs, fmt.Sprint(class))
+		}
+		if len(strs) == 0 {
+			strs = append(strs, "none")
+		}
+		eff["keep-kernel-driver"] = strings.Join(strs, ",")
+	}
+
+	if paths := quirks.GetAllowPaths(); paths != nil {
+		eff["allow-paths"] = strings.Join(paths, ",")
+	}
+
+	if paths := quirks.GetDenyPaths(); paths != nil {
+		eff["deny-paths"] = strings.Join(paths, ",")
+	}
+
+	if paths := quirks.GetIppQueues(); paths != nil {
+		eff["ipp-queues"] = strings.Join(paths, ",")
+	}
+
+	if port != 0 {
+		eff["http-port"] = fmt.Sprint(port)
+	}
+
+	for i := len(quirks) - 1; i >= 0; i-- {
+		for name, value := range quirks[i].HttpHeaders {
+			eff["http-"+strings.ToLower(name)] = value
+		}
+	}
+
+	for name, value := range extraTxt {
+		eff["extra-txt-"+name] = value
+	}
+
+	for _, q := range quirks {
+		dump.Quirks = append(dump.Quirks, ConfDumpQuirks{
+			Model:  q.Model,
+			Origin: q.Origin,
+			Params: q.Params,
+		})
+	}
+
+	return dump
+}
@@ -0,0 +1,99 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for dump of the effective configuration
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that all per-device quirks are included into the dump
+func TestConfDumpDevice(t *testing.T) {
+	quirks := QuirksSet{&Quirks{
+		Origin:           "test.conf:1",
+		Model:            "HP LaserJet*",
+		Blacklist:        true,
+		HttpHeaders:      map[string]string{"Connection": "close"},
+		UsbMaxInterfaces: 1,
+		DisableFax:       true,
+		ResetMethod:      QuirksResetSoft,
+		InitDelay:        time.Second,
+		RequestDelay:     time.Millisecond,
+		ShortReadTimeout: 500 * time.Millisecond,
+		KeepKernelDriver: []int{7},
+		ForceContentLen:  true,
+		CaptureJobs:      true,
+		ExtraTxt:         map[string]string{"note": "quirks"},
+		UsbAltSetting:    QuirksUsbAltAuto,
+		UsbWriteRate:     1000,
+		AllowPaths:       []string{"/ipp", "/eSCL"},
+		DenyPaths:        []string{"/hp"},
+		IppQueues:        []string{"/ipp/print2"},
+	}}
+
+	dump := confDumpDevice("HP LaserJet", 60000, quirks,
+		quirks.GetExtraTxt())
+
+	// Effective parameter, dumped for each QuirksSet getter.
+	// If you add a new quirk, add it to confDumpDevice and here
+	getters := map[string]string{
+		"GetBlacklist":          "blacklist",
+		"GetUsbMaxInterfaces":   "usb-max-interfaces",
+		"GetDisableFax":         "disable-fax",
+		"GetResetMethod":        "init-reset",
+		"GetInitDelay":          "init-delay",
+		"GetRequestDelay":       "request-delay",
+		"GetShortReadTimeout":   "short-read-timeout",
+		"GetKeepKernelDriver":   "keep-kernel-driver",
+		"GetAllowPaths":         "allow-paths",
+		"GetDenyPaths":          "deny-paths",
+		"GetIppQueues":          "ipp-queues",
+		"GetForceContentLength": "force-content-length",
+		"GetCaptureJobs":        "capture-jobs",
+		"GetExtraTxt":           "extra-txt-note",
+		"GetUsbAltSetting":      "usb-alt-setting",
+		"GetUsbWriteRate":       "usb-write-rate",
+	}
+
+	qtype := reflect.TypeOf(quirks)
+	for i := 0; i < qtype.NumMethod(); i++ {
+		name := qtype.Method(i).Name
+		if !strings.HasPrefix(name, "Get") {
+			continue
+		}
+
+		key, ok := getters[name]
+		if !ok {
+			t.Errorf("QuirksSet.%s: not dumped", name)
+			continue
+		}
+
+		if _, ok := dump.Effective[key]; !ok {
+			t.Errorf("QuirksSet.%s: %q missed in dump", name, key)
+		}
+	}
+
+	// Check some values
+	expected := map[string]string{
+		"short-read-timeout": "500ms",
+		"allow-paths":        "/ipp,/eSCL",
+		"deny-paths":         "/hp",
+		"ipp-queues":         "/ipp/print2",
+		"http-connection":    "close",
+		"http-port":          "60000",
+	}
+
+	for key, value := range expected {
+		if present := dump.Effective[key]; present != value {
+			t.Errorf("%s: expected %q, present %q", key, value, present)
+		}
+	}
+}
@@ -25,7 +25,52 @@ const (
 	// failed device initialization
 	DevInitRetryInterval = 2 * time.Second
 
-	// DNSSdRetryInterval specifies the retry interval in a case
-	// of failed DNS-SD operation
+	// DNSSdRetryInterval specifies the default retry interval in
+	// a case of failed DNS-SD operation. Can be changed via
+	// configuration file
 	DNSSdRetryInterval = 2 * time.Second
+
+	// DNSSdReconnectMax specifies the maximum interval between
+	// attempts to reconnect to the DNS-SD daemon (i.e., Avahi),
+	// when connection is lost. Interval starts from the DNS-SD
+	// retry interval and doubles with each failed attempt
+	DNSSdReconnectMax = time.Minute
+
+	// DNSSdHookTimeout specifies how much time to wait for
+	// the DNS-SD hook program to complete
+	DNSSdHookTimeout = 5 * time.Second
+
+	// WatchdogWindow specifies the default window, within which
+	// consecutive device failures are counted by the watchdog.
+	// Can be changed via configuration file
+	WatchdogWindow = 60 * time.Second
+
+	// WatchdogProbeInterval specifies how often watchdog probes
+	// the device, while the streak of failures is in progress
+	WatchdogProbeInterval = 5 * time.Second
+
+	// EsclJobIdleTimeout specifies how long eSCL scan job may
+	// remain idle, before it is not counted anymore against the
+	// limit of concurrent scan jobs
+	EsclJobIdleTimeout = 2 * time.Minute
+
+	// IppEmptyRetryDelay specifies the default delay before
+	// repeating Get-Printer-Attributes, if device has returned
+	// an empty response. Can be changed via configuration file
+	IppEmptyRetryDelay = 1 * time.Second
+
+	// IppInterfaceFallbackDelay specifies how long to wait for
+	// response from the IPP-over-USB interface during device
+	// initialization, before trying the next interface
+	IppInterfaceFallbackDelay = 1 * time.Second
+
+	// IconMaxSize specifies max size of device icon, that
+	// can be cached by ipp-usb
+	IconMaxSize = 256 * 1024
+
+	// HTTPCopyBufferSize specifies size of buffer, used to copy
+	// response body from device to client. Response body is never
+	// buffered in whole, so memory usage is bounded by this value
+	// even for very large responses, like eSCL scans
+	HTTPCopyBufferSize = 64 * 1024
 )
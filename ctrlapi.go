@@ -0,0 +1,348 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * JSON API over unix domain socket
+ *
+ * Optionally, ipp-usb listens on the separate unix domain socket,
+ * that exposes a small JSON API for local tooling (GUI frontends,
+ * packaging scripts):
+ *
+ *   GET  /devices                    - list of devices
+ *   GET  /device?device=DEV          - full decoded device info
+ *   POST /reset?device=DEV           - reset the device
+ *   POST /identify?device=DEV[&action=A,...] - identify the device
+ *
+ * DEV is the device filter, as accepted by the -device option. On
+ * error, response contains {"error": "message"}
+ *
+ * Access to the socket is controlled by the socket file mode, see the
+ * api-socket and api-socket-mode configuration parameters, and by the
+ * shared token, if configured by the token-file parameter. Like with
+ * the control socket, action requests (POST) are only accepted from
+ * root
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// ctrlapiServer is a HTTP server that runs on a top of
+	// the API socket
+	ctrlapiServer = http.Server{
+		Handler:  ctrlsockAuth(ctrlapiHandler),
+		ErrorLog: log.New(Log.LineWriter(LogError, '!'), "", 0),
+	}
+)
+
+// CtrlapiDevice is the device summary, returned by GET /devices
+type CtrlapiDevice struct {
+	Device      string `json:"device"`      // BUS/ADDR, usable as DEV
+	Vendor      string `json:"vendor"`      // Vendor ID, hex
+	Product     string `json:"product"`     // Product ID, hex
+	Model       string `json:"model"`       // Manufacturer and product
+	Status      string `json:"status"`      // "OK" or initialization error
+	Maintenance bool   `json:"maintenance"` // Device in maintenance mode
+}
+
+// CtrlapiDeviceInfo is the full device info, returned by GET /device
+type CtrlapiDeviceInfo struct {
+	CtrlapiDevice
+	Serial    string           `json:"serial,omitempty"`      // Serial number
+	Interface string           `json:"interface,omitempty"`   // USB interface
+	HTTPPort  int              `json:"http_port,omitempty"`   // HTTP port
+	DNSSdName string           `json:"dns_sd_name,omitempty"` // DNS-SD name
+	Services  []CtrlapiService `json:"services,omitempty"`    // DNS-SD services
+	IPP       *IppPrinterInfo  `json:"ipp,omitempty"`         // Decoded IPP info
+}
+
+// CtrlapiService is the published DNS-SD service
+type CtrlapiService struct {
+	Type string   `json:"type"` // Service type
+	Port int      `json:"port"` // Advertised port
+	Txt  []string `json:"txt"`  // TXT record, as "key=value"
+}
+
+// CtrlapiResult is the result of action, returned by POST requests
+type CtrlapiResult struct {
+	Device string `json:"device"` // Device filter
+	Result string `json:"result"` // Action result
+}
+
+// ctrlapiError is the error response
+type ctrlapiError struct {
+	Error string `json:"error"`
+}
+
+// ctrlapiHandler handles HTTP requests that come over the API socket
+func ctrlapiHandler(w http.ResponseWriter, r *http.Request) {
+	Log.Debug(' ', "ctrlapi: %s %s", r.Method, r.URL)
+
+	// Catch panics to log
+	defer func() {
+		v := recover()
+		if v != nil {
+			Log.Panic(v)
+		}
+	}()
+
+	// Check request path and method
+	var method string
+	rootOnly := false
+	switch r.URL.Path {
+	case "/devices", "/device":
+		method = "GET"
+	case "/reset", "/identify":
+		method = "POST"
+		rootOnly = true
+	default:
+		ctrlapiReply(w, http.StatusNotFound,
+			ctrlapiError{"Not found"})
+		return
+	}
+
+	if r.Method != method {
+		ctrlapiReply(w, http.StatusMethodNotAllowed,
+			ctrlapiError{r.Method + ": method not supported"})
+		return
+	}
+
+	if rootOnly && r.RemoteAddr != ctrlsockPeerRoot {
+		ctrlapiReply(w, http.StatusForbidden,
+			ctrlapiError{ErrAccess.Error()})
+		return
+	}
+
+	if r.URL.Path == "/devices" {
+		ctrlapiReply(w, http.StatusOK, ctrlapiDevices())
+		return
+	}
+
+	// Other requests refer the particular device
+	filter, err := ParseUsbDeviceFilter(r.URL.Query().Get("device"))
+	if err != nil {
+		ctrlapiReply(w, http.StatusBadRequest, ctrlapiError{err.Error()})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/device":
+		ctrlapiDeviceInfo(w, filter)
+	case "/reset":
+		ctrlapiReset(w, filter)
+	case "/identify":
+		ctrlapiIdentify(w, r, filter)
+	}
+}
+
+// ctrlapiDevices returns list of all devices
+func ctrlapiDevices() []CtrlapiDevice {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	devs := []CtrlapiDevice{}
+	for _, status := range statusSorted() {
+		devs = append(devs, ctrlapiMakeDevice(status, status.info))
+	}
+
+	return devs
+}
+
+// ctrlapiMakeDevice makes CtrlapiDevice out of the device status
+func ctrlapiMakeDevice(status *statusOfDevice,
+	info UsbDeviceInfo) CtrlapiDevice {
+
+	dev := CtrlapiDevice{
+		Device: fmt.Sprintf("%d/%d", status.desc.Bus,
+			status.desc.Address),
+		Model:       info.MfgAndProduct,
+		Status:      "OK",
+		Maintenance: status.maint,
+	}
+
+	if info.Vendor != 0 {
+		dev.Vendor = fmt.Sprintf("%4.4x", info.Vendor)
+		dev.Product = fmt.Sprintf("%4.4x", info.Product)
+	}
+
+	if status.init != nil {
+		dev.Status = status.init.Error()
+	}
+
+	return dev
+}
+
+// ctrlapiDeviceInfo handles the GET /device request
+//
+// Device info is served from the status table, so neither Device,
+// that may be closed meanwhile, nor USB are touched here
+func ctrlapiDeviceInfo(w http.ResponseWriter, filter *UsbDeviceFilter) {
+	statusLock.RLock()
+	status := statusFind(filter)
+	var devinfo CtrlapiDeviceInfo
+	if status != nil {
+		devinfo = ctrlapiMakeDeviceInfo(status, status.info)
+	}
+	statusLock.RUnlock()
+
+	if status == nil {
+		ctrlapiReply(w, http.StatusNotFound,
+			ctrlapiError{ErrNoDevice.Error()})
+		return
+	}
+
+	ctrlapiReply(w, http.StatusOK, devinfo)
+}
+
+// ctrlapiMakeDeviceInfo makes CtrlapiDeviceInfo out of the
+// device status. Must be called under the statusLock
+func ctrlapiMakeDeviceInfo(status *statusOfDevice,
+	info UsbDeviceInfo) CtrlapiDeviceInfo {
+
+	devinfo := CtrlapiDeviceInfo{
+		CtrlapiDevice: ctrlapiMakeDevice(status, info),
+		Serial:        info.SerialNumber,
+		Interface:     status.iface,
+		HTTPPort:      status.port,
+		DNSSdName:     status.name,
+		IPP:           status.ippinfo,
+	}
+
+	for _, svc := range status.svcs {
+		apisvc := CtrlapiService{Type: svc.Type, Port: svc.Port,
+			Txt: []string{}}
+		for _, txt := range svc.Txt {
+			apisvc.Txt = append(apisvc.Txt, txt.Key+"="+txt.Value)
+		}
+		devinfo.Services = append(devinfo.Services, apisvc)
+	}
+
+	return devinfo
+}
+
+// ctrlapiReset handles the POST /reset request
+func ctrlapiReset(w http.ResponseWriter, filter *UsbDeviceFilter) {
+	err := PnPReset(filter)
+	switch err {
+	case nil:
+		ctrlapiReply(w, http.StatusOK,
+			CtrlapiResult{filter.String(), "reset"})
+	case ErrNoDevice:
+		ctrlapiReply(w, http.StatusNotFound, ctrlapiError{err.Error()})
+	case ErrResetBusy:
+		ctrlapiReply(w, http.StatusConflict, ctrlapiError{err.Error()})
+	case ErrPnPBusy:
+		w.Header().Set("Retry-After", "5")
+		ctrlapiReply(w, http.StatusServiceUnavailable,
+			ctrlapiError{err.Error()})
+	default:
+		ctrlapiReply(w, http.StatusServiceUnavailable,
+			ctrlapiError{err.Error()})
+	}
+}
+
+// ctrlapiIdentify handles the POST /identify request
+func ctrlapiIdentify(w http.ResponseWriter, r *http.Request,
+	filter *UsbDeviceFilter) {
+
+	var actions []string
+	if s := r.URL.Query().Get("action"); s != "" {
+		actions = strings.Split(s, ",")
+	}
+
+	dev, err := PnPFind(filter)
+	switch err {
+	case nil:
+	case ErrPnPBusy:
+		w.Header().Set("Retry-After", "5")
+		ctrlapiReply(w, http.StatusServiceUnavailable,
+			ctrlapiError{err.Error()})
+		return
+	default:
+		ctrlapiReply(w, http.StatusNotFound, ctrlapiError{err.Error()})
+		return
+	}
+
+	status, err := dev.Identify(actions)
+	if err != nil {
+		ctrlapiReply(w, http.StatusServiceUnavailable,
+			ctrlapiError{err.Error()})
+		return
+	}
+
+	ctrlapiReply(w, http.StatusOK,
+		CtrlapiResult{filter.String(), status.String()})
+}
+
+// ctrlapiReply writes JSON response
+func ctrlapiReply(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	httpNoCache(w)
+	w.WriteHeader(status)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+// CtrlapiStart starts the API socket server, if enabled
+func CtrlapiStart() error {
+	if Conf.CtrlAPISocket == "" {
+		return nil
+	}
+
+	Log.Debug(' ', "ctrlapi: listening at %q", Conf.CtrlAPISocket)
+
+	// Load the token. Normally it is already loaded by
+	// CtrlsockStart, but API must not be started without
+	// the token, if control socket has failed to load it
+	token, err := ctrlsockLoadToken()
+	if err != nil {
+		return err
+	}
+
+	ctrlsockToken = token
+
+	// Listen the socket
+	os.Remove(Conf.CtrlAPISocket)
+
+	listener, err := net.ListenUnix("unix",
+		&net.UnixAddr{Name: Conf.CtrlAPISocket, Net: "unix"})
+	if err != nil {
+		return err
+	}
+
+	// Socket file mode is the only access control here, so
+	// failure to set it is fatal
+	err = os.Chmod(Conf.CtrlAPISocket, Conf.CtrlAPIMode)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	// Peer credentials are checked the same way, as for the
+	// control socket
+	go func() {
+		ctrlapiServer.Serve(ctrlsockListener{listener})
+	}()
+
+	return nil
+}
+
+// CtrlapiStop stops the API socket server
+func CtrlapiStop() {
+	if Conf.CtrlAPISocket != "" {
+		Log.Debug(' ', "ctrlapi: shutdown")
+		ctrlapiServer.Close()
+	}
+}
@@ -0,0 +1,214 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for JSON API
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Test JSON representation of devices
+func TestCtrlapiDevice(t *testing.T) {
+	status := &statusOfDevice{
+		desc:  UsbDeviceDesc{UsbAddr: UsbAddr{Bus: 1, Address: 5}},
+		iface: "Bus 001 Device 005 Config 1 Interface 0 Alt 0",
+		maint: true,
+		port:  60000,
+		name:  "HP LaserJet",
+		svcs: DNSSdServices{{
+			Type: "_ipp._tcp",
+			Port: 60000,
+			Txt: DNSSdTxtRecord{
+				{Key: "txtvers", Value: "1"},
+				{Key: "ty", Value: "HP"},
+			},
+		}},
+	}
+
+	info := UsbDeviceInfo{
+		Vendor:        0x03f0,
+		Product:       0x2b17,
+		SerialNumber:  "12345",
+		MfgAndProduct: "HP LaserJet",
+	}
+
+	devinfo := ctrlapiMakeDeviceInfo(status, info)
+	data, _ := json.Marshal(devinfo)
+
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+
+	expected := map[string]interface{}{
+		"device":      "1/5",
+		"vendor":      "03f0",
+		"product":     "2b17",
+		"model":       "HP LaserJet",
+		"status":      "OK",
+		"maintenance": true,
+		"serial":      "12345",
+		"interface":   status.iface,
+		"http_port":   float64(60000),
+		"dns_sd_name": "HP LaserJet",
+		"services": []interface{}{
+			map[string]interface{}{
+				"type": "_ipp._tcp",
+				"port": float64(60000),
+				"txt":  []interface{}{"txtvers=1", "ty=HP"},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("expected:\n%v\npresent:\n%v", expected, decoded)
+	}
+
+	// Failed device
+	status = &statusOfDevice{
+		desc: UsbDeviceDesc{UsbAddr: UsbAddr{Bus: 2, Address: 7}},
+		init: errors.New("Device initialization timed out"),
+	}
+
+	dev := ctrlapiMakeDevice(status, UsbDeviceInfo{})
+	if dev.Status != status.init.Error() || dev.Device != "2/7" ||
+		dev.Vendor != "" {
+		t.Errorf("failed device: %+v", dev)
+	}
+}
+
+// Test JSON API request errors
+func TestCtrlapiErrors(t *testing.T) {
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/unknown", http.StatusNotFound},
+		{"POST", "/devices", http.StatusMethodNotAllowed},
+		{"GET", "/reset?device=1/5", http.StatusMethodNotAllowed},
+		{"GET", "/device", http.StatusBadRequest},
+		{"GET", "/device?device=garbage", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		ctrlapiHandler(w, httptest.NewRequest(test.method, test.path, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d",
+				test.method, test.path, test.status, w.Code)
+		}
+
+		var rsp ctrlapiError
+		err := json.Unmarshal(w.Body.Bytes(), &rsp)
+		if err != nil || rsp.Error == "" {
+			t.Errorf("%s %s: invalid error response %q",
+				test.method, test.path, w.Body.String())
+		}
+	}
+}
+
+// Test GET /device, served from the status table, and access
+// restrictions of POST requests
+func TestCtrlapiDeviceRequest(t *testing.T) {
+	addr := UsbAddr{Bus: 250, Address: 17}
+
+	StatusSet(addr, UsbDeviceDesc{UsbAddr: addr}, nil, ErrInitTimedOut)
+	defer StatusDel(addr)
+
+	statusLock.Lock()
+	statusTable[addr].info = UsbDeviceInfo{Vendor: 0x03f0, Product: 0x2b17}
+	statusTable[addr].ippinfo = &IppPrinterInfo{
+		CopiesMax:    99,
+		JobMandatory: []string{"media"},
+		IppSvcIndex:  1,
+	}
+	statusLock.Unlock()
+
+	for _, dev := range []string{"250/17", "03f0:2b17"} {
+		w := httptest.NewRecorder()
+		ctrlapiHandler(w, httptest.NewRequest("GET",
+			"/device?device="+dev, nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected %d, got %d",
+				dev, http.StatusOK, w.Code)
+			continue
+		}
+
+		var decoded struct {
+			Device string                 `json:"device"`
+			IPP    map[string]interface{} `json:"ipp"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &decoded)
+
+		expected := map[string]interface{}{
+			"copies_max":               float64(99),
+			"job_mandatory_attributes": []interface{}{"media"},
+		}
+
+		if decoded.Device != "250/17" ||
+			!reflect.DeepEqual(decoded.IPP, expected) {
+			t.Errorf("%s: unexpected response %s", dev, w.Body)
+		}
+	}
+
+	// Unknown device
+	w := httptest.NewRecorder()
+	ctrlapiHandler(w, httptest.NewRequest("GET", "/device?device=250/18",
+		nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown device: expected %d, got %d",
+			http.StatusNotFound, w.Code)
+	}
+
+	// Actions are only accepted from root
+	for _, path := range []string{"/reset", "/identify"} {
+		w := httptest.NewRecorder()
+		ctrlapiHandler(w, httptest.NewRequest("POST",
+			path+"?device=250/17", nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("POST %s: expected %d, got %d",
+				path, http.StatusForbidden, w.Code)
+		}
+	}
+}
+
+// Test that API socket requires the shared token, if configured
+func TestCtrlapiToken(t *testing.T) {
+	save := ctrlsockToken
+	defer func() { ctrlsockToken = save }()
+	ctrlsockToken = "secret"
+
+	tests := []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusForbidden},
+		{"Bearer secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/devices", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+
+		w := httptest.NewRecorder()
+		ctrlapiServer.Handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%q: expected %d, got %d",
+				test.auth, test.status, w.Code)
+		}
+	}
+}
@@ -8,19 +8,32 @@
  * ipp-usb runs a HTTP server on a top of the unix domain control
  * socket.
  *
- * Currently it is only used to obtain a per-device status from the
- * running daemon. Using HTTP here sounds as overkill, but taking
- * in account that it costs us virtually nothing and this mechanism
- * is well-extendable, this is a good choice
+ * It is used to obtain a per-device status from the running daemon,
+ * to list device job queues and to request actions on devices (reset,
+ * identify, maintenance mode). Using HTTP here sounds as overkill,
+ * but taking in account that it costs us virtually nothing and this
+ * mechanism is well-extendable, this is a good choice
+ *
+ * Status is available to everybody, while job queues (that contain
+ * user names), effective configuration and action requests are only
+ * accepted from root. Optionally, all requests may require the shared
+ * token, see the token-file configuration parameter
  */
 
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"syscall"
 )
 
@@ -32,11 +45,66 @@ var (
 	// ctrlsockServer is a HTTP server that runs on a top of
 	// the status socket
 	ctrlsockServer = http.Server{
-		Handler:  http.HandlerFunc(ctrlsockHandler),
+		Handler:  ctrlsockAuth(ctrlsockHandler),
 		ErrorLog: log.New(Log.LineWriter(LogError, '!'), "", 0),
 	}
+
+	// ctrlsockToken is the shared token, required to access
+	// the control socket. Empty if not required
+	ctrlsockToken string
 )
 
+// ctrlsockAuth wraps control socket handler and checks that request
+// is authorized with the shared token, if token is configured
+func ctrlsockAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ctrlsockToken != "" {
+			auth := []byte(r.Header.Get("Authorization"))
+			expected := []byte("Bearer " + ctrlsockToken)
+
+			switch {
+			case len(auth) == 0:
+				Log.Debug(' ', "ctrlsock: %s %s: no token",
+					r.Method, r.URL)
+				w.Header().Set("WWW-Authenticate",
+					`Bearer realm="ipp-usb"`)
+				http.Error(w, "Authorization required",
+					http.StatusUnauthorized)
+				return
+
+			case subtle.ConstantTimeCompare(auth, expected) != 1:
+				Log.Error('!', "ctrlsock: %s %s: invalid token",
+					r.Method, r.URL)
+				http.Error(w, ErrAccess.Error(),
+					http.StatusForbidden)
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// ctrlsockLoadToken loads the shared token from the file,
+// specified by configuration
+func ctrlsockLoadToken() (string, error) {
+	if Conf.CtrlTokenFile == "" {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(Conf.CtrlTokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if token == "" {
+		return "", fmt.Errorf("%s: empty token", Conf.CtrlTokenFile)
+	}
+
+	return token, nil
+}
+
 // ctrlsockHandler handles HTTP requests that come over the
 // control socket
 func ctrlsockHandler(w http.ResponseWriter, r *http.Request) {
@@ -50,30 +118,142 @@ func ctrlsockHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Check request method
-	if r.Method != "GET" {
+	// Check request path and method
+	var method string
+	rootOnly := true
+	switch r.URL.Path {
+	case "/status":
+		method = "GET"
+		rootOnly = false
+	case "/jobs", "/config":
+		method = "GET"
+	case "/reset", "/identify", "/maintenance":
+		method = "POST"
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != method {
 		http.Error(w, r.Method+": method not supported",
 			http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Check request path
-	if r.URL.Path != "/status" {
-		http.Error(w, "Not found", http.StatusNotFound)
+	if rootOnly && r.RemoteAddr != ctrlsockPeerRoot {
+		http.Error(w, ErrAccess.Error(), http.StatusForbidden)
 		return
 	}
 
 	// Handle the request
+	switch r.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		httpNoCache(w)
+		w.WriteHeader(http.StatusOK)
+		w.Write(StatusFormat())
+
+	case "/jobs":
+		ctrlsockJobs(w, r)
+
+	case "/config":
+		ctrlsockConfig(w, r)
+
+	case "/reset":
+		ctrlsockReset(w, r)
+
+	case "/identify":
+		ctrlsockIdentify(w, r)
+
+	case "/maintenance":
+		ctrlsockMaintenance(w, r)
+	}
+}
+
+// ctrlsockReset handles the device reset request
+func ctrlsockReset(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseUsbDeviceFilter(r.URL.Query().Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = PnPReset(filter)
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Device %s: reset\n", filter)
+	case ErrNoDevice:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrResetBusy:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrPnPBusy:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// ctrlsockMaintenance handles the maintenance mode request
+//
+// Query parameters are device (device filter) and mode ("on"
+// or "off")
+func ctrlsockMaintenance(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseUsbDeviceFilter(r.URL.Query().Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var on bool
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "on":
+		on = true
+	case "off":
+	default:
+		http.Error(w, fmt.Sprintf("%q: invalid mode", mode),
+			http.StatusBadRequest)
+		return
+	}
+
+	err = PnPMaintenance(filter, on)
+	switch err {
+	case nil:
+	case ErrNoDevice:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case ErrPnPBusy:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	httpNoCache(w)
 	w.WriteHeader(http.StatusOK)
-	w.Write(StatusFormat())
+	if on {
+		fmt.Fprintf(w, "Device %s: maintenance mode\n", filter)
+	} else {
+		fmt.Fprintf(w, "Device %s: normal mode\n", filter)
+	}
 }
 
 // CtrlsockStart starts control socket server
 func CtrlsockStart() error {
 	Log.Debug(' ', "ctrlsock: listening at %q", PathControlSocket)
 
+	// Load the token
+	token, err := ctrlsockLoadToken()
+	if err != nil {
+		return err
+	}
+
+	ctrlsockToken = token
+
 	// Listen the socket
 	os.Remove(PathControlSocket)
 
@@ -88,7 +268,7 @@ func CtrlsockStart() error {
 
 	// Start HTTP server on a top of the listening socket
 	go func() {
-		ctrlsockServer.Serve(listener)
+		ctrlsockServer.Serve(ctrlsockListener{listener})
 	}()
 
 	return nil
@@ -100,6 +280,296 @@ func CtrlsockStop() {
 	ctrlsockServer.Close()
 }
 
+// ctrlsockIdentify handles the device identify request
+//
+// Query parameters are device (device filter) and optional
+// action (comma-separated list of identify actions)
+func ctrlsockIdentify(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseUsbDeviceFilter(r.URL.Query().Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var actions []string
+	if s := r.URL.Query().Get("action"); s != "" {
+		actions = strings.Split(s, ",")
+	}
+
+	dev, err := PnPFind(filter)
+	switch err {
+	case nil:
+	case ErrPnPBusy:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	status, err := dev.Identify(actions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Device %s: identify: %s\n", filter, status)
+}
+
+// ctrlsockJobs handles the job queue request
+//
+// Query parameters are device (device filter) and optional which
+// (one of the device's "which-jobs-supported" values). Jobs are
+// returned as JSON array
+func ctrlsockJobs(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseUsbDeviceFilter(r.URL.Query().Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dev, err := PnPFind(filter)
+	switch err {
+	case nil:
+	case ErrPnPBusy:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	jobs, err := dev.Jobs(r.URL.Query().Get("which"))
+	switch {
+	case err == ErrNotSupported:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	data, _ := json.MarshalIndent(jobs, "", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	httpNoCache(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+// ctrlsockConfig handles the effective configuration request
+//
+// Optional query parameter is device (device filter). If specified,
+// the per-device settings (matched quirks and effective parameters)
+// are included. Configuration is returned as JSON, see ConfDump
+func ctrlsockConfig(w http.ResponseWriter, r *http.Request) {
+	var dev *DevQuery
+
+	if s := r.URL.Query().Get("device"); s != "" {
+		filter, err := ParseUsbDeviceFilter(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dev, err = PnPFind(filter)
+		switch err {
+		case nil:
+		case ErrPnPBusy:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	data, _ := json.MarshalIndent(ConfDumpMake(dev), "", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	httpNoCache(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+// ctrlsockPeerRoot is the remote address of connections,
+// accepted from root. See ctrlsockListener for details
+const ctrlsockPeerRoot = "ctrlsock:root"
+
+// ctrlsockListener wraps the control socket listener. It
+// checks credentials of the connecting peer and reports
+// root connections with the ctrlsockPeerRoot remote address,
+// so handler can distinguish them via http.Request.RemoteAddr
+type ctrlsockListener struct {
+	*net.UnixListener
+}
+
+// Accept accepts the next connection
+func (l ctrlsockListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+
+	peer := "ctrlsock:user"
+	if uid, err := ctrlsockPeerUID(conn); err == nil && uid == 0 {
+		peer = ctrlsockPeerRoot
+	}
+
+	return ctrlsockConn{conn, ctrlsockAddr(peer)}, nil
+}
+
+// ctrlsockConn is the accepted control socket connection
+type ctrlsockConn struct {
+	*net.UnixConn
+	peer ctrlsockAddr
+}
+
+// RemoteAddr returns the peer address
+func (conn ctrlsockConn) RemoteAddr() net.Addr {
+	return conn.peer
+}
+
+// ctrlsockAddr implements net.Addr for the control socket peer
+type ctrlsockAddr string
+
+// Network returns the address's network name
+func (addr ctrlsockAddr) Network() string { return "unix" }
+
+// String returns string form of address
+func (addr ctrlsockAddr) String() string { return string(addr) }
+
+// CtrlsockClient returns http.Client, connected to the control
+// socket of the running ipp-usb daemon. If token is configured,
+// it is sent with each request
+func CtrlsockClient() *http.Client {
+	t := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return CtrlsockDial()
+		},
+	}
+
+	// Note, if token file is not readable, request is sent
+	// without token and daemon rejects it
+	token, _ := ctrlsockLoadToken()
+
+	return &http.Client{
+		Transport: ctrlsockClientTransport{t, token},
+	}
+}
+
+// ctrlsockClientTransport adds token to the outgoing requests
+type ctrlsockClientTransport struct {
+	http.RoundTripper
+	token string
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t ctrlsockClientTransport) RoundTrip(rq *http.Request) (
+	*http.Response, error) {
+
+	if t.token != "" {
+		rq2 := *rq
+		rq2.Header = make(http.Header, len(rq.Header)+1)
+		for k, v := range rq.Header {
+			rq2.Header[k] = v
+		}
+		rq2.Header.Set("Authorization", "Bearer "+t.token)
+		rq = &rq2
+	}
+
+	return t.RoundTripper.RoundTrip(rq)
+}
+
+// CtrlsockReset requests the running ipp-usb daemon to reset
+// the device, matching the filter
+func CtrlsockReset(filter *UsbDeviceFilter) error {
+	c := CtrlsockClient()
+
+	uri := "http://localhost/reset?device=" +
+		url.QueryEscape(filter.String())
+	rsp, err := c.Post(uri, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(rsp.Body)
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// CtrlsockIdentify requests the running ipp-usb daemon to perform
+// Identify-Printer operation on the device, matching the filter.
+// It returns the daemon's response message
+func CtrlsockIdentify(filter *UsbDeviceFilter, actions []string) (
+	string, error) {
+
+	c := CtrlsockClient()
+
+	uri := "http://localhost/identify?device=" +
+		url.QueryEscape(filter.String())
+	if len(actions) != 0 {
+		uri += "&action=" + url.QueryEscape(strings.Join(actions, ","))
+	}
+
+	rsp, err := c.Post(uri, "text/plain", nil)
+	if err != nil {
+		return "", err
+	}
+
+	defer rsp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return "", errors.New(strings.TrimSpace(string(msg)))
+	}
+
+	return strings.TrimSpace(string(msg)), nil
+}
+
+// CtrlsockMaintenance requests the running ipp-usb daemon to enable
+// or disable the maintenance mode of the device, matching the filter.
+// It returns the daemon's response message
+func CtrlsockMaintenance(filter *UsbDeviceFilter, on bool) (
+	string, error) {
+
+	c := CtrlsockClient()
+
+	mode := "off"
+	if on {
+		mode = "on"
+	}
+
+	uri := "http://localhost/maintenance?device=" +
+		url.QueryEscape(filter.String()) + "&mode=" + mode
+
+	rsp, err := c.Post(uri, "text/plain", nil)
+	if err != nil {
+		return "", err
+	}
+
+	defer rsp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return "", errors.New(strings.TrimSpace(string(msg)))
+	}
+
+	return strings.TrimSpace(string(msg)), nil
+}
+
 // CtrlsockDial connects to the control socket of the running
 // ipp-usb daemon
 func CtrlsockDial() (net.Conn, error) {
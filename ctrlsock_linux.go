@@ -0,0 +1,40 @@
+// +build linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Control socket peer credentials -- Linux version
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// ctrlsockPeerUID returns UID of the control socket peer
+func ctrlsockPeerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var cred *syscall.Ucred
+	err2 := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if err2 != nil {
+		return -1, err2
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,24 @@
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Control socket peer credentials -- generic version
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// ctrlsockPeerUID returns UID of the control socket peer
+//
+// Peer credentials are not supported on this platform, so
+// control socket peers are never treated as root
+func ctrlsockPeerUID(conn *net.UnixConn) (int, error) {
+	return -1, errors.New("peer credentials not supported")
+}
@@ -13,7 +13,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"reflect"
 	"time"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 // Device object brings all parts together, namely:
@@ -29,7 +32,10 @@ type Device struct {
 	HTTPProxy      *HTTPProxy      // HTTP proxy
 	UsbTransport   *UsbTransport   // Backing USB transport
 	DNSSdPublisher *DNSSdPublisher // DNS-SD publisher
+	IppInfo        *IppPrinterInfo // Decoded IPP attributes, may be nil
 	Log            *Logger         // Device's logger
+	dnssdName      string          // DNS-SD name
+	dnssdBase      DNSSdServices   // DNS-SD services, before overrides
 }
 
 // NewDevice creates new Device object
@@ -78,14 +84,30 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	log = dev.Log.Begin()
 	defer log.Commit()
 
+	// Select responsive interface, if device has many of them
+	_, err = IppSelectInterface(log, dev.UsbTransport, dev.State.HTTPPort,
+		dev.State.IppPrintPath())
+	if err != nil {
+		err = fmt.Errorf("IPP: no responsive interface: %s", err)
+		goto ERROR
+	}
+
 	ippinfo, err = IppService(log, &dnssdServices,
 		dev.State.HTTPPort, info, dev.UsbTransport.Quirks(),
-		dev.HTTPClient)
+		dev.State, dev.HTTPClient)
 
 	if err != nil {
 		dev.Log.Error('!', "IPP: %s", err)
 	}
 
+	dev.IppInfo = ippinfo
+	if ippinfo != nil {
+		dev.HTTPProxy.SetOperations(ippinfo.Operations)
+		dev.HTTPProxy.SetPrintPath(ippinfo.PrintPath)
+		dev.HTTPProxy.SetHealthProbe(dev.HTTPClient,
+			fmt.Sprintf("http://localhost:%d/%s",
+				dev.State.HTTPPort, ippinfo.PrintPath))
+	}
 	log.Flush()
 
 	if dev.UsbTransport.DeadlineExpired() {
@@ -98,8 +120,11 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		dnssdName = ippinfo.DNSSdName
 	} else {
 		dnssdName = info.DNSSdName()
+		dev.Log.Info(' ', "IPP: using USB device name %q", dnssdName)
 	}
 
+	dnssdName = dnssdTagName(dnssdName)
+
 	// Update device state, if name changed
 	if dnssdName != dev.State.DNSSdName {
 		dev.State.DNSSdName = dnssdName
@@ -109,7 +134,7 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 
 	// Obtain DNS-SD info for eSCL
 	err = EsclService(log, &dnssdServices, dev.State.HTTPPort, info,
-		ippinfo, dev.HTTPClient)
+		ippinfo, dev.HTTPProxy.Icons(), dev.HTTPClient)
 
 	if err != nil {
 		dev.Log.Error('!', "ESCL: %s", err)
@@ -147,7 +172,7 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 	}
 
 	// Advertise Web service. Assume it always exists
-	dnssdServices.Add(DNSSdSvcInfo{Type: "_http._tcp", Port: dev.State.HTTPPort})
+	dnssdServices.Add(DNSSdWebService(dev.State.HTTPPort, info, ippinfo))
 
 	// Advertise service with the following parameters:
 	//   Instance: "BBPP", where BB and PP are bus and port numbers in hex
@@ -165,6 +190,26 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		Loopback: true,
 	})
 
+	// Use the same UUID for all services
+	dnssdServices.ShareUUID(info.UUID())
+
+	// Apply advertised port overrides. The listener still uses
+	// the actual port, only DNS-SD advertising is affected
+	for i := range dnssdServices {
+		svc := &dnssdServices[i]
+		if port, ok := Conf.AdvertisedPorts[svc.Type]; ok {
+			dev.Log.Debug(' ', "%s: advertised port %d -> %d",
+				svc.Type, svc.Port, port)
+			svc.Port = port
+		}
+	}
+
+	// Apply TXT overrides
+	dev.dnssdName = dnssdName
+	dev.dnssdBase = dnssdServices
+	dnssdServices = dev.dnssdServices(log)
+	log.Flush()
+
 	// Enable handling incoming requests
 	dev.UsbTransport.SetDeadline(time.Time{})
 	dev.HTTPProxy.Enable()
@@ -177,12 +222,27 @@ func NewDevice(desc UsbDeviceDesc) (*Device, error) {
 		}
 	}
 
-	if Conf.DNSSdEnable {
+	// DNS-SD advertises TCP port, so it is not possible, if
+	// proxy listens on Unix domain socket
+	if path := dev.State.HTTPSocketPath(); path != "" {
+		dev.Log.Info(' ', "HTTP: listening at %q, DNS-SD disabled", path)
+	} else if Conf.DNSSdEnable || Conf.DNSSdExportDir != "" {
 		dev.DNSSdPublisher = NewDNSSdPublisher(dev.Log, dev.State,
 			dnssdServices)
+		// Note, DNS-SD failure is fatal, unless configured
+		// otherwise: in degraded mode, proxy remains available for
+		// manually configured clients, while publisher retries in
+		// background
 		err = dev.DNSSdPublisher.Publish()
 		if err != nil {
-			goto ERROR
+			if Conf.DNSSdFatal {
+				dev.DNSSdPublisher.Unpublish()
+				dev.DNSSdPublisher = nil
+				err = fmt.Errorf("DNS-SD: %s", err)
+				goto ERROR
+			}
+
+			dev.Log.Error('!', "DNS-SD: %s", err)
 		}
 	}
 
@@ -204,6 +264,213 @@ ERROR:
 	return nil, err
 }
 
+// dnssdServices returns DNS-SD services to be published, with
+// extra TXT items, TXT reordering and DNS-SD hook applied
+func (dev *Device) dnssdServices(log *LogMessage) DNSSdServices {
+	// Make a deep copy of base services, so overrides don't
+	// affect them
+	services := make(DNSSdServices, len(dev.dnssdBase))
+	for i, svc := range dev.dnssdBase {
+		svc.Txt = append(DNSSdTxtRecord(nil), svc.Txt...)
+		services[i] = svc
+	}
+
+	// Add pseudo MAC, if enabled. It is a compatibility hack
+	// for legacy clients, so it never replaces the real item
+	if Conf.DNSSdPseudoMAC {
+		mac := dev.UsbTransport.UsbDeviceInfo().PseudoMAC()
+		for i := range services {
+			if _, found := services[i].Txt.find("mac"); !found {
+				services[i].Txt.Add("mac", mac)
+			}
+		}
+	}
+
+	services.AddExtraTxt(log, dev.extraTxt())
+	services.ReorderTxt(Conf.DNSSdTxtOrder)
+
+	if Conf.DNSSdHook != "" {
+		services = services.RunHook(log, dev.dnssdName, Conf.DNSSdHook)
+	}
+
+	return services
+}
+
+// extraTxt returns extra TXT items for the device. Per-device items
+// take precedence over the global ones. Quirks are looked up in the
+// current configuration, so they are affected by reload
+func (dev *Device) extraTxt() map[string]string {
+	info := dev.UsbTransport.UsbDeviceInfo()
+	quirks := Conf.Quirks.ByModelName(info.MfgAndProduct)
+
+	extraTxt := make(map[string]string)
+	for name, value := range Conf.ExtraTxt {
+		extraTxt[name] = value
+	}
+	for name, value := range quirks.GetExtraTxt() {
+		extraTxt[name] = value
+	}
+
+	return extraTxt
+}
+
+// Reload applies reloaded configuration to the running Device,
+// see ConfReload for the list of affected parameters. If DNS-SD
+// services were changed, they are republished
+func (dev *Device) Reload() {
+	dev.Log.SetLevels(Conf.LogDevice).SetSubsysLevels(Conf.LogSubsys)
+
+	if dev.DNSSdPublisher == nil {
+		return
+	}
+
+	log := dev.Log.Begin()
+	defer log.Commit()
+
+	dev.republish(log)
+}
+
+// republish republishes DNS-SD services, if they were changed
+func (dev *Device) republish(log *LogMessage) {
+	services := dev.dnssdServices(log)
+	if reflect.DeepEqual(services, dev.DNSSdPublisher.Services) {
+		log.Debug(' ', "DNS-SD: %s: not changed", dev.dnssdName)
+		return
+	}
+
+	log.Info(' ', "DNS-SD: %s: republishing", dev.dnssdName)
+	log.Flush()
+
+	dev.DNSSdPublisher.Unpublish()
+	dev.DNSSdPublisher = NewDNSSdPublisher(dev.Log, dev.State, services)
+	StatusSetServices(dev.UsbAddr, services)
+
+	err := dev.DNSSdPublisher.Publish()
+	if err != nil {
+		dev.Log.Error('!', "DNS-SD: %s", err)
+	}
+}
+
+// DevRefresh represents refresh of the device's DNS-SD services
+//
+// It is the snapshot of the Device, taken by RefreshBegin, so refresh
+// may run in any goroutine without touching the Device itself, which
+// may be closed meanwhile. Results are applied by ApplyRefresh
+type DevRefresh struct {
+	dev     *Device         // The device
+	log     *Logger         // Device's logger
+	client  *http.Client    // HTTP client for queries
+	port    int             // HTTP port
+	info    UsbDeviceInfo   // USB device info
+	quirks  QuirksSet       // Device quirks
+	state   *DevState       // Detached copy of the device state
+	ippinfo *IppPrinterInfo // IPP printer info
+	base    DNSSdServices   // Base DNS-SD services (before overrides)
+}
+
+// RefreshBegin takes a snapshot of the Device for refresh of its
+// DNS-SD services. It must be called from the goroutine, that owns
+// the Device (i.e., PnP manager). If device doesn't support IPP,
+// ErrNotSupported is returned
+func (dev *Device) RefreshBegin() (*DevRefresh, error) {
+	if dev.IppInfo == nil || dev.UsbTransport == nil {
+		return nil, ErrNotSupported
+	}
+
+	base := make(DNSSdServices, len(dev.dnssdBase))
+	for i, svc := range dev.dnssdBase {
+		svc.Txt = append(DNSSdTxtRecord(nil), svc.Txt...)
+		base[i] = svc
+	}
+
+	return &DevRefresh{
+		dev:     dev,
+		log:     dev.Log,
+		client:  dev.HTTPClient,
+		port:    dev.State.HTTPPort,
+		info:    dev.UsbTransport.UsbDeviceInfo(),
+		quirks:  dev.UsbTransport.Quirks(),
+		state:   dev.State.Detached(),
+		ippinfo: dev.IppInfo,
+		base:    base,
+	}, nil
+}
+
+// Run re-queries IPP printer attributes and updates the IPP service
+// in the snapshot. Other services are preserved as is
+//
+// If device reports, its configuration is not changed since the
+// last query, ErrUnchanged is returned
+//
+// It may be called from any goroutine, concurrently with request
+// handling. If device is closed meanwhile, queries just fail
+func (rf *DevRefresh) Run() error {
+	log := rf.log.Begin()
+	defer log.Commit()
+
+	// Skip the full query, if device configuration is not changed
+	if !IppConfigChanged(log, rf.client, rf.port,
+		rf.ippinfo.PrintPath, rf.state) {
+		log.Debug(' ', "IPP: configuration not changed")
+		return ErrUnchanged
+	}
+
+	var services DNSSdServices
+	ippinfo, err := IppService(log, &services, rf.port, rf.info,
+		rf.quirks, rf.state, rf.client)
+	if err != nil {
+		return err
+	}
+
+	old := &rf.base[rf.ippinfo.IppSvcIndex]
+	svc := services[ippinfo.IppSvcIndex]
+
+	// Preserve parameters, set after the IPP decoding
+	if scan, found := old.Txt.find("Scan"); found {
+		svc.Txt.Set("Scan", scan)
+	}
+	svc.Instance = old.Instance
+	svc.InstanceSuffix = old.InstanceSuffix
+	svc.Port = old.Port
+
+	*old = svc
+	rf.base.ShareUUID(rf.info.UUID())
+
+	// IPP service keeps its place in the base services
+	ippinfo.IppSvcIndex = rf.ippinfo.IppSvcIndex
+	rf.ippinfo = ippinfo
+
+	return nil
+}
+
+// ApplyRefresh applies results of the successfully completed
+// DevRefresh. Device info and cached state are updated, DNS-SD
+// services are republished, only if changed
+//
+// Like RefreshBegin, it must be called from the goroutine, that
+// owns the Device
+func (dev *Device) ApplyRefresh(rf *DevRefresh) {
+	dev.IppInfo = rf.ippinfo
+	dev.dnssdBase = rf.base
+	StatusSetIppInfo(dev.UsbAddr, dev.IppInfo)
+
+	if dev.State.IppVersion != rf.state.IppVersion ||
+		dev.State.ConfigChange != rf.state.ConfigChange {
+		dev.State.IppVersion = rf.state.IppVersion
+		dev.State.ConfigChange = rf.state.ConfigChange
+		dev.State.Save()
+	}
+
+	if dev.DNSSdPublisher == nil {
+		return
+	}
+
+	log := dev.Log.Begin()
+	defer log.Commit()
+
+	dev.republish(log)
+}
+
 // Shutdown gracefully shuts down the device. If provided context
 // expires before the shutdown is complete, Shutdown returns the
 // context's error
@@ -225,8 +492,146 @@ func (dev *Device) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// Detach marks the Device as temporarily disconnected from USB.
+// DNS-SD advertising and HTTP listener remain active, while
+// requests fail until Reattach is called
+func (dev *Device) Detach() {
+	dev.UsbTransport.Detach()
+}
+
+// Reattach connects detached Device to the device, that came
+// back under the new descriptor. On error, Device must be closed
+func (dev *Device) Reattach(desc UsbDeviceDesc) error {
+	err := dev.UsbTransport.Reattach(desc)
+	if err == nil {
+		dev.UsbAddr = desc.UsbAddr
+	}
+	return err
+}
+
+// SetMaintenance enables or disables the maintenance mode of
+// the device. In maintenance mode device remains published and
+// answers queries, but rejects new jobs
+//
+// It must be called from the goroutine, that owns the Device.
+// To keep maintenance mode across device re-initialization,
+// use PnPMaintenance
+func (dev *Device) SetMaintenance(on bool) {
+	if dev.HTTPProxy == nil {
+		return
+	}
+
+	if on {
+		dev.Log.Info(' ', "maintenance mode: on")
+	} else {
+		dev.Log.Info(' ', "maintenance mode: off")
+	}
+
+	dev.HTTPProxy.SetMaintenance(on)
+	StatusSetMaintenance(dev.UsbAddr, on)
+}
+
+// DevQuery is the snapshot of the Device, taken by Query, for
+// queries from other goroutines (i.e., control socket handlers)
+//
+// Queries don't touch the Device itself, which may be closed
+// meanwhile. In this case, they just fail
+type DevQuery struct {
+	UsbAddr  UsbAddr           // Device's USB address
+	log      *Logger           // Device's logger
+	client   *http.Client      // HTTP client for queries
+	port     int               // HTTP port
+	ippinfo  *IppPrinterInfo   // IPP printer info, may be nil
+	info     UsbDeviceInfo     // USB device info
+	quirks   QuirksSet         // Device quirks
+	extraTxt map[string]string // Effective extra TXT items
+}
+
+// Query takes a snapshot of the Device for queries. It must be
+// called from the goroutine, that owns the Device (i.e., PnP
+// manager). Closed device returns nil
+func (dev *Device) Query() *DevQuery {
+	if dev.UsbTransport == nil {
+		return nil
+	}
+
+	return &DevQuery{
+		UsbAddr:  dev.UsbAddr,
+		log:      dev.Log,
+		client:   dev.HTTPClient,
+		port:     dev.State.HTTPPort,
+		ippinfo:  dev.IppInfo,
+		info:     dev.UsbTransport.UsbDeviceInfo(),
+		quirks:   dev.UsbTransport.Quirks(),
+		extraTxt: dev.extraTxt(),
+	}
+}
+
+// Identify performs the IPP Identify-Printer operation, so device
+// can be physically located. Device must advertise support of
+// this operation with the "identify-actions-supported" attribute,
+// and requested actions, if any, must be supported
+func (q *DevQuery) Identify(actions []string) (goipp.Status, error) {
+	if q.ippinfo == nil || len(q.ippinfo.Identify) == 0 {
+		return 0, ErrNotSupported
+	}
+
+	for _, action := range actions {
+		found := false
+		for _, supp := range q.ippinfo.Identify {
+			found = found || action == supp
+		}
+
+		if !found {
+			return 0, fmt.Errorf("identify action %q: %s",
+				action, ErrNotSupported)
+		}
+	}
+
+	log := q.log.Begin()
+	defer log.Commit()
+
+	return IppIdentify(log, q.client, q.port, q.ippinfo.PrintPath, actions)
+}
+
+// Jobs returns the device's job queue. If which is not empty,
+// it selects jobs to be returned (see "which-jobs-supported")
+func (q *DevQuery) Jobs(which string) ([]IppJob, error) {
+	if q.ippinfo == nil {
+		return nil, ErrNotSupported
+	}
+
+	if which != "" && len(q.ippinfo.WhichJobs) != 0 {
+		found := false
+		for _, supp := range q.ippinfo.WhichJobs {
+			found = found || which == supp
+		}
+
+		if !found {
+			return nil, fmt.Errorf("which-jobs %q: %s",
+				which, ErrNotSupported)
+		}
+	}
+
+	log := q.log.Begin()
+	defer log.Commit()
+
+	return IppGetJobs(log, q.client, q.port, q.ippinfo.PrintPath, which)
+}
+
 // Close the Device
 func (dev *Device) Close() {
+	dev.close(false)
+}
+
+// Reset closes the Device and performs USB reset of it, so
+// device can be initialized again from scratch
+func (dev *Device) Reset() {
+	dev.close(true)
+}
+
+// close closes the Device, with optional USB reset
+func (dev *Device) close(reset bool) {
 	if dev.DNSSdPublisher != nil {
 		dev.DNSSdPublisher.Unpublish()
 		dev.DNSSdPublisher = nil
@@ -238,7 +643,7 @@ func (dev *Device) Close() {
 	}
 
 	if dev.UsbTransport != nil {
-		dev.UsbTransport.Close(false)
+		dev.UsbTransport.Close(reset)
 		dev.UsbTransport = nil
 	}
 }
@@ -17,18 +17,23 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 // DevState manages a per-device persistent state (such as HTTP
 // port allocation etc)
 type DevState struct {
-	Ident         string // Device identification
-	HTTPPort      int    // Allocated HTTP port
-	DNSSdName     string // DNS-SD name, as reported by device
-	DNSSdOverride string // DNS-SD name after collision resolution
+	Ident         string        // Device identification
+	HTTPPort      int           // Allocated HTTP port
+	DNSSdName     string        // DNS-SD name, as reported by device
+	DNSSdOverride string        // DNS-SD name after collision resolution
+	IppVersion    goipp.Version // Negotiated IPP version, 0 if unknown
+	ConfigChange  string        // Config change stamp, "" if unknown
+	PrintPath     string        // IPP print resource path, "" if unknown
 
 	comment string // Comment in the state file
-	path    string // Path to the disk file
+	path    string // Path to the disk file, "" if detached
 }
 
 // LoadDevState loads DevState from a disk file
@@ -62,6 +67,15 @@ func LoadDevState(ident, comment string) *DevState {
 				state.DNSSdName = rec.Value
 			case "dns-sd-override":
 				state.DNSSdOverride = rec.Value
+			case "ipp-version":
+				ver, ok := ippParseVersion(rec.Value)
+				if ok {
+					state.IppVersion = ver
+				}
+			case "config-change":
+				state.ConfigChange = rec.Value
+			case "print-path":
+				state.PrintPath = rec.Value
 			}
 		}
 
@@ -96,8 +110,31 @@ func (state *DevState) loadTCPPort(out *int, rec *IniRecord) error {
 	return nil
 }
 
+// Detached returns a copy of the DevState, not connected to the
+// disk file, so Save of the copy does nothing. The copy may be used
+// outside of the goroutine, that owns the DevState
+func (state *DevState) Detached() *DevState {
+	detached := *state
+	detached.path = ""
+	return &detached
+}
+
+// IppPrintPath returns IPP print resource path, without leading
+// slash, as reported by device last time, or the default path,
+// if not known yet
+func (state *DevState) IppPrintPath() string {
+	if state.PrintPath != "" {
+		return state.PrintPath
+	}
+	return ippPrintPath
+}
+
 // Save updates DevState on disk
 func (state *DevState) Save() {
+	if state.path == "" {
+		return
+	}
+
 	os.MkdirAll(PathProgStateDev, 0755)
 
 	var buf bytes.Buffer
@@ -110,6 +147,15 @@ func (state *DevState) Save() {
 	fmt.Fprintf(&buf, "http-port       = %d\n", state.HTTPPort)
 	fmt.Fprintf(&buf, "dns-sd-name     = %q\n", state.DNSSdName)
 	fmt.Fprintf(&buf, "dns-sd-override = %q\n", state.DNSSdOverride)
+	if state.IppVersion != 0 {
+		fmt.Fprintf(&buf, "ipp-version     = %s\n", state.IppVersion)
+	}
+	if state.ConfigChange != "" {
+		fmt.Fprintf(&buf, "config-change   = %q\n", state.ConfigChange)
+	}
+	if state.PrintPath != "" {
+		fmt.Fprintf(&buf, "print-path      = %q\n", state.PrintPath)
+	}
 
 	err := ioutil.WriteFile(state.path, buf.Bytes(), 0644)
 	if err != nil {
@@ -119,11 +165,27 @@ func (state *DevState) Save() {
 }
 
 // HTTPListen allocates HTTP port and updates persistent configuration
+//
+// If unix-socket-dir is configured, the Unix domain socket listener
+// is created instead (see HTTPSocketPath)
 func (state *DevState) HTTPListen() (net.Listener, error) {
+	if Conf.HTTPUnixDir != "" {
+		return state.unixListen()
+	}
+
+	// Use the pinned port, if configured. Don't fall back to
+	// another port, if it is busy: the pinned port is expected
+	// by firewall rules or clients configuration
+	if port, ok := Conf.DevicePorts[state.Ident]; ok {
+		return state.pinnedListen(port)
+	}
+
 	port := state.HTTPPort
 
 	// Check that preallocated port is within the configured range
-	if !(Conf.HTTPMinPort <= port && port <= Conf.HTTPMaxPort) {
+	// and not pinned to another device
+	if !(Conf.HTTPMinPort <= port && port <= Conf.HTTPMaxPort) ||
+		devStatePortPinned(port) {
 		port = 0
 	}
 
@@ -137,6 +199,10 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 
 	// Allocate a port
 	for port = Conf.HTTPMinPort; port <= Conf.HTTPMaxPort; port++ {
+		if devStatePortPinned(port) {
+			continue
+		}
+
 		listener, err := NewListener(port)
 		if err == nil {
 			state.HTTPPort = port
@@ -151,6 +217,67 @@ func (state *DevState) HTTPListen() (net.Listener, error) {
 	return nil, err
 }
 
+// pinnedListen creates listener on the port, pinned to the device
+// by configuration
+func (state *DevState) pinnedListen(port int) (net.Listener, error) {
+	listener, err := NewListener(port)
+	if err != nil {
+		err = state.error("pinned http-port %d: %s", port, err)
+		Log.Error('!', "STATE PORT: %s", err)
+		return nil, err
+	}
+
+	if state.HTTPPort != port {
+		state.HTTPPort = port
+		state.Save()
+	}
+
+	return listener, nil
+}
+
+// devStatePortPinned tells if port is pinned to some device
+// by configuration, so it must not be allocated automatically
+func devStatePortPinned(port int) bool {
+	for _, pinned := range Conf.DevicePorts {
+		if pinned == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HTTPSocketPath returns path to the device's Unix domain socket,
+// or "" if Unix domain sockets are not used
+func (state *DevState) HTTPSocketPath() string {
+	if Conf.HTTPUnixDir == "" {
+		return ""
+	}
+
+	return filepath.Join(Conf.HTTPUnixDir, state.Ident+".sock")
+}
+
+// unixListen creates Unix domain socket listener
+//
+// The socket file is removed when listener is closed
+func (state *DevState) unixListen() (net.Listener, error) {
+	path := state.HTTPSocketPath()
+	os.Remove(path)
+
+	listener, err := net.ListenUnix("unix",
+		&net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		err = state.error("%s", err)
+		Log.Error('!', "STATE SOCKET: %s", err)
+		return nil, err
+	}
+
+	// Access is controlled by the directory permissions
+	os.Chmod(path, 0666)
+
+	return listener, nil
+}
+
 // devStatePath returns a path to the DevState file
 func (state *DevState) devStatePath() string {
 	return filepath.Join(PathProgStateDev, state.Ident+".state")
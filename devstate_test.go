@@ -0,0 +1,44 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for per-device persistent state
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that detached copy of DevState is never saved
+func TestDevStateDetached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.state")
+	state := &DevState{
+		Ident:        "1234-5678-SERIAL-Test-Printer",
+		ConfigChange: "1",
+		path:         path,
+	}
+
+	detached := state.Detached()
+	detached.ConfigChange = "2"
+	detached.Save()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("detached state saved")
+	}
+
+	if state.ConfigChange != "1" {
+		t.Errorf("original state modified: %q", state.ConfigChange)
+	}
+}
@@ -10,6 +10,8 @@ package main
 
 import (
 	"fmt"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -86,6 +88,82 @@ func (txt *DNSSdTxtRecord) URLIfNotEmpty(key, value string) bool {
 	return false
 }
 
+// find returns value of the item with the specified key
+func (txt DNSSdTxtRecord) find(key string) (string, bool) {
+	for _, item := range txt {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// size returns size of the TXT record, as it is sent to the wire
+func (txt DNSSdTxtRecord) size() int {
+	size := 0
+	for _, item := range txt {
+		size += 1 + len(item.Key) + 1 + len(item.Value)
+	}
+
+	return size
+}
+
+// Del removes item with the specified key, if any
+func (txt *DNSSdTxtRecord) Del(key string) {
+	out := (*txt)[:0]
+	for _, item := range *txt {
+		if item.Key != key {
+			out = append(out, item)
+		}
+	}
+
+	*txt = out
+}
+
+// Set replaces value of the existing item. If item doesn't
+// exist, it will be added
+func (txt *DNSSdTxtRecord) Set(key, value string) {
+	for i := range *txt {
+		if (*txt)[i].Key == key {
+			(*txt)[i].Value = value
+			return
+		}
+	}
+
+	txt.Add(key, value)
+}
+
+// Reorder moves items with the specified keys to the beginning
+// of the TXT record, in the order of keys. Relative order of other
+// items is preserved
+func (txt DNSSdTxtRecord) Reorder(keys []string) {
+	reordered := make(DNSSdTxtRecord, 0, len(txt))
+
+	for _, key := range keys {
+		for _, item := range txt {
+			if item.Key == key {
+				reordered = append(reordered, item)
+			}
+		}
+	}
+
+	for _, item := range txt {
+		listed := false
+		for _, key := range keys {
+			if item.Key == key {
+				listed = true
+			}
+		}
+
+		if !listed {
+			reordered = append(reordered, item)
+		}
+	}
+
+	copy(txt, reordered)
+}
+
 // export DNSSdTxtRecord into Avahi format
 func (txt DNSSdTxtRecord) export() [][]byte {
 	var exported [][]byte
@@ -102,12 +180,30 @@ func (txt DNSSdTxtRecord) export() [][]byte {
 
 // DNSSdSvcInfo represents a DNS-SD service information
 type DNSSdSvcInfo struct {
-	Instance string         // If not "", override common instance name
-	Type     string         // Service type, i.e. "_ipp._tcp"
-	SubTypes []string       // Service subtypes, if any
-	Port     int            // TCP port
-	Txt      DNSSdTxtRecord // TXT record
-	Loopback bool           // Advertise only on loopback interface
+	Instance       string         // If not "", override common instance name
+	InstanceSuffix string         // Appended to common instance name
+	Type           string         // Service type, i.e. "_ipp._tcp"
+	SubTypes       []string       // Service subtypes, if any
+	Port           int            // TCP port
+	Txt            DNSSdTxtRecord // TXT record
+	Loopback       bool           // Advertise only on loopback interface
+}
+
+// InstanceName returns the service instance name, based on
+// the common instance name, shared by all services of the device
+func (svc DNSSdSvcInfo) InstanceName(common string) string {
+	switch {
+	case svc.Instance != "":
+		return svc.Instance
+	case svc.InstanceSuffix == "":
+		return common
+	}
+
+	const MAX_DNSSD_NAME = 63
+	common = dnssdTruncateName(common,
+		MAX_DNSSD_NAME-len(svc.InstanceSuffix), Conf.DNSSdTruncate)
+
+	return common + svc.InstanceSuffix
 }
 
 // DNSSdServices represents a collection of DNS-SD services
@@ -118,16 +214,300 @@ func (services *DNSSdServices) Add(srv DNSSdSvcInfo) {
 	*services = append(*services, srv)
 }
 
+// AddExtraTxt appends extra items to TXT records of all services
+//
+// Items, already present in the TXT record, are not replaced, unless
+// key is prefixed with '!' (i.e., "!note"), which means that override
+// is intended. Items that violate DNS-SD limits are skipped. Both
+// cases are logged
+func (services DNSSdServices) AddExtraTxt(log *LogMessage,
+	extra map[string]string) {
+
+	// Sort keys, for consistent order of items
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := extra[key]
+		override := strings.HasPrefix(key, "!")
+		name := strings.TrimPrefix(key, "!")
+
+		if err := dnssdCheckTxtItem(name, value); err != nil {
+			log.Error('!', "extra-txt: %q: %s", name, err)
+			continue
+		}
+
+		for i := range services {
+			txt := &services[i].Txt
+			if _, found := txt.find(name); found && !override {
+				log.Error('!', "extra-txt: %s: %q already set, "+
+					"use \"!%s\" to override",
+					services[i].Type, name, name)
+				continue
+			}
+
+			txt.Set(name, value)
+
+			if size := txt.size(); size > 1300 {
+				log.Error('!', "extra-txt: %s: TXT record "+
+					"is too large (%d bytes)",
+					services[i].Type, size)
+			}
+		}
+	}
+}
+
+// ShareUUID makes UUID TXT item consistent across all services,
+// so clients may correlate services of the same physical device
+//
+// The first UUID found (IPP service comes first, if present)
+// wins. If no service has UUID, the fallback is used
+func (services DNSSdServices) ShareUUID(fallback string) {
+	uuid := fallback
+	for _, svc := range services {
+		if value, found := svc.Txt.find("UUID"); found && value != "" {
+			uuid = value
+			break
+		}
+	}
+
+	if uuid == "" {
+		return
+	}
+
+	for i := range services {
+		services[i].Txt.Set("UUID", uuid)
+	}
+}
+
+// ReorderTxt reorders TXT records of all services,
+// see DNSSdTxtRecord.Reorder for details
+func (services DNSSdServices) ReorderTxt(keys []string) {
+	for i := range services {
+		services[i].Txt.Reorder(keys)
+	}
+}
+
+// DNSSdWebService returns the _http._tcp service, that advertises
+// device's web UI, enriched according to the configuration
+//
+// If dns-sd-web-path is "auto", path is taken from device's
+// printer-more-info URL (ippinfo may be nil, if unknown)
+//
+// If dns-sd-web-uuid is enabled, device UUID and friendly name are
+// added, so clients may correlate web UI with the print and scan
+// services of the same device
+func DNSSdWebService(port int, usbinfo UsbDeviceInfo,
+	ippinfo *IppPrinterInfo) DNSSdSvcInfo {
+
+	svc := DNSSdSvcInfo{Type: "_http._tcp", Port: port}
+
+	if Conf.DNSSdWebLabel != "" {
+		svc.InstanceSuffix = " (" + Conf.DNSSdWebLabel + ")"
+	}
+
+	path := Conf.DNSSdWebPath
+	if path == "auto" {
+		path = ""
+		if ippinfo != nil {
+			path = dnssdWebPath(ippinfo.AdminURL)
+		}
+	}
+
+	if path != "" {
+		svc.Txt.Add("path", path)
+	}
+
+	if Conf.DNSSdWebUUID {
+		uuid := usbinfo.UUID()
+		if ippinfo != nil && ippinfo.UUID != "" {
+			uuid = ippinfo.UUID
+		}
+
+		svc.Txt.IfNotEmpty("UUID", uuid)
+		svc.Txt.IfNotEmpty("ty", usbinfo.ProductName+svc.InstanceSuffix)
+	}
+
+	return svc
+}
+
+// dnssdWebPath returns path part of the web UI URL, suitable
+// for the "path" TXT item, or "" if there is nothing to advertise
+func dnssdWebPath(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Path == "" || u.Path == "/" {
+		return ""
+	}
+
+	return u.RequestURI()
+}
+
+// dnssdCheckDomain validates DNS-SD registration domain name,
+// according to the host name rules (RFC 1123), which are the
+// only names that work reliably in wide-area DNS-SD
+func dnssdCheckDomain(domain string) error {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return fmt.Errorf("empty domain")
+	}
+
+	if len(domain) > 253 {
+		return fmt.Errorf("domain too long (%d bytes, max is 253)",
+			len(domain))
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		switch {
+		case label == "":
+			return fmt.Errorf("empty label")
+		case len(label) > 63:
+			return fmt.Errorf("%q: label too long", label)
+		case label[0] == '-' || label[len(label)-1] == '-':
+			return fmt.Errorf("%q: label starts or ends with '-'", label)
+		}
+
+		for _, c := range []byte(label) {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			case c >= '0' && c <= '9', c == '-':
+			default:
+				return fmt.Errorf("%q: invalid character in label",
+					label)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dnssdCheckTxtItem validates TXT record item against the
+// DNS-SD limits (RFC 6763, section 6)
+func dnssdCheckTxtItem(key, value string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("empty key")
+	case len(key)+1+len(value) > 255:
+		return fmt.Errorf("item too long (%d bytes, max is 255)",
+			len(key)+1+len(value))
+	}
+
+	for _, c := range []byte(key) {
+		if c < 0x20 || c > 0x7e || c == '=' {
+			return fmt.Errorf("invalid character in key")
+		}
+	}
+
+	return nil
+}
+
+// DNSSdBackend represents a system-dependent DNS-SD backend,
+// that actually publishes services. Backend instance publishes
+// the set of services under the single instance name, and reports
+// the publishing status via the Chan() channel
+type DNSSdBackend interface {
+	Halt()                    // Cancel all activity
+	Chan() <-chan DNSSdStatus // Status notifications channel
+}
+
+// DNSSdBackendFactory creates a new DNSSdBackend instance
+//
+// If publishing fails immediately, error is returned together
+// with the backend, which reports failure via its status
+// channel as well, so failure is handled the usual way
+type DNSSdBackendFactory func(log *LogMessage, instance string,
+	services DNSSdServices) (DNSSdBackend, error)
+
+var (
+	// dnssdBackendNames lists all known DNS-SD backends, in
+	// order of preference when backend is selected automatically
+	dnssdBackendNames = []string{"avahi", "builtin"}
+
+	// dnssdBackends contains backends, available in this build,
+	// indexed by name
+	dnssdBackends = make(map[string]DNSSdBackendFactory)
+)
+
+// DNSSdRegisterBackend makes DNS-SD backend available for use.
+// It is intended to be called from init() functions of the
+// backends implementations
+func DNSSdRegisterBackend(name string, factory DNSSdBackendFactory) {
+	dnssdBackends[name] = factory
+}
+
+// dnssdBackendAvailable checks that backend is known and available
+// in this build. "auto" is available, if any backend is available
+func dnssdBackendAvailable(name string) error {
+	if name == "auto" {
+		if len(dnssdBackends) == 0 {
+			return fmt.Errorf("no DNS-SD backends available")
+		}
+		return nil
+	}
+
+	for _, known := range dnssdBackendNames {
+		if name == known {
+			if dnssdBackends[name] == nil {
+				return fmt.Errorf("%s: not available in this build",
+					name)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: unknown backend", name)
+}
+
+// dnssdNewBackend creates the new instance of the DNS-SD backend,
+// selected by configuration
+func dnssdNewBackend(log *LogMessage, instance string,
+	services DNSSdServices) (DNSSdBackend, error) {
+
+	name := Conf.DNSSdBackend
+	if name == "auto" {
+		for _, known := range dnssdBackendNames {
+			if dnssdBackends[known] != nil {
+				name = known
+				break
+			}
+		}
+	}
+
+	factory := dnssdBackends[name]
+	if factory == nil {
+		// Configuration is validated, so it only may
+		// happen, if no backends available at all
+		err := dnssdBackendAvailable(name)
+		log.Error('!', "DNS-SD: %s", err)
+		return dnssdNoBackend{}, err
+	}
+
+	return factory(log, instance, services)
+}
+
+// dnssdNoBackend is the DNSSdBackend, used when no backend
+// is available. It never publishes anything
+type dnssdNoBackend struct{}
+
+// Halt dnssdNoBackend
+func (dnssdNoBackend) Halt() {}
+
+// Chan returns dnssdNoBackend status channel, that is never signalled
+func (dnssdNoBackend) Chan() <-chan DNSSdStatus { return nil }
+
 // DNSSdPublisher represents a DNS-SD service publisher
 // One publisher may publish multiple services unser the
 // same Service Instance Name
 type DNSSdPublisher struct {
-	Log      *Logger        // Device's logger
+	Log      *LogMessage    // Device's logger, DNS-SD subsystem
 	DevState *DevState      // Device persistent state
 	Services DNSSdServices  // Registered services
 	fin      chan struct{}  // Closed to terminate publisher goroutine
 	finDone  sync.WaitGroup // To wait for goroutine termination
-	sysdep   *dnssdSysdep   // System-dependent stuff
+	backend  DNSSdBackend   // System-dependent stuff
+	exported []string       // Exported .service files
 }
 
 // DNSSdStatus represents DNS-SD publisher status
@@ -138,6 +518,7 @@ const (
 	DNSSdCollision                    // Service instance name collision
 	DNSSdFailure                      // Publisher failed
 	DNSSdSuccess                      // Services successfully published
+	DNSSdReconnect                    // Connection to daemon lost
 )
 
 // String returns human-readable representation of DNSSdStatus
@@ -151,6 +532,8 @@ func (status DNSSdStatus) String() string {
 		return "DNSSdFailure"
 	case DNSSdSuccess:
 		return "DNSSdSuccess"
+	case DNSSdReconnect:
+		return "DNSSdReconnect"
 	}
 
 	return fmt.Sprintf("Unknown DNSSdStatus %d", status)
@@ -165,7 +548,7 @@ func NewDNSSdPublisher(log *Logger,
 	devstate *DevState, services DNSSdServices) *DNSSdPublisher {
 
 	return &DNSSdPublisher{
-		Log:      log,
+		Log:      log.Subsys(LogSubsysDNSSd),
 		DevState: devstate,
 		Services: services,
 		fin:      make(chan struct{}),
@@ -173,17 +556,47 @@ func NewDNSSdPublisher(log *Logger,
 }
 
 // Publish all services
+//
+// If services are exported (see dns-sd-export-dir), they are
+// advertised by Avahi from the exported files, so they are not
+// published directly, to avoid duplicates. Avahi static services
+// can't be restricted to the loopback interface, so in the
+// loopback-only mode export is skipped
 func (publisher *DNSSdPublisher) Publish() error {
 	instance := publisher.instance(0)
-	publisher.sysdep = newDnssdSysdep(publisher.Log, instance,
+
+	export := Conf.DNSSdExportDir != ""
+	if export && Conf.LoopbackOnly {
+		publisher.Log.Info('!', "DNS-SD: %s: not exported, "+
+			"as interface = loopback", instance)
+		export = false
+	}
+
+	if export {
+		publisher.export(instance)
+	}
+
+	// Publisher may exist only for export
+	if export || !Conf.DNSSdEnable {
+		publisher.backend = dnssdNoBackend{}
+		return nil
+	}
+
+	var err error
+	publisher.backend, err = dnssdNewBackend(publisher.Log, instance,
 		publisher.Services)
 
-	publisher.Log.Info('+', "DNS-SD: %s: publishing requested", instance)
+	if err == nil {
+		publisher.Log.Info('+', "DNS-SD: %s: publishing requested",
+			instance)
+	}
 
+	// Note, goroutine is started even on error, as failed
+	// publishing is retried in background
 	publisher.finDone.Add(1)
 	go publisher.goroutine()
 
-	return nil
+	return err
 }
 
 // Unpublish everything
@@ -191,7 +604,12 @@ func (publisher *DNSSdPublisher) Unpublish() {
 	close(publisher.fin)
 	publisher.finDone.Wait()
 
-	publisher.sysdep.Halt()
+	publisher.backend.Halt()
+	publisher.unexport()
+
+	if _, none := publisher.backend.(dnssdNoBackend); none {
+		return
+	}
 
 	publisher.Log.Info('-', "DNS-SD: %s: removed", publisher.instance(0))
 }
@@ -217,13 +635,118 @@ func (publisher *DNSSdPublisher) instance(suffix int) string {
 	}
 
 	const MAX_DNSSD_NAME = 63
-	if len(name)+len(strSuffix) > MAX_DNSSD_NAME {
-		name = name[:MAX_DNSSD_NAME-len(strSuffix)]
-	}
+	name = dnssdTruncateName(name, MAX_DNSSD_NAME-len(strSuffix),
+		Conf.DNSSdTruncate)
 
 	return name + strSuffix
 }
 
+// dnssdTagName applies the configured prefix and suffix to the
+// DNS-SD name, as reported by device
+//
+// The device name is truncated, if needed, so prefix and suffix
+// always survive, with room left for the " (USB n)" suffix,
+// appended later by publisher
+func dnssdTagName(name string) string {
+	prefix, suffix := Conf.DNSSdNamePrefix, Conf.DNSSdNameSuffix
+	if prefix == "" && suffix == "" {
+		return name
+	}
+
+	const MAX_DNSSD_NAME = 63
+	const MAX_USB_SUFFIX = len(" (USB 99)")
+
+	max := MAX_DNSSD_NAME - MAX_USB_SUFFIX - len(prefix) - len(suffix)
+	if max < 1 {
+		max = 1
+	}
+
+	name = dnssdTruncateName(name, max, Conf.DNSSdTruncate)
+
+	return prefix + name + suffix
+}
+
+// DNSSdTruncate represents DNS-SD name truncation strategy
+type DNSSdTruncate int
+
+// DNSSdTruncateEnd    - drop the end of name
+// DNSSdTruncateMiddle - drop the middle of name, replacing
+//                       it with ellipsis
+const (
+	DNSSdTruncateEnd DNSSdTruncate = iota
+	DNSSdTruncateMiddle
+)
+
+// dnssdTruncateName truncates DNS-SD name to fit the specified
+// length, in bytes, using the specified strategy. It never splits
+// UTF-8 sequences
+func dnssdTruncateName(name string, max int, how DNSSdTruncate) string {
+	if len(name) <= max {
+		return name
+	}
+
+	const ellipsis = "\u2026"
+	if how == DNSSdTruncateMiddle && max > len(ellipsis)+1 {
+		avail := max - len(ellipsis)
+		head := dnssdUtf8Prefix(name, avail-avail/2)
+		tail := dnssdUtf8Suffix(name, avail-len(head))
+		return strings.TrimRight(head, " ") + ellipsis +
+			strings.TrimLeft(tail, " ")
+	}
+
+	return dnssdUtf8Prefix(name, max)
+}
+
+// dnssdUtf8Prefix returns the longest prefix of s, not exceeding
+// max bytes and not splitting UTF-8 sequences
+func dnssdUtf8Prefix(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	// Move back while s[max] is an UTF-8 continuation byte
+	for max > 0 && s[max]&0xc0 == 0x80 {
+		max--
+	}
+
+	return s[:max]
+}
+
+// dnssdUtf8Suffix returns the longest suffix of s, not exceeding
+// max bytes and not splitting UTF-8 sequences
+func dnssdUtf8Suffix(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	// Move forward while suffix starts from the continuation byte
+	i := len(s) - max
+	for i < len(s) && s[i]&0xc0 == 0x80 {
+		i++
+	}
+
+	return s[i:]
+}
+
+// degraded writes to the log that device is working in the
+// degraded mode: proxy works, but device is not advertised
+func (publisher *DNSSdPublisher) degraded(instance string) {
+	publisher.Log.Error('!', "DNS-SD: %s: degraded mode: device is "+
+		"not advertised, but still available at port %d; "+
+		"retry in %s", instance, publisher.DevState.HTTPPort,
+		Conf.DNSSdRetry)
+}
+
+// dnssdBackoff returns the next reconnect interval: twice
+// the previous one, but not above the DNSSdReconnectMax
+func dnssdBackoff(retry time.Duration) time.Duration {
+	retry *= 2
+	if retry > DNSSdReconnectMax {
+		retry = DNSSdReconnectMax
+	}
+	return retry
+}
+
 // Event handling goroutine
 func (publisher *DNSSdPublisher) goroutine() {
 	// Catch panics to log
@@ -240,9 +763,14 @@ func (publisher *DNSSdPublisher) goroutine() {
 	timer.Stop()       // Not ticking now
 	defer timer.Stop() // And cleanup at return
 
-	var err error
 	var suffix int
 
+	// When connection to the DNS-SD daemon is lost (i.e., Avahi
+	// is restarted), all registrations are lost too, so backend
+	// is recreated, with exponential backoff until success
+	reconnect := false
+	retry := Conf.DNSSdRetry
+
 	instance := publisher.instance(0)
 	for {
 		fail := false
@@ -251,10 +779,16 @@ func (publisher *DNSSdPublisher) goroutine() {
 		case <-publisher.fin:
 			return
 
-		case status := <-publisher.sysdep.Chan():
+		case status := <-publisher.backend.Chan():
 			switch status {
 			case DNSSdSuccess:
 				publisher.Log.Info(' ', "DNS-SD: %s: published", instance)
+				if reconnect {
+					publisher.Log.Info(' ',
+						"DNS-SD: %s: reconnected", instance)
+					reconnect = false
+					retry = Conf.DNSSdRetry
+				}
 				if instance != publisher.DevState.DNSSdOverride {
 					publisher.DevState.DNSSdOverride = instance
 					publisher.DevState.Save()
@@ -267,11 +801,26 @@ func (publisher *DNSSdPublisher) goroutine() {
 				fallthrough
 
 			case DNSSdFailure:
-				publisher.Log.Error(' ', "DNS-SD: %s: publishing failed",
-					instance)
+				if reconnect {
+					publisher.Log.Debug(' ',
+						"DNS-SD: %s: reconnect failed, retry in %s",
+						instance, retry)
+				} else {
+					publisher.Log.Error(' ',
+						"DNS-SD: %s: publishing failed", instance)
+					publisher.degraded(instance)
+				}
+
+				fail = true
+				publisher.backend.Halt()
+
+			case DNSSdReconnect:
+				publisher.Log.Error('!', "DNS-SD: %s: connection to "+
+					"daemon lost, reconnecting in %s", instance, retry)
 
+				reconnect = true
 				fail = true
-				publisher.sysdep.Halt()
+				publisher.backend.Halt()
 
 			default:
 				publisher.Log.Error(' ', "DNS-SD: %s: unknown event %s",
@@ -279,18 +828,19 @@ func (publisher *DNSSdPublisher) goroutine() {
 			}
 
 		case <-timer.C:
+			// Failure is reported via status channel
 			instance = publisher.instance(suffix)
-			publisher.sysdep = newDnssdSysdep(publisher.Log,
+			publisher.backend, _ = dnssdNewBackend(publisher.Log,
 				instance, publisher.Services)
-
-			if err != nil {
-				publisher.Log.Error('!', "DNS-SD: %s: %s", instance, err)
-				fail = true
-			}
 		}
 
 		if fail {
-			timer.Reset(DNSSdRetryInterval)
+			if reconnect {
+				timer.Reset(retry)
+				retry = dnssdBackoff(retry)
+			} else {
+				timer.Reset(Conf.DNSSdRetry)
+			}
 		}
 	}
 }
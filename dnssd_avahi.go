@@ -38,9 +38,17 @@ var (
 	avahiEgroupMap    = make(map[*C.AvahiEntryGroup]*dnssdSysdep)
 )
 
+// Register Avahi DNS-SD backend
+func init() {
+	DNSSdRegisterBackend("avahi", func(log *LogMessage, instance string,
+		services DNSSdServices) (DNSSdBackend, error) {
+		return newDnssdSysdep(log, instance, services)
+	})
+}
+
 // dnssdSysdep represents a system-dependent DNS-SD advertiser
 type dnssdSysdep struct {
-	log        *Logger            // Device's logger
+	log        *LogMessage        // Device's logger
 	instance   string             // Service Instance Name
 	fqdn       string             // Host's fully-qualified domain name
 	client     *C.AvahiClient     // Avahi client
@@ -58,8 +66,11 @@ func (err dnssdSysdepErr) Error() string {
 }
 
 // newDnssdSysdep creates new dnssdSysdep instance
-func newDnssdSysdep(log *Logger, instance string,
-	services DNSSdServices) *dnssdSysdep {
+//
+// On error, both dnssdSysdep and error are returned, and failure
+// is also reported via the status channel
+func newDnssdSysdep(log *LogMessage, instance string,
+	services DNSSdServices) (*dnssdSysdep, error) {
 
 	log.Debug(' ', "DNS-SD: %s: trying", instance)
 
@@ -67,6 +78,8 @@ func newDnssdSysdep(log *Logger, instance string,
 	var poll *C.AvahiPoll
 	var rc C.int
 	var proto, iface int
+	var domain string
+	var c_domain *C.char
 
 	sysdep := &dnssdSysdep{
 		log:        log,
@@ -136,29 +149,55 @@ func newDnssdSysdep(log *Logger, instance string,
 		proto = C.AVAHI_PROTO_INET
 	}
 
+	// Note, address selection is not needed here, and link-local
+	// addresses need no special handling:
+	//
+	//   - we publish only SRV and TXT records (and PTR for
+	//     browsing), pointing to the host name. No address
+	//     records are published by ipp-usb at all
+	//   - A/AAAA records of the host name are published by
+	//     avahi-daemon itself, separately on each interface,
+	//     with addresses of that interface
+	//   - mDNS query is answered on the interface it came from,
+	//     so client receives only addresses of that interface,
+	//     together with the interface index. This is exactly
+	//     the scope, needed to use the link-local address
+	//
+	// The only thing we control is the interface we publish on
+	// (all or loopback only, see above), and it is already correct
+
+	// Prepare registration domain. Empty means default (.local)
+	domain = Conf.DNSSdDomain
+
+RETRY:
+	c_domain = nil
+	if domain != "" {
+		c_domain = C.CString(domain)
+		sysdep.log.Debug(' ', "DNS-SD: domain: %q", domain)
+	}
+
 	// Populate entry group
 	for _, svc := range services {
 		// Prepare TXT record
 		var c_txt *C.AvahiStringList
 		c_txt, err = sysdep.avahiTxtRecord(svc.Port, svc.Txt)
 		if err != nil {
+			C.free(unsafe.Pointer(c_domain))
 			goto ERROR
 		}
 
 		// Prepare C strings for service instance and type
 		c_svc_type := C.CString(svc.Type)
 
-		var c_instance *C.char
-		if svc.Instance != "" {
-			c_instance = C.CString(svc.Instance)
-		} else {
-			c_instance = C.CString(instance)
-		}
+		c_instance := C.CString(svc.InstanceName(instance))
 
-		// Handle loopback-only mode
+		// Handle loopback-only mode. Loopback services
+		// are always registered in the default domain
 		iface_in_use := iface
+		domain_in_use := c_domain
 		if svc.Loopback {
 			iface_in_use = loopback
+			domain_in_use = nil
 		}
 
 		// Register service type
@@ -169,7 +208,7 @@ func newDnssdSysdep(log *Logger, instance string,
 			0,
 			c_instance,
 			c_svc_type,
-			nil, // Domain
+			domain_in_use,
 			nil, // Host
 			C.uint16_t(svc.Port),
 			c_txt,
@@ -191,7 +230,7 @@ func newDnssdSysdep(log *Logger, instance string,
 				0,
 				c_instance,
 				c_svc_type,
-				nil,
+				domain_in_use,
 				c_subtype,
 			)
 			C.free(unsafe.Pointer(c_subtype))
@@ -203,12 +242,29 @@ func newDnssdSysdep(log *Logger, instance string,
 		C.free(unsafe.Pointer(c_svc_type))
 		C.avahi_string_list_free(c_txt)
 
-		// Check for Avahi error
+		// Check for Avahi error. If registration domain is not
+		// supported, fall back to the default domain
+		if rc != C.AVAHI_OK && domain_in_use != nil &&
+			(rc == C.AVAHI_ERR_INVALID_DOMAIN_NAME ||
+				rc == C.AVAHI_ERR_NOT_SUPPORTED) {
+
+			sysdep.log.Error('!', "DNS-SD: domain %q: %s; using .local",
+				domain, dnssdSysdepErr(rc))
+
+			C.free(unsafe.Pointer(c_domain))
+			C.avahi_entry_group_reset(sysdep.egroup)
+			domain = ""
+			goto RETRY
+		}
+
 		if rc != C.AVAHI_OK {
+			C.free(unsafe.Pointer(c_domain))
 			goto AVAHI_ERROR
 		}
 	}
 
+	C.free(unsafe.Pointer(c_domain))
+
 	// Commit changes
 	rc = C.avahi_entry_group_commit(sysdep.egroup)
 	if rc != C.AVAHI_OK {
@@ -216,7 +272,7 @@ func newDnssdSysdep(log *Logger, instance string,
 	}
 
 	// Create and return dnssdSysdep
-	return sysdep
+	return sysdep, nil
 
 	// Error: cleanup and exit
 AVAHI_ERROR:
@@ -233,7 +289,7 @@ ERROR:
 		sysdep.notify(DNSSdFailure)
 	}
 
-	return sysdep
+	return sysdep, err
 }
 
 // Halt dnssdSysdep
@@ -353,7 +409,11 @@ func avahiClientCallback(client *C.AvahiClient,
 		event = "AVAHI_CLIENT_FAILURE"
 		status = DNSSdFailure
 	case C.AVAHI_CLIENT_CONNECTING:
+		// As client is created with AVAHI_CLIENT_NO_FAIL, this
+		// state means, the daemon has gone (i.e., restarted), and
+		// our registrations are lost together with the connection
 		event = "AVAHI_CLIENT_CONNECTING"
+		status = DNSSdReconnect
 	default:
 		event = fmt.Sprintf("Unknown event %d", state)
 	}
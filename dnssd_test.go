@@ -0,0 +1,653 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for DNS-SD system-independent stuff
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Test DNS-SD name truncation
+func TestDNSSdTruncateName(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		how  DNSSdTruncate
+		out  string
+	}{
+		// Short names remain unchanged
+		{"Kyocera ECOSYS M2040dn", 63, DNSSdTruncateEnd,
+			"Kyocera ECOSYS M2040dn"},
+		{"Kyocera ECOSYS M2040dn", 63, DNSSdTruncateMiddle,
+			"Kyocera ECOSYS M2040dn"},
+
+		// ASCII names
+		{"0123456789", 5, DNSSdTruncateEnd, "01234"},
+		{"0123456789", 8, DNSSdTruncateMiddle, "012…89"},
+
+		// Multibyte: "Ж" is 2 bytes, "€" is 3 bytes
+		{"ЖЖЖЖ", 5, DNSSdTruncateEnd, "ЖЖ"},
+		{"ЖЖЖЖ", 6, DNSSdTruncateEnd, "ЖЖЖ"},
+		{"a€€€", 6, DNSSdTruncateEnd, "a€"},
+		{"€€€€€€", 10, DNSSdTruncateMiddle, "€…€"},
+		{"€€€€€€", 11, DNSSdTruncateMiddle, "€…€"},
+		{"€€€€€€", 12, DNSSdTruncateMiddle, "€…€€"},
+	}
+
+	for _, test := range tests {
+		out := dnssdTruncateName(test.name, test.max, test.how)
+		if out != test.out {
+			t.Errorf("%q, %d, %d: expected %q, got %q",
+				test.name, test.max, test.how, test.out, out)
+		}
+	}
+
+	// Check all lengths around the 63-byte boundary
+	for _, how := range []DNSSdTruncate{DNSSdTruncateEnd,
+		DNSSdTruncateMiddle} {
+		for n := 20; n < 40; n++ {
+			name := strings.Repeat("П", n) + " (USB)"
+			for max := 55; max <= 63; max++ {
+				out := dnssdTruncateName(name, max, how)
+				if len(out) > max {
+					t.Errorf("%d/%d: %q too long", n, max, out)
+				}
+				if !utf8.ValidString(out) {
+					t.Errorf("%d/%d: %q invalid UTF-8", n, max, out)
+				}
+			}
+		}
+	}
+}
+
+// Test that DNS-SD name prefix and suffix survive truncation
+func TestDNSSdTagName(t *testing.T) {
+	savePrefix, saveSuffix := Conf.DNSSdNamePrefix, Conf.DNSSdNameSuffix
+	saveTruncate := Conf.DNSSdTruncate
+	defer func() {
+		Conf.DNSSdNamePrefix, Conf.DNSSdNameSuffix = savePrefix, saveSuffix
+		Conf.DNSSdTruncate = saveTruncate
+	}()
+
+	// Without prefix and suffix, name remains unchanged
+	Conf.DNSSdNamePrefix, Conf.DNSSdNameSuffix = "", ""
+	name := strings.Repeat("П", 40)
+	if out := dnssdTagName(name); out != name {
+		t.Errorf("expected %q, got %q", name, out)
+	}
+
+	Conf.DNSSdNamePrefix, Conf.DNSSdNameSuffix = "Lab: ", " [€]"
+	out := dnssdTagName("Kyocera ECOSYS M2040dn")
+	if out != "Lab: Kyocera ECOSYS M2040dn [€]" {
+		t.Errorf("short name: got %q", out)
+	}
+
+	for _, how := range []DNSSdTruncate{DNSSdTruncateEnd,
+		DNSSdTruncateMiddle} {
+		Conf.DNSSdTruncate = how
+		for n := 20; n < 40; n++ {
+			name := strings.Repeat("П", n)
+			tagged := dnssdTagName(name)
+
+			publisher := &DNSSdPublisher{
+				DevState: &DevState{
+					DNSSdName:     tagged,
+					DNSSdOverride: tagged,
+				},
+			}
+
+			for suffix := 0; suffix < 100; suffix++ {
+				out := publisher.instance(suffix)
+				if len(out) > 63 {
+					t.Errorf("%d/%d: %q too long", n, suffix, out)
+				}
+				if !utf8.ValidString(out) {
+					t.Errorf("%d/%d: %q invalid UTF-8", n, suffix, out)
+				}
+				if !strings.HasPrefix(out, Conf.DNSSdNamePrefix) {
+					t.Errorf("%d/%d: %q prefix lost", n, suffix, out)
+				}
+				if !strings.Contains(out, Conf.DNSSdNameSuffix+" (USB") {
+					t.Errorf("%d/%d: %q suffix lost", n, suffix, out)
+				}
+			}
+		}
+	}
+}
+
+// Test that txtvers goes first in all TXT records, and TXT reordering
+func TestDNSSdTxtOrder(t *testing.T) {
+	_, ippsvc := testIppAttrs().decode(UsbDeviceInfo{})
+
+	platen := `<scan:Platen><scan:PlatenInputCaps>` +
+		testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`
+	esclsvc, err := esclDecodeCaps(testEsclCaps(platen),
+		UsbDeviceInfo{}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, svc := range []DNSSdSvcInfo{ippsvc, esclsvc} {
+		if len(svc.Txt) == 0 || svc.Txt[0].Key != "txtvers" {
+			t.Errorf("%s: txtvers is not the first TXT item",
+				svc.Type)
+		}
+	}
+
+	txt := DNSSdTxtRecord{}
+	for _, key := range []string{"air", "rp", "txtvers", "ty", "note"} {
+		txt.Add(key, "")
+	}
+
+	txt.Reorder([]string{"ty", "missed", "txtvers"})
+
+	keys := []string{}
+	for _, item := range txt {
+		keys = append(keys, item.Key)
+	}
+
+	expected := "ty,txtvers,air,rp,note"
+	if s := strings.Join(keys, ","); s != expected {
+		t.Errorf("Reorder: expected %q, got %q", expected, s)
+	}
+}
+
+// Test that all services share the same UUID
+func TestDNSSdShareUUID(t *testing.T) {
+	const uuid = "6b9c4e28-0d3b-4a58-9c7e-1f1f2e3d4c5b"
+
+	_, ippsvc := testIppAttrs(
+		goipp.MakeAttribute("printer-uuid", goipp.TagURI,
+			goipp.String("urn:uuid:"+uuid)),
+	).decode(UsbDeviceInfo{})
+
+	platen := `<scan:Platen><scan:PlatenInputCaps>` +
+		testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`
+	esclsvc, err := esclDecodeCaps(testEsclCaps(platen),
+		UsbDeviceInfo{SerialNumber: "12345"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	services := DNSSdServices{ippsvc, esclsvc}
+	services.Add(DNSSdSvcInfo{Type: "_http._tcp"})
+	services.ShareUUID("fallback")
+
+	for _, svc := range services {
+		if value, _ := svc.Txt.find("UUID"); value != uuid {
+			t.Errorf("%s: UUID expected %q, got %q",
+				svc.Type, uuid, value)
+		}
+	}
+
+	// Without any UUID, fallback is used
+	services = DNSSdServices{{Type: "_http._tcp"}, {Type: "_uscan._tcp"}}
+	services.ShareUUID(uuid)
+
+	for _, svc := range services {
+		if value, _ := svc.Txt.find("UUID"); value != uuid {
+			t.Errorf("%s: UUID expected %q, got %q",
+				svc.Type, uuid, value)
+		}
+	}
+}
+
+// Test DNS-SD domain validation
+func TestDNSSdCheckDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		ok     bool
+	}{
+		{"local", true},
+		{"dns-sd.example.com", true},
+		{"example.com.", true},
+		{"", false},
+		{"example..com", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exa_mple.com", false},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("a.", 127) + "com", false},
+	}
+
+	for _, test := range tests {
+		err := dnssdCheckDomain(test.domain)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: expected ok=%v, got %v",
+				test.domain, test.ok, err)
+		}
+	}
+}
+
+// Test DNS-SD backend selection
+func TestDNSSdBackendAvailable(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"auto", true},
+		{"avahi", true},
+		{"builtin", false},
+		{"bonjour", false},
+	}
+
+	for _, test := range tests {
+		err := dnssdBackendAvailable(test.name)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: expected ok=%v, got %v",
+				test.name, test.ok, err)
+		}
+	}
+}
+
+// Test advertising of the web UI service
+func TestDNSSdWebService(t *testing.T) {
+	saveLabel, savePath := Conf.DNSSdWebLabel, Conf.DNSSdWebPath
+	defer func() {
+		Conf.DNSSdWebLabel, Conf.DNSSdWebPath = saveLabel, savePath
+	}()
+
+	ippinfo := &IppPrinterInfo{
+		AdminURL: "http://localhost:60000/hp/device/info?tab=home",
+	}
+
+	tests := []struct {
+		label, path string          // Configuration
+		ippinfo     *IppPrinterInfo // Device info
+		suffix      string          // Expected InstanceSuffix
+		txt         string          // Expected "path", "" if none
+	}{
+		{"", "", ippinfo, "", ""},
+		{"Web", "", ippinfo, " (Web)", ""},
+		{"", "/admin", ippinfo, "", "/admin"},
+		{"", "auto", ippinfo, "", "/hp/device/info?tab=home"},
+		{"", "auto", nil, "", ""},
+		{"", "auto", &IppPrinterInfo{}, "", ""},
+		{"", "auto", &IppPrinterInfo{AdminURL: "http://localhost/"},
+			"", ""},
+	}
+
+	for _, test := range tests {
+		Conf.DNSSdWebLabel, Conf.DNSSdWebPath = test.label, test.path
+		svc := DNSSdWebService(60000, UsbDeviceInfo{}, test.ippinfo)
+
+		if svc.Type != "_http._tcp" || svc.Port != 60000 {
+			t.Errorf("%q/%q: bad service %s:%d",
+				test.label, test.path, svc.Type, svc.Port)
+		}
+
+		if svc.InstanceSuffix != test.suffix {
+			t.Errorf("%q/%q: suffix: expected %q, got %q",
+				test.label, test.path, test.suffix,
+				svc.InstanceSuffix)
+		}
+
+		path, found := testTxtLookup(svc.Txt, "path")
+		if found != (test.txt != "") || path != test.txt {
+			t.Errorf("%q/%q: path: expected %q, got %q (%v)",
+				test.label, test.path, test.txt, path, found)
+		}
+	}
+}
+
+// Test UUID and friendly name of the _http._tcp service
+func TestDNSSdWebServiceUUID(t *testing.T) {
+	saveLabel, saveUUID := Conf.DNSSdWebLabel, Conf.DNSSdWebUUID
+	defer func() {
+		Conf.DNSSdWebLabel, Conf.DNSSdWebUUID = saveLabel, saveUUID
+	}()
+
+	usbinfo := UsbDeviceInfo{
+		Vendor:        0x03f0,
+		Product:       0xc511,
+		SerialNumber:  "TH6CM4N1DY0662",
+		Manufacturer:  "HP",
+		ProductName:   "HP LaserJet MFP M426fdn",
+		MfgAndProduct: "HP LaserJet MFP M426fdn",
+	}
+	ippinfo := &IppPrinterInfo{UUID: "564e4333-4230-3738-3554-a45d36a1f4e8"}
+
+	Conf.DNSSdWebLabel = ""
+
+	// Disabled by default
+	Conf.DNSSdWebUUID = false
+	svc := DNSSdWebService(60000, usbinfo, ippinfo)
+	for _, key := range []string{"UUID", "ty"} {
+		if _, found := testTxtLookup(svc.Txt, key); found {
+			t.Errorf("disabled: %q added", key)
+		}
+	}
+
+	// UUID is taken from IPP, if available
+	Conf.DNSSdWebUUID = true
+	svc = DNSSdWebService(60000, usbinfo, ippinfo)
+	if uuid, _ := testTxtLookup(svc.Txt, "UUID"); uuid != ippinfo.UUID {
+		t.Errorf("UUID: expected %q, got %q", ippinfo.UUID, uuid)
+	}
+
+	if ty, _ := testTxtLookup(svc.Txt, "ty"); ty != usbinfo.ProductName {
+		t.Errorf("ty: expected %q, got %q", usbinfo.ProductName, ty)
+	}
+
+	// Without IPP, UUID is generated from the USB info, the same
+	// way as for the scanner
+	Conf.DNSSdWebLabel = "Web"
+	svc = DNSSdWebService(60000, usbinfo, nil)
+	if uuid, _ := testTxtLookup(svc.Txt, "UUID"); uuid != usbinfo.UUID() {
+		t.Errorf("UUID: expected %q, got %q", usbinfo.UUID(), uuid)
+	}
+
+	expected := usbinfo.ProductName + " (Web)"
+	if ty, _ := testTxtLookup(svc.Txt, "ty"); ty != expected {
+		t.Errorf("ty: expected %q, got %q", expected, ty)
+	}
+}
+
+// testDNSSdBackend is the DNSSdBackend for testing of the publisher
+type testDNSSdBackend struct {
+	ch     chan DNSSdStatus // Status notifications
+	halted chan struct{}    // Closed by Halt
+}
+
+// Halt testDNSSdBackend
+func (backend *testDNSSdBackend) Halt() {
+	select {
+	case <-backend.halted:
+	default:
+		close(backend.halted)
+	}
+}
+
+// Chan returns testDNSSdBackend status channel
+func (backend *testDNSSdBackend) Chan() <-chan DNSSdStatus {
+	return backend.ch
+}
+
+// Test recovery of DNS-SD publisher after loss of daemon connection
+func TestDNSSdPublisherReconnect(t *testing.T) {
+	saveBackend, saveRetry := Conf.DNSSdBackend, Conf.DNSSdRetry
+	defer func() {
+		Conf.DNSSdBackend, Conf.DNSSdRetry = saveBackend, saveRetry
+		delete(dnssdBackends, "test")
+	}()
+
+	created := make(chan *testDNSSdBackend, 10)
+	DNSSdRegisterBackend("test", func(log *LogMessage, instance string,
+		services DNSSdServices) (DNSSdBackend, error) {
+		backend := &testDNSSdBackend{
+			ch:     make(chan DNSSdStatus, 1),
+			halted: make(chan struct{}),
+		}
+		created <- backend
+		return backend, nil
+	})
+
+	Conf.DNSSdBackend = "test"
+	Conf.DNSSdRetry = 20 * time.Millisecond
+
+	// Make sure, DevState will not be saved
+	state := &DevState{DNSSdName: "Test", DNSSdOverride: "Test Printer"}
+	publisher := NewDNSSdPublisher(NewLogger(), state, nil)
+	publisher.Publish()
+	defer publisher.Unpublish()
+
+	next := func() *testDNSSdBackend {
+		select {
+		case backend := <-created:
+			return backend
+		case <-time.After(5 * time.Second):
+			t.Fatalf("backend not created")
+		}
+		return nil
+	}
+
+	backend := next()
+	backend.ch <- DNSSdSuccess
+
+	// Connection lost: backend is halted and recreated
+	backend.ch <- DNSSdReconnect
+	start := time.Now()
+	backend2 := next()
+	<-backend.halted
+
+	// Reconnect fails: next attempt is delayed twice longer
+	backend2.ch <- DNSSdFailure
+	start2 := time.Now()
+	backend3 := next()
+	<-backend2.halted
+
+	elapsed, elapsed2 := start2.Sub(start), time.Since(start2)
+	if elapsed2 < Conf.DNSSdRetry*3/2 {
+		t.Errorf("no backoff: %s, then %s", elapsed, elapsed2)
+	}
+
+	backend3.ch <- DNSSdSuccess
+
+	// Backoff is capped
+	retry := Conf.DNSSdRetry
+	for i := 0; i < 20; i++ {
+		retry = dnssdBackoff(retry)
+	}
+
+	if retry != DNSSdReconnectMax {
+		t.Errorf("backoff: expected %s, got %s",
+			DNSSdReconnectMax, retry)
+	}
+}
+
+// Test DNS-SD publisher when initial publishing fails
+func TestDNSSdPublisherFailure(t *testing.T) {
+	saveBackend, saveRetry := Conf.DNSSdBackend, Conf.DNSSdRetry
+	defer func() {
+		Conf.DNSSdBackend, Conf.DNSSdRetry = saveBackend, saveRetry
+		delete(dnssdBackends, "test")
+	}()
+
+	// First attempt fails, next attempts succeed
+	created := make(chan *testDNSSdBackend, 10)
+	failed := false
+	DNSSdRegisterBackend("test", func(log *LogMessage, instance string,
+		services DNSSdServices) (DNSSdBackend, error) {
+		backend := &testDNSSdBackend{
+			ch:     make(chan DNSSdStatus, 1),
+			halted: make(chan struct{}),
+		}
+
+		var err error
+		if !failed {
+			failed = true
+			err = errors.New("test failure")
+			backend.ch <- DNSSdFailure
+		}
+
+		created <- backend
+		return backend, err
+	})
+
+	Conf.DNSSdBackend = "test"
+	Conf.DNSSdRetry = 20 * time.Millisecond
+
+	state := &DevState{DNSSdName: "Test", DNSSdOverride: "Test Printer"}
+	publisher := NewDNSSdPublisher(NewLogger(), state, nil)
+	err := publisher.Publish()
+	defer publisher.Unpublish()
+
+	if err == nil || err.Error() != "test failure" {
+		t.Errorf("Publish: expected %q, got %v", "test failure", err)
+	}
+
+	next := func() *testDNSSdBackend {
+		select {
+		case backend := <-created:
+			return backend
+		case <-time.After(5 * time.Second):
+			t.Fatalf("backend not created")
+		}
+		return nil
+	}
+
+	// Failed backend is halted and publishing is retried
+	backend := next()
+	backend2 := next()
+	<-backend.halted
+	backend2.ch <- DNSSdSuccess
+}
+
+// Test export of services as Avahi .service files
+func TestDNSSdExportXML(t *testing.T) {
+	saveDomain, saveIPv6 := Conf.DNSSdDomain, Conf.IPV6Enable
+	defer func() {
+		Conf.DNSSdDomain, Conf.IPV6Enable = saveDomain, saveIPv6
+	}()
+
+	Conf.DNSSdDomain = ""
+	Conf.IPV6Enable = false
+
+	var services DNSSdServices
+
+	ipp := DNSSdSvcInfo{
+		Type:     "_ipp._tcp",
+		SubTypes: []string{"_universal._sub._ipp._tcp"},
+		Port:     60000,
+	}
+	ipp.Txt.Add("ty", "Printer & Co")
+	ipp.Txt.AddURL("adminurl", "http://localhost:60000/admin")
+	services.Add(ipp)
+
+	services.Add(DNSSdSvcInfo{Type: "_ipp-usb._tcp", Port: 60000,
+		Instance: "0102", Loopback: true})
+	services.Add(DNSSdSvcInfo{Type: "_uscan._tcp", Port: 60000,
+		InstanceSuffix: " (Scanner)"})
+	services.Add(DNSSdSvcInfo{Type: "_http._tcp", Port: 60000})
+
+	files, err := DNSSdExportXML("Printer", "host.local", services)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Loopback service is skipped, scanner goes to separate file
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	for _, data := range files {
+		if !strings.HasPrefix(string(data), dnssdExportHeader) {
+			t.Errorf("missed header:\n%s", data)
+		}
+	}
+
+	var group dnssdExportGroup
+	err = xml.Unmarshal(files[0], &group)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := dnssdExportGroup{
+		XMLName: xml.Name{Local: "service-group"},
+		Name:    dnssdExportName{Wildcards: "no", Name: "Printer"},
+		Services: []dnssdExportService{
+			{
+				Protocol: "ipv4",
+				Type:     "_ipp._tcp",
+				SubTypes: []string{"_universal._sub._ipp._tcp"},
+				Port:     60000,
+				Txt: []string{
+					"ty=Printer & Co",
+					"adminurl=http://host.local:60000/admin",
+				},
+			},
+			{
+				Protocol: "ipv4",
+				Type:     "_http._tcp",
+				Port:     60000,
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(group, expected) {
+		t.Errorf("expected:\n%+v\ngot:\n%+v", expected, group)
+	}
+
+	group = dnssdExportGroup{}
+	xml.Unmarshal(files[1], &group)
+	if group.Name.Name != "Printer (Scanner)" ||
+		len(group.Services) != 1 ||
+		group.Services[0].Type != "_uscan._tcp" {
+		t.Errorf("scanner: got %+v", group)
+	}
+}
+
+// Test export of services by DNSSdPublisher
+func TestDNSSdPublisherExport(t *testing.T) {
+	saveDir, saveEnable := Conf.DNSSdExportDir, Conf.DNSSdEnable
+	saveLoopback := Conf.LoopbackOnly
+	defer func() {
+		Conf.DNSSdExportDir, Conf.DNSSdEnable = saveDir, saveEnable
+		Conf.LoopbackOnly = saveLoopback
+	}()
+
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	Conf.DNSSdExportDir = dir
+	state := &DevState{Ident: "test-device", DNSSdName: "Printer"}
+
+	var services DNSSdServices
+	services.Add(DNSSdSvcInfo{Type: "_ipp._tcp", Port: 60000})
+
+	exported := func() []string {
+		matches, _ := filepath.Glob(filepath.Join(Conf.DNSSdExportDir,
+			"*.service"))
+		return matches
+	}
+
+	// Exported services are not published directly
+	Conf.DNSSdEnable, Conf.LoopbackOnly = true, false
+	publisher := NewDNSSdPublisher(NewLogger(), state, services)
+	if err = publisher.Publish(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, none := publisher.backend.(dnssdNoBackend); !none {
+		t.Errorf("exported services published directly")
+	}
+
+	if files := exported(); len(files) != 1 {
+		t.Errorf("expected 1 exported file, got %d", len(files))
+	}
+
+	publisher.Unpublish()
+	if files := exported(); len(files) != 0 {
+		t.Errorf("exported files not removed")
+	}
+
+	// Loopback-only mode: export is skipped
+	Conf.DNSSdEnable, Conf.LoopbackOnly = false, true
+	publisher = NewDNSSdPublisher(NewLogger(), state, services)
+	publisher.Publish()
+
+	if files := exported(); len(files) != 0 {
+		t.Errorf("loopback-only: services exported")
+	}
+
+	publisher.Unpublish()
+}
@@ -0,0 +1,207 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Export of DNS-SD services as Avahi .service files
+ *
+ * If enabled by the dns-sd-export-dir parameter, services of each
+ * device are written in the Avahi service-group XML format, so
+ * advertising can be handed off to Avahi's static services (or just
+ * inspected). Avahi service-group has a single instance name, so
+ * services with different instance names go to separate files
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dnssdExportHeader is the header of the Avahi .service file
+const dnssdExportHeader = `<?xml version="1.0" standalone='no'?>
+<!DOCTYPE service-group SYSTEM "avahi-service.dtd">
+`
+
+// dnssdExportGroup represents Avahi <service-group> element
+type dnssdExportGroup struct {
+	XMLName  xml.Name             `xml:"service-group"`
+	Name     dnssdExportName      `xml:"name"`
+	Services []dnssdExportService `xml:"service"`
+}
+
+// dnssdExportName represents Avahi <name> element
+type dnssdExportName struct {
+	Wildcards string `xml:"replace-wildcards,attr"`
+	Name      string `xml:",chardata"`
+}
+
+// dnssdExportService represents Avahi <service> element. Order
+// of fields follows the avahi-service.dtd
+type dnssdExportService struct {
+	Protocol string   `xml:"protocol,attr,omitempty"`
+	Type     string   `xml:"type"`
+	SubTypes []string `xml:"subtype"`
+	Domain   string   `xml:"domain-name,omitempty"`
+	Port     int      `xml:"port"`
+	Txt      []string `xml:"txt-record"`
+}
+
+// DNSSdExportXML formats services as Avahi .service files, one per
+// distinct instance name, in order of appearance
+//
+// Avahi static services can't be bound to the particular interface,
+// so loopback-only services are not exported. URLs in TXT records
+// use the specified host name
+func DNSSdExportXML(instance, host string,
+	services DNSSdServices) ([][]byte, error) {
+
+	var groups []*dnssdExportGroup
+	byName := make(map[string]*dnssdExportGroup)
+
+	for _, svc := range services {
+		if svc.Loopback {
+			continue
+		}
+
+		name := svc.InstanceName(instance)
+		group := byName[name]
+		if group == nil {
+			group = &dnssdExportGroup{
+				Name: dnssdExportName{Wildcards: "no", Name: name},
+			}
+			byName[name] = group
+			groups = append(groups, group)
+		}
+
+		xsvc := dnssdExportService{
+			Type:     svc.Type,
+			SubTypes: svc.SubTypes,
+			Domain:   Conf.DNSSdDomain,
+			Port:     svc.Port,
+		}
+
+		if !Conf.IPV6Enable {
+			xsvc.Protocol = "ipv4"
+		}
+
+		for _, t := range svc.Txt {
+			value := t.Value
+			if t.URL {
+				value = dnssdExportURL(value, host, svc.Port)
+			}
+			xsvc.Txt = append(xsvc.Txt, t.Key+"="+value)
+		}
+
+		group.Services = append(group.Services, xsvc)
+	}
+
+	files := make([][]byte, 0, len(groups))
+	for _, group := range groups {
+		data, err := xml.MarshalIndent(group, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		buf.WriteString(dnssdExportHeader)
+		buf.Write(data)
+		buf.WriteByte('\n')
+		files = append(files, buf.Bytes())
+	}
+
+	return files, nil
+}
+
+// dnssdExportURL replaces host part of URL with the specified host
+// and port, the same way as DNS-SD backend does
+func dnssdExportURL(value, host string, port int) string {
+	parsed, err := url.Parse(value)
+	if err != nil || !parsed.IsAbs() || host == "" {
+		return value
+	}
+
+	parsed.Host = host
+	if port != 0 {
+		parsed.Host += fmt.Sprintf(":%d", port)
+	}
+
+	return parsed.String()
+}
+
+// dnssdExportHost returns host name for URLs in the exported
+// TXT records, in the DNS-SD registration domain
+func dnssdExportHost() string {
+	if Conf.LoopbackOnly {
+		return "localhost"
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		host = host[:i]
+	}
+
+	domain := Conf.DNSSdDomain
+	if domain == "" {
+		domain = "local"
+	}
+
+	return host + "." + domain
+}
+
+// export writes publisher's services into the Avahi .service files
+// in the dns-sd-export-dir directory. Errors are logged, but not
+// returned, as export is not essential for the device operation
+func (publisher *DNSSdPublisher) export(instance string) {
+	dir := Conf.DNSSdExportDir
+	files, err := DNSSdExportXML(instance, dnssdExportHost(),
+		publisher.Services)
+
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+
+	for i := 0; err == nil && i < len(files); i++ {
+		name := "ipp-usb-" + publisher.DevState.Ident
+		if i > 0 {
+			name += fmt.Sprintf("-%d", i+1)
+		}
+		path := filepath.Join(dir, name+".service")
+
+		// Avahi watches the directory, so file is written under
+		// the temporary name, then atomically renamed
+		tmp := path + ".tmp"
+		err = ioutil.WriteFile(tmp, files[i], 0644)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+
+		if err == nil {
+			publisher.exported = append(publisher.exported, path)
+			publisher.Log.Debug(' ', "DNS-SD: exported to %s", path)
+		}
+	}
+
+	if err != nil {
+		publisher.Log.Error('!', "DNS-SD: export: %s", err)
+	}
+}
+
+// unexport removes files, written by export
+func (publisher *DNSSdPublisher) unexport() {
+	for _, path := range publisher.exported {
+		os.Remove(path)
+	}
+	publisher.exported = nil
+}
@@ -0,0 +1,151 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * DNS-SD TXT record post-processing hook
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// dnssdHookSvc is the JSON representation of DNSSdSvcInfo,
+// exchanged with the hook
+type dnssdHookSvc struct {
+	Instance string            `json:"instance,omitempty"`
+	Type     string            `json:"type"`
+	Port     int               `json:"port"`
+	Txt      []dnssdHookTxtItm `json:"txt"`
+}
+
+// dnssdHookTxtItm is the JSON representation of DNSSdTxtItem
+type dnssdHookTxtItm struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// RunHook runs external program to post-process TXT records of
+// DNSSdServices
+//
+// The program receives JSON array of services on its stdin and
+// must write the same array, with TXT records modified, to its
+// stdout. Only TXT records are taken from the program output,
+// other service parameters cannot be changed.
+//
+// On any error, including timeout, error is logged and services
+// are returned unmodified
+func (services DNSSdServices) RunHook(log *LogMessage,
+	name, path string) DNSSdServices {
+
+	out, err := services.runHook(log, name, path, DNSSdHookTimeout)
+	if err != nil {
+		log.Error('!', "dns-sd-hook: %s", err)
+		log.Error('!', "dns-sd-hook: using unmodified TXT records")
+		return services
+	}
+
+	return out
+}
+
+// runHook does the actual work for RunHook
+func (services DNSSdServices) runHook(log *LogMessage,
+	name, path string, timeout time.Duration) (DNSSdServices, error) {
+
+	// Encode services
+	in := make([]dnssdHookSvc, len(services))
+	for i, svc := range services {
+		in[i] = dnssdHookSvc{
+			Instance: svc.InstanceName(name),
+			Type:     svc.Type,
+			Port:     svc.Port,
+			Txt:      make([]dnssdHookTxtItm, len(svc.Txt)),
+		}
+
+		for j, txt := range svc.Txt {
+			in[i].Txt[j] = dnssdHookTxtItm{txt.Key, txt.Value}
+		}
+	}
+
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run the hook
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debug(' ', "dns-sd-hook: running %q", path)
+	err = cmd.Run()
+
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if line != "" {
+			log.Debug(' ', "dns-sd-hook: %s", line)
+		}
+	}
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return nil, fmt.Errorf("%q: timeout (%s)", path, timeout)
+	case err != nil:
+		return nil, fmt.Errorf("%q: %s", path, err)
+	}
+
+	// Decode and validate output
+	var out []dnssdHookSvc
+	err = json.Unmarshal(stdout.Bytes(), &out)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output: %s", err)
+	}
+
+	if len(out) != len(services) {
+		return nil, fmt.Errorf("invalid output: %d services "+
+			"expected, %d returned", len(services), len(out))
+	}
+
+	modified := make(DNSSdServices, len(services))
+	for i, svc := range services {
+		if out[i].Type != svc.Type {
+			return nil, fmt.Errorf("invalid output: service %d: "+
+				"%q expected, %q returned", i, svc.Type, out[i].Type)
+		}
+
+		// URL flag is preserved for items with the same key
+		var txt DNSSdTxtRecord
+		for _, itm := range out[i].Txt {
+			if err = dnssdCheckTxtItem(itm.Key, itm.Value); err != nil {
+				return nil, fmt.Errorf("invalid output: %s: %q: %s",
+					svc.Type, itm.Key, err)
+			}
+
+			url := false
+			for _, old := range svc.Txt {
+				if old.Key == itm.Key {
+					url = old.URL
+				}
+			}
+
+			txt = append(txt, DNSSdTxtItem{itm.Key, itm.Value, url})
+		}
+
+		modified[i] = svc
+		modified[i].Txt = txt
+	}
+
+	return modified, nil
+}
@@ -0,0 +1,161 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for DNS-SD TXT record post-processing hook
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDNSSdHook writes shell script hook into the directory
+// and returns its path
+func testDNSSdHook(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return path
+}
+
+// testDNSSdHookServices returns services, passed to the hook
+func testDNSSdHookServices() DNSSdServices {
+	return DNSSdServices{
+		{
+			Type: "_ipp._tcp",
+			Port: 60000,
+			Txt: DNSSdTxtRecord{
+				{"ty", "Printer", false},
+				{"adminurl", "http://localhost:60000/", true},
+			},
+		},
+		{
+			Type: "_uscan._tcp",
+			Port: 60000,
+			Txt:  DNSSdTxtRecord{{"ty", "Scanner", false}},
+		},
+	}
+}
+
+// Test successful run of the DNS-SD hook
+func TestDNSSdHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	services := testDNSSdHookServices()
+
+	// Hook that changes nothing
+	path := testDNSSdHook(t, dir, "cat", "exec cat")
+	out := services.RunHook(log, "Test", path)
+	if !reflect.DeepEqual(out, services) {
+		t.Errorf("cat: expected %v, got %v", services, out)
+	}
+
+	// Hook that modifies TXT records. URL flag must be preserved
+	path = testDNSSdHook(t, dir, "modify", `cat > /dev/null
+echo '[{"type": "_ipp._tcp", "port": 1,
+	"txt": [{"key": "note", "value": "Office"},
+		{"key": "adminurl", "value": "http://localhost:60000/"}]},
+	{"type": "_uscan._tcp", "port": 1, "txt": []}]'`)
+
+	out = services.RunHook(log, "Test", path)
+	expected := testDNSSdHookServices()
+	expected[0].Txt = DNSSdTxtRecord{
+		{"note", "Office", false},
+		{"adminurl", "http://localhost:60000/", true},
+	}
+	expected[1].Txt = nil
+
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("modify: expected %v, got %v", expected, out)
+	}
+}
+
+// Test DNS-SD hook failures: services must be returned unmodified
+func TestDNSSdHookFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	services := testDNSSdHookServices()
+
+	tests := []struct {
+		name   string // Script name
+		script string // Script body
+		err    string // Expected error substring
+	}{
+		{"fail", "exit 1", "exit status 1"},
+		{"garbage", "echo garbage", "invalid output"},
+		{"count", `echo '[{"type": "_ipp._tcp", "txt": []}]'`,
+			"2 services expected, 1 returned"},
+		{"type", `echo '[{"type": "_ipp._tcp", "txt": []},
+			{"type": "_http._tcp", "txt": []}]'`,
+			`"_uscan._tcp" expected, "_http._tcp" returned`},
+		{"key", `echo '[{"type": "_ipp._tcp",
+			"txt": [{"key": "a=b", "value": ""}]},
+			{"type": "_uscan._tcp", "txt": []}]'`,
+			"invalid character in key"},
+		{"empty", `echo '[{"type": "_ipp._tcp",
+			"txt": [{"key": "", "value": "x"}]},
+			{"type": "_uscan._tcp", "txt": []}]'`,
+			"empty key"},
+	}
+
+	for _, test := range tests {
+		path := testDNSSdHook(t, dir, test.name,
+			"cat > /dev/null\n"+test.script)
+
+		_, err := services.runHook(log, "Test", path, DNSSdHookTimeout)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+
+		out := services.RunHook(log, "Test", path)
+		if !reflect.DeepEqual(out, services) {
+			t.Errorf("%s: services modified on error", test.name)
+		}
+	}
+
+	// Missed hook
+	path := filepath.Join(dir, "missed")
+	out := services.RunHook(log, "Test", path)
+	if !reflect.DeepEqual(out, services) {
+		t.Errorf("missed: services modified on error")
+	}
+
+	// Hook that hangs
+	path = testDNSSdHook(t, dir, "hang", "exec sleep 10")
+	start := time.Now()
+	_, err = services.runHook(log, "Test", path, 100*time.Millisecond)
+	elapsed := time.Since(start)
+
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("hang: expected timeout, got %v", err)
+	}
+
+	if elapsed > 5*time.Second {
+		t.Errorf("hang: timeout not enforced (%s)", elapsed)
+	}
+}
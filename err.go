@@ -21,4 +21,14 @@ var (
 	ErrUnusable     = errors.New("Device doesn't implement print or scan service")
 	ErrNoIppUsb     = errors.New("ipp-usb daemon not running")
 	ErrAccess       = errors.New("Access denied")
+	ErrNoDevice     = errors.New("Device not found")
+	ErrResetBusy    = errors.New("Device reset is in progress")
+	ErrDetached     = errors.New("Device is temporarily disconnected")
+	ErrNotSupported = errors.New("Operation not supported by device")
+	ErrMaxDevices   = errors.New("Too many devices, queued")
+	ErrScannerBusy  = errors.New("Scanner is busy with another job")
+	ErrEmptyIpp     = errors.New("Empty IPP response")
+	ErrUnchanged    = errors.New("Device configuration not changed")
+	ErrResume       = errors.New("Device cannot be resumed after idle")
+	ErrPnPBusy      = errors.New("Device manager is busy, try again later")
 )
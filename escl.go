@@ -17,6 +17,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -24,21 +25,20 @@ import (
 // http.Client and decodes received information into the form
 // suitable for DNS-SD registration
 //
-// Discovered services will be added to the services collection
+// Discovered services will be added to the services collection.
+// If icons is not nil, scanner icon is fetched into that cache
+// (see esclCacheIcon)
 func EsclService(log *LogMessage, services *DNSSdServices,
 	port int, usbinfo UsbDeviceInfo, ippinfo *IppPrinterInfo,
-	c *http.Client) (err error) {
+	icons *IconCache, c *http.Client) (err error) {
 
-	uri := fmt.Sprintf("http://localhost:%d/eSCL/ScannerCapabilities", port)
+	log = log.BeginSubsys(LogSubsysESCL)
+	defer log.Commit()
 
-	decoder := newEsclCapsDecoder(ippinfo)
-	svc := DNSSdSvcInfo{
-		Type: "_uscan._tcp",
-		Port: port,
-	}
+	uri := fmt.Sprintf("http://localhost:%d/eSCL/ScannerCapabilities", port)
 
 	var xmlData []byte
-	var list []string
+	var svc DNSSdSvcInfo
 
 	// Query ScannerCapabilities
 	resp, err := c.Get(uri)
@@ -64,11 +64,69 @@ func EsclService(log *LogMessage, services *DNSSdServices,
 	log.Flush()
 
 	// Decode the XML
-	err = decoder.decode(bytes.NewBuffer(xmlData))
+	svc, err = esclDecodeCaps(xmlData, usbinfo, ippinfo)
 	if err != nil {
 		goto ERROR
 	}
 
+	// Cache the icon
+	if icons != nil {
+		esclCacheIcon(log, &svc, port, icons, c)
+	}
+
+	// Add to services
+	svc.Port = port
+	services.Add(svc)
+
+	return
+
+	// Handle a error
+ERROR:
+	err = fmt.Errorf("eSCL: %s", err)
+	return
+}
+
+// esclCacheIcon fetches the scanner icon ("representation") into
+// the icon cache and makes "representation" to refer the cached copy.
+// If icon is not available, "representation" is removed, so clients
+// will not try the broken URL
+func esclCacheIcon(log *LogMessage, svc *DNSSdSvcInfo, port int,
+	icons *IconCache, c *http.Client) {
+
+	url, found := svc.Txt.find("representation")
+	if !found {
+		return
+	}
+
+	local, err := icons.Fetch(c, port, "scanner", url)
+	if err != nil {
+		log.Debug('!', "eSCL icon %q: %s", url, err)
+		svc.Txt.Del("representation")
+		return
+	}
+
+	log.Debug(' ', "eSCL icon %q cached as %q", url, local)
+	svc.Txt.Set("representation", local)
+}
+
+// esclDecodeCaps decodes eSCL ScannerCapabilities and builds
+// the _uscan._tcp service. Port of returned service is not set
+func esclDecodeCaps(xmlData []byte, usbinfo UsbDeviceInfo,
+	ippinfo *IppPrinterInfo) (svc DNSSdSvcInfo, err error) {
+
+	decoder := newEsclCapsDecoder(ippinfo)
+	svc = DNSSdSvcInfo{
+		Type: "_uscan._tcp",
+	}
+
+	var list []string
+
+	// Decode the XML
+	err = decoder.decode(bytes.NewBuffer(xmlData))
+	if err != nil {
+		return
+	}
+
 	if decoder.uuid == "" {
 		decoder.uuid = usbinfo.UUID()
 	}
@@ -87,11 +145,14 @@ func EsclService(log *LogMessage, services *DNSSdServices,
 	}
 
 	if err != nil {
-		goto ERROR
+		return
 	}
 
 	// Build eSCL DNSSdInfo
-	if decoder.duplex {
+	//
+	// Note, duplex is only possible with ADF
+	svc.Txt.Add("txtvers", "1")
+	if decoder.adf && decoder.duplex {
 		svc.Txt.Add("duplex", "T")
 	} else {
 		svc.Txt.Add("duplex", "F")
@@ -114,30 +175,33 @@ func EsclService(log *LogMessage, services *DNSSdServices,
 	svc.Txt.IfNotEmpty("cs", strings.Join(list, ","))
 
 	svc.Txt.IfNotEmpty("UUID", decoder.uuid)
+	svc.Txt.IfNotEmpty("PaperMax", decoder.paperMax())
+
+	// Mopria scan certification. Note, there is no public
+	// specification for it, as Mopria Alliance doesn't publish
+	// its extensions of eSCL. So the TXT key is named after the
+	// "mopria-certified" key of the IPP service, and the value is
+	// taken as is from the scan:MopriaCertified element of
+	// ScannerCapabilities or, if missed, from the
+	// "mopria-certified-scan" IPP attribute. If device reports
+	// neither, the key is omitted
+	svc.Txt.IfNotEmpty("mopria-certified-scan", decoder.mopria)
 	svc.Txt.URLIfNotEmpty("adminurl", decoder.adminurl)
 	svc.Txt.URLIfNotEmpty("representation", decoder.representation)
 
-	list = []string{}
-	for p := range decoder.pdl {
-		list = append(list, p)
+	svc.Txt.AddPDL("pdl", strings.Join(decoder.formats(), ","))
+
+	// If configured, distinguish scanner from printer in the
+	// service pickers
+	if Conf.DNSSdScanLabel != "" {
+		svc.InstanceSuffix = " (" + Conf.DNSSdScanLabel + ")"
 	}
-	sort.Strings(list)
-	svc.Txt.AddPDL("pdl", strings.Join(list, ","))
 
-	svc.Txt.Add("ty", usbinfo.ProductName)
+	svc.Txt.Add("ty", usbinfo.ProductName+svc.InstanceSuffix)
 	svc.Txt.Add("rs", "eSCL")
 	svc.Txt.IfNotEmpty("vers", decoder.version)
-	svc.Txt.IfNotEmpty("txtvers", "1")
-
-	// Add to services
-	services.Add(svc)
 
 	return
-
-	// Handle a error
-ERROR:
-	err = fmt.Errorf("eSCL: %s", err)
-	return
 }
 
 // esclCapsDecoder represents eSCL ScannerCapabilities decoder
@@ -146,9 +210,12 @@ type esclCapsDecoder struct {
 	adminurl       string              // Admin URL
 	representation string              // Icon URL
 	version        string              // eSCL Version
+	mopria         string              // Mopria scan certification
 	platen, adf    bool                // Has platen/ADF
 	duplex         bool                // Has duplex
+	maxW, maxH     int                 // Max scan region, 1/300 inch
 	pdl, cs        map[string]struct{} // Formats/colors
+	preferred      string              // Preferred format
 }
 
 // newesclCapsDecoder creates new esclCapsDecoder
@@ -162,6 +229,7 @@ func newEsclCapsDecoder(ippinfo *IppPrinterInfo) *esclCapsDecoder {
 		decoder.uuid = ippinfo.UUID
 		decoder.adminurl = ippinfo.AdminURL
 		decoder.representation = ippinfo.IconURL
+		decoder.mopria = ippinfo.MopriaScanCert
 	}
 
 	return decoder
@@ -212,12 +280,15 @@ const (
 	esclPlatenInputCaps = esclPlaten + "/scan:PlatenInputCaps"
 	esclAdfSimplexCaps  = esclAdf + "/scan:AdfSimplexInputCaps"
 	esclAdfDuplexCaps   = esclAdf + "/scan:AdfDuplexInputCaps"
+	esclAdfOption       = esclAdf + "/scan:AdfOptions/scan:AdfOption"
 
 	// Relative to esclPlatenInputCaps, esclAdfSimplexCaps or esclAdfDuplexCaps
 	esclSettingProfile    = "/scan:SettingProfiles/scan:SettingProfile"
 	esclColorMode         = esclSettingProfile + "/scan:ColorModes/scan:ColorMode"
 	esclDocumentFormat    = esclSettingProfile + "/scan:DocumentFormats/pwg:DocumentFormat"
 	esclDocumentFormatExt = esclSettingProfile + "/scan:DocumentFormats/scan:DocumentFormatExt"
+	esclMaxWidth          = "/scan:MaxWidth"
+	esclMaxHeight         = "/scan:MaxHeight"
 )
 
 // handle beginning of XML element
@@ -246,6 +317,15 @@ func (decoder *esclCapsDecoder) data(path, data string) {
 		decoder.representation = data
 	case "/scan:ScannerCapabilities/pwg:Version":
 		decoder.version = data
+	case "/scan:ScannerCapabilities/scan:MopriaCertified":
+		decoder.mopria = data
+
+	case esclAdfOption:
+		// Some devices report duplex ADF this way, without
+		// providing separate AdfDuplexInputCaps
+		if data == "Duplex" {
+			decoder.duplex = true
+		}
 
 	case esclPlatenInputCaps + esclColorMode,
 		esclAdfSimplexCaps + esclColorMode,
@@ -266,11 +346,68 @@ func (decoder *esclCapsDecoder) data(path, data string) {
 		esclAdfDuplexCaps + esclDocumentFormat:
 
 		decoder.pdl[data] = struct{}{}
+		if decoder.preferred == "" {
+			decoder.preferred = data
+		}
 
 	case esclPlatenInputCaps + esclDocumentFormatExt,
 		esclAdfSimplexCaps + esclDocumentFormatExt,
 		esclAdfDuplexCaps + esclDocumentFormatExt:
 
 		decoder.pdl[data] = struct{}{}
+
+	case esclPlatenInputCaps + esclMaxWidth,
+		esclAdfSimplexCaps + esclMaxWidth,
+		esclAdfDuplexCaps + esclMaxWidth:
+
+		if v, err := strconv.Atoi(data); err == nil && v > decoder.maxW {
+			decoder.maxW = v
+		}
+
+	case esclPlatenInputCaps + esclMaxHeight,
+		esclAdfSimplexCaps + esclMaxHeight,
+		esclAdfDuplexCaps + esclMaxHeight:
+
+		if v, err := strconv.Atoi(data); err == nil && v > decoder.maxH {
+			decoder.maxH = v
+		}
+	}
+}
+
+// formats returns supported document formats for the "pdl" TXT item
+//
+// eSCL has no explicit document-format-preferred, so the format,
+// the device lists first, is considered preferred. It is hoisted
+// first, the same way as preferred format of printer, others are
+// sorted
+func (decoder *esclCapsDecoder) formats() []string {
+	list := []string{}
+	for p := range decoder.pdl {
+		if p != decoder.preferred {
+			list = append(list, p)
+		}
 	}
+	sort.Strings(list)
+
+	if decoder.preferred != "" {
+		list = append([]string{decoder.preferred}, list...)
+	}
+
+	return list
+}
+
+// paperMax returns max scan region, classified the same way as
+// PaperMax of the IPP printer, taking all input sources into account
+//
+// If scan region is not known, it returns empty string
+func (decoder *esclCapsDecoder) paperMax() string {
+	if decoder.maxW <= 0 || decoder.maxH <= 0 {
+		return ""
+	}
+
+	// Convert from 1/300 inch to 1/100 mm
+	return PaperSize{
+		decoder.maxW * 2540 / 300,
+		decoder.maxH * 2540 / 300,
+	}.Classify()
 }
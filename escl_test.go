@@ -0,0 +1,366 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for eSCL capabilities decoding
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Make ScannerCapabilities XML document. Input sources
+// are inserted as is
+func testEsclCaps(sources string) []byte {
+	const caps = `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerCapabilities xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm" xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03">
+  <pwg:Version>2.63</pwg:Version>
+  %s
+</scan:ScannerCapabilities>`
+
+	return []byte(fmt.Sprintf(caps, sources))
+}
+
+// Input caps, shared by all sources
+const testEsclInputCaps = `
+  <scan:SettingProfiles>
+    <scan:SettingProfile>
+      <scan:ColorModes>
+        <scan:ColorMode>RGB24</scan:ColorMode>
+      </scan:ColorModes>
+      <scan:DocumentFormats>
+        <pwg:DocumentFormat>image/jpeg</pwg:DocumentFormat>
+      </scan:DocumentFormats>
+    </scan:SettingProfile>
+  </scan:SettingProfiles>`
+
+// Test ADF duplex detection
+func TestEsclDecodeDuplex(t *testing.T) {
+	platen := `<scan:Platen><scan:PlatenInputCaps>` +
+		testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`
+	adfSimplex := `<scan:AdfSimplexInputCaps>` +
+		testEsclInputCaps + `</scan:AdfSimplexInputCaps>`
+	adfDuplex := `<scan:AdfDuplexInputCaps>` +
+		testEsclInputCaps + `</scan:AdfDuplexInputCaps>`
+	adfOptDuplex := `<scan:AdfOptions>
+	  <scan:AdfOption>DetectPaperLoaded</scan:AdfOption>
+	  <scan:AdfOption>Duplex</scan:AdfOption>
+	</scan:AdfOptions>`
+
+	tests := []struct {
+		name    string
+		sources string
+		duplex  string
+		is      string
+	}{
+		{"platen", platen, "F", "platen"},
+		{"simplex ADF",
+			`<scan:Adf>` + adfSimplex + `</scan:Adf>`, "F", "adf"},
+		{"duplex ADF",
+			platen + `<scan:Adf>` + adfSimplex + adfDuplex +
+				`</scan:Adf>`, "T", "platen,adf"},
+		{"duplex ADF, AdfOption",
+			`<scan:Adf>` + adfSimplex + adfOptDuplex + `</scan:Adf>`,
+			"T", "adf"},
+	}
+
+	for _, test := range tests {
+		svc, err := esclDecodeCaps(testEsclCaps(test.sources),
+			UsbDeviceInfo{}, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		duplex, _ := testTxtLookup(svc.Txt, "duplex")
+		if duplex != test.duplex {
+			t.Errorf("%s: duplex: expected %q, got %q",
+				test.name, test.duplex, duplex)
+		}
+
+		is, _ := testTxtLookup(svc.Txt, "is")
+		if is != test.is {
+			t.Errorf("%s: is: expected %q, got %q",
+				test.name, test.is, is)
+		}
+	}
+}
+
+// Test PaperMax decoding from the scan region
+func TestEsclDecodePaperMax(t *testing.T) {
+	region := func(w, h int) string {
+		return fmt.Sprintf("<scan:MaxWidth>%d</scan:MaxWidth>"+
+			"<scan:MaxHeight>%d</scan:MaxHeight>", w, h)
+	}
+
+	tests := []struct {
+		name     string
+		sources  string
+		paperMax string
+		present  bool
+	}{
+		{"no region",
+			`<scan:Platen><scan:PlatenInputCaps>` + testEsclInputCaps +
+				`</scan:PlatenInputCaps></scan:Platen>`,
+			"", false},
+		{"A4/Letter platen",
+			`<scan:Platen><scan:PlatenInputCaps>` + region(2550, 3508) +
+				testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`,
+			"legal-A4", true},
+		{"A4 platen, Legal ADF",
+			`<scan:Platen><scan:PlatenInputCaps>` + region(2550, 3508) +
+				testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>` +
+				`<scan:Adf><scan:AdfSimplexInputCaps>` + region(2550, 4200) +
+				testEsclInputCaps + `</scan:AdfSimplexInputCaps></scan:Adf>`,
+			"legal-A4", true},
+		{"A3 platen",
+			`<scan:Platen><scan:PlatenInputCaps>` + region(3508, 4961) +
+				testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`,
+			"tabloid-A3", true},
+		{"small platen",
+			`<scan:Platen><scan:PlatenInputCaps>` + region(1200, 1800) +
+				testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`,
+			"<legal-A4", true},
+	}
+
+	for _, test := range tests {
+		svc, err := esclDecodeCaps(testEsclCaps(test.sources),
+			UsbDeviceInfo{}, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		paperMax, present := testTxtLookup(svc.Txt, "PaperMax")
+		if present != test.present || paperMax != test.paperMax {
+			t.Errorf("%s: PaperMax: expected %q (present=%v), "+
+				"got %q (present=%v)", test.name,
+				test.paperMax, test.present, paperMax, present)
+		}
+	}
+}
+
+// Test scanner label
+func TestEsclDecodeScannerLabel(t *testing.T) {
+	saved := Conf.DNSSdScanLabel
+	defer func() { Conf.DNSSdScanLabel = saved }()
+
+	platen := `<scan:Platen><scan:PlatenInputCaps>` +
+		testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`
+	usbinfo := UsbDeviceInfo{ProductName: "HP LaserJet"}
+
+	tests := []struct {
+		label, ty, instance string
+	}{
+		{"", "HP LaserJet", "HP LaserJet (USB)"},
+		{"Scanner", "HP LaserJet (Scanner)",
+			"HP LaserJet (USB) (Scanner)"},
+	}
+
+	for _, test := range tests {
+		Conf.DNSSdScanLabel = test.label
+		svc, err := esclDecodeCaps(testEsclCaps(platen), usbinfo, nil)
+		if err != nil {
+			t.Fatalf("%q: %s", test.label, err)
+		}
+
+		ty, _ := testTxtLookup(svc.Txt, "ty")
+		if ty != test.ty {
+			t.Errorf("%q: ty: expected %q, got %q",
+				test.label, test.ty, ty)
+		}
+
+		instance := svc.InstanceName("HP LaserJet (USB)")
+		if instance != test.instance {
+			t.Errorf("%q: instance: expected %q, got %q",
+				test.label, test.instance, instance)
+		}
+	}
+}
+
+// Test the "mopria-certified-scan" TXT item, taken from the
+// ScannerCapabilities or from the IPP printer attributes
+func TestEsclDecodeMopria(t *testing.T) {
+	platen := `<scan:Platen><scan:PlatenInputCaps>` +
+		testEsclInputCaps + `</scan:PlatenInputCaps></scan:Platen>`
+	element := `<scan:MopriaCertified>1.3</scan:MopriaCertified>`
+
+	// Decode IPP attributes, with and without the certification
+	ipp := func(cert string) *IppPrinterInfo {
+		msg := goipp.NewResponse(goipp.DefaultVersion,
+			goipp.StatusOk, 1)
+		if cert != "" {
+			msg.Printer.Add(goipp.MakeAttribute(
+				"mopria-certified-scan",
+				goipp.TagText, goipp.String(cert)))
+		}
+
+		ippinfo, _ := IppDecodePrinterAttributes(msg, UsbDeviceInfo{})
+		if ippinfo.MopriaScanCert != cert {
+			t.Errorf("IPP: mopria-certified-scan: expected %q, got %q",
+				cert, ippinfo.MopriaScanCert)
+		}
+
+		return ippinfo
+	}
+
+	tests := []struct {
+		name    string
+		sources string
+		ippinfo *IppPrinterInfo
+		cert    string
+	}{
+		{"none", platen, nil, ""},
+		{"none, IPP", platen, ipp(""), ""},
+		{"eSCL", platen + element, nil, "1.3"},
+		{"IPP", platen, ipp("1.2"), "1.2"},
+		{"eSCL and IPP", platen + element, ipp("1.2"), "1.3"},
+	}
+
+	for _, test := range tests {
+		svc, err := esclDecodeCaps(testEsclCaps(test.sources),
+			UsbDeviceInfo{}, test.ippinfo)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		cert, found := testTxtLookup(svc.Txt, "mopria-certified-scan")
+		switch {
+		case test.cert == "" && found:
+			t.Errorf("%s: unexpected mopria-certified-scan=%q",
+				test.name, cert)
+		case test.cert != "" && cert != test.cert:
+			t.Errorf("%s: mopria-certified-scan: expected %q, got %q",
+				test.name, test.cert, cert)
+		}
+	}
+}
+
+// Test ordering of document formats in the "pdl" TXT item
+func TestEsclDecodeFormats(t *testing.T) {
+	const profile = `
+  <scan:SettingProfiles>
+    <scan:SettingProfile>
+      <scan:ColorModes>
+        <scan:ColorMode>RGB24</scan:ColorMode>
+      </scan:ColorModes>
+      <scan:DocumentFormats>
+        %s
+      </scan:DocumentFormats>
+    </scan:SettingProfile>
+  </scan:SettingProfiles>`
+
+	tests := []struct {
+		formats []string
+		pdl     string
+	}{
+		{[]string{"image/jpeg", "application/pdf"},
+			"image/jpeg,application/pdf"},
+		{[]string{"application/pdf", "image/jpeg"},
+			"application/pdf,image/jpeg"},
+		{[]string{"image/png", "image/jpeg", "application/pdf",
+			"image/jpeg"},
+			"image/png,application/pdf,image/jpeg"},
+	}
+
+	for _, test := range tests {
+		formats := ""
+		for _, f := range test.formats {
+			formats += "<pwg:DocumentFormat>" + f +
+				"</pwg:DocumentFormat>"
+		}
+
+		platen := `<scan:Platen><scan:PlatenInputCaps>` +
+			fmt.Sprintf(profile, formats) +
+			`</scan:PlatenInputCaps></scan:Platen>`
+
+		svc, err := esclDecodeCaps(testEsclCaps(platen),
+			UsbDeviceInfo{}, nil)
+		if err != nil {
+			t.Fatalf("%q: %s", test.formats, err)
+		}
+
+		pdl, _ := testTxtLookup(svc.Txt, "pdl")
+		if pdl != test.pdl {
+			t.Errorf("%q: expected %q, got %q",
+				test.formats, test.pdl, pdl)
+		}
+	}
+}
+
+// Test caching of the scanner icon
+func TestEsclCacheIcon(t *testing.T) {
+	icon := []byte("\x89PNG\r\n\x1a\n...")
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/icon.png":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(icon)
+			case "/page.html":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte("<html></html>"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	tests := []struct {
+		url    string // Device-supplied URL
+		cached bool   // Icon must be cached
+	}{
+		{"http://192.168.1.10/icon.png", true},
+		{"http://192.168.1.10/missed.png", false},
+		{"http://192.168.1.10/page.html", false},
+	}
+
+	for _, test := range tests {
+		icons := NewIconCache()
+		svc := DNSSdSvcInfo{Type: "_uscan._tcp"}
+		svc.Txt.Add("txtvers", "1")
+		svc.Txt.AddURL("representation", test.url)
+		svc.Txt.Add("rs", "eSCL")
+
+		esclCacheIcon(log, &svc, port, icons, srv.Client())
+
+		local, found := svc.Txt.find("representation")
+		switch {
+		case !test.cached && found:
+			t.Errorf("%s: representation not removed", test.url)
+			continue
+		case !test.cached:
+			if len(svc.Txt) != 2 {
+				t.Errorf("%s: TXT damaged: %v", test.url, svc.Txt)
+			}
+			continue
+		}
+
+		expected := fmt.Sprintf("http://localhost:%d%sscanner",
+			port, IconCachePath)
+		if local != expected {
+			t.Errorf("%s: expected %q, got %q", test.url, expected, local)
+		}
+
+		ctype, data, ok := icons.Lookup(IconCachePath + "scanner")
+		if !ok || ctype != "image/png" || !bytes.Equal(data, icon) {
+			t.Errorf("%s: icon not cached", test.url)
+		}
+	}
+}
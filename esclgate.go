@@ -0,0 +1,189 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Limiting of concurrent eSCL scan jobs
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EsclGate limits count of concurrent eSCL scan jobs
+//
+// Scanners typically can't perform two scans at once, and concurrent
+// scan jobs may corrupt scanner state. So new jobs (POST to ScanJobs)
+// are rejected, while the limit is reached
+//
+// Job is identified by its URI, returned by device in the Location
+// header. Job is finished when client deletes it, when NextDocument
+// returns 404 (no more documents) or 410, or when job remains idle
+// for too long (client has gone)
+type EsclGate struct {
+	log     *LogMessage             // Logger, eSCL subsystem
+	lock    sync.Mutex              // Access lock
+	pending int                     // Count of jobs being created
+	jobs    map[string]*esclGateJob // Active jobs, by path
+}
+
+// esclGateJob represents an active scan job
+type esclGateJob struct {
+	active int       // Count of requests in progress
+	last   time.Time // Time of last activity
+}
+
+// EsclGateRq represents request, registered by EsclGate.Begin
+type EsclGateRq struct {
+	newJob bool         // Request creates a new job
+	job    *esclGateJob // Job the request is counted by, nil if none
+}
+
+// NewEsclGate creates a new EsclGate
+func NewEsclGate(log *LogMessage) *EsclGate {
+	return &EsclGate{
+		log:  log,
+		jobs: make(map[string]*esclGateJob),
+	}
+}
+
+// Begin must be called before request is sent to device. If new
+// scan job is not allowed, ErrScannerBusy is returned. Otherwise,
+// End must be called with the returned EsclGateRq, when request
+// is completed
+func (gate *EsclGate) Begin(r *http.Request) (EsclGateRq, error) {
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+
+	var rq EsclGateRq
+
+	switch {
+	case esclIsNewJob(r):
+		gate.expire()
+
+		limit := int(Conf.UsbMaxScanJobs)
+		if limit > 0 && gate.pending+len(gate.jobs) >= limit {
+			return rq, ErrScannerBusy
+		}
+		gate.pending++
+		rq.newJob = true
+
+	default:
+		if job := gate.jobs[esclJobPath(r.URL.Path)]; job != nil {
+			job.active++
+			job.last = time.Now()
+			rq.job = job
+		}
+	}
+
+	return rq, nil
+}
+
+// End must be called when request is completed. resp is the
+// device's response, nil if request has failed
+//
+// Only requests, counted by Begin, are uncounted here: request
+// may refer the job, that was not known yet, when request has
+// started (i.e., NextDocument, racing with job creation)
+func (gate *EsclGate) End(rq EsclGateRq, r *http.Request,
+	resp *http.Response) {
+
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+
+	if rq.newJob {
+		gate.pending--
+		if resp == nil || resp.StatusCode != http.StatusCreated {
+			return
+		}
+
+		path := ""
+		if u, err := url.Parse(resp.Header.Get("Location")); err == nil {
+			path = esclJobPath(u.Path)
+		}
+
+		if path == "" {
+			gate.log.Error('!', "eSCL: can't track job: Location %q",
+				resp.Header.Get("Location"))
+			return
+		}
+
+		gate.jobs[path] = &esclGateJob{last: time.Now()}
+		gate.log.Debug(' ', "eSCL: %s: started (%d active)",
+			path, len(gate.jobs))
+		return
+	}
+
+	path := esclJobPath(r.URL.Path)
+	job := gate.jobs[path]
+	if job == nil {
+		return
+	}
+
+	if rq.job == job && job.active > 0 {
+		job.active--
+	}
+	job.last = time.Now()
+
+	switch {
+	case r.Method == "DELETE" && path == strings.TrimSuffix(r.URL.Path, "/"):
+	case resp != nil && (resp.StatusCode == http.StatusNotFound ||
+		resp.StatusCode == http.StatusGone):
+	default:
+		return
+	}
+
+	delete(gate.jobs, path)
+	gate.log.Debug(' ', "eSCL: %s: finished (%d active)",
+		path, len(gate.jobs))
+}
+
+// expire removes jobs, idle for too long. Must be called
+// under the lock
+func (gate *EsclGate) expire() {
+	now := time.Now()
+	for path, job := range gate.jobs {
+		if job.active == 0 && now.Sub(job.last) > EsclJobIdleTimeout {
+			delete(gate.jobs, path)
+			gate.log.Debug(' ', "eSCL: %s: expired (%d active)",
+				path, len(gate.jobs))
+		}
+	}
+}
+
+// esclIsNewJob tells if request creates a new scan job
+func esclIsNewJob(r *http.Request) bool {
+	return r.Method == "POST" &&
+		strings.HasPrefix(r.URL.Path, "/eSCL") &&
+		strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/ScanJobs")
+}
+
+// esclJobPath returns path of the scan job, the request refers to
+// (i.e., "/eSCL/ScanJobs/1234" for "/eSCL/ScanJobs/1234/NextDocument"),
+// or "", if request doesn't refer any job
+func esclJobPath(path string) string {
+	const jobs = "/ScanJobs/"
+
+	i := strings.Index(path, jobs)
+	if i < 0 {
+		return ""
+	}
+
+	end := i + len(jobs)
+	id := path[end:]
+	if j := strings.IndexByte(id, '/'); j >= 0 {
+		id = id[:j]
+	}
+
+	if id == "" {
+		return ""
+	}
+
+	return path[:end+len(id)]
+}
@@ -0,0 +1,161 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for limiting of concurrent eSCL scan jobs
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test job path extraction
+func TestEsclJobPath(t *testing.T) {
+	tests := []struct{ path, job string }{
+		{"/eSCL/ScanJobs/1234", "/eSCL/ScanJobs/1234"},
+		{"/eSCL/ScanJobs/1234/", "/eSCL/ScanJobs/1234"},
+		{"/eSCL/ScanJobs/1234/NextDocument", "/eSCL/ScanJobs/1234"},
+		{"/eSCL/ScanJobs/", ""},
+		{"/eSCL/ScanJobs", ""},
+		{"/eSCL/ScannerStatus", ""},
+	}
+
+	for _, test := range tests {
+		job := esclJobPath(test.path)
+		if job != test.job {
+			t.Errorf("%q: expected %q, got %q", test.path, test.job, job)
+		}
+	}
+}
+
+// Test limiting of concurrent scan jobs
+func TestEsclGate(t *testing.T) {
+	save := Conf.UsbMaxScanJobs
+	defer func() { Conf.UsbMaxScanJobs = save }()
+	Conf.UsbMaxScanJobs = 1
+
+	gate := NewEsclGate(NewLogger().Subsys(LogSubsysESCL))
+
+	var rq EsclGateRq
+	var err error
+
+	post := httptest.NewRequest("POST", "/eSCL/ScanJobs", nil)
+	created := &http.Response{
+		StatusCode: http.StatusCreated,
+		Header: http.Header{
+			"Location": {"http://localhost:60000/eSCL/ScanJobs/1"},
+		},
+	}
+
+	// Start the first job
+	if rq, err = gate.Begin(post); err != nil {
+		t.Fatalf("first job: %s", err)
+	}
+
+	// Second job rejected even before first is created
+	if _, err := gate.Begin(post); err != ErrScannerBusy {
+		t.Errorf("second job, pending: expected %v, got %v",
+			ErrScannerBusy, err)
+	}
+
+	gate.End(rq, post, created)
+
+	if _, err := gate.Begin(post); err != ErrScannerBusy {
+		t.Errorf("second job, active: expected %v, got %v",
+			ErrScannerBusy, err)
+	}
+
+	// Other requests are not affected
+	status := httptest.NewRequest("GET", "/eSCL/ScannerStatus", nil)
+	if rq, err = gate.Begin(status); err != nil {
+		t.Errorf("ScannerStatus: %s", err)
+	}
+	gate.End(rq, status, &http.Response{StatusCode: http.StatusOK})
+
+	// NextDocument returning 404 finishes the job
+	next := httptest.NewRequest("GET", "/eSCL/ScanJobs/1/NextDocument", nil)
+	rq, _ = gate.Begin(next)
+	gate.End(rq, next, &http.Response{StatusCode: http.StatusOK})
+
+	if _, err := gate.Begin(post); err != ErrScannerBusy {
+		t.Errorf("job finished too early")
+	}
+
+	rq, _ = gate.Begin(next)
+	gate.End(rq, next, &http.Response{StatusCode: http.StatusNotFound})
+
+	if rq, err = gate.Begin(post); err != nil {
+		t.Fatalf("job not finished by 404: %s", err)
+	}
+	gate.End(rq, post, created)
+
+	// DELETE finishes the job
+	del := httptest.NewRequest("DELETE", "/eSCL/ScanJobs/1", nil)
+	rq, _ = gate.Begin(del)
+	gate.End(rq, del, &http.Response{StatusCode: http.StatusOK})
+
+	if rq, err = gate.Begin(post); err != nil {
+		t.Fatalf("job not finished by DELETE: %s", err)
+	}
+
+	// Failed job creation releases the slot
+	gate.End(rq, post, nil)
+
+	if rq, err = gate.Begin(post); err != nil {
+		t.Fatalf("slot not released by failed job: %s", err)
+	}
+	gate.End(rq, post, nil)
+
+	// Unlimited
+	Conf.UsbMaxScanJobs = 0
+	for i := 0; i < 5; i++ {
+		if _, err := gate.Begin(post); err != nil {
+			t.Fatalf("unlimited: %s", err)
+		}
+	}
+}
+
+// Test request to the job, started before the job is registered
+func TestEsclGateLateJob(t *testing.T) {
+	save := Conf.UsbMaxScanJobs
+	defer func() { Conf.UsbMaxScanJobs = save }()
+	Conf.UsbMaxScanJobs = 1
+
+	gate := NewEsclGate(NewLogger().Subsys(LogSubsysESCL))
+
+	post := httptest.NewRequest("POST", "/eSCL/ScanJobs", nil)
+	next := httptest.NewRequest("GET", "/eSCL/ScanJobs/1/NextDocument", nil)
+	created := &http.Response{
+		StatusCode: http.StatusCreated,
+		Header: http.Header{
+			"Location": {"http://localhost:60000/eSCL/ScanJobs/1"},
+		},
+	}
+
+	// NextDocument starts before job creation is completed
+	postRq, _ := gate.Begin(post)
+	nextRq, _ := gate.Begin(next)
+	gate.End(postRq, post, created)
+	gate.End(nextRq, next, &http.Response{StatusCode: http.StatusOK})
+
+	job := gate.jobs["/eSCL/ScanJobs/1"]
+	if job == nil {
+		t.Fatalf("job not registered")
+	}
+
+	if job.active != 0 {
+		t.Errorf("expected 0 active requests, got %d", job.active)
+	}
+
+	// So idle job expires
+	job.last = time.Now().Add(-2 * EsclJobIdleTimeout)
+	if _, err := gate.Begin(post); err != nil {
+		t.Errorf("idle job not expired: %s", err)
+	}
+}
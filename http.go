@@ -9,16 +9,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 var (
@@ -29,10 +38,18 @@ var (
 // specified http.RoundTripper. It implements http.Handler
 // interface
 type HTTPProxy struct {
-	log       *Logger       // Logger instance
+	log       *LogMessage   // Logger instance, proxy subsystem
 	server    *http.Server  // HTTP server
 	enable    bool          // Proxy can handle incoming requests
 	transport *UsbTransport // Transport for outgoing requests
+	watchdog  *Watchdog     // Watchdog of device failures
+	escl      *EsclGate     // Limits concurrent scan jobs
+	icons     *IconCache    // Cached device icons
+	capture   *JobCapture   // Print jobs capture, nil if disabled
+	ops       ippOpSet      // Supported IPP operations, nil if unknown
+	printPath string        // IPP print resource path, "" if default
+	paths     *httpPaths    // Paths allowed for proxying, nil if any
+	maint     int32         // Non-zero in maintenance mode, atomic
 	closeWait chan struct{} // Closed at server close
 }
 
@@ -41,11 +58,26 @@ func NewHTTPProxy(logger *Logger,
 	listener net.Listener, transport *UsbTransport) *HTTPProxy {
 
 	proxy := &HTTPProxy{
-		log:       logger,
+		log:       logger.Subsys(LogSubsysProxy),
 		transport: transport,
 		closeWait: make(chan struct{}),
 	}
 
+	proxy.escl = NewEsclGate(logger.Subsys(LogSubsysESCL))
+	proxy.icons = NewIconCache()
+	if transport.Quirks().GetCaptureJobs() {
+		dir := filepath.Join(PathProgStateCapture,
+			transport.UsbDeviceInfo().Ident())
+		proxy.capture = NewJobCapture(proxy.log, dir)
+	}
+
+	proxy.paths = newHTTPPaths(transport.Quirks().GetAllowPaths(),
+		transport.Quirks().GetDenyPaths())
+
+	proxy.watchdog = NewWatchdog(transport.usbLog, func() error {
+		return PnPReset(&UsbDeviceFilter{Addr: transport.Addr()})
+	})
+
 	proxy.server = &http.Server{
 		Handler:  proxy,
 		ErrorLog: log.New(logger.LineWriter(LogError, '!'), "", 0),
@@ -61,8 +93,13 @@ func NewHTTPProxy(logger *Logger,
 
 // Close the proxy
 func (proxy *HTTPProxy) Close() {
+	proxy.watchdog.Close()
 	proxy.server.Close()
 	<-proxy.closeWait
+
+	if proxy.capture != nil {
+		proxy.capture.Close()
+	}
 }
 
 // Enable indicates that initialization is completed and
@@ -71,11 +108,86 @@ func (proxy *HTTPProxy) Enable() {
 	proxy.enable = true
 }
 
+// SetHealthProbe sets the IPP liveness probe of the device, used
+// by the watchdog. Probe is sent to the specified uri, using the
+// specified http.Client. See the health-probe parameter
+func (proxy *HTTPProxy) SetHealthProbe(c *http.Client, uri string) {
+	proxy.watchdog.SetProbe(func() error {
+		log := proxy.log.Begin()
+		defer log.Commit()
+
+		_, err := IppProbe(log, c, Conf.HealthProbe, uri)
+		return err
+	})
+}
+
+// SetMaintenance enables or disables the maintenance mode
+//
+// In maintenance mode, IPP requests that create jobs are rejected
+// with the IPP status, configured by the maintenance-status
+// parameter, while all other requests are handled as usual
+func (proxy *HTTPProxy) SetMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&proxy.maint, v)
+}
+
+// Maintenance tells if proxy is in maintenance mode
+func (proxy *HTTPProxy) Maintenance() bool {
+	return atomic.LoadInt32(&proxy.maint) != 0
+}
+
+// SetOperations sets IPP operations, supported by device. If
+// enabled by the check-operations parameter, other operations
+// are rejected without sending them to the device
+//
+// Must be called before Enable
+func (proxy *HTTPProxy) SetOperations(ops []goipp.Op) {
+	if len(ops) == 0 {
+		proxy.ops = nil
+		return
+	}
+
+	proxy.ops = make(ippOpSet, len(ops))
+	for _, op := range ops {
+		proxy.ops[op] = struct{}{}
+	}
+}
+
+// SetPrintPath sets IPP print resource path, as reported by device
+// (see IppPrinterInfo.PrintPath). Requests to this path are checked
+// against supported operations
+//
+// Must be called before Enable
+func (proxy *HTTPProxy) SetPrintPath(path string) {
+	proxy.printPath = path
+}
+
+// isPrintPath tells if URL path refers the IPP print resource
+func (proxy *HTTPProxy) isPrintPath(path string) bool {
+	printPath := proxy.printPath
+	if printPath == "" {
+		printPath = ippPrintPath
+	}
+
+	return path == "/"+printPath
+}
+
+// Icons returns cache of device icons, served by proxy
+func (proxy *HTTPProxy) Icons() *IconCache {
+	return proxy.icons
+}
+
 // Handle HTTP request
 func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Catch panics to log
 	defer func() {
 		v := recover()
+		if v == http.ErrAbortHandler {
+			panic(v)
+		}
 		if v != nil {
 			Log.Panic(v)
 		}
@@ -108,13 +220,49 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Normalize the resource path. Depending on the format of the
+	// "rp" TXT item (see rp-leading-slash), some clients may add
+	// an extra slash, so "//ipp/print" is handled as "/ipp/print"
+	if path := httpNormalizePath(r.URL.Path); path != r.URL.Path {
+		r.URL.Path, r.URL.RawPath = path, ""
+	}
+
+	// Serve cached icons without touching the device
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if ctype, data, ok := proxy.icons.Lookup(r.URL.Path); ok {
+			proxy.log.HTTPDebug(' ', session, "%s %s: cached icon",
+				r.Method, r.URL)
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == "GET" {
+				w.Write(data)
+			}
+			return
+		}
+	}
+
+	// Check resource path against the allow/deny lists
+	if !proxy.paths.Allowed(r.URL.Path) {
+		proxy.httpError(session, w, r, http.StatusForbidden,
+			errors.New("Path not allowed by configuration"))
+		return
+	}
+
 	// Obtain our local address the request was ordered to
+	//
+	// Requests, received via Unix domain socket, are handled
+	// as if they were ordered to the localhost
 	var localAddr *net.TCPAddr
+	unixSocket := false
 
 	if v := r.Context().Value(http.LocalAddrContextKey); v != nil {
-		if v != nil {
-			localAddr, _ = v.(*net.TCPAddr)
-		}
+		localAddr, _ = v.(*net.TCPAddr)
+		_, unixSocket = v.(*net.UnixAddr)
+	}
+
+	if unixSocket {
+		localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 	}
 
 	if localAddr == nil {
@@ -127,10 +275,9 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	httpRemoveHopByHopHeaders(r.Header)
 
 	if r.Host == "" {
-		if localAddr.IP.IsLoopback() {
-			r.Host = fmt.Sprintf("localhost:%d", localAddr.Port)
-		} else {
-			r.Host = localAddr.String()
+		r.Host = httpHostFromAddr(localAddr)
+		if unixSocket {
+			r.Host = "localhost"
 		}
 	}
 
@@ -148,7 +295,7 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// This redirection fixes compatibility with these printers for
 	// clients that follow redirects (i.e., web browser and sane-airscan;
 	// CUPS unfortunately doesn't follow redirects)
-	if localAddr.IP.IsLoopback() &&
+	if localAddr.IP.IsLoopback() && !unixSocket &&
 		(r.Method == "GET" || r.Method == "HEAD") {
 
 		host := strings.ToLower(r.Host)
@@ -163,19 +310,109 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Peek IPP operation, if needed for maintenance mode,
+	// checking of operations or capture of print jobs
+	isIpp := r.Method == "POST" && r.Body != nil && httpIsIpp(r.Header)
+	checkOps := Conf.IppCheckOps && proxy.ops != nil &&
+		proxy.isPrintPath(r.URL.Path)
+
+	var hdr [8]byte
+	var op goipp.Op
+	var ok bool
+
+	if isIpp && (proxy.Maintenance() || checkOps || proxy.capture != nil) {
+		hdr, op, ok = httpPeekIppHeader(r)
+	}
+
+	// In maintenance mode, reject requests that create jobs
+	if ok && proxy.Maintenance() && ippMaintenanceBlocked(op) {
+		proxy.ippReject(session, w, r, hdr, op, Conf.IppMaintStatus,
+			"Printer is in maintenance mode")
+		return
+	}
+
+	// Reject operations, not supported by device, if enabled
+	if _, found := proxy.ops[op]; ok && checkOps && !found {
+		proxy.ippReject(session, w, r, hdr, op,
+			goipp.StatusErrorOperationNotSupported,
+			"Operation not supported by printer")
+		return
+	}
+
+	// Capture print jobs, if enabled
+	if ok && proxy.capture != nil && JobCaptureOp(op) {
+		r.Body = proxy.capture.Capture(session, op, r.Body)
+	}
+
+	// Capture IPP message header, for diagnostics of failed requests
+	var ippHdr *httpIppHeaderCapture
+	if Conf.LogFailedRequests && r.Body != nil && httpIsIpp(r.Header) {
+		ippHdr = &httpIppHeaderCapture{ReadCloser: r.Body}
+		r.Body = ippHdr
+	}
+
+	// Apply request timeout, if configured
+	timeout := Conf.UsbRqTimeout
+	if strings.HasPrefix(r.URL.Path, "/eSCL") {
+		timeout = Conf.UsbScanRqTimeout
+	}
+
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Apply limit of concurrent scan jobs
+	esclRq, err := proxy.escl.Begin(r)
+	if err != nil {
+		w.Header().Set("Retry-After", "5")
+		proxy.httpError(session, w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	var resp *http.Response
+	defer func() { proxy.escl.End(esclRq, r, resp) }()
+
 	// Send request and obtain response status and header
-	resp, err := proxy.transport.RoundTripWithSession(session, r)
+	resp, err = proxy.roundTrip(session, r)
+	switch err {
+	case nil:
+		proxy.watchdog.Success()
+	case context.Canceled, ErrDetached, ErrShutdown:
+		// Not a device failure: request canceled by client,
+		// device is temporarily disconnected or going away
+	default:
+		proxy.watchdog.Failure(err)
+	}
+
+	if err == context.DeadlineExceeded {
+		proxy.httpError(session, w, r, http.StatusGatewayTimeout,
+			fmt.Errorf("Device didn't respond in %s", timeout))
+		return
+	}
+
 	if err != nil {
 		proxy.httpError(session, w, r, http.StatusServiceUnavailable, err)
 		return
 	}
 
+	if Conf.LogFailedRequests && resp.StatusCode >= 400 {
+		proxy.logFailedRequest(session, r, resp, ippHdr)
+	}
+
 	httpRemoveHopByHopHeaders(resp.Header)
 	httpCopyHeaders(w.Header(), resp.Header)
+	httpAdjustForClient(w.Header(), r)
 	w.WriteHeader(resp.StatusCode)
 
 	// Obtain response body, if any
-	_, err = io.Copy(w, resp.Body)
+	var body io.Reader = resp.Body
+	if timeout > 0 {
+		body = &httpDeadlineReader{body, r.Context()}
+	}
+
+	_, err = httpCopyBody(w, body)
 
 	if err != nil {
 		proxy.log.HTTPError('!', session, "%s", err)
@@ -183,6 +420,240 @@ func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	resp.Body.Close()
 
+	// If response was not completed in time, abort connection, so
+	// client will notice that response is truncated
+	if err == context.DeadlineExceeded {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// roundTrip sends request to the device and waits for response
+//
+// If request context has a deadline, waiting is limited by that
+// deadline. USB transfer cannot be canceled in the middle, so the
+// late response is drained and released in background
+func (proxy *HTTPProxy) roundTrip(session int, r *http.Request) (
+	*http.Response, error) {
+
+	ctx := r.Context()
+	if _, ok := ctx.Deadline(); !ok {
+		return proxy.transport.RoundTripWithSession(session, r)
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		resp, err := proxy.transport.RoundTripWithSession(session, r)
+		done <- result{resp, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-ctx.Done():
+	}
+
+	go func() {
+		res := <-done
+		if res.resp != nil {
+			proxy.log.HTTPDebug(' ', session, "late response: %s",
+				res.resp.Status)
+			res.resp.Body.Close()
+		}
+	}()
+
+	return nil, ctx.Err()
+}
+
+// httpDeadlineReader wraps response body and fails reading,
+// when context deadline is exceeded
+type httpDeadlineReader struct {
+	io.Reader                 // Underlying body
+	ctx       context.Context // Request context
+}
+
+// Read reads the body and checks the deadline
+func (rd *httpDeadlineReader) Read(buf []byte) (int, error) {
+	n, err := rd.Reader.Read(buf)
+	if err == nil && rd.ctx.Err() == context.DeadlineExceeded {
+		err = context.DeadlineExceeded
+	}
+
+	return n, err
+}
+
+// logFailedRequest writes diagnostics of the request, failed
+// by device, into the log
+//
+// Only the request line, selected headers and IPP operation are
+// logged, as the request body may contain sensitive job data
+func (proxy *HTTPProxy) logFailedRequest(session int, r *http.Request,
+	resp *http.Response, ippHdr *httpIppHeaderCapture) {
+
+	log := proxy.log.Begin()
+	defer log.Commit()
+
+	log.HTTPDebug('!', session, "request failed: %s %s - %s",
+		r.Method, r.URL.RequestURI(), resp.Status)
+
+	for _, name := range []string{"Host", "Content-Type",
+		"Content-Length", "Transfer-Encoding", "Expect", "User-Agent"} {
+		if v := r.Header.Get(name); v != "" {
+			log.HTTPDebug(' ', session, "  %s: %s", name, v)
+		}
+	}
+
+	if r.ContentLength > 0 && r.Header.Get("Content-Length") == "" {
+		log.HTTPDebug(' ', session, "  Content-Length: %d",
+			r.ContentLength)
+	}
+
+	if ippHdr != nil {
+		if op, ok := ippHdr.Op(); ok {
+			log.HTTPDebug(' ', session, "  IPP operation: %s (0x%4.4x)",
+				op, uint16(op))
+		} else {
+			log.HTTPDebug(' ', session, "  IPP operation: unknown")
+		}
+	}
+}
+
+// Respond to IPP request with the IPP error status, without
+// sending request to the device. hdr is the fixed-size header
+// of the request (version, operation, request-id), op is the
+// operation, decoded from it
+func (proxy *HTTPProxy) ippReject(session int, w http.ResponseWriter,
+	r *http.Request, hdr [8]byte, op goipp.Op,
+	status goipp.Status, msg string) {
+
+	proxy.log.Begin().
+		HTTPRqParams(LogDebug, '>', session, r).
+		Commit()
+
+	proxy.log.HTTPDebug('!', session, "%s rejected: %s (%s)",
+		op, status, msg)
+
+	rsp := goipp.NewResponse(
+		goipp.Version(binary.BigEndian.Uint16(hdr[0:2])),
+		status, binary.BigEndian.Uint32(hdr[4:8]))
+
+	rsp.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	rsp.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	rsp.Operation.Add(goipp.MakeAttribute("status-message",
+		goipp.TagText, goipp.String(msg)))
+
+	w.Header().Set("Content-Type", goipp.ContentType)
+	httpNoCache(w)
+	w.WriteHeader(http.StatusOK)
+	rsp.Encode(w)
+}
+
+// httpIsIpp tells if HTTP message carries the IPP message,
+// according to its Content-Type. Media type parameters, if
+// any, are ignored
+func httpIsIpp(hdr http.Header) bool {
+	mediatype, _, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	return err == nil && mediatype == goipp.ContentType
+}
+
+// httpPeekIppHeader reads the fixed-size header of the IPP message
+// (version, operation, request-id) from the request body and decodes
+// the operation code. The body is restored, so request can be
+// forwarded as is
+func httpPeekIppHeader(r *http.Request) (hdr [8]byte, op goipp.Op, ok bool) {
+	n, _ := io.ReadFull(r.Body, hdr[:])
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(hdr[:n]), r.Body), r.Body}
+
+	if n != len(hdr) {
+		return hdr, 0, false
+	}
+
+	op = goipp.Op(binary.BigEndian.Uint16(hdr[2:4]))
+	return hdr, op, true
+}
+
+// httpIppHeaderCapture wraps request body and captures the
+// fixed-size header of the IPP message, while body is being
+// sent to the device
+type httpIppHeaderCapture struct {
+	io.ReadCloser            // Underlying body
+	lock          sync.Mutex // Access lock
+	hdr           [8]byte    // version, operation, request-id
+	cnt           int        // Count of captured bytes
+}
+
+// Read reads the body and captures the IPP header
+func (capture *httpIppHeaderCapture) Read(buf []byte) (int, error) {
+	n, err := capture.ReadCloser.Read(buf)
+
+	capture.lock.Lock()
+	if capture.cnt < len(capture.hdr) {
+		capture.cnt += copy(capture.hdr[capture.cnt:], buf[:n])
+	}
+	capture.lock.Unlock()
+
+	return n, err
+}
+
+// Op returns IPP operation code, if IPP header was captured
+func (capture *httpIppHeaderCapture) Op() (goipp.Op, bool) {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+
+	if capture.cnt < len(capture.hdr) {
+		return 0, false
+	}
+
+	return goipp.Op(binary.BigEndian.Uint16(capture.hdr[2:4])), true
+}
+
+// httpAdjustForClient adjusts response headers for the
+// HTTP/1.0 client
+//
+// HTTP/1.0 has no chunked encoding, so net/http delimits response
+// body by closing connection, if length is unknown. And legacy
+// clients often don't handle keep-alive properly, even if they ask
+// for it. So connection is explicitly closed, unless keep-alive is
+// requested by client, enabled by configuration and possible
+func httpAdjustForClient(hdr http.Header, r *http.Request) {
+	if r.ProtoAtLeast(1, 1) {
+		return
+	}
+
+	keepAlive := Conf.HTTP10KeepAlive && !r.Close &&
+		hdr.Get("Content-Length") != ""
+	if !keepAlive {
+		hdr.Set("Connection", "close")
+	}
+}
+
+// httpHostFromAddr makes Host: header value from the local
+// address the request was ordered to
+//
+// For IPv6 link-local addresses, zone identifier is encoded
+// according to RFC 6874 (i.e., "[fe80::1%25eth0]:60000"), as
+// '%' is not allowed in the URL host part without escaping
+func httpHostFromAddr(addr *net.TCPAddr) string {
+	if addr.IP.IsLoopback() {
+		return fmt.Sprintf("localhost:%d", addr.Port)
+	}
+
+	if addr.IP.To4() == nil && addr.Zone != "" {
+		return fmt.Sprintf("[%s%%25%s]:%d", addr.IP, addr.Zone,
+			addr.Port)
+	}
+
+	return addr.String()
 }
 
 // Reject request with a error
@@ -223,6 +694,74 @@ func (proxy *HTTPProxy) httpRedirect(session int, w http.ResponseWriter, r *http
 	proxy.log.HTTPDebug(' ', session, "redirected to %s", location)
 }
 
+// httpNormalizePath collapses leading slashes of the request path
+func httpNormalizePath(path string) string {
+	if strings.HasPrefix(path, "//") {
+		path = "/" + strings.TrimLeft(path, "/")
+	}
+	return path
+}
+
+// httpPaths represents per-device lists of resource paths, allowed
+// and denied for proxying. Each list entry matches the path itself
+// and everything below it
+type httpPaths struct {
+	allow []string // Allowed paths, nil if any
+	deny  []string // Denied paths
+}
+
+// newHTTPPaths creates a new httpPaths. If both lists are nil,
+// it returns nil, meaning "everything is allowed"
+func newHTTPPaths(allow, deny []string) *httpPaths {
+	if allow == nil && deny == nil {
+		return nil
+	}
+
+	return &httpPaths{allow: allow, deny: deny}
+}
+
+// Allowed tells if request to the specified path may be proxied
+//
+// Deny list takes precedence over allow list. Path is cleaned
+// before matching, so "/ipp/../admin" doesn't bypass the check
+func (paths *httpPaths) Allowed(rpath string) bool {
+	if paths == nil {
+		return true
+	}
+
+	rpath = path.Clean("/" + rpath)
+
+	for _, prefix := range paths.deny {
+		if httpPathMatch(rpath, prefix) {
+			return false
+		}
+	}
+
+	if paths.allow == nil {
+		return true
+	}
+
+	for _, prefix := range paths.allow {
+		if httpPathMatch(rpath, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpPathMatch tells if path matches the prefix at the path
+// segment boundary, i.e., "/ipp" matches "/ipp" and "/ipp/print",
+// but not "/ipp-usb"
+func httpPathMatch(rpath, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(rpath, prefix) {
+		return false
+	}
+
+	return len(rpath) == len(prefix) || rpath[len(prefix)] == '/'
+}
+
 // Set response headers to disable cacheing
 func httpNoCache(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -247,6 +786,44 @@ func httpRemoveHopByHopHeaders(hdr http.Header) {
 	}
 }
 
+// httpCopyBody copies response body from src to dst
+//
+// It uses the fixed-size buffer and flushes each portion of data
+// to the client as soon as it is received from the device. So the
+// body is streamed with memory usage bounded by HTTPCopyBufferSize,
+// and slow client naturally throttles reading from the device
+func httpCopyBody(dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, HTTPCopyBufferSize)
+	flusher, _ := dst.(http.Flusher)
+
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			n2, err2 := dst.Write(buf[:n])
+			total += int64(n2)
+			if err2 == nil && n2 != n {
+				err2 = io.ErrShortWrite
+			}
+			if err2 != nil {
+				return total, err2
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err == io.EOF {
+			return total, nil
+		}
+
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
 // Copy HTTP headers
 func httpCopyHeaders(dst, src http.Header) {
 	for k, v := range src {
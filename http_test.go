@@ -0,0 +1,577 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for HTTP proxy
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// testScanResponse generates a large HTTP response on the fly,
+// without holding it in memory, as a scanner does
+type testScanResponse struct {
+	hdr     []byte // Not yet returned part of response header
+	size    int64  // Not yet returned part of body
+	chunked bool   // Use chunked encoding
+	chunk   int    // Not yet returned part of current chunk
+	trailer []byte // Not yet returned chunk trailer
+}
+
+// newTestScanResponse creates a new testScanResponse
+func newTestScanResponse(size int64, chunked bool) *testScanResponse {
+	gen := &testScanResponse{size: size, chunked: chunked}
+
+	hdr := "HTTP/1.1 200 OK\r\nContent-Type: image/jpeg\r\n"
+	if chunked {
+		hdr += "Transfer-Encoding: chunked\r\n\r\n"
+	} else {
+		hdr += fmt.Sprintf("Content-Length: %d\r\n\r\n", size)
+	}
+	gen.hdr = []byte(hdr)
+
+	return gen
+}
+
+// Read from testScanResponse
+func (gen *testScanResponse) Read(buf []byte) (int, error) {
+	switch {
+	case len(gen.hdr) > 0:
+		n := copy(buf, gen.hdr)
+		gen.hdr = gen.hdr[n:]
+		return n, nil
+
+	case len(gen.trailer) > 0:
+		n := copy(buf, gen.trailer)
+		gen.trailer = gen.trailer[n:]
+		return n, nil
+
+	case gen.chunked && gen.chunk == 0:
+		if gen.size == 0 {
+			gen.chunked = false
+			gen.trailer = []byte("0\r\n\r\n")
+		} else {
+			gen.chunk = 32768
+			if int64(gen.chunk) > gen.size {
+				gen.chunk = int(gen.size)
+			}
+			gen.hdr = []byte(fmt.Sprintf("%x\r\n", gen.chunk))
+		}
+		return gen.Read(buf)
+
+	case gen.size == 0:
+		return 0, io.EOF
+	}
+
+	n := len(buf)
+	if int64(n) > gen.size {
+		n = int(gen.size)
+	}
+	if gen.chunked {
+		if n > gen.chunk {
+			n = gen.chunk
+		}
+		gen.chunk -= n
+		if gen.chunk == 0 {
+			gen.trailer = []byte("\r\n")
+		}
+	}
+
+	for i := range buf[:n] {
+		buf[i] = byte(i)
+	}
+	gen.size -= int64(n)
+
+	return n, nil
+}
+
+// testCountingWriter counts written bytes and flushes
+type testCountingWriter struct {
+	count   int64
+	flushes int
+}
+
+// Write to testCountingWriter
+func (w *testCountingWriter) Write(buf []byte) (int, error) {
+	w.count += int64(len(buf))
+	return len(buf), nil
+}
+
+// Flush testCountingWriter
+func (w *testCountingWriter) Flush() {
+	w.flushes++
+}
+
+// Test that large responses are streamed with bounded memory
+func TestHTTPCopyBodyStreaming(t *testing.T) {
+	const size = 256 * 1024 * 1024
+	const limit = 8 * 1024 * 1024
+
+	for _, chunked := range []bool{false, true} {
+		gen := newTestScanResponse(size, chunked)
+		resp, err := http.ReadResponse(bufio.NewReader(gen), nil)
+		if err != nil {
+			t.Fatalf("chunked=%v: %s", chunked, err)
+		}
+
+		body := &usbResponseBodyWrapper{
+			log:      NewLogger().Subsys(LogSubsysUSB),
+			body:     resp.Body,
+			expected: resp.ContentLength,
+		}
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		w := &testCountingWriter{}
+		n, err := httpCopyBody(w, body)
+
+		runtime.ReadMemStats(&after)
+
+		if err != nil {
+			t.Errorf("chunked=%v: %s", chunked, err)
+		}
+
+		if n != size || w.count != size {
+			t.Errorf("chunked=%v: expected %d bytes, copied %d, written %d",
+				chunked, size, n, w.count)
+		}
+
+		if w.flushes == 0 {
+			t.Errorf("chunked=%v: response was never flushed", chunked)
+		}
+
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > limit {
+			t.Errorf("chunked=%v: %d bytes allocated, limit is %d",
+				chunked, alloc, limit)
+		}
+	}
+}
+
+// Test that response body copying stops when deadline is exceeded
+func TestHTTPCopyBodyDeadline(t *testing.T) {
+	gen := newTestScanResponse(1024*1024, false)
+	resp, err := http.ReadResponse(bufio.NewReader(gen), nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+
+	w := &testCountingWriter{}
+	n, err := httpCopyBody(w, &httpDeadlineReader{resp.Body, ctx})
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if n >= 1024*1024 {
+		t.Errorf("body was copied completely, despite of deadline")
+	}
+}
+
+// Test that maintenance mode rejects job creation requests
+func TestHTTPMaintenance(t *testing.T) {
+	proxy := &HTTPProxy{
+		log:    NewLogger().Subsys(LogSubsysProxy),
+		enable: true,
+	}
+	proxy.SetMaintenance(true)
+
+	rq := goipp.NewRequest(goipp.DefaultVersion, goipp.OpPrintJob, 42)
+	data, _ := rq.EncodeBytes()
+	data = append(data, "%PDF-1.7 ..."...)
+
+	// Media type parameters must not bypass the check
+	for _, ctype := range []string{goipp.ContentType,
+		"Application/IPP; charset=utf-8"} {
+
+		r := httptest.NewRequest("POST", "/ipp/print",
+			bytes.NewReader(data))
+		r.Header.Set("Content-Type", ctype)
+		r = r.WithContext(context.WithValue(r.Context(),
+			http.LocalAddrContextKey,
+			&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 60000}))
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		var rsp goipp.Message
+		err := rsp.DecodeBytes(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%q: %s", ctype, err)
+		}
+
+		if goipp.Status(rsp.Code) != Conf.IppMaintStatus {
+			t.Errorf("%q: expected %s, got %s", ctype,
+				Conf.IppMaintStatus, goipp.Status(rsp.Code))
+		}
+
+		if rsp.RequestID != 42 {
+			t.Errorf("%q: request-id: expected 42, got %d",
+				ctype, rsp.RequestID)
+		}
+	}
+
+	// Peeked header must be returned to the body
+	r := httptest.NewRequest("POST", "/ipp/print", bytes.NewReader(data))
+	if _, _, ok := httpPeekIppHeader(r); !ok {
+		t.Errorf("IPP header not found")
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !bytes.Equal(body, data) {
+		t.Errorf("body not restored after peeking IPP header")
+	}
+
+	// Other operations are not blocked
+	for _, op := range []goipp.Op{goipp.OpGetPrinterAttributes,
+		goipp.OpValidateJob, goipp.OpSendDocument, goipp.OpCancelJob} {
+		if ippMaintenanceBlocked(op) {
+			t.Errorf("%s blocked in maintenance mode", op)
+		}
+	}
+}
+
+// Test rejection of operations, not supported by device
+func TestHTTPCheckOperations(t *testing.T) {
+	save := Conf.IppCheckOps
+	defer func() { Conf.IppCheckOps = save }()
+	Conf.IppCheckOps = true
+
+	proxy := &HTTPProxy{
+		log:    NewLogger().Subsys(LogSubsysProxy),
+		enable: true,
+	}
+	proxy.SetOperations([]goipp.Op{goipp.OpPrintJob,
+		goipp.OpGetPrinterAttributes})
+
+	rq := goipp.NewRequest(goipp.DefaultVersion, goipp.OpCreateJob, 7)
+	data, _ := rq.EncodeBytes()
+
+	r := httptest.NewRequest("POST", "/ipp/print", bytes.NewReader(data))
+	r.Header.Set("Content-Type", goipp.ContentType)
+	r = r.WithContext(context.WithValue(r.Context(),
+		http.LocalAddrContextKey,
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 60000}))
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	var rsp goipp.Message
+	err := rsp.DecodeBytes(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if goipp.Status(rsp.Code) != goipp.StatusErrorOperationNotSupported {
+		t.Errorf("expected %s, got %s",
+			goipp.StatusErrorOperationNotSupported,
+			goipp.Status(rsp.Code))
+	}
+
+	if rsp.RequestID != 7 {
+		t.Errorf("request-id: expected 7, got %d", rsp.RequestID)
+	}
+
+	// Without operations-supported, nothing is checked
+	proxy.SetOperations(nil)
+	if proxy.ops != nil {
+		t.Errorf("empty operations-supported must disable checking")
+	}
+}
+
+// Test that requests to the detached or closing device
+// don't trip the watchdog
+func TestHTTPWatchdogDetached(t *testing.T) {
+	save := Conf.UsbWdFailures
+	defer func() { Conf.UsbWdFailures = save }()
+	Conf.UsbWdFailures = 1
+
+	logger := NewLogger()
+	transport := &UsbTransport{
+		log:      logger,
+		usbLog:   logger.Subsys(LogSubsysUSB),
+		shutdown: make(chan struct{}),
+		detached: true,
+	}
+
+	resets := make(chan struct{}, 10)
+	proxy := &HTTPProxy{
+		log:       logger.Subsys(LogSubsysProxy),
+		transport: transport,
+		escl:      NewEsclGate(logger.Subsys(LogSubsysESCL)),
+		watchdog: NewWatchdog(transport.usbLog, func() error {
+			resets <- struct{}{}
+			return nil
+		}),
+		enable: true,
+	}
+
+	request := func() {
+		r := httptest.NewRequest("GET", "/ipp/print", nil)
+		r = r.WithContext(context.WithValue(r.Context(),
+			http.LocalAddrContextKey,
+			&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 60000}))
+		r.Host = "localhost:60000"
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("HTTP status: expected %d, got %d",
+				http.StatusServiceUnavailable, w.Code)
+		}
+	}
+
+	// Detached device
+	for i := 0; i < 3; i++ {
+		request()
+	}
+
+	// Device is going away
+	transport.detached = false
+	close(transport.shutdown)
+	for i := 0; i < 3; i++ {
+		request()
+	}
+
+	select {
+	case <-resets:
+		t.Errorf("watchdog fired")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Test per-device path allow/deny lists
+func TestHTTPPaths(t *testing.T) {
+	if !(*httpPaths)(nil).Allowed("/hp/device") {
+		t.Errorf("nil list must allow everything")
+	}
+
+	if newHTTPPaths(nil, nil) != nil {
+		t.Errorf("empty lists must give nil")
+	}
+
+	paths := newHTTPPaths([]string{"/ipp", "/eSCL/"},
+		[]string{"/ipp/faxout"})
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"/ipp", true},
+		{"/ipp/print", true},
+		{"/eSCL", true},
+		{"/eSCL/ScannerStatus", true},
+		{"/ipp/faxout", false},
+		{"/ipp/faxout/x", false},
+		{"/ipp-usb", false},
+		{"/", false},
+		{"/hp/device/info", false},
+		{"/ipp/../hp/device", false},
+		{"/ipp/./faxout", false},
+	}
+
+	for _, test := range tests {
+		allowed := paths.Allowed(test.path)
+		if allowed != test.allowed {
+			t.Errorf("%q: expected %v, got %v",
+				test.path, test.allowed, allowed)
+		}
+	}
+
+	// Denied requests are rejected with 403
+	proxy := &HTTPProxy{
+		log:    NewLogger().Subsys(LogSubsysProxy),
+		enable: true,
+		paths:  paths,
+	}
+
+	r := httptest.NewRequest("GET", "/hp/device/info", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+// Test making of the Host: header value from the local address
+func TestHTTPHostFromAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		zone string
+		host string
+	}{
+		{"127.0.0.1", "", "localhost:60000"},
+		{"::1", "", "localhost:60000"},
+		{"192.168.1.5", "", "192.168.1.5:60000"},
+		{"2001:db8::5", "", "[2001:db8::5]:60000"},
+		{"fe80::1", "eth0", "[fe80::1%25eth0]:60000"},
+		{"fe80::1", "", "[fe80::1]:60000"},
+	}
+
+	for _, test := range tests {
+		addr := &net.TCPAddr{
+			IP:   net.ParseIP(test.ip),
+			Port: 60000,
+			Zone: test.zone,
+		}
+
+		host := httpHostFromAddr(addr)
+		if host != test.host {
+			t.Errorf("%s%%%s: expected %q, got %q",
+				test.ip, test.zone, test.host, host)
+		}
+	}
+}
+
+// Test handling of HTTP/1.0 clients
+func TestHTTP10Client(t *testing.T) {
+	const size = 100000
+
+	// Simulate proxying of chunked device response
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gen := newTestScanResponse(size, true)
+			resp, err := http.ReadResponse(bufio.NewReader(gen), nil)
+			if err != nil {
+				panic(err)
+			}
+
+			httpRemoveHopByHopHeaders(resp.Header)
+			httpCopyHeaders(w.Header(), resp.Header)
+			httpAdjustForClient(w.Header(), r)
+			w.WriteHeader(resp.StatusCode)
+			httpCopyBody(w, resp.Body)
+		}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /eSCL/ScanJobs/1/NextDocument HTTP/1.0\r\n" +
+		"Connection: keep-alive\r\n\r\n"))
+
+	// Connection must be closed at the end of response
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)),
+		&http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if len(body) != size {
+		t.Errorf("body: expected %d bytes, got %d", size, len(body))
+	}
+
+	if len(resp.TransferEncoding) != 0 {
+		t.Errorf("chunked response to HTTP/1.0 client")
+	}
+
+	if c := resp.Header.Get("Connection"); c != "close" {
+		t.Errorf("Connection: expected %q, got %q", "close", c)
+	}
+
+	// Device must still receive HTTP/1.1 request
+	transport := &UsbTransport{log: NewLogger()}
+	transport.usbLog = transport.log.Subsys(LogSubsysUSB)
+
+	rq, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+		"GET /ipp/print HTTP/1.0\r\nHost: localhost\r\n\r\n")))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	outreq, err := transport.outRequest(0, rq)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	outreq.Write(buf)
+
+	devrq, err := http.ReadRequest(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !devrq.ProtoAtLeast(1, 1) || devrq.Close {
+		t.Errorf("device request: %s, close=%v",
+			devrq.Proto, devrq.Close)
+	}
+}
+
+// Test that pin printing jobs are passed to device untouched
+func TestHTTPJobPasswordPassthrough(t *testing.T) {
+	rq := goipp.NewRequest(goipp.DefaultVersion, goipp.OpPrintJob, 1)
+	rq.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	rq.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	rq.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String("ipp://localhost/ipp/print")))
+	rq.Operation.Add(goipp.MakeAttribute("job-password",
+		goipp.TagString, goipp.Binary("\x00\x011234\xff")))
+	rq.Operation.Add(goipp.MakeAttribute("job-password-encryption",
+		goipp.TagKeyword, goipp.String("none")))
+
+	data, _ := rq.EncodeBytes()
+	data = append(data, "%PDF-1.7 ..."...)
+
+	transport := &UsbTransport{log: NewLogger()}
+	transport.usbLog = transport.log.Subsys(LogSubsysUSB)
+
+	r := httptest.NewRequest("POST", "/ipp/print", bytes.NewReader(data))
+	r.Header.Set("Content-Type", goipp.ContentType)
+
+	outreq, err := transport.outRequest(0, r)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	outreq.Write(buf)
+
+	devrq, err := http.ReadRequest(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	body, _ := ioutil.ReadAll(devrq.Body)
+	if !bytes.Equal(body, data) {
+		t.Errorf("request body modified")
+	}
+}
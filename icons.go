@@ -0,0 +1,105 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Cache of device icons
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// IconCachePath is the HTTP path prefix, used to serve cached icons
+const IconCachePath = "/ipp-usb/icons/"
+
+// IconCache keeps device icons, fetched during device initialization,
+// so they can be served by ipp-usb itself, without touching the
+// device (which may be busy, sleeping or just slow)
+type IconCache struct {
+	lock  sync.Mutex                // Access lock
+	icons map[string]iconCacheEntry // Icons, by name
+}
+
+// iconCacheEntry represents a single cached icon
+type iconCacheEntry struct {
+	ctype string // Content-Type
+	data  []byte // Icon data
+}
+
+// NewIconCache creates a new IconCache
+func NewIconCache() *IconCache {
+	return &IconCache{icons: make(map[string]iconCacheEntry)}
+}
+
+// Fetch fetches icon from the device, using the provided http.Client,
+// and saves it under the specified name
+//
+// Host part of the device-supplied URL is ignored, icon is always
+// fetched from the localhost:port. On success, the local URL of
+// the cached copy is returned
+func (cache *IconCache) Fetch(c *http.Client, port int,
+	name, rawurl string) (string, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	uri := fmt.Sprintf("http://localhost:%d%s", port, u.RequestURI())
+	resp, err := c.Get(uri)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("HTTP status: %s", resp.Status)
+	}
+
+	ctype := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(ctype, "image/") {
+		return "", fmt.Errorf("%q: not an image", ctype)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, IconMaxSize+1))
+	switch {
+	case err != nil:
+		return "", err
+	case len(data) == 0:
+		return "", fmt.Errorf("empty icon")
+	case len(data) > IconMaxSize:
+		return "", fmt.Errorf("icon too large")
+	}
+
+	cache.lock.Lock()
+	cache.icons[name] = iconCacheEntry{ctype, data}
+	cache.lock.Unlock()
+
+	return fmt.Sprintf("http://localhost:%d%s%s", port, IconCachePath,
+		name), nil
+}
+
+// Lookup returns cached icon by its HTTP path
+func (cache *IconCache) Lookup(path string) (ctype string, data []byte,
+	ok bool) {
+
+	if !strings.HasPrefix(path, IconCachePath) {
+		return
+	}
+
+	cache.lock.Lock()
+	icon, ok := cache.icons[path[len(IconCachePath):]]
+	cache.lock.Unlock()
+
+	return icon.ctype, icon.data, ok
+}
@@ -13,7 +13,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/OpenPrinting/goipp"
 )
@@ -22,11 +26,51 @@ import (
 // is not included into DNS-SD TXT record, but still needed for
 // other purposes
 type IppPrinterInfo struct {
-	DNSSdName   string // DNS-SD device name
-	UUID        string // Device UUID
-	AdminURL    string // Admin URL
-	IconURL     string // Device icon URL
-	IppSvcIndex int    // IPP DNSSdSvcInfo index within array of services
+	DNSSdName      string   `json:"dns_sd_name,omitempty"`              // DNS-SD device name
+	UUID           string   `json:"uuid,omitempty"`                     // Device UUID
+	AdminURL       string   `json:"admin_url,omitempty"`                // Admin URL
+	IconURL        string   `json:"icon_url,omitempty"`                 // Device icon URL
+	MopriaScanCert string   `json:"mopria_scan_cert,omitempty"`         // Mopria scan certification, if reported
+	Finishings     []string `json:"finishings,omitempty"`               // Supported finishings, nil if unknown
+	PPM            int      `json:"ppm,omitempty"`                      // Pages per minute, 0 if unknown
+	PPMColor       int      `json:"ppm_color,omitempty"`                // Pages per minute, color, 0 if unknown
+	CopiesMax      int      `json:"copies_max,omitempty"`               // Max copies per job, 0 if unknown
+	JobKOctetsMax  int      `json:"job_k_octets_max,omitempty"`         // Max job size, KiB, 0 if unknown
+	JobPasswordMax int      `json:"job_password_max,omitempty"`         // Max job-password length, 0 if no pin printing
+	JobPasswordEnc []string `json:"job_password_encryption,omitempty"`  // Supported job-password-encryption
+	JobPasswordRep []string `json:"job_password_repertoire,omitempty"`  // Supported job-password-repertoire
+	JpegKOctetsMax int      `json:"jpeg_k_octets_max,omitempty"`        // Max JPEG size, KiB, 0 if unknown
+	JpegXDimMax    int      `json:"jpeg_x_dimension_max,omitempty"`     // Max JPEG width, pixels, 0 if unknown
+	JpegYDimMax    int      `json:"jpeg_y_dimension_max,omitempty"`     // Max JPEG height, pixels, 0 if unknown
+	JpegFeatures   []string `json:"jpeg_features,omitempty"`            // Supported JPEG features, empty if unknown
+	PrintScaling   []string `json:"print_scaling,omitempty"`            // Supported print-scaling, empty if unknown
+	MediaCol       []string `json:"media_col,omitempty"`                // Supported media-col members, empty if unknown
+	JobCreation    []string `json:"job_creation_attributes,omitempty"`  // Supported job creation attrs, empty if unknown
+	JobMandatory   []string `json:"job_mandatory_attributes,omitempty"` // Mandatory job attributes, empty if none
+	Identify       []string `json:"identify_actions,omitempty"`         // Supported identify actions, empty if none
+	WhichJobs      []string `json:"which_jobs,omitempty"`               // Supported which-jobs values, empty if unknown
+	Firmware       []string `json:"firmware,omitempty"`                 // Firmware versions, empty if unknown
+	Borderless     string   `json:"borderless,omitempty"`               // "T"/"F" if borderless supported, "" if unknown
+	FormatDetails  []string `json:"document_format_details,omitempty"`  // Document format details, empty if unknown
+	OutputTrays    []string `json:"output_trays,omitempty"`             // Output trays status, empty if unknown
+	URISecurity    string   `json:"uri_security,omitempty"`             // "uri-security-supported", "" if unknown
+	PDLOverride    string   `json:"pdl_override,omitempty"`             // "pdl-override-supported", "" if unknown
+	MediaSources   []string `json:"media_sources,omitempty"`            // Supported input trays, empty if unknown
+	MediaTypes     []string `json:"media_types,omitempty"`              // Supported media types, empty if unknown
+	PrintQuality   []string `json:"print_quality,omitempty"`            // Supported print-quality, empty if unknown
+	Charset        string   `json:"charset,omitempty"`                  // Charset to use in requests to device
+	ConfigChange   string   `json:"config_change,omitempty"`            // Config change stamp, "" if unknown
+	PrintPath      string   `json:"print_path,omitempty"`               // IPP print resource path, without leading "/"
+	ChargeInfo     string   `json:"charge_info,omitempty"`              // "printer-charge-info", "" if unknown
+	Organization   []string `json:"organization,omitempty"`             // "printer-organization", empty if unknown
+	OrgUnits       []string `json:"organizational_units,omitempty"`     // "printer-organizational-unit", empty if unknown
+	IppSvcIndex    int      `json:"-"`                                  // IPP DNSSdSvcInfo index within array of services
+
+	InputTrays []IppInputTray `json:"input_trays,omitempty"` // Input trays status, empty if unknown
+	Operations []goipp.Op     `json:"operations,omitempty"`  // Supported operations, empty if unknown
+
+	// Get-Printer-Supported-Values, nil if not requested or failed
+	SupportedValues map[string][]string `json:"supported_values,omitempty"`
 }
 
 // IppService performs IPP Get-Printer-Attributes query using provided
@@ -34,20 +78,76 @@ type IppPrinterInfo struct {
 // for DNS-SD registration
 //
 // Discovered services will be added to the services collection
+//
+// Negotiated IPP version and configuration change stamp are cached
+// in the DevState. State may be nil, if caching is not needed
 func IppService(log *LogMessage, services *DNSSdServices,
 	port int, usbinfo UsbDeviceInfo, quirks QuirksSet,
-	c *http.Client) (ippinfo *IppPrinterInfo, err error) {
+	state *DevState, c *http.Client) (ippinfo *IppPrinterInfo, err error) {
+
+	log = log.BeginSubsys(LogSubsysIPP)
+	defer log.Commit()
 
 	// Query printer attributes
-	uri := fmt.Sprintf("http://localhost:%d/ipp/print", port)
-	msg, err := ippGetPrinterAttributes(log, c, uri)
+	//
+	// If device doesn't serve IPP at the default path, the
+	// path it has reported before via "printer-uri-supported"
+	// (cached in the DevState) is tried
+	uri := fmt.Sprintf("http://localhost:%d/%s", port, ippPrintPath)
+	ver := ippGetVersion(log, c, uri, state)
+	msg, err := ippGetPrinterAttributesLang(log, c, uri, ver)
+	if err != nil && state != nil && state.IppPrintPath() != ippPrintPath {
+		log.Debug('!', "IPP: /%s: %s; trying /%s",
+			ippPrintPath, err, state.PrintPath)
+		uri = fmt.Sprintf("http://localhost:%d/%s", port,
+			state.PrintPath)
+		msg, err = ippGetPrinterAttributesLang(log, c, uri, ver)
+	}
+
 	if err != nil {
 		return
 	}
 
 	// Decode IPP service info
-	attrs := newIppDecoder(msg)
-	ippinfo, ippScv := attrs.decode(usbinfo)
+	ippinfo, ippScv := IppDecodePrinterAttributes(msg, usbinfo)
+
+	// Save configuration change stamp, for cheap change detection,
+	// and IPP resource path
+	if state != nil && (state.ConfigChange != ippinfo.ConfigChange ||
+		state.IppPrintPath() != ippinfo.PrintPath) {
+		state.ConfigChange = ippinfo.ConfigChange
+		state.PrintPath = ippinfo.PrintPath
+		state.Save()
+	}
+	if len(ippinfo.Firmware) != 0 {
+		log.Debug(' ', "IPP firmware: %s",
+			strings.Join(ippinfo.Firmware, "; "))
+	}
+
+	// Device may serve IPP on its own resource path
+	if ippinfo.PrintPath != ippPrintPath {
+		log.Debug(' ', "IPP resource path: /%s", ippinfo.PrintPath)
+		uri = fmt.Sprintf("http://localhost:%d/%s", port,
+			ippinfo.PrintPath)
+	}
+
+	// Enrich device info with supported values, if enabled. Many
+	// devices don't implement this operation, so errors are ignored
+	if Conf.IppSupportedVals {
+		vals, err2 := IppGetSupportedValues(log, c, uri, ver)
+		if err2 != nil {
+			log.Debug('!', "IPP Get-Printer-Supported-Values: %s", err2)
+		} else {
+			ippinfo.SupportedValues = vals
+			log.Debug(' ', "IPP supported values: %d attributes",
+				len(vals))
+		}
+	}
+
+	if air := Conf.IppAirOverride; air != "" && !ippAirKnown(air) {
+		log.Info('!', "air-override: %q is not a known \"air\" value",
+			air)
+	}
 
 	// Check for fax support
 	canFax := false
@@ -60,8 +160,9 @@ func IppService(log *LogMessage, services *DNSSdServices,
 		// not on device capabilities, lets leave it here
 		// for now, just in case. Firmwares in general are
 		// too buggy, I can't trust them :-(
-		uri = fmt.Sprintf("http://localhost:%d/ipp/faxout", port)
-		if _, err2 := ippGetPrinterAttributes(log, c, uri); err2 == nil {
+		uri = fmt.Sprintf("http://localhost:%d/%s", port, ippFaxOutPath)
+		if _, err2 := ippGetPrinterAttributes(log, c, uri, ver,
+			ippinfo.Charset, ippDefaultLanguage); err2 == nil {
 			canFax = true
 			log.Debug(' ', "IPP FaxOut service detected")
 		} else {
@@ -71,9 +172,15 @@ func IppService(log *LogMessage, services *DNSSdServices,
 		log.Debug(' ', "IPP FaxOut service not in capabilities")
 	}
 
+	// ipp-usb serves plain HTTP only, so TLS is never advertised
+	if ippinfo.URISecurity != "" && ippinfo.URISecurity != "none" {
+		log.Debug(' ', "IPP uri-security-supported: %s, "+
+			"TLS not advertised", ippinfo.URISecurity)
+	}
+
 	if canFax {
 		ippScv.Txt.Add("Fax", "T")
-		ippScv.Txt.Add("rfo", "ipp/faxout")
+		ippScv.Txt.Add("rfo", ippResourcePath(ippFaxOutPath))
 	} else {
 		ippScv.Txt.Add("Fax", "F")
 	}
@@ -86,18 +193,250 @@ func IppService(log *LogMessage, services *DNSSdServices,
 		Txt:  nil,
 	}
 
+	// Query extra print queues, if device has them (see the
+	// ipp-queues quirk), and set queue-related TXT items
+	queues := []*DNSSdSvcInfo{&ippScv}
+	for _, path := range quirks.GetIppQueues() {
+		svc, err2 := ippQueueService(log, c, port, path, ver,
+			ippinfo.Charset, usbinfo)
+		if err2 != nil {
+			log.Error('!', "IPP queue %s: %s", path, err2)
+			continue
+		}
+
+		queues = append(queues, svc)
+	}
+
+	ippSetQueues(queues)
+
 	// Pack it all together
 	ippScv.Port = port
 	services.Add(lpdScv)
 
 	ippinfo.IppSvcIndex = len(*services)
-	services.Add(ippScv)
+	for _, svc := range queues {
+		services.Add(*svc)
+	}
 
 	return
 }
 
+// ippQueueService queries attributes of the extra print queue
+// at the specified path, and returns its IPP service
+//
+// Extra queues don't support fax. Their instance names are
+// made distinct by the queue path
+func ippQueueService(log *LogMessage, c *http.Client, port int,
+	path string, ver goipp.Version, charset string,
+	usbinfo UsbDeviceInfo) (*DNSSdSvcInfo, error) {
+
+	uri := fmt.Sprintf("http://localhost:%d%s", port, path)
+	msg, err := ippGetPrinterAttributes(log, c, uri, ver,
+		charset, ippDefaultLanguage)
+	if err != nil {
+		return nil, err
+	}
+
+	_, svc := IppDecodePrinterAttributes(msg, usbinfo)
+
+	path = strings.Trim(path, "/")
+	svc.Txt.Set("rp", ippResourcePath(path))
+	svc.Txt.Add("Fax", "F")
+	svc.InstanceSuffix = " (" + path + ")"
+	svc.Port = port
+
+	return &svc, nil
+}
+
+// IppDecodePrinterAttributes decodes printer attributes, received
+// from the device in response to the Get-Printer-Attributes request,
+// into IppPrinterInfo and TXT record of the IPP service
+//
+// It doesn't depend on network or device, so it can be used on
+// a previously saved response. usbinfo is used for fallback, when
+// device doesn't report something (i.e., DNS-SD name or UUID)
+//
+// Returned service has its Port unset; fax and queue related TXT
+// items are not set either, as they require device probing
+func IppDecodePrinterAttributes(msg *goipp.Message, usbinfo UsbDeviceInfo) (
+	*IppPrinterInfo, DNSSdSvcInfo) {
+	return newIppDecoder(msg).decode(usbinfo)
+}
+
+// ippDNSSdNameAttrsDefault is the default list of attributes,
+// DNS-SD name is taken from, in order of preference
+var ippDNSSdNameAttrsDefault = []string{
+	"printer-dns-sd-name",
+	"printer-info",
+	"printer-make-and-model",
+}
+
+// ippDNSSdNameAttrsAll lists all attributes, DNS-SD name can
+// be taken from
+var ippDNSSdNameAttrsAll = []string{
+	"printer-dns-sd-name",
+	"printer-info",
+	"printer-make-and-model",
+	"printer-name",
+}
+
+// IPP resource paths, relative to the device root. See
+// ippResourcePath for their advertised form
+const (
+	ippPrintPath  = "ipp/print"
+	ippFaxOutPath = "ipp/faxout"
+)
+
+// ippResourcePath returns the resource path, as advertised in
+// the "rp" and "rfo" TXT items. Normally it goes without the
+// leading slash, but some clients need it, see rp-leading-slash
+func ippResourcePath(path string) string {
+	if Conf.IppRpSlash {
+		return "/" + path
+	}
+	return path
+}
+
+// ippDefaultLanguage is the natural language, used by default
+// and as a fallback
+const ippDefaultLanguage = "en-US"
+
+// ippDefaultCharset is the charset, used by default and as a fallback
+const ippDefaultCharset = "utf-8"
+
+// ippNewRequest creates a new IPP request with the operation
+// attributes, common for all requests, sent by ipp-usb itself:
+// "attributes-charset" (ippDefaultCharset), "attributes-natural-language"
+// (ippDefaultLanguage) and "printer-uri", followed by attrs
+//
+// Attributes in attrs, named as the common ones, replace them
+// in place (i.e., to send request in the specific charset)
+//
+// Request is created with goipp.DefaultVersion. Callers, that
+// use the negotiated version, set msg.Version
+func ippNewRequest(op goipp.Op, uri string,
+	attrs ...goipp.Attribute) *goipp.Message {
+
+	msg := goipp.NewRequest(goipp.DefaultVersion, op, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String(ippDefaultCharset)))
+	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String(ippDefaultLanguage)))
+	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+
+	common := len(msg.Operation)
+
+ATTRS:
+	for _, attr := range attrs {
+		for i := 0; i < common; i++ {
+			if msg.Operation[i].Name == attr.Name {
+				msg.Operation[i] = attr
+				continue ATTRS
+			}
+		}
+
+		msg.Operation.Add(attr)
+	}
+
+	return msg
+}
+
+// ippGetPrinterAttributesLang performs GetPrinterAttributes query,
+// requesting attributes in the natural language, specified by
+// configuration, using the specified IPP version
+//
+// Attributes first requested in utf-8 and the default (or configured)
+// language. Then charset and, in the "auto" mode, language are chosen
+// among values, supported by device, and if choice differs, request
+// is repeated. If repeated request fails, the first response is used
+//
+// This allows to talk to legacy devices, that don't support utf-8,
+// in the charset they understand
+func ippGetPrinterAttributesLang(log *LogMessage, c *http.Client,
+	uri string, ver goipp.Version) (*goipp.Message, error) {
+
+	lang := Conf.IppLanguage
+	if lang == "auto" {
+		lang = ippDefaultLanguage
+	}
+
+	msg, err := ippGetPrinterAttributes(log, c, uri, ver,
+		ippDefaultCharset, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := newIppDecoder(msg)
+	charset := ippChooseCharset(attrs.getStrings("charset-supported"))
+	lang2 := lang
+	if Conf.IppLanguage == "auto" {
+		lang2 = ippChooseLanguage(
+			attrs.getStrings("generated-natural-language-supported"),
+			attrs.strSingle("natural-language-configured"))
+	}
+
+	if charset == ippDefaultCharset && strings.EqualFold(lang, lang2) {
+		return msg, nil
+	}
+
+	log.Debug(' ', "IPP: requesting attributes in %q/%q", charset, lang2)
+	msg2, err := ippGetPrinterAttributes(log, c, uri, ver, charset, lang2)
+	if err != nil {
+		log.Debug('!', "IPP: %s; using %q/%q", err,
+			ippDefaultCharset, lang)
+		return msg, nil
+	}
+
+	return msg2, nil
+}
+
+// ippChooseCharset chooses charset for requests, based on
+// device's "charset-supported". utf-8 is preferred, then
+// us-ascii, then whatever device supports
+func ippChooseCharset(supported []string) string {
+	if len(supported) == 0 {
+		return ippDefaultCharset
+	}
+
+	for _, charset := range []string{ippDefaultCharset, "us-ascii"} {
+		for _, s := range supported {
+			if strings.EqualFold(s, charset) {
+				return charset
+			}
+		}
+	}
+
+	return strings.ToLower(supported[0])
+}
+
+// ippChooseLanguage chooses natural language for requests, based
+// on device's "generated-natural-language-supported". Device's
+// configured language is preferred, then the default language,
+// then whatever device supports. Empty list means, anything goes
+func ippChooseLanguage(supported []string, configured string) string {
+	for _, lang := range []string{configured, ippDefaultLanguage} {
+		if lang == "" {
+			continue
+		}
+
+		if len(supported) == 0 {
+			return lang
+		}
+
+		for _, s := range supported {
+			if strings.EqualFold(s, lang) {
+				return s
+			}
+		}
+	}
+
+	return supported[0]
+}
+
 // ippGetPrinterAttributes performs GetPrinterAttributes query,
-// using the specified http.Client and uri
+// using the specified http.Client, uri, IPP version, charset and
+// natural language
 //
 // If this function returns nil error, it means that:
 //   1) HTTP transaction performed successfully
@@ -105,36 +444,122 @@ func IppService(log *LogMessage, services *DNSSdServices,
 //   3) It is not an IPP error response
 //
 // Otherwise, the appropriate error is generated and returned
-func ippGetPrinterAttributes(log *LogMessage, c *http.Client, uri string) (
+func ippGetPrinterAttributes(log *LogMessage, c *http.Client,
+	uri string, ver goipp.Version, charset, lang string) (
 	msg *goipp.Message, err error) {
 
 	// Query printer attributes
-	msg = goipp.NewRequest(goipp.DefaultVersion, goipp.OpGetPrinterAttributes, 1)
-	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
-		goipp.TagCharset, goipp.String("utf-8")))
-	msg.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
-		goipp.TagLanguage, goipp.String("en-US")))
-	msg.Operation.Add(goipp.MakeAttribute("printer-uri",
-		goipp.TagURI, goipp.String(uri)))
+	msg = ippNewRequest(goipp.OpGetPrinterAttributes, uri,
+		goipp.MakeAttribute("attributes-charset",
+			goipp.TagCharset, goipp.String(charset)),
+		goipp.MakeAttribute("attributes-natural-language",
+			goipp.TagLanguage, goipp.String(lang)))
+	msg.Version = ver
 
 	rq := goipp.Attribute{Name: "requested-attributes"}
+	rq.Values.Add(goipp.TagKeyword, goipp.String("charset-supported"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("color-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("copies-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("document-format-details-supported"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("document-format-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("finishings-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("generated-natural-language-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("identify-actions-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-creation-attributes-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-k-octets-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-password-encryption-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-password-repertoire-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-password-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("jpeg-features-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("jpeg-k-octets-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("jpeg-x-dimension-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("jpeg-y-dimension-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("media-bottom-margin-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("media-col-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("media-left-margin-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("media-right-margin-supported"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("media-size-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("media-source-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("media-top-margin-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("media-type-supported"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("mopria-certified"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("mopria-certified-scan"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("natural-language-configured"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("operations-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("pages-per-minute"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("pages-per-minute-color"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("pdl-override-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("print-quality-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("print-scaling-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-charge-info"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-config-change-date-time"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-config-change-time"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-config-changes"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-device-id"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-dns-sd-name"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-firmware-name"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-firmware-string-version"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-icons"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-info"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-kind"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-location"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-make-and-model"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-mandatory-job-attributes"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-more-info"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-name"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-organization"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-organizational-unit"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-input-tray"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-output-tray"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-uri-supported"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("printer-uuid"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("pwg-raster-document-resolution-supported"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("sides-supported"))
 	rq.Values.Add(goipp.TagKeyword, goipp.String("urf-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("uri-authentication-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("uri-security-supported"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("which-jobs-supported"))
 	msg.Operation.Add(rq)
 
+	// Some firmwares, while waking up, respond with an empty body.
+	// This is transient, so request is repeated a few times
+	req := msg
+	for retry := uint(0); ; retry++ {
+		msg, err = ippDoRequest(log, c, uri, req)
+		if err != ErrEmptyIpp || retry >= Conf.IppEmptyRetries {
+			break
+		}
+
+		log.Debug(' ', "IPP: empty response, retry %d/%d in %s",
+			retry+1, Conf.IppEmptyRetries, Conf.IppEmptyDelay)
+		time.Sleep(Conf.IppEmptyDelay)
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Check response status
+	if msg.Code >= 100 {
+		err = fmt.Errorf("IPP: %s", goipp.Status(msg.Code))
+		return
+	}
+
+	return
+}
+
+// ippDoRequest sends IPP request to the specified uri, using
+// the provided http.Client, and returns decoded IPP response
+//
+// If this function returns nil error, it means that HTTP transaction
+// performed successfully and the response is decoded. IPP status of
+// the response is not checked, it's up to the caller
+func ippDoRequest(log *LogMessage, c *http.Client, uri string,
+	msg *goipp.Message) (*goipp.Message, error) {
+
+	log = log.BeginSubsys(LogSubsysIPP)
+	defer log.Commit()
+
 	log.Add(LogTraceIPP, '>', "IPP request:").
 		IppRequest(LogTraceIPP, '>', msg).
 		Nl(LogTraceIPP).
@@ -143,44 +568,76 @@ func ippGetPrinterAttributes(log *LogMessage, c *http.Client, uri string) (
 	req, _ := msg.EncodeBytes()
 	resp, err := c.Post(uri, goipp.ContentType, bytes.NewBuffer(req))
 	if err != nil {
-		err = fmt.Errorf("HTTP: %s", err)
-		return
+		return nil, fmt.Errorf("HTTP: %s", err)
 	}
 
 	defer resp.Body.Close()
 
 	// Check HTTP status
 	if resp.StatusCode/100 != 2 {
-		err = fmt.Errorf("HTTP: %s", resp.Status)
-		return
+		return nil, fmt.Errorf("HTTP: %s", resp.Status)
 	}
 
 	// Decode IPP response message
 	respData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		err = fmt.Errorf("HTTP: %s", err)
-		return
+		return nil, fmt.Errorf("HTTP: %s", err)
 	}
 
-	err = msg.DecodeBytes(respData)
+	// Empty response is not the same as malformed one: the
+	// former is usually transient and worth retrying
+	if len(respData) == 0 {
+		log.Debug(' ', "Empty IPP response (HTTP %s)", resp.Status)
+		return nil, ErrEmptyIpp
+	}
+
+	rsp, recovered, err := ippDecodeMessage(respData)
 	if err != nil {
-		log.Debug(' ', "Failed to decode IPP message: %s", err)
 		log.HexDump(LogTraceIPP, ' ', respData)
-		err = fmt.Errorf("IPP decode: %s", err)
-		return
+		if recovered == 0 {
+			log.Debug(' ', "Malformed IPP response: %s", err)
+			return nil, fmt.Errorf("IPP decode: %s", err)
+		}
+
+		log.Info('!', "IPP message partially decoded: %s", err)
+		log.Info('!', "%d attributes recovered", recovered)
 	}
 
 	log.Add(LogTraceIPP, '<', "IPP response:").
-		IppResponse(LogTraceIPP, '<', msg).
+		IppResponse(LogTraceIPP, '<', rsp).
 		Nl(LogTraceIPP).
 		Flush()
 
-	// Check response status
-	if msg.Code >= 100 {
-		err = fmt.Errorf("IPP: %s", goipp.Status(msg.Code))
+	return rsp, nil
+}
+
+// ippDecodeMessage decodes IPP message
+//
+// goipp fills the message progressively, so if message is malformed
+// somewhere in the middle, attributes, decoded before the error, are
+// still valid (though the last of them may miss some trailing values).
+// Even a partial set of attributes yields a better DNS-SD advertising
+// than nothing, so they are salvaged. In this case, decoded message
+// is returned together with the error, and recovered is the count of
+// salvaged attributes. If nothing can be salvaged, recovered is 0
+func ippDecodeMessage(data []byte) (msg *goipp.Message,
+	recovered int, err error) {
+
+	msg = &goipp.Message{}
+	err = msg.DecodeBytes(data)
+	if err == nil {
 		return
 	}
 
+	for _, grp := range []goipp.Attributes{
+		msg.Operation, msg.Job, msg.Printer, msg.Unsupported,
+		msg.Subscription, msg.EventNotification, msg.Resource,
+		msg.Document, msg.System, msg.Future11, msg.Future12,
+		msg.Future13, msg.Future14, msg.Future15,
+	} {
+		recovered += len(grp)
+	}
+
 	return
 }
 
@@ -192,11 +649,18 @@ type ippAttrs map[string]goipp.Values
 func newIppDecoder(msg *goipp.Message) ippAttrs {
 	attrs := make(ippAttrs)
 
-	// Note, we move from the end of list to the beginning, so
-	// in a case of duplicated attributes, first occurrence wins
-	for i := len(msg.Printer) - 1; i >= 0; i-- {
-		attr := msg.Printer[i]
-		attrs[attr.Name] = attr.Values
+	// Note, by default we move from the end of list to the beginning,
+	// so in a case of duplicated attributes, first occurrence wins.
+	// Some firmwares need the opposite, see duplicate-attributes
+	if Conf.IppDupLastWins {
+		for _, attr := range msg.Printer {
+			attrs[attr.Name] = attr.Values
+		}
+	} else {
+		for i := len(msg.Printer) - 1; i >= 0; i-- {
+			attr := msg.Printer[i]
+			attrs[attr.Name] = attr.Values
+		}
 	}
 
 	return attrs
@@ -208,30 +672,42 @@ func newIppDecoder(msg *goipp.Message) ippAttrs {
 //
 //   DNS-SD name: "printer-dns-sd-name" with fallback to "printer-info",
 //                "printer-make-and-model" and finally to MfgAndProduct
-//                from the UsbDeviceInfo
+//                from the UsbDeviceInfo. The list of attributes may
+//                be changed by configuration file
 //
 //   TXT fields:
-//     air:              hardcoded as "none"
+//     txtvers:          hardcoded as "1", always goes first
+//     air:              "uri-authentication-supported", see getAir
 //     mopria-certified: "mopria-certified"
-//     rp:               hardcoded as "ipp/print"
+//     rp:               "printer-uri-supported" path with fallback to
+//                       "ipp/print", see getPrintPath, ippResourcePath
 //     kind:             "printer-kind"
 //     PaperMax:         based on decoding "media-size-supported"
 //     URF:              "urf-supported" with fallback to
-//                       URF extracted from "printer-device-id"
+//                       URF extracted from "printer-device-id",
+//                       optionally fixed, see getURF
 //     UUID:             "printer-uuid", without "urn:uuid:" prefix
 //     Color:            "color-supported"
-//     Duplex:           search "sides-supported" for strings with
-//                       prefix "one" or "two"
-//     note:             "printer-location"
-//     qtotal:           hardcoded as "1"
+//     Copies:           "T" if upper bound of "copies-supported"
+//                       is greater than 1, "F" if 1
+//     Duplex:           search "sides-supported" for "one-sided"
+//                       and "two-sided-long/short-edge"
+//     Bind, Punch,
+//     Staple:           search "finishings-supported" for bind,
+//                       punch and staple finishings
+//     note:             "printer-location", omitted if empty
+//     qtotal:           number of IPP queues, see ippSetQueues
 //     usb_MDL:          MDL, extracted from "printer-device-id"
 //     usb_MFG:          MFG, extracted from "printer-device-id"
 //     usb_CMD:          CMD, extracted from "printer-device-id"
 //     ty:               "printer-make-and-model"
-//     priority:         hardcoded as "50"
-//     product:          "printer-make-and-model", in round brackets
-//     pdl:              "document-format-supported"
-//     txtvers:          hardcoded as "1"
+//     priority:         "50" for the first queue, see ippSetQueues
+//     product:          "printer-make-and-model", in round brackets,
+//                       optionally normalized, see ippNormalizeProduct
+//
+//                       Both ty and product may be replaced with the
+//                       friendly name from the [model-names] section
+//     pdl:              "document-format-supported", see getPDL
 //     adminurl:         "printer-more-info"
 //
 func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo) (
@@ -244,17 +720,58 @@ func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo) (
 
 	// Obtain IppPrinterInfo
 	ippinfo = &IppPrinterInfo{
-		AdminURL: attrs.strSingle("printer-more-info"),
-		IconURL:  attrs.strSingle("printer-icons"),
+		AdminURL:       attrs.strSingle("printer-more-info"),
+		IconURL:        attrs.strSingle("printer-icons"),
+		MopriaScanCert: attrs.strSingle("mopria-certified-scan"),
+		Finishings:     attrs.getFinishings(),
+		PPM:            attrs.intSingle("pages-per-minute"),
+		PPMColor:       attrs.intSingle("pages-per-minute-color"),
+		CopiesMax:      attrs.intUpper("copies-supported"),
+		JobKOctetsMax:  attrs.intUpper("job-k-octets-supported"),
+		JobPasswordMax: attrs.intSingle("job-password-supported"),
+		JpegKOctetsMax: attrs.intUpper("jpeg-k-octets-supported"),
+		JpegXDimMax:    attrs.intUpper("jpeg-x-dimension-supported"),
+		JpegYDimMax:    attrs.intUpper("jpeg-y-dimension-supported"),
+		JpegFeatures:   attrs.getStrings("jpeg-features-supported"),
+		PrintScaling:   attrs.getStrings("print-scaling-supported"),
+		MediaCol:       attrs.getStrings("media-col-supported"),
+		JobCreation:    attrs.getStrings("job-creation-attributes-supported"),
+		JobMandatory:   attrs.getStrings("printer-mandatory-job-attributes"),
+		Identify:       attrs.getStrings("identify-actions-supported"),
+		WhichJobs:      attrs.getStrings("which-jobs-supported"),
+		Firmware:       attrs.getFirmware(),
+		Borderless:     attrs.getBorderless(),
+		FormatDetails:  attrs.getFormatDetails(),
+		OutputTrays:    attrs.getOutputTrays(),
+		InputTrays:     attrs.getInputTrays(),
+		URISecurity:    attrs.getURISecurity(),
+		PDLOverride:    attrs.strSingle("pdl-override-supported"),
+		MediaSources:   attrs.getMediaSources(),
+		MediaTypes:     attrs.getMediaTypes(),
+		PrintQuality:   attrs.getPrintQuality(),
+		Charset:        ippChooseCharset(attrs.getStrings("charset-supported")),
+		ConfigChange:   attrs.getConfigChange(),
+		PrintPath:      attrs.getPrintPath(),
+		ChargeInfo:     attrs.strTrimmed("printer-charge-info"),
+		Organization:   attrs.getTexts("printer-organization"),
+		OrgUnits:       attrs.getTexts("printer-organizational-unit"),
+		Operations:     attrs.getOperations(),
 	}
 
-	// Obtain DNSSdName
-	ippinfo.DNSSdName = attrs.strSingle("printer-dns-sd-name")
-	if ippinfo.DNSSdName == "" {
-		ippinfo.DNSSdName = attrs.strSingle("printer-info")
+	// Pin printing related attributes are meaningless,
+	// if pin printing is not supported
+	if ippinfo.JobPasswordMax > 0 {
+		ippinfo.JobPasswordEnc = attrs.getStrings(
+			"job-password-encryption-supported")
+		ippinfo.JobPasswordRep = attrs.getStrings(
+			"job-password-repertoire-supported")
 	}
-	if ippinfo.DNSSdName == "" {
-		ippinfo.DNSSdName = attrs.strSingle("printer-make-and-model")
+
+	// Obtain DNSSdName
+	for _, name := range Conf.IppDNSSdNameAttrs {
+		if ippinfo.DNSSdName == "" {
+			ippinfo.DNSSdName = attrs.strSingle(name)
+		}
 	}
 	if ippinfo.DNSSdName == "" {
 		ippinfo.DNSSdName = usbinfo.MfgAndProduct
@@ -275,49 +792,261 @@ func (attrs ippAttrs) decode(usbinfo UsbDeviceInfo) (
 		}
 	}
 
-	svc.Txt.Add("air", "none")
+	svc.Txt.Add("txtvers", "1")
+	air := attrs.getAir()
+	if Conf.IppAirOverride != "" {
+		air = Conf.IppAirOverride
+	}
+	svc.Txt.Add("air", air)
 	svc.Txt.IfNotEmpty("mopria-certified", attrs.strSingle("mopria-certified"))
-	svc.Txt.Add("rp", "ipp/print")
+	svc.Txt.Add("rp", ippResourcePath(ippinfo.PrintPath))
 	svc.Txt.Add("priority", "50")
 	svc.Txt.IfNotEmpty("kind", attrs.strJoined("printer-kind"))
 	svc.Txt.IfNotEmpty("PaperMax", attrs.getPaperMax())
-	if !svc.Txt.IfNotEmpty("URF", attrs.strJoined("urf-supported")) {
-		svc.Txt.IfNotEmpty("URF", devid["URF"])
-	}
+	svc.Txt.IfNotEmpty("URF", attrs.getURF(devid["URF"]))
 	svc.Txt.IfNotEmpty("UUID", ippinfo.UUID)
 	svc.Txt.IfNotEmpty("Color", attrs.getBool("color-supported"))
+	svc.Txt.IfNotEmpty("Copies", ippCopiesTxt(ippinfo.CopiesMax))
 	svc.Txt.IfNotEmpty("Duplex", attrs.getDuplex())
-	svc.Txt.Add("note", attrs.strSingle("printer-location"))
+	if ippinfo.Finishings != nil {
+		svc.Txt.Add("Bind", ippFinishingsTxt(ippinfo.Finishings, "bind"))
+		svc.Txt.Add("Punch", ippFinishingsTxt(ippinfo.Finishings, "punch"))
+		svc.Txt.Add("Staple", ippFinishingsTxt(ippinfo.Finishings, "staple"))
+	}
+	if !svc.Txt.IfNotEmpty("note", attrs.strSingle("printer-location")) &&
+		Conf.IppEmptyNote {
+		svc.Txt.Add("note", "")
+	}
 	svc.Txt.Add("qtotal", "1")
 	svc.Txt.IfNotEmpty("usb_MDL", devid["MDL"])
 	svc.Txt.IfNotEmpty("usb_MFG", devid["MFG"])
 	svc.Txt.IfNotEmpty("usb_CMD", devid["CMD"])
 	svc.Txt.IfNotEmpty("ty", attrs.strSingle("printer-make-and-model"))
-	svc.Txt.IfNotEmpty("product", attrs.strBrackets("printer-make-and-model"))
-	svc.Txt.AddPDL("pdl", attrs.strJoined("document-format-supported"))
-	svc.Txt.Add("txtvers", "1")
+	svc.Txt.IfNotEmpty("product", attrs.getProduct())
+	if name := Conf.ModelNames.Lookup(
+		attrs.strSingle("printer-make-and-model")); name != "" {
+		svc.Txt.Set("ty", name)
+		svc.Txt.Set("product", "("+name+")")
+	}
+	svc.Txt.AddPDL("pdl", attrs.getPDL())
+	if Conf.IppMediaSrcTxt && len(ippinfo.MediaSources) != 0 {
+		svc.Txt.AddPDL("media-source",
+			strings.Join(ippinfo.MediaSources, ","))
+	}
+	if Conf.IppMediaTypeTxt && len(ippinfo.MediaTypes) != 0 {
+		svc.Txt.AddPDL("media-type",
+			strings.Join(ippinfo.MediaTypes, ","))
+	}
+	if Conf.IppQualityTxt && len(ippinfo.PrintQuality) != 0 {
+		svc.Txt.Add("print-quality",
+			strings.Join(ippinfo.PrintQuality, ","))
+	}
 	svc.Txt.URLIfNotEmpty("adminurl", ippinfo.AdminURL)
 
 	return
 }
 
+// ippSetQueues sets "qtotal" and "priority" TXT items for
+// IPP services of all print queues of the same device
+//
+// "qtotal" is a total count of queues. Each queue gets a distinct
+// "priority", starting from the default "50" for the first queue
+// (smaller value means higher priority). So for a single-queue
+// device TXT record remains unchanged
+func ippSetQueues(queues []*DNSSdSvcInfo) {
+	qtotal := strconv.Itoa(len(queues))
+	for i, svc := range queues {
+		priority := 50 + i
+		if priority > 99 {
+			priority = 99
+		}
+
+		svc.Txt.Set("priority", strconv.Itoa(priority))
+		svc.Txt.Set("qtotal", qtotal)
+	}
+}
+
+// ippCopiesTxt returns value of the "Copies" TXT item, based
+// on the upper bound of "copies-supported": "T" if printer
+// can make multiple copies, "F" if not and "" if unknown
+func ippCopiesTxt(copiesMax int) string {
+	switch {
+	case copiesMax > 1:
+		return "T"
+	case copiesMax == 1:
+		return "F"
+	}
+
+	return ""
+}
+
 // getUUID returns printer UUID, or "", if UUID not available
 func (attrs ippAttrs) getUUID() string {
 	uuid := attrs.strSingle("printer-uuid")
 	return UUIDNormalize(uuid)
 }
 
+// getAir returns value of the "air" TXT item, based on the
+// first value of "uri-authentication-supported":
+//
+//   none, requesting-user-name -> "none"
+//   basic, digest              -> "username,password"
+//   certificate                -> "certificate"
+//   negotiate                  -> "negotiate"
+//
+// If attribute is missed or its value is not recognized,
+// "none" is returned
+func (attrs ippAttrs) getAir() string {
+	auth := attrs.strSingle("uri-authentication-supported")
+	switch strings.ToLower(auth) {
+	case "basic", "digest":
+		return "username,password"
+	case "certificate":
+		return "certificate"
+	case "negotiate":
+		return "negotiate"
+	}
+
+	return "none"
+}
+
+// ippMaintenanceBlocked tells if IPP operation is rejected in
+// maintenance mode. These are operations that create new jobs;
+// other operations, including these that complete already created
+// jobs, are passed to device
+func ippMaintenanceBlocked(op goipp.Op) bool {
+	switch op {
+	case goipp.OpPrintJob, goipp.OpPrintURI, goipp.OpCreateJob:
+		return true
+	}
+
+	return false
+}
+
+// getMediaSources returns "media-source-supported" (input trays,
+// i.e., "tray-1", "manual", "auto"). Empty and duplicate values,
+// reported by some devices, are skipped
+func (attrs ippAttrs) getMediaSources() []string {
+	sources := []string{}
+	seen := make(map[string]struct{})
+
+	for _, src := range attrs.getStrings("media-source-supported") {
+		src = strings.TrimSpace(src)
+		if _, dup := seen[src]; dup || src == "" {
+			continue
+		}
+
+		seen[src] = struct{}{}
+		sources = append(sources, src)
+	}
+
+	return sources
+}
+
+// getMediaTypes returns "media-type-supported" (i.e., "stationery",
+// "photographic-glossy", "transparency"), normalized to the PWG
+// media-type names. Empty and duplicate values are skipped
+func (attrs ippAttrs) getMediaTypes() []string {
+	types := []string{}
+	seen := make(map[string]struct{})
+
+	for _, t := range attrs.getStrings("media-type-supported") {
+		t = ippNormalizeMediaType(t)
+		if _, dup := seen[t]; dup || t == "" {
+			continue
+		}
+
+		seen[t] = struct{}{}
+		types = append(types, t)
+	}
+
+	return types
+}
+
+// ippNormalizeMediaType normalizes media-type name, as reported
+// by device, into the PWG form: lower case, with words separated
+// by dash (i.e., "Photographic_Glossy" becomes "photographic-glossy")
+func ippNormalizeMediaType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	t = strings.Map(func(c rune) rune {
+		if c == '_' || c == ' ' {
+			return '-'
+		}
+		return c
+	}, t)
+
+	// Common misspelling of "stationery"
+	if t == "stationary" || strings.HasPrefix(t, "stationary-") {
+		t = "stationery" + t[len("stationary"):]
+	}
+
+	return t
+}
+
+// getPrintPath returns IPP print resource path, without leading
+// slash, taken from the first value of "printer-uri-supported"
+//
+// If attribute is missed or contains no usable path, ippPrintPath
+// is returned
+func (attrs ippAttrs) getPrintPath() string {
+	u, err := url.Parse(attrs.strSingle("printer-uri-supported"))
+	if err != nil {
+		return ippPrintPath
+	}
+
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		return ippPrintPath
+	}
+
+	return path
+}
+
+// getURISecurity returns security mechanism of the printer URI,
+// based on "uri-security-supported", decoded alongside with
+// "uri-authentication-supported" (see getAir): the first value
+// is used, as both attributes are parallel to "printer-uri-supported"
+//
+//   none       -> "none"
+//   tls, ssl3  -> "tls" (ssl3 is obsolete alias)
+//
+// Other values are returned as is, in lower case. If attribute
+// is missed, "" is returned
+func (attrs ippAttrs) getURISecurity() string {
+	sec := strings.ToLower(attrs.strSingle("uri-security-supported"))
+	if sec == "ssl3" {
+		sec = "tls"
+	}
+
+	return sec
+}
+
+// ippAirKnown tells if value is one of the "air" TXT values,
+// known to clients
+func ippAirKnown(air string) bool {
+	switch air {
+	case "none", "username,password", "certificate", "negotiate",
+		"oauth":
+		return true
+	}
+
+	return false
+}
+
 // getDuplex returns "T" if printer supports two-sided
 // printing, "F" if not and "" if it cant' tell
+//
+// Only the standard PWG keywords are recognized; unknown
+// values are ignored
 func (attrs ippAttrs) getDuplex() string {
 	vals := attrs.getAttr(goipp.TypeString, "sides-supported")
 	one, two := false, false
 	for _, v := range vals {
-		s := string(v.(goipp.String))
-		switch {
-		case strings.HasPrefix(s, "one"):
+		s := strings.ToLower(strings.TrimSpace(string(v.(goipp.String))))
+		switch s {
+		case "one-sided":
 			one = true
-		case strings.HasPrefix(s, "two"):
+		case "two-sided-long-edge", "two-sided-short-edge":
 			two = true
 		}
 	}
@@ -333,6 +1062,82 @@ func (attrs ippAttrs) getDuplex() string {
 	return ""
 }
 
+// getFinishings returns list of finishings, supported by printer,
+// decoded from "finishings-supported" enums into keyword names
+//
+// If attribute is missed, it returns nil
+func (attrs ippAttrs) getFinishings() []string {
+	vals := attrs.getAttr(goipp.TypeInteger, "finishings-supported")
+	if vals == nil {
+		return nil
+	}
+
+	names := make([]string, len(vals))
+	for i, v := range vals {
+		names[i] = ippEnumName(ippFinishingsNames, int(v.(goipp.Integer)))
+	}
+
+	return names
+}
+
+// getPrintQuality returns list of print qualities, supported by
+// printer, decoded from "print-quality-supported" enums into
+// keyword names ("draft", "normal", "high")
+//
+// Duplicates are removed. If attribute is missed, it returns
+// empty list
+func (attrs ippAttrs) getPrintQuality() []string {
+	names := []string{}
+	seen := make(map[int]struct{})
+
+	for _, v := range attrs.getAttr(goipp.TypeInteger,
+		"print-quality-supported") {
+
+		q := int(v.(goipp.Integer))
+		if _, dup := seen[q]; !dup {
+			seen[q] = struct{}{}
+			names = append(names, ippEnumName(ippPrintQualityNames, q))
+		}
+	}
+
+	return names
+}
+
+// ippOpSet represents a set of IPP operations
+type ippOpSet map[goipp.Op]struct{}
+
+// getOperations returns list of operations, supported by printer,
+// decoded from "operations-supported" enums. Duplicates are removed
+func (attrs ippAttrs) getOperations() []goipp.Op {
+	ops := []goipp.Op{}
+	seen := make(map[goipp.Op]struct{})
+
+	for _, v := range attrs.getAttr(goipp.TypeInteger,
+		"operations-supported") {
+
+		op := goipp.Op(v.(goipp.Integer))
+		if _, dup := seen[op]; !dup {
+			seen[op] = struct{}{}
+			ops = append(ops, op)
+		}
+	}
+
+	return ops
+}
+
+// ippFinishingsTxt returns "T" if list of finishing names contains
+// the specified kind of finishing (i.e., "staple" matches "staple"
+// and all "staple-xxx" finishings), "F" otherwise
+func ippFinishingsTxt(finishings []string, kind string) string {
+	for _, name := range finishings {
+		if name == kind || strings.HasPrefix(name, kind+"-") {
+			return "T"
+		}
+	}
+
+	return "F"
+}
+
 // getPaperMax returns max paper size, supported by printer
 //
 // According to Bonjour Printing Specification, Version 1.2.1,
@@ -367,28 +1172,14 @@ func (attrs ippAttrs) getPaperMax() string {
 		}
 
 		if len(x_dim_attr.Values) > 0 {
-			switch dim := x_dim_attr.Values[0].V.(type) {
-			case goipp.Integer:
-				if int(dim) > x_dim_max {
-					x_dim_max = int(dim)
-				}
-			case goipp.Range:
-				if int(dim.Upper) > x_dim_max {
-					x_dim_max = int(dim.Upper)
-				}
+			if dim := ippIntUpper(x_dim_attr.Values[0].V); dim > x_dim_max {
+				x_dim_max = dim
 			}
 		}
 
 		if len(y_dim_attr.Values) > 0 {
-			switch dim := y_dim_attr.Values[0].V.(type) {
-			case goipp.Integer:
-				if int(dim) > y_dim_max {
-					y_dim_max = int(dim)
-				}
-			case goipp.Range:
-				if int(dim.Upper) > y_dim_max {
-					y_dim_max = int(dim.Upper)
-				}
+			if dim := ippIntUpper(y_dim_attr.Values[0].V); dim > y_dim_max {
+				y_dim_max = dim
 			}
 		}
 	}
@@ -411,21 +1202,504 @@ func (attrs ippAttrs) strSingle(name string) string {
 	return strs[0]
 }
 
+// Get a single-integer attribute. Returns 0, if attribute is missed
+func (attrs ippAttrs) intSingle(name string) int {
+	vals := attrs.getAttr(goipp.TypeInteger, name)
+	if len(vals) == 0 {
+		return 0
+	}
+
+	return int(vals[0].(goipp.Integer))
+}
+
+// Get an upper bound of the rangeOfInteger attribute. Plain integer
+// is also accepted. Returns 0, if attribute is missed
+func (attrs ippAttrs) intUpper(name string) int {
+	v, ok := attrs[name]
+	if !ok {
+		return 0
+	}
+
+	return ippIntUpper(v[0].V)
+}
+
+// ippIntUpper returns an upper bound of the rangeOfInteger value,
+// or the value itself, if it is integer. Returns 0 for other types
+func ippIntUpper(v goipp.Value) int {
+	switch val := v.(type) {
+	case goipp.Integer:
+		return int(val)
+	case goipp.Range:
+		return val.Upper
+	}
+
+	return 0
+}
+
+// Get a single-string attribute with leading and trailing
+// spaces removed
+func (attrs ippAttrs) strTrimmed(name string) string {
+	return strings.TrimSpace(attrs.strSingle(name))
+}
+
 // Get a multi-string attribute, represented as a comma-separated list
 func (attrs ippAttrs) strJoined(name string) string {
 	strs := attrs.getStrings(name)
 	return strings.Join(strs, ",")
 }
 
-// Get a single string, and put it into brackets
-func (attrs ippAttrs) strBrackets(name string) string {
-	s := attrs.strSingle(name)
+// getBorderless detects borderless printing support from
+// the "media-{bottom,left,right,top}-margin-supported"
+//
+// Borderless printing is supported, if zero margin is supported
+// at all four sides. Returns "T" or "F", or empty string, if some
+// of these attributes is missed
+func (attrs ippAttrs) getBorderless() string {
+	borderless := "T"
+
+	for _, side := range []string{"bottom", "left", "right", "top"} {
+		vals := attrs.getAttr(goipp.TypeInteger,
+			"media-"+side+"-margin-supported")
+		if vals == nil {
+			return ""
+		}
+
+		zero := false
+		for _, v := range vals {
+			zero = zero || v.(goipp.Integer) == 0
+		}
+
+		if !zero {
+			borderless = "F"
+		}
+	}
+
+	return borderless
+}
+
+// getFirmware returns firmware versions, decoded from the
+// "printer-firmware-name" and "printer-firmware-string-version"
+//
+// These attributes are parallel lists, one entry per firmware
+// component, so each version is prefixed with the component name,
+// if it is known
+func (attrs ippAttrs) getFirmware() []string {
+	names := attrs.getStrings("printer-firmware-name")
+	versions := attrs.getStrings("printer-firmware-string-version")
+
+	firmware := []string{}
+	for i, version := range versions {
+		if i < len(names) && names[i] != "" {
+			version = names[i] + " " + version
+		}
+
+		firmware = append(firmware, version)
+	}
+
+	return firmware
+}
+
+// getFormatDetails returns "document-format-details-supported",
+// formatted for display
+//
+// Per IPP specification, it is the list of supported members of
+// the "document-format-details" collection, but some devices report
+// collections, describing each supported format (i.e., PDF versions)
+// instead. Both variants are handled
+func (attrs ippAttrs) getFormatDetails() []string {
+	details := []string{}
+	for _, v := range attrs["document-format-details-supported"] {
+		details = append(details, ippFormatValue(v.V))
+	}
+
+	return details
+}
+
+// getOutputTrays returns "printer-output-tray", formatted for
+// display as "name: state", one string per tray
+//
+// Each value is octetString, containing semicolon-separated
+// list of key=value pairs, as defined by PWG 5100.13 (i.e.,
+// "type=unRemovableBin;maxcapacity=150;remaining=0;status=0;
+// name=Face Down Tray;"). "remaining" is the remaining capacity
+// of the tray, so 0 means that tray is full
+func (attrs ippAttrs) getOutputTrays() []string {
+	trays := []string{}
+	for i, v := range attrs["printer-output-tray"] {
+		kv := ippParseKeyValues(ippOctets(v.V))
+
+		name := kv["name"]
+		if name == "" {
+			name = kv["type"]
+		}
+		if name == "" {
+			name = fmt.Sprintf("tray %d", i+1)
+		}
+
+		remaining, err1 := strconv.Atoi(kv["remaining"])
+		capacity, err2 := strconv.Atoi(kv["maxcapacity"])
+
+		state := "unknown"
+		switch {
+		case err1 != nil:
+		case remaining == 0:
+			state = "full"
+		case remaining == -3:
+			state = "not full"
+		case remaining > 0 && err2 == nil && capacity > 0:
+			state = fmt.Sprintf("%d of %d free", remaining, capacity)
+		case remaining > 0:
+			state = fmt.Sprintf("%d free", remaining)
+		}
+
+		// Status is the PrtSubUnitStatusTC bitmask (RFC 3805)
+		if status, err := strconv.Atoi(kv["status"]); err == nil {
+			if status&16 != 0 {
+				state += ", critical alert"
+			}
+			if status&32 != 0 {
+				state += ", offline"
+			}
+		}
+
+		trays = append(trays, name+": "+state)
+	}
+
+	return trays
+}
+
+// IppInputTray represents decoded "printer-input-tray" value
+type IppInputTray struct {
+	Name     string `json:"name,omitempty"`  // Tray name, or type, if name is not reported
+	Type     string `json:"type,omitempty"`  // Tray type, i.e., "sheetFeedAutoRemovableTray"
+	Media    string `json:"media,omitempty"` // Loaded media size, i.e., "210x297mm", "" if unknown
+	Capacity int    `json:"capacity"`        // Max capacity, negative if unknown
+	Level    int    `json:"level"`           // Current level, -2 if unknown, -3 if not empty
+	Status   int    `json:"status"`          // PrtSubUnitStatusTC bitmask (RFC 3805)
+}
+
+// String returns textual representation of IppInputTray, for display
+// as "name: media, level"
+func (tray IppInputTray) String() string {
+	state := "unknown"
+	switch {
+	case tray.Level == 0:
+		state = "empty"
+	case tray.Level == -3:
+		state = "not empty"
+	case tray.Level > 0 && tray.Capacity > 0:
+		state = fmt.Sprintf("%d of %d", tray.Level, tray.Capacity)
+	case tray.Level > 0:
+		state = fmt.Sprintf("%d", tray.Level)
+	}
+
+	if tray.Status&16 != 0 {
+		state += ", critical alert"
+	}
+	if tray.Status&32 != 0 {
+		state += ", offline"
+	}
+
+	if tray.Media != "" {
+		state = tray.Media + ", " + state
+	}
+
+	return tray.Name + ": " + state
+}
+
+// getInputTrays returns decoded "printer-input-tray"
+//
+// The encoding is the same as of "printer-output-tray" (see
+// getOutputTrays), but the tray state is reported as "level"
+// (i.e., amount of loaded media) and loaded media size is reported
+// as "mediafeed" and "mediaxfeed" dimensions, in "dimunit" units
+func (attrs ippAttrs) getInputTrays() []IppInputTray {
+	trays := []IppInputTray{}
+	for i, v := range attrs["printer-input-tray"] {
+		kv := ippParseKeyValues(ippOctets(v.V))
+
+		tray := IppInputTray{
+			Name:     kv["name"],
+			Type:     kv["type"],
+			Capacity: -2,
+			Level:    -2,
+		}
+
+		if tray.Name == "" {
+			tray.Name = tray.Type
+		}
+		if tray.Name == "" {
+			tray.Name = fmt.Sprintf("tray %d", i+1)
+		}
+
+		if n, err := strconv.Atoi(kv["maxcapacity"]); err == nil {
+			tray.Capacity = n
+		}
+		if n, err := strconv.Atoi(kv["level"]); err == nil {
+			tray.Level = n
+		}
+		if n, err := strconv.Atoi(kv["status"]); err == nil {
+			tray.Status = n
+		}
+
+		feed, err1 := strconv.Atoi(kv["mediafeed"])
+		xfeed, err2 := strconv.Atoi(kv["mediaxfeed"])
+		if err1 == nil && err2 == nil && feed > 0 && xfeed > 0 {
+			tray.Media = ippFormatTrayMedia(xfeed, feed, kv["dimunit"])
+		}
+
+		trays = append(trays, tray)
+	}
+
+	return trays
+}
+
+// ippFormatTrayMedia formats media dimensions, reported by
+// "printer-input-tray", as "WxHmm" or "WxHin"
+func ippFormatTrayMedia(width, height int, unit string) string {
+	switch strings.ToLower(unit) {
+	case "micrometers":
+		return fmt.Sprintf("%dx%dmm", (width+500)/1000, (height+500)/1000)
+	case "tenthousandthsofinches":
+		return strconv.FormatFloat(float64(width)/10000, 'f', -1, 64) +
+			"x" +
+			strconv.FormatFloat(float64(height)/10000, 'f', -1, 64) +
+			"in"
+	}
+
+	return ""
+}
+
+// ippOctets returns content of the octetString (or string)
+// IPP value
+func ippOctets(v goipp.Value) string {
+	switch v := v.(type) {
+	case goipp.Binary:
+		return string(v)
+	case goipp.String:
+		return string(v)
+	}
+
+	return ""
+}
+
+// ippParseKeyValues parses semicolon-separated list of key=value
+// pairs, used by printer-output-tray and similar attributes
+func ippParseKeyValues(s string) map[string]string {
+	kv := make(map[string]string)
+	for _, item := range strings.Split(s, ";") {
+		if i := strings.IndexByte(item, '='); i > 0 {
+			key := strings.ToLower(strings.TrimSpace(item[:i]))
+			kv[key] = strings.TrimSpace(item[i+1:])
+		}
+	}
+
+	return kv
+}
+
+// ippFormatValue formats IPP value for display. Collections are
+// formatted as "{name=value name=value1|value2}"
+func ippFormatValue(v goipp.Value) string {
+	col, ok := v.(goipp.Collection)
+	if !ok {
+		return v.String()
+	}
+
+	members := make([]string, 0, len(col))
+	for _, attr := range col {
+		vals := make([]string, len(attr.Values))
+		for i := range attr.Values {
+			vals[i] = ippFormatValue(attr.Values[i].V)
+		}
+		members = append(members, attr.Name+"="+strings.Join(vals, "|"))
+	}
+
+	return "{" + strings.Join(members, " ") + "}"
+}
+
+// ippRawFormats contains document formats, used for raw printing
+var ippRawFormats = map[string]bool{
+	"application/octet-stream": true,
+}
+
+// getPDL returns value of the "pdl" TXT item
+//
+// Clients tend to choose the first suitable format from the list,
+// and PWG-raster jobs are much larger that PDF, so if configured,
+// "application/pdf" is moved to the front of the list. This also
+// protects it from being dropped, if list needs to be truncated
+//
+// If device reports "pdl-override-supported" as "not-attempted",
+// raw formats (see ippRawFormats) are not advertised: such device
+// doesn't enforce job attributes over the document content, so
+// "print as raw" gives unpredictable results
+func (attrs ippAttrs) getPDL() string {
+	pdl := attrs.getStrings("document-format-supported")
+
+	if attrs.strSingle("pdl-override-supported") == "not-attempted" {
+		out := 0
+		for _, format := range pdl {
+			if !ippRawFormats[format] {
+				pdl[out] = format
+				out++
+			}
+		}
+		pdl = pdl[:out]
+	}
+
+	if Conf.IppPreferPDF {
+		for i, format := range pdl {
+			if i > 0 && format == "application/pdf" {
+				copy(pdl[1:i+1], pdl[:i])
+				pdl[0] = format
+				break
+			}
+		}
+	}
+
+	return strings.Join(pdl, ",")
+}
+
+// getURF returns value of the "URF" TXT item. If device doesn't
+// report "urf-supported", devidURF, taken from the IEEE 1284 device
+// ID, is used instead
+//
+// If configured, and URF lacks resolution (the RSxxx token), it
+// is taken from "pwg-raster-document-resolution-supported", so
+// clients will not guess a resolution, unsupported by device
+func (attrs ippAttrs) getURF(devidURF string) string {
+	urf := attrs.strJoined("urf-supported")
+	if urf == "" {
+		urf = devidURF
+	}
+
+	if urf == "" || !Conf.IppURFFixRes {
+		return urf
+	}
+
+	for _, token := range strings.Split(urf, ",") {
+		if strings.HasPrefix(token, "RS") {
+			return urf
+		}
+	}
+
+	var res []int
+	for _, v := range attrs.getAttr(goipp.TypeResolution,
+		"pwg-raster-document-resolution-supported") {
+		r := v.(goipp.Resolution)
+		if r.Units == goipp.UnitsDpi && r.Xres == r.Yres && r.Xres > 0 {
+			res = append(res, r.Xres)
+		}
+	}
+
+	if len(res) == 0 {
+		return urf
+	}
+
+	sort.Ints(res)
+
+	rs := "RS" + strconv.Itoa(res[0])
+	for i := 1; i < len(res); i++ {
+		if res[i] != res[i-1] {
+			rs += "-" + strconv.Itoa(res[i])
+		}
+	}
+
+	return urf + "," + rs
+}
+
+// getProduct returns value of the "product" TXT item
+func (attrs ippAttrs) getProduct() string {
+	s := attrs.strSingle("printer-make-and-model")
+	if Conf.IppProductNorm {
+		s = ippNormalizeProduct(s)
+	}
+
 	if s != "" {
 		s = "(" + s + ")"
 	}
 	return s
 }
 
+// ippNormalizeProduct normalizes printer make and model for use
+// in the "product" TXT item, so clients can reliably match it
+// against their drivers database:
+//   - nested round brackets are removed
+//   - sequences of whitespace are collapsed into single space
+//   - trailing firmware version (i.e., "Ver 1.02", "FW:1.05",
+//     "v2.10") is removed
+func ippNormalizeProduct(s string) string {
+	s = strings.Map(func(c rune) rune {
+		if c == '(' || c == ')' {
+			return ' '
+		}
+		return c
+	}, s)
+
+	fields := strings.Fields(s)
+
+	for len(fields) > 1 {
+		last := strings.ToLower(fields[len(fields)-1])
+
+		// "Ver 1.02", "Firmware 1.05" and so on
+		if len(fields) > 2 && ippIsFirmwareVersion(last) &&
+			ippIsFirmwareKeyword(fields[len(fields)-2]) {
+			fields = fields[:len(fields)-2]
+			continue
+		}
+
+		// "FW:1.05", "Ver.1.02" and so on
+		if i := strings.IndexAny(last, ":=."); i > 0 &&
+			ippIsFirmwareKeyword(last[:i]) &&
+			ippIsFirmwareVersion(last[i+1:]) {
+			fields = fields[:len(fields)-1]
+			continue
+		}
+
+		// "v2.10"
+		if len(last) > 1 && last[0] == 'v' &&
+			strings.IndexByte(last, '.') > 0 &&
+			strings.Trim(last[1:], "0123456789.") == "" {
+			fields = fields[:len(fields)-1]
+			continue
+		}
+
+		break
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// ippIsFirmwareKeyword tells if word introduces firmware version
+func ippIsFirmwareKeyword(word string) bool {
+	switch strings.TrimSuffix(strings.ToLower(word), ".") {
+	case "ver", "version", "fw", "firmware", "rev":
+		return true
+	}
+	return false
+}
+
+// ippIsFirmwareVersion tells if word looks like firmware version:
+// it starts with digit and contains only digits, letters, dots,
+// dashes and underscores
+func ippIsFirmwareVersion(word string) bool {
+	if word == "" || word[0] < '0' || word[0] > '9' {
+		return false
+	}
+
+	for _, c := range word {
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c == '.' || c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
 // Get attribute's []string value by attribute name
 func (attrs ippAttrs) getStrings(name string) []string {
 	vals := attrs.getAttr(goipp.TypeString, name)
@@ -437,6 +1711,19 @@ func (attrs ippAttrs) getStrings(name string) []string {
 	return strs
 }
 
+// Get attribute's []string value by attribute name, with leading
+// and trailing spaces removed. Empty strings are skipped
+func (attrs ippAttrs) getTexts(name string) []string {
+	var strs []string
+	for _, s := range attrs.getStrings(name) {
+		if s = strings.TrimSpace(s); s != "" {
+			strs = append(strs, s)
+		}
+	}
+
+	return strs
+}
+
 // Get boolean attribute. Returns "F" or "T" if attribute is found,
 // empty string otherwise.
 func (attrs ippAttrs) getBool(name string) string {
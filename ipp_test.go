@@ -0,0 +1,1759 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP attributes decoding
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Make ippAttrs from the list of printer attributes
+func testIppAttrs(attrs ...goipp.Attribute) ippAttrs {
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	msg.Printer = attrs
+	return newIppDecoder(msg)
+}
+
+// Make attribute with multiple enum values
+func testIppEnums(name string, values ...int) goipp.Attribute {
+	attr := goipp.Attribute{Name: name}
+	for _, v := range values {
+		attr.Values.Add(goipp.TagEnum, goipp.Integer(v))
+	}
+	return attr
+}
+
+// Lookup TXT record value by key
+func testTxtLookup(txt DNSSdTxtRecord, key string) (string, bool) {
+	for _, item := range txt {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return "", false
+}
+
+// Test decoding of "finishings-supported"
+func TestIppDecodeFinishings(t *testing.T) {
+	attrs := testIppAttrs(testIppEnums("finishings-supported",
+		3, 4, 5, 28, 74, 1000))
+
+	ippinfo, svc := attrs.decode(UsbDeviceInfo{})
+
+	expected := []string{"none", "staple", "punch",
+		"staple-dual-left", "punch-dual-left", "1000"}
+
+	if !reflect.DeepEqual(ippinfo.Finishings, expected) {
+		t.Errorf("finishings: expected %q, got %q",
+			expected, ippinfo.Finishings)
+	}
+
+	for key, value := range map[string]string{
+		"Bind": "F", "Punch": "T", "Staple": "T"} {
+
+		v, found := testTxtLookup(svc.Txt, key)
+		if !found || v != value {
+			t.Errorf("TXT %s: expected %q, got %q", key, value, v)
+		}
+	}
+
+	// Attribute missed: TXT keys must be omitted
+	ippinfo, svc = testIppAttrs().decode(UsbDeviceInfo{})
+	if ippinfo.Finishings != nil {
+		t.Errorf("finishings: expected nil, got %q", ippinfo.Finishings)
+	}
+
+	if _, found := testTxtLookup(svc.Txt, "Staple"); found {
+		t.Errorf("TXT Staple: must be omitted")
+	}
+}
+
+// Test "qtotal" and "priority" for multi-queue devices
+func TestIppSetQueues(t *testing.T) {
+	// Single queue: TXT record must remain unchanged
+	_, svc := testIppAttrs().decode(UsbDeviceInfo{})
+	saved := append(DNSSdTxtRecord(nil), svc.Txt...)
+
+	ippSetQueues([]*DNSSdSvcInfo{&svc})
+	if !reflect.DeepEqual(svc.Txt, saved) {
+		t.Errorf("single queue: TXT record changed:\n%v\n%v",
+			saved, svc.Txt)
+	}
+
+	// Two queues
+	_, svc1 := testIppAttrs().decode(UsbDeviceInfo{})
+	_, svc2 := testIppAttrs().decode(UsbDeviceInfo{})
+	ippSetQueues([]*DNSSdSvcInfo{&svc1, &svc2})
+
+	tests := []struct {
+		svc      DNSSdSvcInfo
+		priority string
+	}{
+		{svc1, "50"},
+		{svc2, "51"},
+	}
+
+	for i, test := range tests {
+		qtotal, _ := testTxtLookup(test.svc.Txt, "qtotal")
+		if qtotal != "2" {
+			t.Errorf("queue %d: qtotal: expected %q, got %q",
+				i, "2", qtotal)
+		}
+
+		priority, _ := testTxtLookup(test.svc.Txt, "priority")
+		if priority != test.priority {
+			t.Errorf("queue %d: priority: expected %q, got %q",
+				i, test.priority, priority)
+		}
+
+		if len(test.svc.Txt) != len(saved) {
+			t.Errorf("queue %d: TXT record size changed", i)
+		}
+	}
+}
+
+// Test IPP services of the device with two queues
+func TestIppServiceQueues(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			rq := &goipp.Message{}
+			rq.DecodeBytes(data)
+
+			if r.URL.Path != "/ipp/print" &&
+				r.URL.Path != "/ipp/print2" {
+				http.NotFound(w, r)
+				return
+			}
+
+			rsp := goipp.NewResponse(rq.Version, goipp.StatusOk,
+				rq.RequestID)
+			rsp.Printer.Add(goipp.MakeAttribute(
+				"printer-uri-supported", goipp.TagURI,
+				goipp.String("ipp://localhost"+r.URL.Path)))
+			rsp.Printer.Add(goipp.MakeAttribute(
+				"printer-dns-sd-name", goipp.TagName,
+				goipp.String("Printer")))
+
+			w.Header().Set("Content-Type", goipp.ContentType)
+			rsp.Encode(w)
+		}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	quirks := QuirksSet{&Quirks{IppQueues: []string{"/ipp/print2"}}}
+
+	var services DNSSdServices
+	ippinfo, err := IppService(log, &services, port, UsbDeviceInfo{},
+		quirks, nil, srv.Client())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	queues := DNSSdServices{}
+	for _, svc := range services {
+		if svc.Type == "_ipp._tcp" {
+			queues = append(queues, svc)
+		}
+	}
+
+	if len(queues) != 2 {
+		t.Fatalf("expected 2 IPP services, got %d", len(queues))
+	}
+
+	if services[ippinfo.IppSvcIndex].InstanceSuffix != "" {
+		t.Errorf("IppSvcIndex doesn't refer the main queue")
+	}
+
+	tests := []struct {
+		rp, priority, suffix string
+	}{
+		{"ipp/print", "50", ""},
+		{"ipp/print2", "51", " (ipp/print2)"},
+	}
+
+	for i, test := range tests {
+		svc := queues[i]
+		for key, value := range map[string]string{
+			"rp":       test.rp,
+			"priority": test.priority,
+			"qtotal":   "2",
+		} {
+			v, _ := testTxtLookup(svc.Txt, key)
+			if v != value {
+				t.Errorf("queue %d: TXT %s: expected %q, got %q",
+					i, key, value, v)
+			}
+		}
+
+		if svc.InstanceSuffix != test.suffix ||
+			svc.Port != port {
+			t.Errorf("queue %d: unexpected %+v", i, svc)
+		}
+	}
+
+	// Queue, that doesn't respond, is skipped
+	quirks[0].IppQueues = []string{"/ipp/print2", "/ipp/missed"}
+
+	services = nil
+	_, err = IppService(log, &services, port, UsbDeviceInfo{},
+		quirks, nil, srv.Client())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if n := len(services); n != 3 {
+		t.Errorf("expected 3 services, got %d", n)
+	}
+}
+
+// Test ippNewRequest
+func TestIppNewRequest(t *testing.T) {
+	const uri = "http://localhost:60000/ipp/print"
+
+	// Common attributes only
+	msg := ippNewRequest(goipp.OpGetJobs, uri)
+	expected := []string{
+		"attributes-charset=" + ippDefaultCharset,
+		"attributes-natural-language=" + ippDefaultLanguage,
+		"printer-uri=" + uri,
+	}
+
+	check := func(name string) {
+		var attrs []string
+		for _, attr := range msg.Operation {
+			attrs = append(attrs, attr.Name+"="+attr.Values.String())
+		}
+
+		if !reflect.DeepEqual(attrs, expected) {
+			t.Errorf("%s: expected %q, got %q", name, expected, attrs)
+		}
+
+		if goipp.Op(msg.Code) != goipp.OpGetJobs ||
+			msg.Version != goipp.DefaultVersion {
+			t.Errorf("%s: unexpected %s %s", name,
+				goipp.Op(msg.Code), msg.Version)
+		}
+	}
+
+	check("common")
+
+	// Common attribute replaced in place, others appended
+	msg = ippNewRequest(goipp.OpGetJobs, uri,
+		goipp.MakeAttribute("attributes-charset",
+			goipp.TagCharset, goipp.String("us-ascii")),
+		goipp.MakeAttribute("requesting-user-name",
+			goipp.TagName, goipp.String("ipp-usb")))
+
+	expected = []string{
+		"attributes-charset=us-ascii",
+		"attributes-natural-language=" + ippDefaultLanguage,
+		"printer-uri=" + uri,
+		"requesting-user-name=ipp-usb",
+	}
+
+	check("replaced")
+}
+
+// Test fallback to the IPP resource path, reported by device
+// before, if device doesn't serve the default path
+func TestIppServicePrintPath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			rq := &goipp.Message{}
+			rq.DecodeBytes(data)
+
+			if r.URL.Path != "/ipp/printer" {
+				http.NotFound(w, r)
+				return
+			}
+
+			rsp := goipp.NewResponse(rq.Version, goipp.StatusOk,
+				rq.RequestID)
+			rsp.Printer.Add(goipp.MakeAttribute(
+				"printer-uri-supported", goipp.TagURI,
+				goipp.String("ipp://localhost/ipp/printer")))
+
+			w.Header().Set("Content-Type", goipp.ContentType)
+			rsp.Encode(w)
+		}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	// Path is not known yet
+	state := &DevState{IppVersion: goipp.DefaultVersion}
+
+	var services DNSSdServices
+	_, err := IppService(log, &services, port, UsbDeviceInfo{},
+		nil, state, srv.Client())
+	if err == nil {
+		t.Errorf("unknown path: expected error")
+	}
+
+	// Path is known from the previous query
+	state.PrintPath = "ipp/printer"
+
+	ippinfo, err := IppService(log, &services, port, UsbDeviceInfo{},
+		nil, state, srv.Client())
+	if err != nil {
+		t.Fatalf("known path: %s", err)
+	}
+
+	if ippinfo.PrintPath != "ipp/printer" {
+		t.Errorf("PrintPath: expected %q, got %q",
+			"ipp/printer", ippinfo.PrintPath)
+	}
+}
+
+// Test IppDecodePrinterAttributes
+func TestIppDecodePrinterAttributes(t *testing.T) {
+	usbinfo := UsbDeviceInfo{
+		Vendor:        0x03f0,
+		Product:       0x0001,
+		SerialNumber:  "SN0001",
+		MfgAndProduct: "HP LaserJet",
+	}
+
+	// Empty response: everything comes from UsbDeviceInfo
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	ippinfo, svc := IppDecodePrinterAttributes(msg, usbinfo)
+
+	if ippinfo.DNSSdName != usbinfo.MfgAndProduct {
+		t.Errorf("DNSSdName: expected %q, got %q",
+			usbinfo.MfgAndProduct, ippinfo.DNSSdName)
+	}
+
+	if ippinfo.UUID != usbinfo.UUID() {
+		t.Errorf("UUID: expected %q, got %q",
+			usbinfo.UUID(), ippinfo.UUID)
+	}
+
+	if svc.Type != "_ipp._tcp" {
+		t.Errorf("Type: expected %q, got %q", "_ipp._tcp", svc.Type)
+	}
+
+	// printer-info takes precedence over printer-make-and-model
+	msg.Printer.Add(goipp.MakeAttribute("printer-make-and-model",
+		goipp.TagText, goipp.String("HP LaserJet MFP M28w")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-info",
+		goipp.TagText, goipp.String("Office printer")))
+
+	ippinfo, svc = IppDecodePrinterAttributes(msg, usbinfo)
+	if ippinfo.DNSSdName != "Office printer" {
+		t.Errorf("DNSSdName: expected %q, got %q",
+			"Office printer", ippinfo.DNSSdName)
+	}
+
+	ty, _ := testTxtLookup(svc.Txt, "ty")
+	if ty != "HP LaserJet MFP M28w" {
+		t.Errorf("TXT ty: expected %q, got %q",
+			"HP LaserJet MFP M28w", ty)
+	}
+}
+
+// Test decoding of "pages-per-minute" and "pages-per-minute-color"
+func TestIppDecodePPM(t *testing.T) {
+	attrs := testIppAttrs(
+		goipp.MakeAttribute("pages-per-minute",
+			goipp.TagInteger, goipp.Integer(20)),
+		goipp.MakeAttribute("pages-per-minute-color",
+			goipp.TagInteger, goipp.Integer(12)),
+	)
+
+	ippinfo, _ := attrs.decode(UsbDeviceInfo{})
+	if ippinfo.PPM != 20 || ippinfo.PPMColor != 12 {
+		t.Errorf("expected 20/12, got %d/%d",
+			ippinfo.PPM, ippinfo.PPMColor)
+	}
+
+	// Missed attributes
+	ippinfo, _ = testIppAttrs().decode(UsbDeviceInfo{})
+	if ippinfo.PPM != 0 || ippinfo.PPMColor != 0 {
+		t.Errorf("expected 0/0, got %d/%d",
+			ippinfo.PPM, ippinfo.PPMColor)
+	}
+
+	// Wrong type must be ignored
+	attrs = testIppAttrs(goipp.MakeAttribute("pages-per-minute",
+		goipp.TagText, goipp.String("20")))
+	ippinfo, _ = attrs.decode(UsbDeviceInfo{})
+	if ippinfo.PPM != 0 {
+		t.Errorf("expected 0, got %d", ippinfo.PPM)
+	}
+}
+
+// Test Duplex decoding from "sides-supported"
+func TestIppDecodeDuplex(t *testing.T) {
+	tests := []struct {
+		sides  []string
+		duplex string
+	}{
+		{nil, ""},
+		{[]string{"one-sided"}, "F"},
+		{[]string{"one-sided", "two-sided-long-edge",
+			"two-sided-short-edge"}, "T"},
+		{[]string{"two-sided-long-edge"}, "T"},
+		{[]string{"two-sided-short-edge"}, "T"},
+		{[]string{"One-Sided", "Two-Sided-Long-Edge"}, "T"},
+		{[]string{"one-sided", "twofold"}, "F"},
+		{[]string{"one", "two"}, ""},
+		{[]string{"bogus"}, ""},
+	}
+
+	for _, test := range tests {
+		var attrs ippAttrs
+		if test.sides == nil {
+			attrs = testIppAttrs()
+		} else {
+			attr := goipp.Attribute{Name: "sides-supported"}
+			for _, s := range test.sides {
+				attr.Values.Add(goipp.TagKeyword, goipp.String(s))
+			}
+			attrs = testIppAttrs(attr)
+		}
+
+		duplex := attrs.getDuplex()
+		if duplex != test.duplex {
+			t.Errorf("%q: expected %q, got %q",
+				test.sides, test.duplex, duplex)
+		}
+
+		_, svc := attrs.decode(UsbDeviceInfo{})
+		v, _ := testTxtLookup(svc.Txt, "Duplex")
+		if v != test.duplex {
+			t.Errorf("%q: TXT Duplex: expected %q, got %q",
+				test.sides, test.duplex, v)
+		}
+	}
+}
+
+// Test decoding of "copies-supported"
+func TestIppDecodeCopies(t *testing.T) {
+	tests := []struct {
+		attrs  ippAttrs
+		max    int
+		copies string
+	}{
+		{testIppAttrs(), 0, ""},
+		{testIppAttrs(goipp.MakeAttribute("copies-supported",
+			goipp.TagRange, goipp.Range{Lower: 1, Upper: 999})),
+			999, "T"},
+		{testIppAttrs(goipp.MakeAttribute("copies-supported",
+			goipp.TagRange, goipp.Range{Lower: 1, Upper: 1})),
+			1, "F"},
+		{testIppAttrs(goipp.MakeAttribute("copies-supported",
+			goipp.TagInteger, goipp.Integer(99))),
+			99, "T"},
+		{testIppAttrs(goipp.MakeAttribute("copies-supported",
+			goipp.TagText, goipp.String("99"))),
+			0, ""},
+	}
+
+	for i, test := range tests {
+		ippinfo, svc := test.attrs.decode(UsbDeviceInfo{})
+		if ippinfo.CopiesMax != test.max {
+			t.Errorf("%d: expected %d, got %d",
+				i, test.max, ippinfo.CopiesMax)
+		}
+
+		v, _ := testTxtLookup(svc.Txt, "Copies")
+		if v != test.copies {
+			t.Errorf("%d: TXT Copies: expected %q, got %q",
+				i, test.copies, v)
+		}
+	}
+}
+
+// Test "air" decoding from "uri-authentication-supported"
+func TestIppDecodeAir(t *testing.T) {
+	tests := []struct {
+		auth []string
+		air  string
+	}{
+		{nil, "none"},
+		{[]string{"none"}, "none"},
+		{[]string{"requesting-user-name"}, "none"},
+		{[]string{"basic"}, "username,password"},
+		{[]string{"digest"}, "username,password"},
+		{[]string{"certificate"}, "certificate"},
+		{[]string{"negotiate"}, "negotiate"},
+		{[]string{"basic", "none"}, "username,password"},
+		{[]string{"unknown"}, "none"},
+	}
+
+	for _, test := range tests {
+		var attrs ippAttrs
+		if test.auth == nil {
+			attrs = testIppAttrs()
+		} else {
+			attr := goipp.Attribute{Name: "uri-authentication-supported"}
+			for _, s := range test.auth {
+				attr.Values.Add(goipp.TagKeyword, goipp.String(s))
+			}
+			attrs = testIppAttrs(attr)
+		}
+
+		_, svc := attrs.decode(UsbDeviceInfo{})
+		v, _ := testTxtLookup(svc.Txt, "air")
+		if v != test.air {
+			t.Errorf("%q: expected %q, got %q", test.auth, test.air, v)
+		}
+	}
+}
+
+// Test "uri-security-supported" decoding
+func TestIppDecodeURISecurity(t *testing.T) {
+	tests := []struct {
+		sec      []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"none"}, "none"},
+		{[]string{"tls"}, "tls"},
+		{[]string{"ssl3"}, "tls"},
+		{[]string{"TLS"}, "tls"},
+		{[]string{"tls", "none"}, "tls"},
+		{[]string{"none", "tls"}, "none"},
+	}
+
+	for _, test := range tests {
+		var attrs ippAttrs
+		if test.sec == nil {
+			attrs = testIppAttrs()
+		} else {
+			attr := goipp.Attribute{Name: "uri-security-supported"}
+			for _, s := range test.sec {
+				attr.Values.Add(goipp.TagKeyword, goipp.String(s))
+			}
+			attrs = testIppAttrs(attr)
+		}
+
+		ippinfo, svc := attrs.decode(UsbDeviceInfo{})
+		if ippinfo.URISecurity != test.expected {
+			t.Errorf("%q: expected %q, got %q",
+				test.sec, test.expected, ippinfo.URISecurity)
+		}
+
+		if _, found := testTxtLookup(svc.Txt, "TLS"); found {
+			t.Errorf("%q: TLS must not be advertised", test.sec)
+		}
+	}
+}
+
+// Test "air" override
+func TestIppDecodeAirOverride(t *testing.T) {
+	save := Conf.IppAirOverride
+	defer func() { Conf.IppAirOverride = save }()
+
+	attr := goipp.MakeAttribute("uri-authentication-supported",
+		goipp.TagKeyword, goipp.String("basic"))
+
+	for _, air := range []string{"none", "certificate", "custom"} {
+		Conf.IppAirOverride = air
+		_, svc := testIppAttrs(attr).decode(UsbDeviceInfo{})
+		v, _ := testTxtLookup(svc.Txt, "air")
+		if v != air {
+			t.Errorf("%q: got %q", air, v)
+		}
+	}
+
+	Conf.IppAirOverride = confAirOverride("auto")
+	_, svc := testIppAttrs(attr).decode(UsbDeviceInfo{})
+	v, _ := testTxtLookup(svc.Txt, "air")
+	if v != "username,password" {
+		t.Errorf("auto: got %q", v)
+	}
+}
+
+// Test configurable DNS-SD name sources
+func TestIppDecodeDNSSdName(t *testing.T) {
+	saved := Conf.IppDNSSdNameAttrs
+	defer func() { Conf.IppDNSSdNameAttrs = saved }()
+
+	attrs := testIppAttrs(
+		goipp.MakeAttribute("printer-info",
+			goipp.TagText, goipp.String("Office printer")),
+		goipp.MakeAttribute("printer-make-and-model",
+			goipp.TagText, goipp.String("Kyocera ECOSYS M2040dn")),
+	)
+	usbinfo := UsbDeviceInfo{MfgAndProduct: "Kyocera M2040dn"}
+
+	tests := []struct {
+		names []string
+		name  string
+	}{
+		{ippDNSSdNameAttrsDefault, "Office printer"},
+		{[]string{"printer-make-and-model", "printer-info"},
+			"Kyocera ECOSYS M2040dn"},
+		{[]string{"printer-name"}, "Kyocera M2040dn"},
+	}
+
+	for _, test := range tests {
+		Conf.IppDNSSdNameAttrs = test.names
+		ippinfo, _ := attrs.decode(usbinfo)
+		if ippinfo.DNSSdName != test.name {
+			t.Errorf("%q: expected %q, got %q",
+				test.names, test.name, ippinfo.DNSSdName)
+		}
+	}
+}
+
+// Test decoding of "print-scaling-supported" and "media-col-supported"
+func TestIppDecodeScalingMediaCol(t *testing.T) {
+	scaling := goipp.Attribute{Name: "print-scaling-supported"}
+	for _, s := range []string{"auto", "fill", "fit", "none"} {
+		scaling.Values.Add(goipp.TagKeyword, goipp.String(s))
+	}
+
+	mediaCol := goipp.Attribute{Name: "media-col-supported"}
+	for _, s := range []string{"media-size", "media-source", "media-type"} {
+		mediaCol.Values.Add(goipp.TagKeyword, goipp.String(s))
+	}
+
+	ippinfo, _ := testIppAttrs(scaling, mediaCol).decode(UsbDeviceInfo{})
+	if !reflect.DeepEqual(ippinfo.PrintScaling,
+		[]string{"auto", "fill", "fit", "none"}) {
+		t.Errorf("print-scaling: got %q", ippinfo.PrintScaling)
+	}
+	if !reflect.DeepEqual(ippinfo.MediaCol,
+		[]string{"media-size", "media-source", "media-type"}) {
+		t.Errorf("media-col: got %q", ippinfo.MediaCol)
+	}
+
+	// Missed attributes
+	ippinfo, _ = testIppAttrs().decode(UsbDeviceInfo{})
+	if len(ippinfo.PrintScaling) != 0 || len(ippinfo.MediaCol) != 0 {
+		t.Errorf("expected empty, got %q, %q",
+			ippinfo.PrintScaling, ippinfo.MediaCol)
+	}
+}
+
+// Test normalization of the "product" TXT item
+func TestIppNormalizeProduct(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"HP LaserJet  Pro\tM404dn ", "HP LaserJet Pro M404dn"},
+		{"Brother HL-L2350DW series Ver 1.02",
+			"Brother HL-L2350DW series"},
+		{"EPSON ET-2750 Series FW:1.05", "EPSON ET-2750 Series"},
+		{"Canon MF640C v2.10", "Canon MF640C"},
+		{"Kyocera ECOSYS M2040dn (KPDL)", "Kyocera ECOSYS M2040dn KPDL"},
+		{"Xerox B210 Firmware 1.0.3-build_7 Rev. 2a",
+			"Xerox B210"},
+		{"Samsung M2070 Series", "Samsung M2070 Series"},
+		{"Version 2.0", "Version 2.0"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		out := ippNormalizeProduct(test.in)
+		if out != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, out)
+		}
+	}
+
+	saved := Conf.IppProductNorm
+	defer func() { Conf.IppProductNorm = saved }()
+
+	attrs := testIppAttrs(goipp.MakeAttribute("printer-make-and-model",
+		goipp.TagText, goipp.String("Canon  MF640C v2.10")))
+
+	for _, norm := range []bool{false, true} {
+		Conf.IppProductNorm = norm
+		expected := "(Canon  MF640C v2.10)"
+		if norm {
+			expected = "(Canon MF640C)"
+		}
+
+		_, svc := attrs.decode(UsbDeviceInfo{})
+		product, _ := testTxtLookup(svc.Txt, "product")
+		if product != expected {
+			t.Errorf("normalize=%v: expected %q, got %q",
+				norm, expected, product)
+		}
+	}
+}
+
+// Test decoding of "job-k-octets-supported" and "jpeg-k-octets-supported"
+func TestIppDecodeKOctets(t *testing.T) {
+	ippinfo, _ := testIppAttrs(
+		goipp.MakeAttribute("job-k-octets-supported",
+			goipp.TagRange, goipp.Range{Lower: 0, Upper: 2097152}),
+		goipp.MakeAttribute("jpeg-k-octets-supported",
+			goipp.TagInteger, goipp.Integer(16384)),
+	).decode(UsbDeviceInfo{})
+
+	if ippinfo.JobKOctetsMax != 2097152 {
+		t.Errorf("job-k-octets: expected %d, got %d",
+			2097152, ippinfo.JobKOctetsMax)
+	}
+
+	if ippinfo.JpegKOctetsMax != 16384 {
+		t.Errorf("jpeg-k-octets: expected %d, got %d",
+			16384, ippinfo.JpegKOctetsMax)
+	}
+
+	// Missed attributes
+	ippinfo, _ = testIppAttrs().decode(UsbDeviceInfo{})
+	if ippinfo.JobKOctetsMax != 0 || ippinfo.JpegKOctetsMax != 0 {
+		t.Errorf("expected zero, got %d, %d",
+			ippinfo.JobKOctetsMax, ippinfo.JpegKOctetsMax)
+	}
+}
+
+// Test decoding of "printer-mandatory-job-attributes"
+func TestIppDecodeJobMandatory(t *testing.T) {
+	attr := goipp.Attribute{Name: "printer-mandatory-job-attributes"}
+	attr.Values.Add(goipp.TagKeyword, goipp.String("media"))
+	attr.Values.Add(goipp.TagKeyword, goipp.String("sides"))
+
+	ippinfo, _ := testIppAttrs(attr).decode(UsbDeviceInfo{})
+
+	expected := []string{"media", "sides"}
+	if !reflect.DeepEqual(ippinfo.JobMandatory, expected) {
+		t.Errorf("expected %q, got %q", expected, ippinfo.JobMandatory)
+	}
+
+	var buf bytes.Buffer
+	statusFormatIppInfo(&buf, ippinfo)
+	if !strings.Contains(buf.String(),
+		"job-mandatory-attributes: media,sides\n") {
+		t.Errorf("status:\n%s", buf.String())
+	}
+
+	// Omitted when absent
+	ippinfo, _ = testIppAttrs().decode(UsbDeviceInfo{})
+	if len(ippinfo.JobMandatory) != 0 {
+		t.Errorf("absent: got %q", ippinfo.JobMandatory)
+	}
+
+	buf.Reset()
+	statusFormatIppInfo(&buf, ippinfo)
+	if strings.Contains(buf.String(), "job-mandatory-attributes") {
+		t.Errorf("absent: status:\n%s", buf.String())
+	}
+}
+
+// Test decoding of JPEG image format capabilities
+func TestIppDecodeJpeg(t *testing.T) {
+	features := goipp.Attribute{Name: "jpeg-features-supported"}
+	for _, s := range []string{"arithmetic", "cmyk", "icc",
+		"progressive"} {
+		features.Values.Add(goipp.TagKeyword, goipp.String(s))
+	}
+
+	ippinfo, _ := testIppAttrs(
+		features,
+		goipp.MakeAttribute("jpeg-x-dimension-supported",
+			goipp.TagRange, goipp.Range{Lower: 0, Upper: 16384}),
+		goipp.MakeAttribute("jpeg-y-dimension-supported",
+			goipp.TagRange, goipp.Range{Lower: 1, Upper: 8192}),
+	).decode(UsbDeviceInfo{})
+
+	expected := []string{"arithmetic", "cmyk", "icc", "progressive"}
+	if !reflect.DeepEqual(ippinfo.JpegFeatures, expected) {
+		t.Errorf("jpeg-features: expected %q, got %q",
+			expected, ippinfo.JpegFeatures)
+	}
+
+	if ippinfo.JpegXDimMax != 16384 || ippinfo.JpegYDimMax != 8192 {
+		t.Errorf("jpeg dimensions: expected %dx%d, got %dx%d",
+			16384, 8192, ippinfo.JpegXDimMax, ippinfo.JpegYDimMax)
+	}
+
+	// Omitted when absent
+	ippinfo, _ = testIppAttrs().decode(UsbDeviceInfo{})
+	if len(ippinfo.JpegFeatures) != 0 ||
+		ippinfo.JpegXDimMax != 0 || ippinfo.JpegYDimMax != 0 {
+		t.Errorf("absent: got %q, %dx%d", ippinfo.JpegFeatures,
+			ippinfo.JpegXDimMax, ippinfo.JpegYDimMax)
+	}
+
+	var buf bytes.Buffer
+	statusFormatIppInfo(&buf, ippinfo)
+	if strings.Contains(buf.String(), "jpeg") {
+		t.Errorf("absent: status:\n%s", buf.String())
+	}
+}
+
+// Test "operations-supported" decoding
+func TestIppDecodeOperations(t *testing.T) {
+	ippinfo, _ := testIppAttrs().decode(UsbDeviceInfo{})
+	if len(ippinfo.Operations) != 0 {
+		t.Errorf("expected no operations, got %v", ippinfo.Operations)
+	}
+
+	attr := testIppEnums("operations-supported",
+		int(goipp.OpPrintJob), int(goipp.OpValidateJob),
+		int(goipp.OpGetPrinterAttributes), int(goipp.OpPrintJob))
+
+	ippinfo, _ = testIppAttrs(attr).decode(UsbDeviceInfo{})
+	expected := []goipp.Op{goipp.OpPrintJob, goipp.OpValidateJob,
+		goipp.OpGetPrinterAttributes}
+
+	if !reflect.DeepEqual(ippinfo.Operations, expected) {
+		t.Errorf("expected %v, got %v", expected, ippinfo.Operations)
+	}
+}
+
+// Test both forms of the "rp" TXT item
+func TestIppDecodeRp(t *testing.T) {
+	save := Conf.IppRpSlash
+	defer func() { Conf.IppRpSlash = save }()
+
+	tests := []struct {
+		slash bool
+		rp    string
+	}{
+		{false, "ipp/print"},
+		{true, "/ipp/print"},
+	}
+
+	for _, test := range tests {
+		Conf.IppRpSlash = test.slash
+
+		_, svc := testIppAttrs().decode(UsbDeviceInfo{})
+		rp, _ := testTxtLookup(svc.Txt, "rp")
+		if rp != test.rp {
+			t.Errorf("rp-leading-slash=%v: expected %q, got %q",
+				test.slash, test.rp, rp)
+		}
+
+		// Clients append rp to "ipp://host:port/", and both
+		// forms must resolve to the same device path
+		path := httpNormalizePath("/" + rp)
+		if path != "/"+ippPrintPath {
+			t.Errorf("rp-leading-slash=%v: expected path %q, got %q",
+				test.slash, "/"+ippPrintPath, path)
+		}
+	}
+}
+
+// Test detection of IPP resource path by "printer-uri-supported"
+func TestIppDecodePrintPath(t *testing.T) {
+	save := Conf.IppRpSlash
+	defer func() { Conf.IppRpSlash = save }()
+	Conf.IppRpSlash = false
+
+	tests := []struct {
+		uris []string // printer-uri-supported, nil if missed
+		path string   // Expected path
+	}{
+		{[]string{"ipp://localhost:60000/ipp/printer",
+			"ipps://localhost:60000/ipp/printer"}, "ipp/printer"},
+		{[]string{"ipp://192.168.1.5/ipp/print/"}, "ipp/print"},
+		{[]string{"ipp://localhost//printers/lp"}, "printers/lp"},
+		{[]string{"ipp://localhost:60000/"}, ippPrintPath},
+		{[]string{"ipp://localhost:60000"}, ippPrintPath},
+		{[]string{"%"}, ippPrintPath},
+		{nil, ippPrintPath},
+	}
+
+	for _, test := range tests {
+		var attrs []goipp.Attribute
+		if test.uris != nil {
+			attr := goipp.Attribute{Name: "printer-uri-supported"}
+			for _, uri := range test.uris {
+				attr.Values.Add(goipp.TagURI, goipp.String(uri))
+			}
+			attrs = append(attrs, attr)
+		}
+
+		ippinfo, svc := testIppAttrs(attrs...).decode(UsbDeviceInfo{})
+		if ippinfo.PrintPath != test.path {
+			t.Errorf("%q: expected %q, got %q",
+				test.uris, test.path, ippinfo.PrintPath)
+		}
+
+		if rp, _ := testTxtLookup(svc.Txt, "rp"); rp != test.path {
+			t.Errorf("%q: rp: expected %q, got %q",
+				test.uris, test.path, rp)
+		}
+	}
+
+	// Proxy checks operations on the detected path
+	proxy := &HTTPProxy{}
+	if !proxy.isPrintPath("/ipp/print") {
+		t.Errorf("default: /ipp/print not recognized")
+	}
+
+	proxy.SetPrintPath("ipp/printer")
+	if !proxy.isPrintPath("/ipp/printer") || proxy.isPrintPath("/ipp/print") {
+		t.Errorf("ipp/printer: path not recognized")
+	}
+}
+
+// Test "pdl-override-supported" decoding
+func TestIppDecodePDLOverride(t *testing.T) {
+	formats := goipp.Attribute{Name: "document-format-supported"}
+	for _, s := range []string{"application/octet-stream",
+		"image/pwg-raster", "application/pdf"} {
+		formats.Values.Add(goipp.TagMimeType, goipp.String(s))
+	}
+
+	tests := []struct {
+		override string
+		pdl      string
+	}{
+		{"", "application/octet-stream,image/pwg-raster," +
+			"application/pdf"},
+		{"attempted", "application/octet-stream,image/pwg-raster," +
+			"application/pdf"},
+		{"not-attempted", "image/pwg-raster,application/pdf"},
+	}
+
+	for _, test := range tests {
+		attrs := []goipp.Attribute{formats}
+		if test.override != "" {
+			attrs = append(attrs, goipp.MakeAttribute(
+				"pdl-override-supported",
+				goipp.TagKeyword, goipp.String(test.override)))
+		}
+
+		ippinfo, svc := testIppAttrs(attrs...).decode(UsbDeviceInfo{})
+		if ippinfo.PDLOverride != test.override {
+			t.Errorf("%q: expected %q, got %q",
+				test.override, test.override, ippinfo.PDLOverride)
+		}
+
+		pdl, _ := testTxtLookup(svc.Txt, "pdl")
+		if pdl != test.pdl {
+			t.Errorf("%q: pdl: expected %q, got %q",
+				test.override, test.pdl, pdl)
+		}
+	}
+}
+
+// Test the prefer-pdf option
+func TestIppDecodePreferPDF(t *testing.T) {
+	saved := Conf.IppPreferPDF
+	defer func() { Conf.IppPreferPDF = saved }()
+
+	formats := goipp.Attribute{Name: "document-format-supported"}
+	for _, s := range []string{"application/octet-stream",
+		"image/pwg-raster", "image/urf", "application/pdf"} {
+		formats.Values.Add(goipp.TagMimeType, goipp.String(s))
+	}
+
+	tests := []struct {
+		prefer bool
+		pdl    string
+	}{
+		{false, "application/octet-stream,image/pwg-raster," +
+			"image/urf,application/pdf"},
+		{true, "application/pdf,application/octet-stream," +
+			"image/pwg-raster,image/urf"},
+	}
+
+	for _, test := range tests {
+		Conf.IppPreferPDF = test.prefer
+		_, svc := testIppAttrs(formats).decode(UsbDeviceInfo{})
+		pdl, _ := testTxtLookup(svc.Txt, "pdl")
+		if pdl != test.pdl {
+			t.Errorf("prefer-pdf=%v: expected %q, got %q",
+				test.prefer, test.pdl, pdl)
+		}
+	}
+
+	// Device without PDF support
+	Conf.IppPreferPDF = true
+	formats = goipp.MakeAttribute("document-format-supported",
+		goipp.TagMimeType, goipp.String("image/pwg-raster"))
+	_, svc := testIppAttrs(formats).decode(UsbDeviceInfo{})
+	if pdl, _ := testTxtLookup(svc.Txt, "pdl"); pdl != "image/pwg-raster" {
+		t.Errorf("no PDF: expected %q, got %q", "image/pwg-raster", pdl)
+	}
+}
+
+// Test decoding of firmware versions
+func TestIppDecodeFirmware(t *testing.T) {
+	names := goipp.Attribute{Name: "printer-firmware-name"}
+	names.Values.Add(goipp.TagName, goipp.String("main"))
+	names.Values.Add(goipp.TagName, goipp.String("engine"))
+
+	versions := goipp.Attribute{Name: "printer-firmware-string-version"}
+	versions.Values.Add(goipp.TagText, goipp.String("2403A"))
+	versions.Values.Add(goipp.TagText, goipp.String("1.0.7"))
+	versions.Values.Add(goipp.TagText, goipp.String("0.3"))
+
+	tests := []struct {
+		attrs    ippAttrs
+		firmware []string
+	}{
+		{testIppAttrs(), []string{}},
+		{testIppAttrs(versions), []string{"2403A", "1.0.7", "0.3"}},
+		{testIppAttrs(names, versions),
+			[]string{"main 2403A", "engine 1.0.7", "0.3"}},
+	}
+
+	for i, test := range tests {
+		ippinfo, _ := test.attrs.decode(UsbDeviceInfo{})
+		if !reflect.DeepEqual(ippinfo.Firmware, test.firmware) {
+			t.Errorf("%d: expected %q, got %q",
+				i, test.firmware, ippinfo.Firmware)
+		}
+	}
+}
+
+// Test detection of borderless printing support
+func TestIppDecodeBorderless(t *testing.T) {
+	margins := func(bottom, left, right, top []int) []goipp.Attribute {
+		var attrs []goipp.Attribute
+		for i, vals := range [][]int{bottom, left, right, top} {
+			side := []string{"bottom", "left", "right", "top"}[i]
+			attr := goipp.Attribute{
+				Name: "media-" + side + "-margin-supported",
+			}
+			for _, v := range vals {
+				attr.Values.Add(goipp.TagInteger, goipp.Integer(v))
+			}
+			if len(vals) != 0 {
+				attrs = append(attrs, attr)
+			}
+		}
+		return attrs
+	}
+
+	tests := []struct {
+		attrs      []goipp.Attribute
+		borderless string
+	}{
+		{nil, ""},
+		{margins([]int{0, 423}, []int{0, 423}, []int{0, 423},
+			[]int{0, 423}), "T"},
+		{margins([]int{423}, []int{0, 423}, []int{0, 423},
+			[]int{0, 423}), "F"},
+		{margins([]int{0}, []int{0}, nil, []int{0}), ""},
+	}
+
+	for i, test := range tests {
+		ippinfo, _ := testIppAttrs(test.attrs...).decode(UsbDeviceInfo{})
+		if ippinfo.Borderless != test.borderless {
+			t.Errorf("%d: expected %q, got %q",
+				i, test.borderless, ippinfo.Borderless)
+		}
+	}
+}
+
+// Test fixing of URF without resolution
+func TestIppDecodeURFResolution(t *testing.T) {
+	saved := Conf.IppURFFixRes
+	defer func() { Conf.IppURFFixRes = saved }()
+
+	resolutions := goipp.Attribute{
+		Name: "pwg-raster-document-resolution-supported",
+	}
+	resolutions.Values.Add(goipp.TagResolution,
+		goipp.Resolution{Xres: 600, Yres: 600, Units: goipp.UnitsDpi})
+	resolutions.Values.Add(goipp.TagResolution,
+		goipp.Resolution{Xres: 300, Yres: 300, Units: goipp.UnitsDpi})
+	resolutions.Values.Add(goipp.TagResolution,
+		goipp.Resolution{Xres: 600, Yres: 1200, Units: goipp.UnitsDpi})
+
+	urf := func(s string) goipp.Attribute {
+		attr := goipp.Attribute{Name: "urf-supported"}
+		for _, token := range strings.Split(s, ",") {
+			attr.Values.Add(goipp.TagKeyword, goipp.String(token))
+		}
+		return attr
+	}
+
+	tests := []struct {
+		fix      bool
+		attrs    []goipp.Attribute
+		expected string
+	}{
+		// Fix disabled
+		{false, []goipp.Attribute{urf("V1.4,CP1,W8"), resolutions},
+			"V1.4,CP1,W8"},
+
+		// Resolution injected
+		{true, []goipp.Attribute{urf("V1.4,CP1,W8"), resolutions},
+			"V1.4,CP1,W8,RS300-600"},
+
+		// Resolution already present
+		{true, []goipp.Attribute{urf("V1.4,RS600,W8"), resolutions},
+			"V1.4,RS600,W8"},
+
+		// No PWG resolutions
+		{true, []goipp.Attribute{urf("V1.4,CP1,W8")},
+			"V1.4,CP1,W8"},
+	}
+
+	for _, test := range tests {
+		Conf.IppURFFixRes = test.fix
+		_, svc := testIppAttrs(test.attrs...).decode(UsbDeviceInfo{})
+		urf, _ := testTxtLookup(svc.Txt, "URF")
+		if urf != test.expected {
+			t.Errorf("fix=%v: expected %q, got %q",
+				test.fix, test.expected, urf)
+		}
+	}
+}
+
+// Test overriding of ty and product with the friendly model name
+func TestIppDecodeModelName(t *testing.T) {
+	saved := Conf.ModelNames
+	defer func() { Conf.ModelNames = saved }()
+
+	mn, _ := NewModelName("ABC2000", "HP OfficeJet Pro 9010")
+	Conf.ModelNames = ModelNames{mn}
+
+	tests := []struct {
+		model, ty, product string
+	}{
+		{"HP ABC2000 Series", "HP OfficeJet Pro 9010",
+			"(HP OfficeJet Pro 9010)"},
+		{"Canon G3010", "Canon G3010", "(Canon G3010)"},
+	}
+
+	for _, test := range tests {
+		attrs := testIppAttrs(goipp.MakeAttribute("printer-make-and-model",
+			goipp.TagText, goipp.String(test.model)))
+		_, svc := attrs.decode(UsbDeviceInfo{})
+
+		ty, _ := testTxtLookup(svc.Txt, "ty")
+		product, _ := testTxtLookup(svc.Txt, "product")
+		if ty != test.ty || product != test.product {
+			t.Errorf("%q: expected ty=%q product=%q, got %q %q",
+				test.model, test.ty, test.product, ty, product)
+		}
+	}
+}
+
+// Test salvaging of attributes from the partially malformed message
+func TestIppDecodeMessagePartial(t *testing.T) {
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	msg.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-make-and-model",
+		goipp.TagText, goipp.String("HP LaserJet")))
+	msg.Printer.Add(goipp.MakeAttribute("printer-uuid",
+		goipp.TagURI, goipp.String("urn:uuid:0123")))
+
+	data, _ := msg.EncodeBytes()
+
+	// Well-formed message
+	rsp, recovered, err := ippDecodeMessage(data)
+	if err != nil || recovered != 0 {
+		t.Fatalf("well-formed: err=%v, recovered=%d", err, recovered)
+	}
+
+	// Cut off the last attribute in the middle
+	rsp, recovered, err = ippDecodeMessage(data[:len(data)-8])
+	if err == nil {
+		t.Fatalf("truncated: error expected")
+	}
+
+	if recovered != 2 {
+		t.Errorf("truncated: expected 2 attributes recovered, got %d",
+			recovered)
+	}
+
+	attrs := newIppDecoder(rsp)
+	if model := attrs.strSingle("printer-make-and-model"); model != "HP LaserJet" {
+		t.Errorf("truncated: printer-make-and-model: expected %q, got %q",
+			"HP LaserJet", model)
+	}
+
+	// Nothing to salvage
+	_, recovered, err = ippDecodeMessage(data[:6])
+	if err == nil || recovered != 0 {
+		t.Errorf("header only: err=%v, recovered=%d", err, recovered)
+	}
+}
+
+// Test decoding of "document-format-details-supported"
+func TestIppDecodeFormatDetails(t *testing.T) {
+	// Keywords, as IPP specification says
+	keywords := goipp.Attribute{Name: "document-format-details-supported"}
+	keywords.Values.Add(goipp.TagKeyword, goipp.String("document-format"))
+	keywords.Values.Add(goipp.TagKeyword,
+		goipp.String("document-format-version"))
+
+	// Collections, as some devices report
+	pdf := goipp.Collection{}
+	pdf.Add(goipp.MakeAttribute("document-format",
+		goipp.TagMimeType, goipp.String("application/pdf")))
+	versions := goipp.Attribute{Name: "document-format-version"}
+	versions.Values.Add(goipp.TagText, goipp.String("PDF/1.7"))
+	versions.Values.Add(goipp.TagText, goipp.String("PDF/A-1b"))
+	pdf.Add(versions)
+
+	collections := goipp.MakeAttribute("document-format-details-supported",
+		goipp.TagBeginCollection, pdf)
+
+	tests := []struct {
+		name     string
+		attrs    []goipp.Attribute
+		expected []string
+	}{
+		{"absent", nil, []string{}},
+		{"keywords", []goipp.Attribute{keywords},
+			[]string{"document-format", "document-format-version"}},
+		{"collections", []goipp.Attribute{collections},
+			[]string{"{document-format=application/pdf " +
+				"document-format-version=PDF/1.7|PDF/A-1b}"}},
+	}
+
+	for _, test := range tests {
+		ippinfo, _ := testIppAttrs(test.attrs...).decode(UsbDeviceInfo{})
+		if !reflect.DeepEqual(ippinfo.FormatDetails, test.expected) {
+			t.Errorf("%s: expected %q, got %q",
+				test.name, test.expected, ippinfo.FormatDetails)
+		}
+	}
+}
+
+// Test "printer-output-tray" decoding
+func TestIppDecodeOutputTrays(t *testing.T) {
+	trays := goipp.Attribute{Name: "printer-output-tray"}
+	for _, s := range []string{
+		"type=unRemovableBin;maxcapacity=150;remaining=0;" +
+			"status=16;name=Face Down Tray;",
+		"type=removableBin;maxcapacity=100;remaining=40;status=0;",
+		"type=unRemovableBin;remaining=-3;status=32;",
+		"maxcapacity=-2;remaining=-2;",
+	} {
+		trays.Values.Add(goipp.TagString, goipp.Binary(s))
+	}
+
+	tests := []struct {
+		name     string
+		attrs    []goipp.Attribute
+		expected []string
+	}{
+		{"absent", nil, []string{}},
+		{"trays", []goipp.Attribute{trays}, []string{
+			"Face Down Tray: full, critical alert",
+			"removableBin: 40 of 100 free",
+			"unRemovableBin: not full, offline",
+			"tray 4: unknown",
+		}},
+	}
+
+	for _, test := range tests {
+		ippinfo, _ := testIppAttrs(test.attrs...).decode(UsbDeviceInfo{})
+		if !reflect.DeepEqual(ippinfo.OutputTrays, test.expected) {
+			t.Errorf("%s: expected %q, got %q",
+				test.name, test.expected, ippinfo.OutputTrays)
+		}
+	}
+}
+
+// Test "printer-input-tray" decoding
+func TestIppDecodeInputTrays(t *testing.T) {
+	trays := goipp.Attribute{Name: "printer-input-tray"}
+	for _, s := range []string{
+		"type=sheetFeedAutoRemovableTray;dimunit=micrometers;" +
+			"mediafeed=297000;mediaxfeed=210000;maxcapacity=250;" +
+			"level=150;status=0;name=Tray 1;",
+		"type=sheetFeedManual;dimunit=tenThousandthsOfInches;" +
+			"mediafeed=110000;mediaxfeed=85000;maxcapacity=1;" +
+			"level=0;status=16;",
+		"type=sheetFeedAutoNonRemovableTray;mediafeed=-2;" +
+			"mediaxfeed=-2;level=-3;status=32;name=Tray 2;",
+		"",
+	} {
+		trays.Values.Add(goipp.TagString, goipp.Binary(s))
+	}
+
+	expected := []IppInputTray{
+		{"Tray 1", "sheetFeedAutoRemovableTray", "210x297mm",
+			250, 150, 0},
+		{"sheetFeedManual", "sheetFeedManual", "8.5x11in", 1, 0, 16},
+		{"Tray 2", "sheetFeedAutoNonRemovableTray", "", -2, -3, 32},
+		{"tray 4", "", "", -2, -2, 0},
+	}
+
+	strs := []string{
+		"Tray 1: 210x297mm, 150 of 250",
+		"sheetFeedManual: 8.5x11in, empty, critical alert",
+		"Tray 2: not empty, offline",
+		"tray 4: unknown",
+	}
+
+	ippinfo, _ := testIppAttrs(trays).decode(UsbDeviceInfo{})
+	if !reflect.DeepEqual(ippinfo.InputTrays, expected) {
+		t.Errorf("expected %+v, got %+v", expected, ippinfo.InputTrays)
+	}
+
+	if out := statusInputTrays(ippinfo.InputTrays); !reflect.DeepEqual(out, strs) {
+		t.Errorf("expected %q, got %q", strs, out)
+	}
+
+	// Omitted when absent
+	ippinfo, _ = testIppAttrs().decode(UsbDeviceInfo{})
+	if len(ippinfo.InputTrays) != 0 {
+		t.Errorf("absent: got %+v", ippinfo.InputTrays)
+	}
+}
+
+// Test resolution of duplicated attributes
+func TestIppDuplicateAttributes(t *testing.T) {
+	save := Conf.IppDupLastWins
+	defer func() { Conf.IppDupLastWins = save }()
+
+	attrs := []goipp.Attribute{
+		goipp.MakeAttribute("printer-info",
+			goipp.TagText, goipp.String("First Name")),
+		goipp.MakeAttribute("printer-make-and-model",
+			goipp.TagText, goipp.String("Model")),
+		goipp.MakeAttribute("printer-info",
+			goipp.TagText, goipp.String("Last Name")),
+	}
+
+	tests := []struct {
+		last     bool
+		expected string
+	}{
+		{false, "First Name"},
+		{true, "Last Name"},
+	}
+
+	for _, test := range tests {
+		Conf.IppDupLastWins = test.last
+
+		ippinfo, _ := testIppAttrs(attrs...).decode(UsbDeviceInfo{})
+		if ippinfo.DNSSdName != test.expected {
+			t.Errorf("last=%v: expected %q, got %q",
+				test.last, test.expected, ippinfo.DNSSdName)
+		}
+
+		// Non-duplicated attributes are not affected
+		model := testIppAttrs(attrs...).strSingle("printer-make-and-model")
+		if model != "Model" {
+			t.Errorf("last=%v: printer-make-and-model: got %q",
+				test.last, model)
+		}
+	}
+}
+
+// Test "print-quality-supported" decoding
+func TestIppDecodePrintQuality(t *testing.T) {
+	save := Conf.IppQualityTxt
+	defer func() { Conf.IppQualityTxt = save }()
+
+	attr := testIppEnums("print-quality-supported", 3, 4, 5, 4, 7)
+	expected := []string{"draft", "normal", "high", "7"}
+
+	for _, txt := range []bool{false, true} {
+		Conf.IppQualityTxt = txt
+
+		ippinfo, svc := testIppAttrs(attr).decode(UsbDeviceInfo{})
+		if !reflect.DeepEqual(ippinfo.PrintQuality, expected) {
+			t.Errorf("expected %q, got %q",
+				expected, ippinfo.PrintQuality)
+		}
+
+		v, found := testTxtLookup(svc.Txt, "print-quality")
+		switch {
+		case txt && v != "draft,normal,high,7":
+			t.Errorf("TXT: got %q", v)
+		case !txt && found:
+			t.Errorf("TXT: added, while disabled")
+		}
+
+		// Omitted when absent
+		ippinfo, svc = testIppAttrs().decode(UsbDeviceInfo{})
+		if len(ippinfo.PrintQuality) != 0 {
+			t.Errorf("absent: got %q", ippinfo.PrintQuality)
+		}
+
+		if _, found := testTxtLookup(svc.Txt, "print-quality"); found {
+			t.Errorf("absent: TXT added")
+		}
+	}
+}
+
+// Test decoding of pin printing attributes
+func TestIppDecodeJobPassword(t *testing.T) {
+	enc := goipp.Attribute{Name: "job-password-encryption-supported"}
+	enc.Values.Add(goipp.TagKeyword, goipp.String("none"))
+	enc.Values.Add(goipp.TagKeyword, goipp.String("sha2-256"))
+
+	rep := goipp.MakeAttribute("job-password-repertoire-supported",
+		goipp.TagKeyword, goipp.String("iana_us-ascii_digits"))
+
+	tests := []struct {
+		name string
+		max  int
+		enc  []string
+		rep  []string
+	}{
+		{"absent", 0, nil, nil},
+		{"disabled", 0, nil, nil},
+		{"supported", 8, []string{"none", "sha2-256"},
+			[]string{"iana_us-ascii_digits"}},
+	}
+
+	for _, test := range tests {
+		var attrs []goipp.Attribute
+		if test.name != "absent" {
+			attrs = []goipp.Attribute{
+				goipp.MakeAttribute("job-password-supported",
+					goipp.TagInteger, goipp.Integer(test.max)),
+				enc, rep,
+			}
+		}
+
+		ippinfo, _ := testIppAttrs(attrs...).decode(UsbDeviceInfo{})
+		if ippinfo.JobPasswordMax != test.max {
+			t.Errorf("%s: max: expected %d, got %d",
+				test.name, test.max, ippinfo.JobPasswordMax)
+		}
+
+		if !reflect.DeepEqual(ippinfo.JobPasswordEnc, test.enc) {
+			t.Errorf("%s: encryption: expected %q, got %q",
+				test.name, test.enc, ippinfo.JobPasswordEnc)
+		}
+
+		if !reflect.DeepEqual(ippinfo.JobPasswordRep, test.rep) {
+			t.Errorf("%s: repertoire: expected %q, got %q",
+				test.name, test.rep, ippinfo.JobPasswordRep)
+		}
+	}
+}
+
+// Test that "note" is omitted, if printer location is not known
+func TestIppDecodeNote(t *testing.T) {
+	save := Conf.IppEmptyNote
+	defer func() { Conf.IppEmptyNote = save }()
+
+	location := goipp.MakeAttribute("printer-location",
+		goipp.TagText, goipp.String("Office"))
+	empty := goipp.MakeAttribute("printer-location",
+		goipp.TagText, goipp.String(""))
+
+	tests := []struct {
+		name  string
+		attrs []goipp.Attribute
+		force bool
+		note  string
+		found bool
+	}{
+		{"absent", nil, false, "", false},
+		{"empty", []goipp.Attribute{empty}, false, "", false},
+		{"location", []goipp.Attribute{location}, false, "Office", true},
+		{"absent, forced", nil, true, "", true},
+		{"empty, forced", []goipp.Attribute{empty}, true, "", true},
+		{"location, forced", []goipp.Attribute{location}, true,
+			"Office", true},
+	}
+
+	for _, test := range tests {
+		Conf.IppEmptyNote = test.force
+
+		_, svc := testIppAttrs(test.attrs...).decode(UsbDeviceInfo{})
+		note, found := testTxtLookup(svc.Txt, "note")
+		if note != test.note || found != test.found {
+			t.Errorf("%s: expected %q (found=%v), got %q (found=%v)",
+				test.name, test.note, test.found, note, found)
+		}
+	}
+}
+
+// Test "media-source-supported" decoding
+func TestIppDecodeMediaSources(t *testing.T) {
+	save := Conf.IppMediaSrcTxt
+	defer func() { Conf.IppMediaSrcTxt = save }()
+
+	attr := goipp.Attribute{Name: "media-source-supported"}
+	for _, s := range []string{"auto", "tray-1", "tray-2", "tray-1",
+		"manual"} {
+		attr.Values.Add(goipp.TagKeyword, goipp.String(s))
+	}
+
+	expected := []string{"auto", "tray-1", "tray-2", "manual"}
+
+	for _, txt := range []bool{false, true} {
+		Conf.IppMediaSrcTxt = txt
+
+		ippinfo, svc := testIppAttrs(attr).decode(UsbDeviceInfo{})
+		if !reflect.DeepEqual(ippinfo.MediaSources, expected) {
+			t.Errorf("expected %q, got %q",
+				expected, ippinfo.MediaSources)
+		}
+
+		v, found := testTxtLookup(svc.Txt, "media-source")
+		switch {
+		case txt && v != "auto,tray-1,tray-2,manual":
+			t.Errorf("TXT: got %q", v)
+		case !txt && found:
+			t.Errorf("TXT: added, while disabled")
+		}
+
+		// Omitted when absent
+		ippinfo, svc = testIppAttrs().decode(UsbDeviceInfo{})
+		if len(ippinfo.MediaSources) != 0 {
+			t.Errorf("absent: got %q", ippinfo.MediaSources)
+		}
+
+		if _, found := testTxtLookup(svc.Txt, "media-source"); found {
+			t.Errorf("absent: TXT added")
+		}
+	}
+}
+
+// Test decoding of media-type-supported
+func TestIppDecodeMediaTypes(t *testing.T) {
+	save := Conf.IppMediaTypeTxt
+	defer func() { Conf.IppMediaTypeTxt = save }()
+
+	attr := goipp.Attribute{Name: "media-type-supported"}
+	for _, s := range []string{"stationery", "Stationery_Letterhead",
+		"stationary-heavyweight", "photographic-glossy",
+		"Photographic Matte", "transparency", "labels", "envelope",
+		"stationery", ""} {
+		attr.Values.Add(goipp.TagKeyword, goipp.String(s))
+	}
+
+	expected := []string{"stationery", "stationery-letterhead",
+		"stationery-heavyweight", "photographic-glossy",
+		"photographic-matte", "transparency", "labels", "envelope"}
+
+	for _, txt := range []bool{false, true} {
+		Conf.IppMediaTypeTxt = txt
+
+		ippinfo, svc := testIppAttrs(attr).decode(UsbDeviceInfo{})
+		if !reflect.DeepEqual(ippinfo.MediaTypes, expected) {
+			t.Errorf("expected %q, got %q",
+				expected, ippinfo.MediaTypes)
+		}
+
+		v, found := testTxtLookup(svc.Txt, "media-type")
+		switch {
+		case txt && v != strings.Join(expected, ","):
+			t.Errorf("TXT: got %q", v)
+		case !txt && found:
+			t.Errorf("TXT: added, while disabled")
+		}
+
+		// Omitted when absent
+		ippinfo, svc = testIppAttrs().decode(UsbDeviceInfo{})
+		if len(ippinfo.MediaTypes) != 0 {
+			t.Errorf("absent: got %q", ippinfo.MediaTypes)
+		}
+
+		if _, found := testTxtLookup(svc.Txt, "media-type"); found {
+			t.Errorf("absent: TXT added")
+		}
+	}
+}
+
+// Test retrying of empty Get-Printer-Attributes responses
+func TestIppEmptyResponse(t *testing.T) {
+	saveRetries, saveDelay := Conf.IppEmptyRetries, Conf.IppEmptyDelay
+	defer func() {
+		Conf.IppEmptyRetries, Conf.IppEmptyDelay = saveRetries, saveDelay
+	}()
+
+	Conf.IppEmptyRetries = 2
+	Conf.IppEmptyDelay = 0
+
+	rsp := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+	rsp.Printer.Add(goipp.MakeAttribute("printer-info",
+		goipp.TagText, goipp.String("Test Printer")))
+	data, _ := rsp.EncodeBytes()
+
+	for _, empty := range []int{0, 2, 3} {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Header().Set("Content-Type", goipp.ContentType)
+				if requests <= empty {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.Write(data)
+			}))
+
+		log := NewLogger().Begin()
+		_, err := ippGetPrinterAttributes(log, srv.Client(),
+			srv.URL+"/ipp/print", goipp.DefaultVersion,
+			ippDefaultCharset, ippDefaultLanguage)
+		log.Commit()
+		srv.Close()
+
+		switch {
+		case empty <= 2 && err != nil:
+			t.Errorf("%d empty responses: %s", empty, err)
+		case empty > 2 && err != ErrEmptyIpp:
+			t.Errorf("%d empty responses: expected %v, got %v",
+				empty, ErrEmptyIpp, err)
+		}
+
+		expected := empty + 1
+		if expected > 3 {
+			expected = 3
+		}
+
+		if requests != expected {
+			t.Errorf("%d empty responses: expected %d requests, got %d",
+				empty, expected, requests)
+		}
+	}
+}
+
+// Test choice of charset and language for a legacy device
+func TestIppCharsetLanguage(t *testing.T) {
+	save := Conf.IppLanguage
+	defer func() { Conf.IppLanguage = save }()
+
+	Conf.IppLanguage = "auto"
+
+	// ASCII-only device
+	requests := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			rq := &goipp.Message{}
+			rq.DecodeBytes(data)
+			rqattrs := newIppDecoder(&goipp.Message{
+				Printer: rq.Operation})
+			requests = append(requests,
+				rqattrs.strSingle("attributes-charset")+"/"+
+					rqattrs.strSingle("attributes-natural-language"))
+
+			rsp := goipp.NewResponse(goipp.DefaultVersion,
+				goipp.StatusOk, rq.RequestID)
+			rsp.Printer.Add(goipp.MakeAttribute("charset-supported",
+				goipp.TagCharset, goipp.String("us-ascii")))
+			rsp.Printer.Add(goipp.MakeAttribute(
+				"generated-natural-language-supported",
+				goipp.TagLanguage, goipp.String("en")))
+			rsp.Printer.Add(goipp.MakeAttribute(
+				"natural-language-configured",
+				goipp.TagLanguage, goipp.String("en")))
+
+			w.Header().Set("Content-Type", goipp.ContentType)
+			rsp.Encode(w)
+		}))
+	defer srv.Close()
+
+	log := NewLogger().Begin()
+	msg, err := ippGetPrinterAttributesLang(log, srv.Client(),
+		srv.URL+"/ipp/print", goipp.DefaultVersion)
+	log.Commit()
+
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	expected := []string{"utf-8/en-US", "us-ascii/en"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("requests: expected %v, got %v", expected, requests)
+	}
+
+	ippinfo, _ := newIppDecoder(msg).decode(UsbDeviceInfo{})
+	if ippinfo.Charset != "us-ascii" {
+		t.Errorf("charset: expected %q, got %q", "us-ascii",
+			ippinfo.Charset)
+	}
+
+	// Choice of charset
+	charsets := []struct {
+		supported []string
+		charset   string
+	}{
+		{nil, "utf-8"},
+		{[]string{"us-ascii", "UTF-8"}, "utf-8"},
+		{[]string{"us-ascii"}, "us-ascii"},
+		{[]string{"ISO-8859-1"}, "iso-8859-1"},
+	}
+
+	for _, test := range charsets {
+		charset := ippChooseCharset(test.supported)
+		if charset != test.charset {
+			t.Errorf("%v: expected %q, got %q",
+				test.supported, test.charset, charset)
+		}
+	}
+
+	// Choice of language
+	langs := []struct {
+		supported  []string
+		configured string
+		lang       string
+	}{
+		{nil, "", "en-US"},
+		{nil, "de-DE", "de-DE"},
+		{[]string{"en-us", "de-DE"}, "de-de", "de-DE"},
+		{[]string{"en-us", "de-DE"}, "fr-FR", "en-us"},
+		{[]string{"ja"}, "", "ja"},
+	}
+
+	for _, test := range langs {
+		lang := ippChooseLanguage(test.supported, test.configured)
+		if lang != test.lang {
+			t.Errorf("%v/%q: expected %q, got %q",
+				test.supported, test.configured, test.lang, lang)
+		}
+	}
+}
+
+// Test decoding of printer organization and charge info
+func TestIppDecodeOrganization(t *testing.T) {
+	org := goipp.Attribute{Name: "printer-organization"}
+	org.Values.Add(goipp.TagText, goipp.String(" ACME Corp. "))
+	org.Values.Add(goipp.TagText, goipp.String(""))
+
+	unit := goipp.Attribute{Name: "printer-organizational-unit"}
+	unit.Values.Add(goipp.TagText, goipp.String("Sales"))
+	unit.Values.Add(goipp.TagText, goipp.String("Marketing"))
+
+	charge := goipp.MakeAttribute("printer-charge-info",
+		goipp.TagText, goipp.String("Free of charge "))
+
+	ippinfo, _ := testIppAttrs(org, unit, charge).decode(UsbDeviceInfo{})
+
+	if expected := []string{"ACME Corp."}; !reflect.DeepEqual(
+		ippinfo.Organization, expected) {
+		t.Errorf("organization: expected %q, got %q",
+			expected, ippinfo.Organization)
+	}
+
+	if expected := []string{"Sales", "Marketing"}; !reflect.DeepEqual(
+		ippinfo.OrgUnits, expected) {
+		t.Errorf("organizational-unit: expected %q, got %q",
+			expected, ippinfo.OrgUnits)
+	}
+
+	if ippinfo.ChargeInfo != "Free of charge" {
+		t.Errorf("charge-info: got %q", ippinfo.ChargeInfo)
+	}
+
+	// Omitted when absent
+	ippinfo, _ = testIppAttrs().decode(UsbDeviceInfo{})
+	if ippinfo.Organization != nil || ippinfo.OrgUnits != nil ||
+		ippinfo.ChargeInfo != "" {
+		t.Errorf("absent: got %q, %q, %q", ippinfo.Organization,
+			ippinfo.OrgUnits, ippinfo.ChargeInfo)
+	}
+}
@@ -0,0 +1,108 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Detection of device configuration changes
+ *
+ * Device reports changes of its configuration (i.e., tray added,
+ * firmware updated) by incrementing "printer-config-change-time"
+ * and "printer-config-changes". Polling these attributes is much
+ * cheaper, than the full Get-Printer-Attributes query, so periodic
+ * refresh of DNS-SD services uses them to skip unchanged devices
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippConfigChangeAttrs lists attributes, that make the
+// configuration change stamp
+var ippConfigChangeAttrs = []string{
+	"printer-config-change-date-time",
+	"printer-config-change-time",
+	"printer-config-changes",
+}
+
+// getConfigChange returns the configuration change stamp, made
+// of all available "printer-config-change-xxx" attributes, or ""
+// if device reports none of them
+func (attrs ippAttrs) getConfigChange() string {
+	stamp := []string{}
+
+	for _, name := range ippConfigChangeAttrs {
+		vals := attrs.getAttr(goipp.TypeInteger, name)
+		if vals == nil {
+			vals = attrs.getAttr(goipp.TypeDateTime, name)
+		}
+
+		if len(vals) != 0 {
+			stamp = append(stamp, name+"="+vals[0].String())
+		}
+	}
+
+	return strings.Join(stamp, ",")
+}
+
+// ippConfigChanged tells if configuration is considered changed,
+// based on the old (saved) and new change stamps. Unknown stamp
+// means "may be changed"
+func ippConfigChanged(old, cur string) bool {
+	return old == "" || cur == "" || old != cur
+}
+
+// ippGetConfigChange performs the minimal Get-Printer-Attributes
+// query, requesting only the configuration change attributes, and
+// returns the configuration change stamp
+func ippGetConfigChange(log *LogMessage, c *http.Client,
+	uri string, ver goipp.Version) (string, error) {
+
+	msg := ippNewRequest(goipp.OpGetPrinterAttributes, uri)
+	msg.Version = ver
+
+	rq := goipp.Attribute{Name: "requested-attributes"}
+	for _, name := range ippConfigChangeAttrs {
+		rq.Values.Add(goipp.TagKeyword, goipp.String(name))
+	}
+	msg.Operation.Add(rq)
+
+	rsp, err := ippDoRequest(log, c, uri, msg)
+	if err != nil {
+		return "", err
+	}
+
+	if rsp.Code >= 100 {
+		return "", fmt.Errorf("IPP: %s", goipp.Status(rsp.Code))
+	}
+
+	return newIppDecoder(rsp).getConfigChange(), nil
+}
+
+// IppConfigChanged tells if device configuration may be changed
+// since the last full query, which stamp is saved in the DevState
+//
+// Errors are not reported, configuration is considered changed
+// instead, so the full query will be performed
+func IppConfigChanged(log *LogMessage, c *http.Client, port int,
+	path string, state *DevState) bool {
+
+	if state.ConfigChange == "" {
+		return true
+	}
+
+	uri := fmt.Sprintf("http://localhost:%d/%s", port, path)
+	ver := ippGetVersion(log, c, uri, state)
+	stamp, err := ippGetConfigChange(log, c, uri, ver)
+	if err != nil {
+		log.Debug('!', "IPP: config change: %s", err)
+		return true
+	}
+
+	return ippConfigChanged(state.ConfigChange, stamp)
+}
@@ -0,0 +1,143 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for detection of device configuration changes
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Test decoding of the configuration change stamp
+func TestIppDecodeConfigChange(t *testing.T) {
+	date := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		attrs []goipp.Attribute
+		stamp string
+	}{
+		{nil, ""},
+		{
+			[]goipp.Attribute{
+				goipp.MakeAttribute("printer-config-change-time",
+					goipp.TagInteger, goipp.Integer(1234)),
+			},
+			"printer-config-change-time=1234",
+		},
+		{
+			[]goipp.Attribute{
+				goipp.MakeAttribute("printer-config-changes",
+					goipp.TagInteger, goipp.Integer(7)),
+				goipp.MakeAttribute("printer-config-change-time",
+					goipp.TagInteger, goipp.Integer(1234)),
+			},
+			"printer-config-change-time=1234," +
+				"printer-config-changes=7",
+		},
+		{
+			[]goipp.Attribute{
+				goipp.MakeAttribute("printer-config-change-date-time",
+					goipp.TagDateTime, goipp.Time{Time: date}),
+			},
+			"printer-config-change-date-time=" +
+				goipp.Time{Time: date}.String(),
+		},
+	}
+
+	for _, test := range tests {
+		stamp := testIppAttrs(test.attrs...).getConfigChange()
+		if stamp != test.stamp {
+			t.Errorf("expected %q, got %q", test.stamp, stamp)
+		}
+
+		ippinfo, _ := testIppAttrs(test.attrs...).decode(UsbDeviceInfo{})
+		if ippinfo.ConfigChange != test.stamp {
+			t.Errorf("IppPrinterInfo: expected %q, got %q",
+				test.stamp, ippinfo.ConfigChange)
+		}
+	}
+}
+
+// Test configuration change detection
+func TestIppConfigChanged(t *testing.T) {
+	tests := []struct {
+		old, cur string
+		changed  bool
+	}{
+		{"", "", true},
+		{"", "printer-config-changes=1", true},
+		{"printer-config-changes=1", "", true},
+		{"printer-config-changes=1", "printer-config-changes=1", false},
+		{"printer-config-changes=1", "printer-config-changes=2", true},
+	}
+
+	for _, test := range tests {
+		changed := ippConfigChanged(test.old, test.cur)
+		if changed != test.changed {
+			t.Errorf("%q->%q: expected %v, got %v",
+				test.old, test.cur, test.changed, changed)
+		}
+	}
+
+	// Query the device
+	changes := 1
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			data, _ := ioutil.ReadAll(r.Body)
+			rq := &goipp.Message{}
+			rq.DecodeBytes(data)
+
+			rsp := goipp.NewResponse(rq.Version, goipp.StatusOk,
+				rq.RequestID)
+			rsp.Printer.Add(goipp.MakeAttribute(
+				"printer-config-changes",
+				goipp.TagInteger, goipp.Integer(changes)))
+
+			w.Header().Set("Content-Type", goipp.ContentType)
+			rsp.Encode(w)
+		}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	state := &DevState{IppVersion: goipp.DefaultVersion}
+	if !IppConfigChanged(log, srv.Client(), port, ippPrintPath, state) {
+		t.Errorf("unknown stamp: must be considered changed")
+	}
+
+	if requests != 0 {
+		t.Errorf("unknown stamp: device must not be queried")
+	}
+
+	state.ConfigChange = "printer-config-changes=1"
+	if IppConfigChanged(log, srv.Client(), port, ippPrintPath, state) {
+		t.Errorf("same stamp: must be considered unchanged")
+	}
+
+	changes = 2
+	if !IppConfigChanged(log, srv.Client(), port, ippPrintPath, state) {
+		t.Errorf("incremented stamp: must be considered changed")
+	}
+
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
@@ -0,0 +1,55 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IPP Identify-Printer operation
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippIdentifyRequest builds the Identify-Printer request. If actions
+// are not empty, they are sent as "identify-actions", otherwise
+// printer uses its default actions
+func ippIdentifyRequest(uri string, actions []string) *goipp.Message {
+	msg := ippNewRequest(goipp.OpIdentifyPrinter, uri,
+		goipp.MakeAttribute("requesting-user-name",
+			goipp.TagName, goipp.String("ipp-usb")))
+
+	if len(actions) != 0 {
+		attr := goipp.Attribute{Name: "identify-actions"}
+		for _, action := range actions {
+			attr.Values.Add(goipp.TagKeyword, goipp.String(action))
+		}
+		msg.Operation.Add(attr)
+	}
+
+	return msg
+}
+
+// IppIdentify performs Identify-Printer operation, so printer
+// can be physically located (i.e., it flashes or beeps)
+//
+// It returns IPP status of the response. IPP error status is not
+// considered as error of this function
+func IppIdentify(log *LogMessage, c *http.Client, port int,
+	path string, actions []string) (goipp.Status, error) {
+
+	uri := fmt.Sprintf("http://localhost:%d/%s", port, path)
+	rsp, err := ippDoRequest(log, c, uri, ippIdentifyRequest(uri, actions))
+	if err != nil {
+		return 0, err
+	}
+
+	status := goipp.Status(rsp.Code)
+	log.Debug(' ', "IPP Identify-Printer: %s", status)
+
+	return status, nil
+}
@@ -0,0 +1,149 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IPP Get-Jobs operation
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// IppJob represents a single job in the device's job queue
+type IppJob struct {
+	ID    int    `json:"id"`    // job-id
+	Name  string `json:"name"`  // job-name
+	State string `json:"state"` // job-state, as keyword
+	User  string `json:"user"`  // job-originating-user-name
+}
+
+// ippJobStates maps job-state enum values to keywords
+var ippJobStates = map[int]string{
+	3: "pending",
+	4: "pending-held",
+	5: "processing",
+	6: "processing-stopped",
+	7: "canceled",
+	8: "aborted",
+	9: "completed",
+}
+
+// ippGetJobsRequest builds the Get-Jobs request. If which is
+// not empty, it is sent as "which-jobs", otherwise printer
+// returns not-completed jobs
+func ippGetJobsRequest(uri, which string) *goipp.Message {
+	msg := ippNewRequest(goipp.OpGetJobs, uri,
+		goipp.MakeAttribute("requesting-user-name",
+			goipp.TagName, goipp.String("ipp-usb")))
+
+	if which != "" {
+		msg.Operation.Add(goipp.MakeAttribute("which-jobs",
+			goipp.TagKeyword, goipp.String(which)))
+	}
+
+	rq := goipp.Attribute{Name: "requested-attributes"}
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-id"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-name"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-originating-user-name"))
+	rq.Values.Add(goipp.TagKeyword, goipp.String("job-state"))
+	msg.Operation.Add(rq)
+
+	return msg
+}
+
+// ippDefaultJobName is the default job-name of jobs, created
+// by ipp-usb itself (i.e., test prints)
+const ippDefaultJobName = "ipp-usb test"
+
+// ippJobRequest builds the job creation request (i.e., Print-Job
+// or Create-Job) for jobs, created by ipp-usb itself. Such jobs
+// are named by the job-name parameter, so operators can tell them
+// from user jobs in the device's queue and log
+//
+// Operation-specific attributes (i.e., document-format) are up
+// to the caller
+func ippJobRequest(op goipp.Op, uri string) *goipp.Message {
+	return ippNewRequest(op, uri,
+		goipp.MakeAttribute("requesting-user-name",
+			goipp.TagName, goipp.String("ipp-usb")),
+		goipp.MakeAttribute("job-name",
+			goipp.TagName, goipp.String(Conf.IppJobName)))
+}
+
+// ippDecodeJobs decodes jobs from the Get-Jobs response
+//
+// goipp merges all job attributes groups of the message into
+// the single list, so job boundaries are detected by repetition
+// of attribute name: each job reports every attribute only once
+func ippDecodeJobs(attrs goipp.Attributes) []IppJob {
+	jobs := []IppJob{}
+	seen := make(map[string]struct{})
+	var job *IppJob
+
+	for _, attr := range attrs {
+		if _, dup := seen[attr.Name]; dup || job == nil {
+			jobs = append(jobs, IppJob{})
+			job = &jobs[len(jobs)-1]
+			seen = make(map[string]struct{})
+		}
+
+		seen[attr.Name] = struct{}{}
+
+		if len(attr.Values) == 0 {
+			continue
+		}
+
+		v := attr.Values[0].V
+		switch attr.Name {
+		case "job-id":
+			if i, ok := v.(goipp.Integer); ok {
+				job.ID = int(i)
+			}
+		case "job-name":
+			job.Name = v.String()
+		case "job-originating-user-name":
+			job.User = v.String()
+		case "job-state":
+			if i, ok := v.(goipp.Integer); ok {
+				job.State = ippJobStates[int(i)]
+				if job.State == "" {
+					job.State = fmt.Sprintf("%d", int(i))
+				}
+			}
+		}
+	}
+
+	return jobs
+}
+
+// IppGetJobs performs Get-Jobs operation and returns the
+// device's job queue
+//
+// If device doesn't support Get-Jobs, ErrNotSupported is returned
+func IppGetJobs(log *LogMessage, c *http.Client, port int,
+	path, which string) ([]IppJob, error) {
+
+	uri := fmt.Sprintf("http://localhost:%d/%s", port, path)
+	rsp, err := ippDoRequest(log, c, uri, ippGetJobsRequest(uri, which))
+	if err != nil {
+		return nil, err
+	}
+
+	status := goipp.Status(rsp.Code)
+	log.Debug(' ', "IPP Get-Jobs: %s", status)
+
+	switch {
+	case status == goipp.StatusErrorOperationNotSupported:
+		return nil, ErrNotSupported
+	case status >= 0x0100:
+		return nil, fmt.Errorf("IPP: %s", status)
+	}
+
+	return ippDecodeJobs(rsp.Job), nil
+}
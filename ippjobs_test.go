@@ -0,0 +1,95 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP Get-Jobs operation
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Test decoding of the Get-Jobs response
+func TestIppDecodeJobs(t *testing.T) {
+	msg := goipp.NewResponse(goipp.DefaultVersion, goipp.StatusOk, 1)
+
+	jobs := []IppJob{
+		{1, "report.pdf", "processing", "alice"},
+		{2, "photo.jpg", "pending", "bob"},
+		{3, "", "canceled", ""},
+	}
+
+	for _, job := range jobs {
+		msg.Job.Add(goipp.MakeAttribute("job-id",
+			goipp.TagInteger, goipp.Integer(job.ID)))
+		if job.Name != "" {
+			msg.Job.Add(goipp.MakeAttribute("job-name",
+				goipp.TagName, goipp.String(job.Name)))
+			msg.Job.Add(goipp.MakeAttribute("job-originating-user-name",
+				goipp.TagName, goipp.String(job.User)))
+		}
+
+		state := 0
+		for i, s := range ippJobStates {
+			if s == job.State {
+				state = i
+			}
+		}
+		msg.Job.Add(goipp.MakeAttribute("job-state",
+			goipp.TagEnum, goipp.Integer(state)))
+	}
+
+	// Encode and decode, so job groups are merged by goipp
+	data, err := msg.EncodeBytes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	rsp := &goipp.Message{}
+	err = rsp.DecodeBytes(data)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	decoded := ippDecodeJobs(rsp.Job)
+	if !reflect.DeepEqual(decoded, jobs) {
+		t.Errorf("expected %+v, got %+v", jobs, decoded)
+	}
+
+	// Empty queue
+	if decoded := ippDecodeJobs(nil); len(decoded) != 0 {
+		t.Errorf("expected empty list, got %+v", decoded)
+	}
+}
+
+// Test building of requests for ipp-usb own jobs
+func TestIppJobRequest(t *testing.T) {
+	save := Conf.IppJobName
+	defer func() { Conf.IppJobName = save }()
+
+	for _, name := range []string{ippDefaultJobName, "Lab test page"} {
+		Conf.IppJobName = name
+
+		msg := ippJobRequest(goipp.OpPrintJob,
+			"http://localhost:60000/ipp/print")
+		if goipp.Op(msg.Code) != goipp.OpPrintJob {
+			t.Errorf("expected %s, got %s",
+				goipp.OpPrintJob, goipp.Op(msg.Code))
+		}
+
+		attrs := newIppDecoder(&goipp.Message{Printer: msg.Operation})
+		if v := attrs.strSingle("job-name"); v != name {
+			t.Errorf("job-name: expected %q, got %q", name, v)
+		}
+
+		if v := attrs.strSingle("requesting-user-name"); v != "ipp-usb" {
+			t.Errorf("requesting-user-name: got %q", v)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Lightweight IPP liveness probe
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// IppProbeOp represents IPP operation, used for liveness probe
+type IppProbeOp int
+
+// IppProbeGetPrinterState - Get-Printer-Attributes, requesting
+//                           only the "printer-state" attribute
+// IppProbeValidateJob     - Validate-Job; it doesn't return
+//                           printer state
+const (
+	IppProbeGetPrinterState IppProbeOp = iota
+	IppProbeValidateJob
+)
+
+// String returns textual representation of IppProbeOp
+func (op IppProbeOp) String() string {
+	switch op {
+	case IppProbeGetPrinterState:
+		return "printer-state"
+	case IppProbeValidateJob:
+		return "validate-job"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(op))
+}
+
+// ippPrinterStateNames maps "printer-state" enum values into names
+var ippPrinterStateNames = map[int]string{
+	3: "idle",
+	4: "processing",
+	5: "stopped",
+}
+
+// ippProbeRequest builds IPP request for the liveness probe
+func ippProbeRequest(op IppProbeOp, uri string) *goipp.Message {
+	code := goipp.OpGetPrinterAttributes
+	if op == IppProbeValidateJob {
+		code = goipp.OpValidateJob
+	}
+
+	msg := ippNewRequest(code, uri)
+
+	switch op {
+	case IppProbeGetPrinterState:
+		msg.Operation.Add(goipp.MakeAttribute("requested-attributes",
+			goipp.TagKeyword, goipp.String("printer-state")))
+	case IppProbeValidateJob:
+		msg.Operation.Add(goipp.MakeAttribute("requesting-user-name",
+			goipp.TagName, goipp.String("ipp-usb")))
+	}
+
+	return msg
+}
+
+// ippProbeDecode decodes response to the liveness probe
+//
+// Device is considered alive only if IPP status is successful:
+// device that answers with error to the trivial request is not
+// able to print. Printer state is returned as "idle", "processing"
+// or "stopped", or "" if unknown
+func ippProbeDecode(rsp *goipp.Message) (state string, err error) {
+	if rsp.Code >= 100 {
+		return "", fmt.Errorf("IPP: %s", goipp.Status(rsp.Code))
+	}
+
+	attrs := newIppDecoder(rsp)
+	vals := attrs.getAttr(goipp.TypeInteger, "printer-state")
+	if len(vals) != 0 {
+		v := int(vals[0].(goipp.Integer))
+		state = ippEnumName(ippPrinterStateNames, v)
+	}
+
+	return state, nil
+}
+
+// IppProbe performs the lightweight liveness probe of the IPP
+// printer at the specified uri, using the specified http.Client
+//
+// It returns printer state (see ippProbeDecode). Non-nil error
+// means device is dead
+func IppProbe(log *LogMessage, c *http.Client, op IppProbeOp,
+	uri string) (state string, err error) {
+
+	rsp, err := ippDoRequest(log, c, uri, ippProbeRequest(op, uri))
+	if err == nil {
+		state, err = ippProbeDecode(rsp)
+	}
+
+	if err != nil {
+		log.Debug('!', "IPP probe (%s): %s", op, err)
+		return "", err
+	}
+
+	log.Debug(' ', "IPP probe (%s): alive, state=%q", op, state)
+
+	return state, nil
+}
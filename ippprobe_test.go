@@ -0,0 +1,148 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP liveness probe
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Test building of the probe requests
+func TestIppProbeRequest(t *testing.T) {
+	const uri = "http://localhost:60000/ipp/print"
+
+	tests := []struct {
+		op    IppProbeOp
+		code  goipp.Op
+		name  string
+		value string
+	}{
+		{IppProbeGetPrinterState, goipp.OpGetPrinterAttributes,
+			"requested-attributes", "printer-state"},
+		{IppProbeValidateJob, goipp.OpValidateJob,
+			"requesting-user-name", "ipp-usb"},
+	}
+
+	for _, test := range tests {
+		msg := ippProbeRequest(test.op, uri)
+		if goipp.Op(msg.Code) != test.code {
+			t.Errorf("%s: expected %s, got %s",
+				test.op, test.code, goipp.Op(msg.Code))
+		}
+
+		attrs := map[string]string{}
+		for _, attr := range msg.Operation {
+			attrs[attr.Name] = attr.Values.String()
+		}
+
+		if s := attrs["printer-uri"]; s != uri {
+			t.Errorf("%s: printer-uri: expected %q, got %q",
+				test.op, uri, s)
+		}
+
+		if s := attrs[test.name]; s != test.value {
+			t.Errorf("%s: %s: expected %q, got %q",
+				test.op, test.name, test.value, s)
+		}
+	}
+}
+
+// Test decoding of the probe response
+func TestIppProbeDecode(t *testing.T) {
+	tests := []struct {
+		status goipp.Status
+		state  int
+		result string
+		alive  bool
+	}{
+		{goipp.StatusOk, 3, "idle", true},
+		{goipp.StatusOk, 5, "stopped", true},
+		{goipp.StatusOk, 0, "", true},
+		{goipp.StatusOkIgnoredOrSubstituted, 4, "processing", true},
+		{goipp.StatusErrorInternal, 3, "", false},
+		{goipp.StatusErrorServiceUnavailable, 0, "", false},
+	}
+
+	for _, test := range tests {
+		rsp := goipp.NewResponse(goipp.DefaultVersion, test.status, 1)
+		if test.state != 0 {
+			rsp.Printer.Add(goipp.MakeAttribute("printer-state",
+				goipp.TagEnum, goipp.Integer(test.state)))
+		}
+
+		state, err := ippProbeDecode(rsp)
+		if (err == nil) != test.alive {
+			t.Errorf("%s: expected alive=%v, got error %v",
+				test.status, test.alive, err)
+		}
+
+		if state != test.result {
+			t.Errorf("%s: expected state %q, got %q",
+				test.status, test.result, state)
+		}
+	}
+}
+
+// Test the probe, sent to the device
+func TestIppProbe(t *testing.T) {
+	status := goipp.StatusOk
+	var op goipp.Op
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			rq := &goipp.Message{}
+			rq.DecodeBytes(data)
+			op = goipp.Op(rq.Code)
+
+			rsp := goipp.NewResponse(rq.Version, status,
+				rq.RequestID)
+			if op == goipp.OpGetPrinterAttributes {
+				rsp.Printer.Add(goipp.MakeAttribute(
+					"printer-state",
+					goipp.TagEnum, goipp.Integer(4)))
+			}
+
+			w.Header().Set("Content-Type", goipp.ContentType)
+			rsp.Encode(w)
+		}))
+	defer srv.Close()
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	uri := srv.URL + "/ipp/print"
+
+	state, err := IppProbe(log, srv.Client(), IppProbeGetPrinterState, uri)
+	if err != nil || state != "processing" {
+		t.Errorf("printer-state: expected %q, got %q, %v",
+			"processing", state, err)
+	}
+
+	state, err = IppProbe(log, srv.Client(), IppProbeValidateJob, uri)
+	if err != nil || state != "" || op != goipp.OpValidateJob {
+		t.Errorf("validate-job: expected alive, got %q, %v", state, err)
+	}
+
+	status = goipp.StatusErrorNotAcceptingJobs
+	_, err = IppProbe(log, srv.Client(), IppProbeValidateJob, uri)
+	if err == nil {
+		t.Errorf("validate-job: IPP error must count as dead")
+	}
+
+	srv.Close()
+	_, err = IppProbe(log, srv.Client(), IppProbeGetPrinterState, uri)
+	if err == nil {
+		t.Errorf("closed server: expected error")
+	}
+}
@@ -0,0 +1,167 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Selection of responsive IPP-over-USB interface
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippIfaceRoundTripper implements http.RoundTripper, sending
+// requests via the particular IPP-over-USB interface
+type ippIfaceRoundTripper struct {
+	transport *UsbTransport // Underlying transport
+	index     int           // Interface index
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (rt ippIfaceRoundTripper) RoundTrip(rq *http.Request) (
+	*http.Response, error) {
+	return rt.transport.RoundTripInterface(rt.index, rq)
+}
+
+// IppSelectInterface selects the IPP-over-USB interface that responds
+// to the IPP request, if device has multiple interfaces. The request
+// is cheap: Get-Printer-Attributes, asking only for "printer-state"
+//
+// Interfaces are probed in the Happy Eyeballs style: request is sent
+// via the first interface, and if it doesn't respond in the
+// IppInterfaceFallbackDelay or fails, via the next one, and so on,
+// while previous requests remain in progress. The first interface
+// that answers wins. Interfaces that have failed are disabled.
+// Requests, still in progress at this moment, are allowed to
+// complete in background, and if they fail, their interfaces
+// are disabled as well
+//
+// Any HTTP response means the interface is responsive, even if
+// HTTP or IPP status is error
+//
+// Path is the IPP print resource path, without leading slash
+//
+// It returns index of the selected interface
+func IppSelectInterface(log *LogMessage, transport *UsbTransport,
+	port int, path string) (int, error) {
+
+	cnt := transport.Interfaces()
+	if cnt < 2 {
+		return 0, nil
+	}
+
+	uri := fmt.Sprintf("http://localhost:%d/%s", port, path)
+	msg := ippProbeRequest(IppProbeGetPrinterState, uri)
+	req, _ := msg.EncodeBytes()
+
+	probe := func(index int) error {
+		c := &http.Client{
+			Transport: ippIfaceRoundTripper{transport, index},
+		}
+
+		resp, err := c.Post(uri, goipp.ContentType, bytes.NewReader(req))
+		if err != nil {
+			return err
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil
+	}
+
+	index, err := ippSelectRace(log, cnt, IppInterfaceFallbackDelay,
+		probe, transport.DisableInterface)
+
+	if err == nil {
+		log.Info(' ', "IPP: selected interface USB[%d]: %s",
+			index, transport.InterfaceAddr(index))
+		transport.SelectInterface(index)
+	}
+
+	return index, err
+}
+
+// ippSelectRace does the actual work for IppSelectInterface. It
+// probes cnt interfaces with the specified fallback delay between
+// attempts, and returns index of the first interface, where probe
+// has succeeded. Interfaces, where probe has failed, are passed to
+// the disable callback, which may be called after return
+func ippSelectRace(log *LogMessage, cnt int, delay time.Duration,
+	probe func(index int) error, disable func(index int)) (int, error) {
+
+	type result struct {
+		index int   // Interface index
+		err   error // Request error
+	}
+
+	results := make(chan result, cnt)
+	pending := 0
+	started := 0
+	failed := []int{}
+
+	start := func() {
+		index := started
+		started++
+		pending++
+
+		go func() {
+			results <- result{index, probe(index)}
+		}()
+	}
+
+	var err error
+	start()
+	next := time.After(delay)
+
+	for pending != 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				for _, index := range failed {
+					disable(index)
+				}
+
+				// Wait for remaining probes in background
+				go func(pending int) {
+					for ; pending != 0; pending-- {
+						if late := <-results; late.err != nil {
+							disable(late.index)
+						}
+					}
+				}(pending)
+
+				return res.index, nil
+			}
+
+			log.Debug('!', "IPP: interface USB[%d]: %s",
+				res.index, res.err)
+			failed = append(failed, res.index)
+			err = res.err
+
+			if started < cnt {
+				start()
+				next = time.After(delay)
+			}
+
+		case <-next:
+			if started < cnt {
+				log.Debug(' ', "IPP: interface USB[%d] not responding, "+
+					"trying USB[%d]", started-1, started)
+				start()
+				next = time.After(delay)
+			}
+		}
+	}
+
+	return -1, err
+}
@@ -0,0 +1,98 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for selection of responsive IPP-over-USB interface
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test selection of responsive interface
+func TestIppSelectRace(t *testing.T) {
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	errFailed := errors.New("I/O error")
+
+	// USB[0] is silent, USB[1] fails, USB[2] answers. Only
+	// USB[1] is disabled, until USB[0] fails later
+	release := make(chan error)
+	disabled := make(chan int, 3)
+
+	index, err := ippSelectRace(log, 3, time.Millisecond,
+		func(index int) error {
+			switch index {
+			case 0:
+				return <-release
+			case 1:
+				return errFailed
+			}
+			return nil
+		},
+		func(index int) { disabled <- index })
+
+	if index != 2 || err != nil {
+		t.Fatalf("expected USB[2] selected, got %d, %v", index, err)
+	}
+
+	if i := <-disabled; i != 1 {
+		t.Errorf("expected USB[1] disabled, got USB[%d]", i)
+	}
+
+	select {
+	case i := <-disabled:
+		t.Errorf("USB[%d] disabled too early", i)
+	default:
+	}
+
+	release <- errFailed
+	select {
+	case i := <-disabled:
+		if i != 0 {
+			t.Errorf("expected USB[0] disabled, got USB[%d]", i)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("late failure of USB[0] not handled")
+	}
+
+	// Slow, but successful interface remains enabled
+	index, err = ippSelectRace(log, 2, time.Millisecond,
+		func(index int) error {
+			if index == 0 {
+				return <-release
+			}
+			return nil
+		},
+		func(index int) { disabled <- index })
+
+	if index != 1 || err != nil {
+		t.Fatalf("expected USB[1] selected, got %d, %v", index, err)
+	}
+
+	release <- nil
+	select {
+	case i := <-disabled:
+		t.Errorf("USB[%d] disabled, but responsive", i)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// All interfaces failed: nothing is disabled
+	index, err = ippSelectRace(log, 2, time.Millisecond,
+		func(index int) error { return errFailed },
+		func(index int) { disabled <- index })
+
+	if index != -1 || err != errFailed {
+		t.Errorf("expected failure, got %d, %v", index, err)
+	}
+
+	if len(disabled) != 0 {
+		t.Errorf("interfaces disabled, while none responded")
+	}
+}
@@ -0,0 +1,82 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IPP Get-Printer-Supported-Values operation
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippGetSupportedValuesRequest builds the Get-Printer-Supported-Values
+// request. Without "requested-attributes", printer returns supported
+// values of all its settable attributes
+func ippGetSupportedValuesRequest(uri string,
+	ver goipp.Version) *goipp.Message {
+	msg := ippNewRequest(goipp.OpGetPrinterSupportedValues, uri,
+		goipp.MakeAttribute("requesting-user-name",
+			goipp.TagName, goipp.String("ipp-usb")))
+	msg.Version = ver
+
+	return msg
+}
+
+// ippDecodeSupportedValues decodes the Get-Printer-Supported-Values
+// response into the map of attribute names to textual values
+//
+// Out-of-band values (no-value, unknown and so on) are skipped.
+// In a case of duplicated attributes, first occurrence wins
+func ippDecodeSupportedValues(attrs goipp.Attributes) map[string][]string {
+	vals := make(map[string][]string)
+
+	for _, attr := range attrs {
+		if _, dup := vals[attr.Name]; dup {
+			continue
+		}
+
+		strs := []string{}
+		for _, v := range attr.Values {
+			if v.V.Type() != goipp.TypeVoid {
+				strs = append(strs, v.V.String())
+			}
+		}
+
+		vals[attr.Name] = strs
+	}
+
+	return vals
+}
+
+// IppGetSupportedValues performs Get-Printer-Supported-Values
+// operation and returns supported values of printer attributes
+//
+// If device doesn't support this operation, ErrNotSupported
+// is returned
+func IppGetSupportedValues(log *LogMessage, c *http.Client,
+	uri string, ver goipp.Version) (map[string][]string, error) {
+
+	rsp, err := ippDoRequest(log, c, uri,
+		ippGetSupportedValuesRequest(uri, ver))
+	if err != nil {
+		return nil, err
+	}
+
+	status := goipp.Status(rsp.Code)
+	log.Debug(' ', "IPP Get-Printer-Supported-Values: %s", status)
+
+	switch {
+	case status == goipp.StatusErrorOperationNotSupported:
+		return nil, ErrNotSupported
+	case status >= 0x0100:
+		return nil, fmt.Errorf("IPP: %s", status)
+	}
+
+	return ippDecodeSupportedValues(rsp.Printer), nil
+}
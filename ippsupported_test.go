@@ -0,0 +1,66 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP Get-Printer-Supported-Values operation
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Test decoding of the Get-Printer-Supported-Values response
+func TestIppDecodeSupportedValues(t *testing.T) {
+	var attrs goipp.Attributes
+
+	attr := goipp.Attribute{Name: "printer-info"}
+	attr.Values.Add(goipp.TagInteger, goipp.Integer(127))
+	attrs.Add(attr)
+
+	attr = goipp.Attribute{Name: "printer-location"}
+	attr.Values.Add(goipp.TagInteger, goipp.Integer(127))
+	attrs.Add(attr)
+
+	attr = goipp.Attribute{Name: "media-default"}
+	attr.Values.Add(goipp.TagKeyword, goipp.String("iso_a4_210x297mm"))
+	attr.Values.Add(goipp.TagKeyword, goipp.String("na_letter_8.5x11in"))
+	attrs.Add(attr)
+
+	// Out-of-band values are skipped
+	attrs.Add(goipp.MakeAttribute("printer-geo-location",
+		goipp.TagNoValue, goipp.Void{}))
+
+	// First occurrence wins
+	attrs.Add(goipp.MakeAttribute("media-default",
+		goipp.TagKeyword, goipp.String("iso_a3_297x420mm")))
+
+	expected := map[string][]string{
+		"printer-info":         {"127"},
+		"printer-location":     {"127"},
+		"media-default":        {"iso_a4_210x297mm", "na_letter_8.5x11in"},
+		"printer-geo-location": {},
+	}
+
+	vals := ippDecodeSupportedValues(attrs)
+	if !reflect.DeepEqual(vals, expected) {
+		t.Errorf("expected %v, got %v", expected, vals)
+	}
+
+	// Request must be properly encoded
+	msg := ippGetSupportedValuesRequest("http://localhost:60000/ipp/print",
+		goipp.DefaultVersion)
+	if _, err := msg.EncodeBytes(); err != nil {
+		t.Errorf("%s", err)
+	}
+
+	if goipp.Op(msg.Code) != goipp.OpGetPrinterSupportedValues {
+		t.Errorf("expected %s, got %s",
+			goipp.OpGetPrinterSupportedValues, goipp.Op(msg.Code))
+	}
+}
@@ -0,0 +1,136 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * IPP protocol version negotiation
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// ippVersionProbe is the IPP version, used for the minimal
+// query of "ipp-versions-supported". IPP/1.1 is the baseline,
+// implemented by all IPP-over-USB devices
+const ippVersionProbe = goipp.Version(0x0101)
+
+// ippVersionMax is the highest IPP version, ipp-usb speaks
+const ippVersionMax = goipp.DefaultVersion
+
+// ippParseVersion parses IPP version string ("major.minor")
+func ippParseVersion(s string) (goipp.Version, bool) {
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0, false
+	}
+
+	major, err := strconv.ParseUint(s[:i], 10, 8)
+	if err != nil || major == 0 {
+		return 0, false
+	}
+
+	minor, err := strconv.ParseUint(s[i+1:], 10, 8)
+	if err != nil {
+		return 0, false
+	}
+
+	return goipp.MakeVersion(uint8(major), uint8(minor)), true
+}
+
+// getVersions returns IPP versions, decoded from the
+// "ipp-versions-supported" attribute. Malformed values
+// are skipped
+func (attrs ippAttrs) getVersions() []goipp.Version {
+	versions := []goipp.Version{}
+	for _, s := range attrs.getStrings("ipp-versions-supported") {
+		if ver, ok := ippParseVersion(s); ok {
+			versions = append(versions, ver)
+		}
+	}
+
+	return versions
+}
+
+// ippChooseVersion returns the highest of device-supported IPP
+// versions, supported by ipp-usb as well, or 0 if there is none
+func ippChooseVersion(versions []goipp.Version) goipp.Version {
+	var best goipp.Version
+	for _, ver := range versions {
+		if ver <= ippVersionMax && ver > best {
+			best = ver
+		}
+	}
+
+	return best
+}
+
+// ippGetVersionsSupported performs the minimal Get-Printer-Attributes
+// query, requesting only the "ipp-versions-supported" attribute
+func ippGetVersionsSupported(log *LogMessage, c *http.Client,
+	uri string) ([]goipp.Version, error) {
+
+	msg := ippNewRequest(goipp.OpGetPrinterAttributes, uri,
+		goipp.MakeAttribute("requested-attributes",
+			goipp.TagKeyword, goipp.String("ipp-versions-supported")))
+	msg.Version = ippVersionProbe
+
+	rsp, err := ippDoRequest(log, c, uri, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Code >= 100 {
+		return nil, fmt.Errorf("IPP: %s", goipp.Status(rsp.Code))
+	}
+
+	return newIppDecoder(rsp).getVersions(), nil
+}
+
+// ippGetVersion returns IPP version to be used for the device queries
+//
+// Unless version is forced by configuration, it is negotiated, based
+// on device's "ipp-versions-supported", and cached in the DevState
+// (state may be nil, if caching is not needed). If negotiation fails,
+// goipp.DefaultVersion is used and nothing is cached, so negotiation
+// will be repeated next time
+func ippGetVersion(log *LogMessage, c *http.Client, uri string,
+	state *DevState) goipp.Version {
+
+	if Conf.IppVersion != 0 {
+		return Conf.IppVersion
+	}
+
+	if state != nil && state.IppVersion != 0 {
+		return state.IppVersion
+	}
+
+	versions, err := ippGetVersionsSupported(log, c, uri)
+	if err != nil {
+		log.Debug('!', "IPP: ipp-versions-supported: %s", err)
+		return goipp.DefaultVersion
+	}
+
+	ver := ippChooseVersion(versions)
+	if ver == 0 {
+		log.Debug('!', "IPP: no usable ipp-versions-supported, using %s",
+			goipp.DefaultVersion)
+		return goipp.DefaultVersion
+	}
+
+	log.Debug(' ', "IPP: using version %s", ver)
+
+	if state != nil {
+		state.IppVersion = ver
+		state.Save()
+	}
+
+	return ver
+}
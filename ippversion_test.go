@@ -0,0 +1,114 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for IPP protocol version negotiation
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Test IPP version negotiation with device that supports only IPP/1.1
+func TestIppVersionNegotiation(t *testing.T) {
+	save := Conf.IppVersion
+	defer func() { Conf.IppVersion = save }()
+	Conf.IppVersion = 0
+
+	versions := []goipp.Version{}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			rq := &goipp.Message{}
+			rq.DecodeBytes(data)
+			versions = append(versions, rq.Version)
+
+			status := goipp.StatusOk
+			if rq.Version > goipp.MakeVersion(1, 1) {
+				status = goipp.StatusErrorVersionNotSupported
+			}
+
+			rsp := goipp.NewResponse(goipp.MakeVersion(1, 1),
+				status, rq.RequestID)
+			attr := goipp.Attribute{Name: "ipp-versions-supported"}
+			attr.Values.Add(goipp.TagKeyword, goipp.String("1.0"))
+			attr.Values.Add(goipp.TagKeyword, goipp.String("1.1"))
+			rsp.Printer.Add(attr)
+			rsp.Printer.Add(goipp.MakeAttribute("printer-info",
+				goipp.TagText, goipp.String("Test Printer")))
+
+			w.Header().Set("Content-Type", goipp.ContentType)
+			rsp.Encode(w)
+		}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	var services DNSSdServices
+	_, err := IppService(log, &services, port, UsbDeviceInfo{},
+		nil, nil, srv.Client())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(versions))
+	}
+
+	for i, ver := range versions {
+		if ver != goipp.MakeVersion(1, 1) {
+			t.Errorf("request %d: expected IPP/1.1, got %s", i, ver)
+		}
+	}
+
+	// Cached version is used without query
+	versions = versions[:0]
+	state := &DevState{IppVersion: goipp.MakeVersion(1, 0)}
+	ver := ippGetVersion(log, srv.Client(), srv.URL+"/ipp/print", state)
+	if ver != goipp.MakeVersion(1, 0) || len(versions) != 0 {
+		t.Errorf("cached: expected 1.0 and no requests, got %s and %d",
+			ver, len(versions))
+	}
+
+	// Version choice
+	tests := []struct {
+		versions []string
+		expected goipp.Version
+	}{
+		{[]string{"1.0", "1.1"}, goipp.MakeVersion(1, 1)},
+		{[]string{"1.1", "2.0", "2.2"}, goipp.MakeVersion(2, 0)},
+		{[]string{"3.0", "x.y", "1"}, 0},
+		{nil, 0},
+	}
+
+	for _, test := range tests {
+		var attrs []goipp.Attribute
+		if len(test.versions) != 0 {
+			attr := goipp.Attribute{Name: "ipp-versions-supported"}
+			for _, s := range test.versions {
+				attr.Values.Add(goipp.TagKeyword, goipp.String(s))
+			}
+			attrs = append(attrs, attr)
+		}
+
+		ver := ippChooseVersion(testIppAttrs(attrs...).getVersions())
+		if ver != test.expected {
+			t.Errorf("%q: expected %s, got %s",
+				test.versions, test.expected, ver)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Capture of print jobs for debugging
+ *
+ * If enabled by the capture-jobs quirk, IPP request bodies of
+ * print operations are written, as they come from client, into
+ * files in the per-device capture directory. Each job goes into
+ * a separate file, only the latest files are preserved
+ *
+ * Capture never blocks the proxied request: data is passed to the
+ * writer goroutine via the buffered channel, and if writer doesn't
+ * keep up, the rest of the job is not captured
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// jobCaptureQueue is the capacity of the channel between
+// the captured request body and the writer goroutine, in
+// chunks of data
+const jobCaptureQueue = 64
+
+// JobCapture writes print jobs, proxied to the device, into files
+type JobCapture struct {
+	log  *LogMessage    // Logger instance
+	dir  string         // Directory for captured jobs
+	lock sync.Mutex     // Serializes rotation
+	wait sync.WaitGroup // Pending writers
+}
+
+// NewJobCapture creates a new JobCapture, that writes files
+// into the specified directory
+func NewJobCapture(log *LogMessage, dir string) *JobCapture {
+	log.Info('!', "JOBS: capture enabled, files are saved in %s", dir)
+	log.Info('!', "JOBS: captured files may contain document data")
+
+	return &JobCapture{log: log, dir: dir}
+}
+
+// JobCaptureOp tells if operation is the print operation,
+// request of which should be captured
+func JobCaptureOp(op goipp.Op) bool {
+	switch op {
+	case goipp.OpPrintJob, goipp.OpSendDocument:
+		return true
+	}
+
+	return false
+}
+
+// Capture wraps the request body, so data, read from it, is
+// captured into a new file
+func (jc *JobCapture) Capture(session int, op goipp.Op,
+	body io.ReadCloser) io.ReadCloser {
+
+	name := fmt.Sprintf("%s-%4.4d.ipp",
+		time.Now().Format("20060102-150405"), session)
+
+	rd := &jobCaptureReader{
+		ReadCloser: body,
+		ch:         make(chan []byte, jobCaptureQueue),
+	}
+
+	jc.log.Debug(' ', "JOBS: capturing %s into %s", op, name)
+
+	jc.wait.Add(1)
+	go jc.write(name, rd)
+
+	return rd
+}
+
+// Close waits until all pending jobs are written
+func (jc *JobCapture) Close() {
+	jc.wait.Wait()
+}
+
+// write writes the captured job into the file
+func (jc *JobCapture) write(name string, rd *jobCaptureReader) {
+	defer jc.wait.Done()
+
+	var file *os.File
+	err := os.MkdirAll(jc.dir, 0700)
+	if err == nil {
+		jc.rotate()
+		file, err = os.OpenFile(filepath.Join(jc.dir, name),
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+
+	var size int64
+	truncated := false
+
+	for data := range rd.ch {
+		if err != nil {
+			continue
+		}
+
+		if rest := Conf.LogCaptureSize - size; int64(len(data)) > rest {
+			data = data[:rest]
+			truncated = true
+		}
+
+		var n int
+		n, err = file.Write(data)
+		size += int64(n)
+	}
+
+	if file != nil {
+		file.Close()
+	}
+
+	switch {
+	case err != nil:
+		jc.log.Error('!', "JOBS: capture %s: %s", name, err)
+	case rd.dropped:
+		jc.log.Info('!', "JOBS: %s: %d bytes, incomplete (writer too slow)",
+			name, size)
+	case truncated:
+		jc.log.Info('!', "JOBS: %s: truncated at %d bytes", name, size)
+	default:
+		jc.log.Debug(' ', "JOBS: %s: %d bytes captured", name, size)
+	}
+}
+
+// rotate removes the oldest captured files, leaving room for
+// the new one
+func (jc *JobCapture) rotate() {
+	jc.lock.Lock()
+	defer jc.lock.Unlock()
+
+	entries, err := ioutil.ReadDir(jc.dir)
+	if err != nil {
+		return
+	}
+
+	var files []string
+	for _, ent := range entries {
+		if ent.Mode().IsRegular() &&
+			strings.HasSuffix(ent.Name(), ".ipp") {
+			files = append(files, ent.Name())
+		}
+	}
+
+	// Names start with the timestamp, so the oldest files go first
+	sort.Strings(files)
+
+	for len(files) >= int(Conf.LogCaptureFiles) {
+		os.Remove(filepath.Join(jc.dir, files[0]))
+		files = files[1:]
+	}
+}
+
+// jobCaptureReader wraps the request body and passes data, read
+// from it, to the writer goroutine
+type jobCaptureReader struct {
+	io.ReadCloser             // Underlying body
+	ch            chan []byte // Captured data
+	lock          sync.Mutex  // Access lock
+	done          bool        // Channel is closed
+	dropped       bool        // Some data was dropped
+}
+
+// Read reads the body and captures data
+func (rd *jobCaptureReader) Read(buf []byte) (int, error) {
+	n, err := rd.ReadCloser.Read(buf)
+
+	rd.lock.Lock()
+	if n > 0 && !rd.done {
+		select {
+		case rd.ch <- append([]byte(nil), buf[:n]...):
+		default:
+			// Writer doesn't keep up. Don't wait for it,
+			// stop capturing instead
+			rd.dropped = true
+			rd.finish()
+		}
+	}
+
+	if err != nil && !rd.done {
+		rd.finish()
+	}
+	rd.lock.Unlock()
+
+	return n, err
+}
+
+// Close closes the body and completes the capture
+func (rd *jobCaptureReader) Close() error {
+	rd.lock.Lock()
+	if !rd.done {
+		rd.finish()
+	}
+	rd.lock.Unlock()
+
+	return rd.ReadCloser.Close()
+}
+
+// finish completes the capture. Must be called under the lock
+func (rd *jobCaptureReader) finish() {
+	rd.done = true
+	close(rd.ch)
+}
@@ -0,0 +1,71 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for capture of print jobs
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// Test capture of print jobs, with size limit and rotation
+func TestJobCapture(t *testing.T) {
+	saveSize, saveFiles := Conf.LogCaptureSize, Conf.LogCaptureFiles
+	defer func() {
+		Conf.LogCaptureSize, Conf.LogCaptureFiles = saveSize, saveFiles
+	}()
+
+	Conf.LogCaptureSize = 8
+	Conf.LogCaptureFiles = 2
+
+	dir, err := ioutil.TempDir("", "ipp-usb-capture")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	jc := NewJobCapture(NewLogger().Begin(), dir)
+
+	jobs := []string{"job1", "job2", "job3-long-body"}
+	for i, job := range jobs {
+		body := ioutil.NopCloser(bytes.NewBufferString(job))
+		rd := jc.Capture(i+1, goipp.OpPrintJob, body)
+
+		// Proxied data must be passed as is
+		data, _ := ioutil.ReadAll(rd)
+		rd.Close()
+		if string(data) != job {
+			t.Errorf("job %d: expected %q, got %q", i+1, job, data)
+		}
+
+		jc.Close()
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ipp"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	expected := []string{"job2", "job3-lon"}
+	for i, file := range files {
+		data, _ := ioutil.ReadFile(file)
+		if string(data) != expected[i] {
+			t.Errorf("%s: expected %q, got %q",
+				filepath.Base(file), expected[i], data)
+		}
+	}
+
+	if JobCaptureOp(goipp.OpGetPrinterAttributes) {
+		t.Errorf("%s must not be captured", goipp.OpGetPrinterAttributes)
+	}
+}
@@ -16,6 +16,10 @@ import (
 
 // Listener wraps net.Listener
 //
+// Optionally, it limits the rate of accepted connections.
+// Excessive connections are not rejected, but remain queued
+// in the listen backlog, until accepted
+//
 // Note, if IP address is not specified, go stdlib
 // creates a beautiful listener, able to listen to
 // IPv4 and IPv6 simultaneously. But it cannot do it,
@@ -26,7 +30,9 @@ import (
 // that create separate IPv4 and IPv6 listeners and dial with
 // them both
 type Listener struct {
-	net.Listener // Underlying net.Listener
+	net.Listener              // Underlying net.Listener
+	limit        *RateLimiter // Accept rate limiter, nil if none
+	throttled    bool         // Limiter has engaged, for logging
 }
 
 // NewListener creates new listener
@@ -40,18 +46,44 @@ func NewListener(port int) (net.Listener, error) {
 	addr := ":" + strconv.Itoa(port)
 
 	// Create net.Listener
-	nl, err := net.Listen(network, addr)
+	var nl net.Listener
+	var err error
+
+	if Conf.HTTPBacklog != 0 {
+		nl, err = listenBacklog(port, int(Conf.HTTPBacklog))
+	} else {
+		nl, err = net.Listen(network, addr)
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
 	// Wrap into Listener
-	return Listener{nl}, nil
+	return &Listener{
+		Listener: nl,
+		limit:    NewRateLimiter(Conf.HTTPAcceptRate),
+	}, nil
 }
 
 // Accept new connection
-func (l Listener) Accept() (net.Conn, error) {
+func (l *Listener) Accept() (net.Conn, error) {
 	for {
+		// Limit accept rate
+		if l.limit != nil {
+			delay := l.limit.Wait(1)
+			switch {
+			case delay > 0 && !l.throttled:
+				Log.Debug(' ', "HTTP %s: accept rate limit engaged",
+					l.Addr())
+				l.throttled = true
+			case delay == 0 && l.throttled:
+				Log.Debug(' ', "HTTP %s: accept rate limit released",
+					l.Addr())
+				l.throttled = false
+			}
+		}
+
 		// Accept new connection
 		conn, err := l.Listener.Accept()
 		if err != nil {
@@ -0,0 +1,77 @@
+// +build linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP listener with custom backlog -- Linux version
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenBacklog creates TCP listener with the specified backlog
+//
+// Go stdlib always uses the system default backlog, so socket
+// is created manually and then converted into net.Listener
+func listenBacklog(port, backlog int) (net.Listener, error) {
+	family := syscall.AF_INET
+	if Conf.IPV6Enable {
+		family = syscall.AF_INET6
+	}
+
+	fd, err := listenSocket(family)
+	if err == syscall.EAFNOSUPPORT && family == syscall.AF_INET6 {
+		// IPv6 disabled in kernel
+		family = syscall.AF_INET
+		fd, err = listenSocket(family)
+	}
+
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+		syscall.SO_REUSEADDR, 1)
+
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{Port: port}
+	if err == nil && family == syscall.AF_INET6 {
+		// Listen to IPv4 and IPv6 simultaneously
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6,
+			syscall.IPV6_V6ONLY, 0)
+		sa = &syscall.SockaddrInet6{Port: port}
+	}
+
+	if err == nil {
+		err = syscall.Bind(fd, sa)
+	}
+
+	if err == nil {
+		err = syscall.Listen(fd, backlog)
+	}
+
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("tcp:%d", port))
+	nl, err := net.FileListener(file)
+	file.Close()
+
+	return nl, err
+}
+
+// listenSocket creates a socket for listenBacklog
+func listenSocket(family int) (int, error) {
+	return syscall.Socket(family,
+		syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK,
+		syscall.IPPROTO_TCP)
+}
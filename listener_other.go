@@ -0,0 +1,29 @@
+// +build !linux
+
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * HTTP listener with custom backlog -- generic version
+ */
+
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// listenBacklog creates TCP listener
+//
+// Custom backlog is not supported on this platform, so the
+// system default backlog is used
+func listenBacklog(port, backlog int) (net.Listener, error) {
+	network := "tcp4"
+	if Conf.IPV6Enable {
+		network = "tcp"
+	}
+
+	return net.Listen(network, ":"+strconv.Itoa(port))
+}
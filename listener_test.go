@@ -0,0 +1,160 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for HTTP listener
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test listener with custom backlog and accept rate limit
+func TestListenerAcceptRate(t *testing.T) {
+	saveBacklog, saveRate := Conf.HTTPBacklog, Conf.HTTPAcceptRate
+	defer func() {
+		Conf.HTTPBacklog, Conf.HTTPAcceptRate = saveBacklog, saveRate
+	}()
+
+	Conf.HTTPBacklog = 16
+	Conf.HTTPAcceptRate = 20
+
+	l, err := NewListener(0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer l.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// All connections are queued, while not accepted
+	const count = 5
+	for i := 0; i < count; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("dial: %s", err)
+		}
+		defer conn.Close()
+	}
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("accept: %s", err)
+		}
+		conn.Close()
+	}
+
+	// The first connection is accepted immediately, the rest
+	// are paced at 50 ms
+	elapsed := time.Since(start)
+	if min := (count - 1) * 50 * time.Millisecond * 9 / 10; elapsed < min {
+		t.Errorf("%d connections accepted in %s, rate exceeded",
+			count, elapsed)
+	}
+}
+
+// Test Unix domain socket listener
+func TestListenerUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipp-usb-test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	save := Conf.HTTPUnixDir
+	defer func() { Conf.HTTPUnixDir = save }()
+
+	Conf.HTTPUnixDir = dir
+	state := &DevState{Ident: "1234-5678-SERIAL-Test-Printer"}
+
+	path := state.HTTPSocketPath()
+	if path != filepath.Join(dir, state.Ident+".sock") {
+		t.Errorf("unexpected socket path %q", path)
+	}
+
+	l, err := state.HTTPListen()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+
+	if string(data) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", data)
+	}
+
+	// Socket file must be removed on close
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed on close")
+	}
+
+	// Without unix-socket-dir, there is no socket path
+	Conf.HTTPUnixDir = ""
+	if path := state.HTTPSocketPath(); path != "" {
+		t.Errorf("unexpected socket path %q", path)
+	}
+}
+
+// Test listener on the pinned port
+func TestListenerPinnedPort(t *testing.T) {
+	save := Conf.DevicePorts
+	defer func() { Conf.DevicePorts = save }()
+
+	busy, err := NewListener(0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	port := busy.Addr().(*net.TCPAddr).Port
+	state := &DevState{Ident: "1234-5678-SERIAL-Test-Printer",
+		HTTPPort: port}
+	Conf.DevicePorts = map[string]int{state.Ident: port}
+
+	if !devStatePortPinned(port) {
+		t.Errorf("port %d: not reported as pinned", port)
+	}
+
+	// Busy pinned port is an error, no fallback to another port
+	if l, err := state.HTTPListen(); err == nil {
+		l.Close()
+		t.Errorf("busy pinned port: error expected")
+	}
+
+	busy.Close()
+
+	l, err := state.HTTPListen()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer l.Close()
+
+	if p := l.Addr().(*net.TCPAddr).Port; p != port {
+		t.Errorf("expected port %d, got %d", port, p)
+	}
+}
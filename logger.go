@@ -64,6 +64,51 @@ const (
 	LogTraceAll = LogTraceIPP | LogTraceESCL | LogTraceHTTP | LogTraceUSB
 )
 
+// LogSubsys enumerates subsystems, log messages may be tagged with,
+// for selective verbosity
+type LogSubsys int
+
+const (
+	LogSubsysNone  LogSubsys = iota // Not tagged, never filtered
+	LogSubsysUSB                    // USB transport
+	LogSubsysIPP                    // IPP printer
+	LogSubsysESCL                   // eSCL scanner
+	LogSubsysDNSSd                  // DNS-SD publishing
+	LogSubsysProxy                  // HTTP proxy
+	logSubsysMax
+)
+
+// logSubsysNames contains names of subsystems, as used
+// in the configuration file (i.e., "usb-log")
+var logSubsysNames = [logSubsysMax]string{
+	LogSubsysUSB:   "usb",
+	LogSubsysIPP:   "ipp",
+	LogSubsysESCL:  "escl",
+	LogSubsysDNSSd: "dns-sd",
+	LogSubsysProxy: "proxy",
+}
+
+// LogSubsysLevels contains log levels of all subsystems
+type LogSubsysLevels [logSubsysMax]LogLevel
+
+// MakeLogSubsysLevels makes LogSubsysLevels with the same
+// levels for all subsystems
+func MakeLogSubsysLevels(levels LogLevel) LogSubsysLevels {
+	var out LogSubsysLevels
+	for i := range out {
+		out[i] = levels
+	}
+	return out
+}
+
+// String returns name of the subsystem
+func (subsys LogSubsys) String() string {
+	if subsys > LogSubsysNone && subsys < logSubsysMax {
+		return logSubsysNames[subsys]
+	}
+	return fmt.Sprintf("LogSubsys(%d)", int(subsys))
+}
+
 // Adjust LogLevel mask, so more detailed log levels
 // imply less detailed
 func (levels *LogLevel) Adjust() {
@@ -91,7 +136,7 @@ const (
 // Logger implements logging facilities
 type Logger struct {
 	LogMessage                 // "Root" log message
-	levels     LogLevel        // Levels generated by this logger
+	levels     int32           // Levels generated by this logger, atomic
 	ccLevels   LogLevel        // Sum of Cc's levels
 	paused     int32           // Logger paused, if counter > 0
 	mode       loggerMode      // Logger mode
@@ -102,6 +147,9 @@ type Logger struct {
 	outhook    func(io.Writer, // Output hook
 		LogLevel, []byte)
 
+	// Per-subsystem levels, atomic (see SetSubsysLevels)
+	subsys [logSubsysMax]int32
+
 	// Don't reexport these methods from the root message
 	Commit, Flush, Reject struct{}
 }
@@ -112,7 +160,7 @@ type Logger struct {
 func NewLogger() *Logger {
 	l := &Logger{
 		mode:     loggerNoMode,
-		levels:   LogAll,
+		levels:   int32(LogAll),
 		ccLevels: 0,
 		outhook: func(w io.Writer, _ LogLevel, line []byte) {
 			w.Write(line)
@@ -121,6 +169,10 @@ func NewLogger() *Logger {
 
 	l.LogMessage.logger = l
 
+	for i := range l.subsys {
+		l.subsys[i] = int32(LogAll)
+	}
+
 	return l
 }
 
@@ -187,7 +239,7 @@ func (l *Logger) ToDevFile(info UsbDeviceInfo) *Logger {
 //   LogInfo implies LogError
 func (l *Logger) Cc(to *Logger) *Logger {
 	l.cc = append(l.cc, to)
-	l.ccLevels |= to.levels
+	l.ccLevels |= to.getLevels()
 
 	return l
 }
@@ -202,12 +254,47 @@ func (l *Logger) Close() {
 }
 
 // SetLevels set logger's log levels
+//
+// Levels may be changed, while logger is in use (i.e., on
+// configuration reload)
 func (l *Logger) SetLevels(levels LogLevel) *Logger {
 	levels.Adjust()
-	l.levels = levels
+	atomic.StoreInt32(&l.levels, int32(levels))
 	return l
 }
 
+// getLevels returns logger's log levels
+func (l *Logger) getLevels() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.levels))
+}
+
+// SetSubsysLevels sets per-subsystem log levels of the logger
+// (see Conf.LogSubsys)
+//
+// Like SetLevels, it may be called while logger is in use
+func (l *Logger) SetSubsysLevels(levels LogSubsysLevels) *Logger {
+	for i := range levels {
+		levels[i].Adjust()
+		atomic.StoreInt32(&l.subsys[i], int32(levels[i]))
+	}
+	return l
+}
+
+// getSubsysLevels returns logger's log levels of the subsystem
+func (l *Logger) getSubsysLevels(subsys LogSubsys) LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.subsys[subsys]))
+}
+
+// Subsys returns the logger's view, tagged with the subsystem.
+// Messages, written via this view, are additionally filtered by
+// the subsystem's log levels (see SetSubsysLevels)
+//
+// The view may be shared by many goroutines and doesn't need to
+// be committed, like the logger itself
+func (l *Logger) Subsys(subsys LogSubsys) *LogMessage {
+	return &LogMessage{logger: l, subsys: subsys}
+}
+
 // Pause the logger. All output will be buffered,
 // and flushed to destination when logger is resumed
 func (l *Logger) Pause() *Logger {
@@ -335,6 +422,7 @@ func (l *Logger) gzip(ipath, opath string) error {
 type LogMessage struct {
 	logger *Logger       // Underlying logger
 	parent *LogMessage   // Parent message
+	subsys LogSubsys     // Subsystem the message is tagged with
 	lines  []*logLineBuf // One buffer per line
 }
 
@@ -347,14 +435,38 @@ func (msg *LogMessage) Begin() *LogMessage {
 	msg2 := logMessagePool.Get().(*LogMessage)
 	msg2.logger = msg.logger
 	msg2.parent = msg
+	msg2.subsys = msg.subsys
 	return msg2
 }
 
+// BeginSubsys returns a child (nested) LogMessage, like Begin,
+// tagged with the subsystem
+func (msg *LogMessage) BeginSubsys(subsys LogSubsys) *LogMessage {
+	msg2 := msg.Begin()
+	msg2.subsys = subsys
+	return msg2
+}
+
+// enabled checks if line of the specified level will be
+// generated, taking subsystem into account. Errors are
+// never filtered by subsystem
+func (msg *LogMessage) enabled(level LogLevel) bool {
+	if (msg.logger.getLevels()|msg.logger.ccLevels)&level == 0 {
+		return false
+	}
+
+	if msg.subsys == LogSubsysNone || level == LogError {
+		return true
+	}
+
+	return msg.logger.getSubsysLevels(msg.subsys)&level != 0
+}
+
 // Add formats a next line of log message, with level and prefix char
 func (msg *LogMessage) Add(level LogLevel, prefix byte,
 	format string, args ...interface{}) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.enabled(level) {
 		buf := logLineBufAlloc(level, prefix)
 		fmt.Fprintf(buf, format, args...)
 
@@ -371,7 +483,7 @@ func (msg *LogMessage) Nl(level LogLevel) *LogMessage {
 
 // addBytes adds a next line of log message, taking slice of bytes as input
 func (msg *LogMessage) addBytes(level LogLevel, prefix byte, line []byte) *LogMessage {
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.enabled(level) {
 		buf := logLineBufAlloc(level, prefix)
 		buf.Write(line)
 
@@ -385,12 +497,14 @@ func (msg *LogMessage) addBytes(level LogLevel, prefix byte, line []byte) *LogMe
 func (msg *LogMessage) appendLineBuf(buf *logLineBuf) {
 	if msg.parent == nil {
 		// Note, many threads may write to the root
-		// message simultaneously
+		// message simultaneously. Subsystem views of
+		// the logger write directly to its root message
+		root := &msg.logger.LogMessage
 		msg.logger.lock.Lock()
-		msg.lines = append(msg.lines, buf)
+		root.lines = append(root.lines, buf)
 		msg.logger.lock.Unlock()
 
-		msg.Flush()
+		root.Flush()
 	} else {
 		msg.lines = append(msg.lines, buf)
 	}
@@ -437,7 +551,7 @@ func (msg *LogMessage) Check(err error) {
 func (msg *LogMessage) HexDump(level LogLevel, prefix byte,
 	data []byte) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if !msg.enabled(level) {
 		return msg
 	}
 
@@ -492,7 +606,7 @@ func (msg *LogMessage) HexDump(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 	session int, rq *http.Request) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if !msg.enabled(level) {
 		return msg
 	}
 
@@ -525,7 +639,7 @@ func (msg *LogMessage) HTTPRequest(level LogLevel, prefix byte,
 func (msg *LogMessage) HTTPResponse(level LogLevel, prefix byte,
 	session int, rsp *http.Response) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level == 0 {
+	if !msg.enabled(level) {
 		return msg
 	}
 
@@ -603,7 +717,7 @@ func (msg *LogMessage) HTTPDebug(prefix byte,
 func (msg *LogMessage) IppRequest(level LogLevel, prefix byte,
 	m *goipp.Message) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.enabled(level) {
 		m.Print(msg.LineWriter(level, prefix), true)
 	}
 	return msg
@@ -613,7 +727,7 @@ func (msg *LogMessage) IppRequest(level LogLevel, prefix byte,
 func (msg *LogMessage) IppResponse(level LogLevel, prefix byte,
 	m *goipp.Message) *LogMessage {
 
-	if (msg.logger.levels|msg.logger.ccLevels)&level != 0 {
+	if msg.enabled(level) {
 		m.Print(msg.LineWriter(level, prefix), false)
 	}
 	return msg
@@ -650,16 +764,24 @@ func (msg *LogMessage) Flush() {
 	}
 
 	// If message has a parent, simply flush our content there
+	//
+	// If our parent is root, we need to flush root as well.
+	// If parent is a subsystem view, its root message is
+	// used instead
 	if msg.parent != nil {
-		msg.parent.lines = append(msg.parent.lines, msg.lines...)
+		parent := msg.parent
+		if parent.parent == nil {
+			parent = &msg.logger.LogMessage
+		}
+
+		parent.lines = append(parent.lines, msg.lines...)
 		msg.lines = msg.lines[:0]
 
-		// If our parent is root, we need to flush root as well
-		if msg.parent.parent == nil {
-			msg = msg.parent
-		} else {
+		if parent != &msg.logger.LogMessage {
 			return
 		}
+
+		msg = parent
 	}
 
 	// Do nothing, if logger is paused
@@ -693,10 +815,11 @@ func (msg *LogMessage) Flush() {
 		cclist = append(cclist, struct {
 			levels LogLevel
 			msg    *LogMessage
-		}{cc.levels, cc.Begin()})
+		}{cc.getLevels(), cc.Begin()})
 	}
 
 	// Send message content to the logger
+	levels := msg.logger.getLevels()
 	buf := msg.logger.fmtTime()
 	defer buf.free()
 
@@ -706,7 +829,7 @@ func (msg *LogMessage) Flush() {
 
 		// Generate own output
 		buf.Truncate(timeLen)
-		if l.level&msg.logger.levels != 0 {
+		if l.level&levels != 0 {
 			if !l.empty() {
 				if timeLen != 0 {
 					buf.WriteByte(' ')
@@ -758,6 +881,7 @@ func (msg *LogMessage) free() {
 	}
 
 	msg.logger = nil
+	msg.subsys = LogSubsysNone
 
 	logMessagePool.Put(msg)
 }
@@ -0,0 +1,65 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for logging
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Test per-subsystem filtering of log messages
+func TestLoggerSubsys(t *testing.T) {
+	levels := MakeLogSubsysLevels(LogAll)
+	levels[LogSubsysUSB] = LogInfo | LogError
+
+	buf := &bytes.Buffer{}
+	l := NewLogger().ToConsole().SetSubsysLevels(levels)
+	l.out = buf
+
+	usb := l.Subsys(LogSubsysUSB)
+	proxy := l.Subsys(LogSubsysProxy)
+
+	l.Debug(' ', "untagged debug")
+	usb.Debug(' ', "usb debug")
+	usb.Info(' ', "usb info")
+	usb.Error(' ', "usb error")
+	proxy.Debug(' ', "proxy debug")
+
+	msg := usb.Begin()
+	msg.Debug(' ', "usb child debug")
+	msg.Info(' ', "usb child info")
+	msg.Commit()
+
+	msg = l.BeginSubsys(LogSubsysUSB)
+	msg.Debug(' ', "usb tagged child debug")
+	msg.Commit()
+
+	// Logging must not depend on ConfLock, that is held
+	// while configuration is reloaded
+	ConfLock.Lock()
+	usb.Info(' ', "usb info under ConfLock")
+	ConfLock.Unlock()
+
+	out := buf.String()
+	for _, s := range []string{"untagged debug", "usb info",
+		"usb error", "proxy debug", "usb child info",
+		"usb info under ConfLock"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q: missed in the log", s)
+		}
+	}
+
+	for _, s := range []string{"usb debug", "usb child debug",
+		"usb tagged child debug"} {
+		if strings.Contains(out, s) {
+			t.Errorf("%q: must be filtered", s)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 )
 
 const usageText = `Usage:
@@ -27,9 +28,21 @@ Modes are:
                   ignored
     check       - check configuration and exit
     status      - print ipp-usb status and exit
+    reset       - ask running ipp-usb to reset the device, specified
+                  by the -device option, and initialize it again
+    identify    - ask running ipp-usb to make the device, specified
+                  by the -device option, identify itself (i.e.,
+                  flash or beep), if device supports it
+    maintenance - put the device, specified by the -device option,
+                  into maintenance mode: new jobs are rejected,
+                  while device remains visible
+    resume      - leave maintenance mode
 
 Options are
     -bg         - run in background (ignored in debug mode)
+    -device dev - serve only the specified device and ignore all
+                  others. Device is specified either as VID:PID
+                  (hex, as shown by lsusb) or as BUS/ADDR (decimal)
 `
 
 // RunMode represents the program run mode
@@ -42,6 +55,10 @@ const (
 	RunDebug
 	RunCheck
 	RunStatus
+	RunReset
+	RunIdentify
+	RunMaintenance
+	RunResume
 )
 
 // String returns RunMode name
@@ -59,15 +76,35 @@ func (m RunMode) String() string {
 		return "check"
 	case RunStatus:
 		return "status"
+	case RunReset:
+		return "reset"
+	case RunIdentify:
+		return "identify"
+	case RunMaintenance:
+		return "maintenance"
+	case RunResume:
+		return "resume"
 	}
 
 	return fmt.Sprintf("unknown (%d)", int(m))
 }
 
+// Control tells if RunMode controls the running ipp-usb daemon
+// over the control socket for the device, specified by -device
+func (m RunMode) Control() bool {
+	switch m {
+	case RunReset, RunIdentify, RunMaintenance, RunResume:
+		return true
+	}
+
+	return false
+}
+
 // RunParameters represents the program run parameters
 type RunParameters struct {
-	Mode       RunMode // Run mode
-	Background bool    // Run in background
+	Mode       RunMode          // Run mode
+	Background bool             // Run in background
+	Device     *UsbDeviceFilter // Serve only this device, if not nil
 }
 
 // usage prints detailed usage and exits
@@ -101,7 +138,18 @@ func parseArgv() (params RunParameters) {
 	params.Mode = RunDebug
 
 	modes := 0
-	for _, arg := range os.Args[1:] {
+	args := os.Args[1:]
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+
+		// Handle options with value
+		var val string
+		if i := strings.IndexByte(arg, '='); i > 0 &&
+			strings.HasPrefix(arg, "-") {
+			arg, val = arg[:i], arg[i+1:]
+		}
+
 		switch arg {
 		case "-h", "-help", "--help":
 			usage()
@@ -120,8 +168,33 @@ func parseArgv() (params RunParameters) {
 		case "status":
 			params.Mode = RunStatus
 			modes++
+		case "reset":
+			params.Mode = RunReset
+			modes++
+		case "identify":
+			params.Mode = RunIdentify
+			modes++
+		case "maintenance":
+			params.Mode = RunMaintenance
+			modes++
+		case "resume":
+			params.Mode = RunResume
+			modes++
 		case "-bg":
 			params.Background = true
+		case "-device", "--device":
+			if val == "" {
+				if len(args) == 0 {
+					usageError("Option %s requires a value", arg)
+				}
+				val, args = args[0], args[1:]
+			}
+
+			var err error
+			params.Device, err = ParseUsbDeviceFilter(val)
+			if err != nil {
+				usageError("%s", err)
+			}
 		default:
 			usageError("Invalid argument %s", arg)
 		}
@@ -135,6 +208,10 @@ func parseArgv() (params RunParameters) {
 		params.Background = false
 	}
 
+	if params.Mode.Control() && params.Device == nil {
+		usageError("Mode %s requires the -device option", params.Mode)
+	}
+
 	return
 }
 
@@ -177,14 +254,15 @@ func main() {
 	// Setup logging
 	if params.Mode != RunDebug &&
 		params.Mode != RunCheck &&
-		params.Mode != RunStatus {
+		params.Mode != RunStatus &&
+		!params.Mode.Control() {
 		Console.ToNowhere()
 	} else if Conf.ColorConsole {
 		Console.ToColorConsole()
 	}
 
-	Log.SetLevels(Conf.LogMain)
-	Console.SetLevels(Conf.LogConsole)
+	Log.SetLevels(Conf.LogMain).SetSubsysLevels(Conf.LogSubsys)
+	Console.SetLevels(Conf.LogConsole).SetSubsysLevels(Conf.LogSubsys)
 	Log.Cc(Console)
 
 	// In RunCheck mode, list IPP-over-USB devices
@@ -198,8 +276,19 @@ func main() {
 			descs, err = UsbGetIppOverUsbDeviceDescs()
 		}
 
+		if err == nil && params.Device != nil {
+			for addr, desc := range descs {
+				if !params.Device.Match(desc) {
+					delete(descs, addr)
+				}
+			}
+		}
+
 		if err != nil {
 			InitLog.Info(0, "Can't read list of USB devices: %s", err)
+		} else if (descs == nil || len(descs) == 0) &&
+			params.Device != nil {
+			InitLog.Info(0, "Device %s not found", params.Device)
 		} else if descs == nil || len(descs) == 0 {
 			InitLog.Info(0, "No IPP over USB devices found")
 		} else {
@@ -235,6 +324,39 @@ func main() {
 		os.Exit(0)
 	}
 
+	// In RunReset mode, ask ipp-usb to reset the device, and we are done
+	if params.Mode == RunReset {
+		err = CtrlsockReset(params.Device)
+		if err != nil {
+			InitLog.Exit(0, "Device %s: %s", params.Device, err)
+		}
+		InitLog.Info(0, "Device %s: reset", params.Device)
+		os.Exit(0)
+	}
+
+	// In RunIdentify mode, ask ipp-usb to identify the device,
+	// and we are done
+	if params.Mode == RunIdentify {
+		msg, err := CtrlsockIdentify(params.Device, nil)
+		if err != nil {
+			InitLog.Exit(0, "Device %s: %s", params.Device, err)
+		}
+		InitLog.Info(0, "%s", msg)
+		os.Exit(0)
+	}
+
+	// In RunMaintenance and RunResume modes, ask ipp-usb to
+	// switch the device's mode, and we are done
+	if params.Mode == RunMaintenance || params.Mode == RunResume {
+		msg, err := CtrlsockMaintenance(params.Device,
+			params.Mode == RunMaintenance)
+		if err != nil {
+			InitLog.Exit(0, "Device %s: %s", params.Device, err)
+		}
+		InitLog.Info(0, "%s", msg)
+		os.Exit(0)
+	}
+
 	// Check user privileges
 	if os.Geteuid() != 0 {
 		InitLog.Exit(0, "This program requires root privileges")
@@ -272,7 +394,8 @@ func main() {
 	InitLog.Check(err)
 
 	// Write to log that we are here
-	if params.Mode != RunCheck && params.Mode != RunStatus {
+	if params.Mode != RunCheck && params.Mode != RunStatus &&
+		!params.Mode.Control() {
 		Log.Info(' ', "===============================")
 		Log.Info(' ', "ipp-usb started in %q mode, pid=%d",
 			params.Mode, os.Getpid())
@@ -291,7 +414,7 @@ func main() {
 
 	// Run PnP manager
 	for {
-		exitReason := PnPStart(params.Mode == RunUdev)
+		exitReason := PnPStart(params.Mode == RunUdev, params.Device)
 
 		// The following race is possible here:
 		// 1) last device disappears, ipp-usb is about to exit
@@ -0,0 +1,68 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Mapping of device models to friendly names
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ModelName maps device model (i.e., "printer-make-and-model")
+// to the friendly name
+type ModelName struct {
+	Pattern string         // Substring to search in the model
+	Regexp  *regexp.Regexp // Or regexp to match, if not nil
+	Name    string         // Friendly name
+}
+
+// ModelNames is the list of ModelName mappings, in order of
+// configuration
+type ModelNames []ModelName
+
+// NewModelName creates a new ModelName. If pattern is enclosed
+// into slashes (i.e., "/^HP .*$/"), it is a regular expression,
+// otherwise it is a substring
+func NewModelName(pattern, name string) (ModelName, error) {
+	mn := ModelName{Pattern: pattern, Name: name}
+
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") &&
+		strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return mn, err
+		}
+		mn.Regexp = re
+	}
+
+	return mn, nil
+}
+
+// Match checks if model matches the ModelName
+func (mn ModelName) Match(model string) bool {
+	if mn.Regexp != nil {
+		return mn.Regexp.MatchString(model)
+	}
+	return strings.Contains(model, mn.Pattern)
+}
+
+// Lookup returns friendly name of the model, or "" if not
+// found. The first matching mapping wins
+func (names ModelNames) Lookup(model string) string {
+	if model == "" {
+		return ""
+	}
+
+	for _, mn := range names {
+		if mn.Match(model) {
+			return mn.Name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,52 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for model names mapping
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// Test ModelNames.Lookup
+func TestModelNamesLookup(t *testing.T) {
+	var names ModelNames
+	for _, m := range []struct{ pattern, name string }{
+		{"HP ABC2000", "HP OfficeJet Pro 9010"},
+		{`/^EPSON ET-\d+ Series$/`, "Epson EcoTank"},
+		{"EPSON", "Epson printer"},
+	} {
+		mn, err := NewModelName(m.pattern, m.name)
+		if err != nil {
+			t.Fatalf("%q: %s", m.pattern, err)
+		}
+		names = append(names, mn)
+	}
+
+	tests := []struct {
+		model, name string
+	}{
+		{"HP ABC2000 Series", "HP OfficeJet Pro 9010"},
+		{"EPSON ET-2810 Series", "Epson EcoTank"},
+		{"EPSON XP-2100 Series", "Epson printer"},
+		{"Canon G3010", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		name := names.Lookup(test.model)
+		if name != test.name {
+			t.Errorf("%q: expected %q, got %q",
+				test.model, test.name, name)
+		}
+	}
+
+	// Invalid regexp
+	if _, err := NewModelName("/(/", "x"); err == nil {
+		t.Errorf("invalid regexp accepted")
+	}
+}
@@ -34,6 +34,10 @@ const (
 	// files are saved to
 	PathProgStateDev = PathProgState + "/dev"
 
+	// PathProgStateCapture defines path to directory where print
+	// jobs are captured to, if enabled by the capture-jobs quirk
+	PathProgStateCapture = PathProgState + "/capture"
+
 	// PathLogDir defines path to log directory
 	PathLogDir = "/var/log/ipp-usb"
 
@@ -0,0 +1,375 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Playback of recorded device responses
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenPrinting/goipp"
+)
+
+// testPlayback is the fake http.RoundTripper, that answers
+// requests with device responses, recorded in the
+// testdata/playback/<device> directory. See README in that
+// directory for the file naming conventions and origin of
+// the responses
+type testPlayback struct {
+	dir      string     // Directory with recorded responses
+	lock     sync.Mutex // Access lock
+	requests []string   // Received requests, "METHOD /path"
+}
+
+// newTestPlayback creates a new testPlayback for the device
+func newTestPlayback(t *testing.T, device string) *testPlayback {
+	dir := filepath.Join("testdata", "playback", device)
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("playback: %s", err)
+	}
+
+	return &testPlayback{dir: dir}
+}
+
+// Client returns http.Client, connected to the playback
+func (pb *testPlayback) Client() *http.Client {
+	return &http.Client{Transport: pb}
+}
+
+// Requests returns list of requests, received so far
+func (pb *testPlayback) Requests() []string {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	return append([]string(nil), pb.requests...)
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (pb *testPlayback) RoundTrip(rq *http.Request) (*http.Response, error) {
+	if rq.Body != nil {
+		ioutil.ReadAll(rq.Body)
+		rq.Body.Close()
+	}
+
+	pb.lock.Lock()
+	pb.requests = append(pb.requests, rq.Method+" "+rq.URL.Path)
+	pb.lock.Unlock()
+
+	// Lookup the response
+	name := rq.Method + strings.Replace(rq.URL.Path, "/", "-", -1)
+	status, ctype := http.StatusNotFound, "text/plain"
+	body := []byte(http.StatusText(http.StatusNotFound))
+
+	for ext, t := range map[string]string{
+		".ipp": "application/ipp",
+		".xml": "text/xml",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(pb.dir, name+ext))
+		if err == nil {
+			status, ctype, body = http.StatusOK, t, data
+			break
+		}
+	}
+
+	// Build the response
+	rsp := &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       rq,
+	}
+
+	rsp.Header.Set("Content-Type", ctype)
+
+	return rsp, nil
+}
+
+// testPlaybackIface is the fake USB interface, that parses HTTP
+// requests, sent to the device, and answers them via testPlayback
+type testPlaybackIface struct {
+	rqR, rspR *io.PipeReader // Read ends of request/response pipes
+	rqW, rspW *io.PipeWriter // Write ends of request/response pipes
+}
+
+// newTestPlaybackIface creates a new testPlaybackIface
+func newTestPlaybackIface(pb *testPlayback) *testPlaybackIface {
+	iface := &testPlaybackIface{}
+	iface.rqR, iface.rqW = io.Pipe()
+	iface.rspR, iface.rspW = io.Pipe()
+
+	go func() {
+		reader := bufio.NewReader(iface.rqR)
+		for {
+			rq, err := http.ReadRequest(reader)
+			if err != nil {
+				iface.rspW.CloseWithError(err)
+				return
+			}
+
+			rsp, _ := pb.RoundTrip(rq)
+			rsp.Write(iface.rspW)
+		}
+	}()
+
+	return iface
+}
+
+// Recv receives the response from device
+func (iface *testPlaybackIface) Recv(data []byte,
+	timeout time.Duration) (int, error) {
+	return iface.rspR.Read(data)
+}
+
+// Send sends the request to device
+func (iface *testPlaybackIface) Send(data []byte,
+	timeout time.Duration) (int, error) {
+	return iface.rqW.Write(data)
+}
+
+// SoftReset does nothing
+func (iface *testPlaybackIface) SoftReset() error { return nil }
+
+// Close closes the interface
+func (iface *testPlaybackIface) Close() {
+	iface.rqW.Close()
+	iface.rspR.Close()
+}
+
+// Transport returns UsbTransport with a single IPP-over-USB
+// interface, connected to the playback
+func (pb *testPlayback) Transport() *UsbTransport {
+	transport := &UsbTransport{
+		log:          NewLogger(),
+		connReleased: make(chan struct{}),
+		shutdown:     make(chan struct{}),
+		connSelected: -1,
+	}
+	transport.usbLog = transport.log.Subsys(LogSubsysUSB)
+
+	transport.connPool = make(chan *usbConn, 1)
+	transport.connstate = newUsbConnState(1)
+
+	conn := &usbConn{
+		transport: transport,
+		iface:     newTestPlaybackIface(pb),
+	}
+	conn.reader = bufio.NewReader(conn)
+	transport.connList = append(transport.connList, conn)
+	transport.connPool <- conn
+
+	return transport
+}
+
+// testPlaybackServices runs IppService and EsclService against
+// the playback of the device and returns discovered services
+func testPlaybackServices(t *testing.T, device string,
+	usbinfo UsbDeviceInfo) (*testPlayback, DNSSdServices) {
+
+	pb := newTestPlayback(t, device)
+	log := NewLogger().Begin()
+	defer log.Commit()
+
+	var services DNSSdServices
+	ippinfo, err := IppService(log, &services, 60000, usbinfo,
+		nil, nil, pb.Client())
+	if err != nil {
+		t.Fatalf("%s: IPP: %s", device, err)
+	}
+
+	err = EsclService(log, &services, 60000, usbinfo, ippinfo,
+		nil, pb.Client())
+	if err != nil {
+		t.Fatalf("%s: %s", device, err)
+	}
+
+	return pb, services
+}
+
+// testPlaybackCheck checks TXT record of the service of
+// the specified type against expected values
+func testPlaybackCheck(t *testing.T, device string,
+	services DNSSdServices, svcType string, expected map[string]string) {
+
+	for _, svc := range services {
+		if svc.Type != svcType {
+			continue
+		}
+
+		for key, value := range expected {
+			v, found := testTxtLookup(svc.Txt, key)
+			switch {
+			case !found:
+				t.Errorf("%s: %s: TXT %s: missed", device,
+					svcType, key)
+			case v != value:
+				t.Errorf("%s: %s: TXT %s: expected %q, got %q",
+					device, svcType, key, value, v)
+			}
+		}
+		return
+	}
+
+	t.Errorf("%s: %s: service not found", device, svcType)
+}
+
+// Test synthetic MFP device: printer, scanner and fax
+func TestPlaybackMfpFax(t *testing.T) {
+	const device = "synthetic-mfp-fax"
+	usbinfo := UsbDeviceInfo{
+		Vendor:      0x03f0,
+		Product:     0x5a2a,
+		ProductName: "HP LaserJet MFP M426fdn",
+		BasicCaps: UsbIppBasicCapsPrint | UsbIppBasicCapsScan |
+			UsbIppBasicCapsFax,
+	}
+
+	pb, services := testPlaybackServices(t, device, usbinfo)
+
+	testPlaybackCheck(t, device, services, "_ipp._tcp", map[string]string{
+		"ty":       "HP LaserJet MFP M426fdn",
+		"UUID":     "564e4333-4230-3731-3536-f8b46a4b2c1d",
+		"Color":    "F",
+		"Copies":   "T",
+		"Duplex":   "T",
+		"Fax":      "T",
+		"rfo":      "ipp/faxout",
+		"PaperMax": "legal-A4",
+		"usb_MFG":  "HP",
+		"qtotal":   "1",
+	})
+
+	testPlaybackCheck(t, device, services, "_uscan._tcp", map[string]string{
+		"ty":     "HP LaserJet MFP M426fdn",
+		"is":     "platen,adf",
+		"duplex": "T",
+		"cs":     "color,grayscale",
+		"UUID":   "564e4333-4230-3731-3536-f8b46a4b2c1d",
+	})
+
+	expected := []string{
+		"POST /ipp/print",
+		"POST /ipp/print",
+		"POST /ipp/faxout",
+		"GET /eSCL/ScannerCapabilities",
+	}
+
+	requests := pb.Requests()
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("%s: requests: expected %q, got %q",
+			device, expected, requests)
+	}
+}
+
+// Test synthetic MFP device: printer and scanner, no fax
+func TestPlaybackMfp(t *testing.T) {
+	const device = "synthetic-mfp"
+	usbinfo := UsbDeviceInfo{
+		Vendor:      0x0482,
+		Product:     0x069b,
+		ProductName: "ECOSYS M2040dn",
+		BasicCaps:   UsbIppBasicCapsPrint | UsbIppBasicCapsScan,
+	}
+
+	_, services := testPlaybackServices(t, device, usbinfo)
+
+	testPlaybackCheck(t, device, services, "_ipp._tcp", map[string]string{
+		"ty":      "Kyocera ECOSYS M2040dn",
+		"note":    "Office",
+		"Duplex":  "T",
+		"Fax":     "F",
+		"usb_MDL": "ECOSYS M2040dn",
+	})
+
+	testPlaybackCheck(t, device, services, "_uscan._tcp", map[string]string{
+		"is":     "platen,adf",
+		"duplex": "F",
+		"cs":     "binary,color,grayscale",
+	})
+}
+
+// Test the request, forwarded to the device by HTTPProxy
+// via UsbTransport
+func TestPlaybackHTTPProxy(t *testing.T) {
+	const device = "synthetic-mfp-fax"
+
+	pb := newTestPlayback(t, device)
+	transport := pb.Transport()
+	defer transport.connList[0].destroy()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	proxy := NewHTTPProxy(transport.log, listener, transport)
+	defer proxy.Close()
+	proxy.Enable()
+
+	// Send Get-Printer-Attributes via proxy
+	port := listener.Addr().(*net.TCPAddr).Port
+	uri := fmt.Sprintf("http://localhost:%d/ipp/print", port)
+	rq := goipp.NewRequest(goipp.DefaultVersion,
+		goipp.OpGetPrinterAttributes, 1)
+	rq.Operation.Add(goipp.MakeAttribute("attributes-charset",
+		goipp.TagCharset, goipp.String("utf-8")))
+	rq.Operation.Add(goipp.MakeAttribute("attributes-natural-language",
+		goipp.TagLanguage, goipp.String("en-US")))
+	rq.Operation.Add(goipp.MakeAttribute("printer-uri",
+		goipp.TagURI, goipp.String(uri)))
+	data, _ := rq.EncodeBytes()
+
+	resp, err := http.Post(uri, goipp.ContentType, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Response must be delivered as is
+	expected, _ := ioutil.ReadFile(
+		filepath.Join(pb.dir, "POST-ipp-print.ipp"))
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("HTTP status: expected %d, got %d",
+			http.StatusOK, resp.StatusCode)
+	}
+
+	if ctype := resp.Header.Get("Content-Type"); ctype != goipp.ContentType {
+		t.Errorf("Content-Type: expected %q, got %q",
+			goipp.ContentType, ctype)
+	}
+
+	if !bytes.Equal(body, expected) {
+		t.Errorf("response body mismatch")
+	}
+
+	requests := pb.Requests()
+	if len(requests) != 1 || requests[0] != "POST /ipp/print" {
+		t.Errorf("requests: expected %q, got %q",
+			"POST /ipp/print", requests)
+	}
+}
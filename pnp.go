@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -25,6 +26,137 @@ const (
 	PnPTerm                      // Terminating signal received
 )
 
+// pnpResetRq is the request to reset device, sent to the
+// PnP manager
+type pnpResetRq struct {
+	filter *UsbDeviceFilter // Device to reset
+	done   chan error       // Completion status
+}
+
+var (
+	// pnpResetChan delivers reset requests to the PnP manager
+	pnpResetChan = make(chan pnpResetRq)
+
+	// pnpResetBusy is non-zero while reset is in progress
+	pnpResetBusy int32
+)
+
+// PnPReset requests PnP manager to perform USB reset of the
+// device, matching the filter, and to initialize it again
+//
+// Only one reset may be in progress at a time. Concurrent
+// requests fail with ErrResetBusy. If PnP manager doesn't
+// accept the request in time, ErrPnPBusy is returned
+func PnPReset(filter *UsbDeviceFilter) error {
+	if !atomic.CompareAndSwapInt32(&pnpResetBusy, 0, 1) {
+		return ErrResetBusy
+	}
+	defer atomic.StoreInt32(&pnpResetBusy, 0)
+
+	rq := pnpResetRq{filter: filter, done: make(chan error, 1)}
+
+	select {
+	case pnpResetChan <- rq:
+	case <-time.After(DevShutdownTimeout):
+		// PnP manager is busy (i.e., initializing devices)
+		// or not running
+		return ErrPnPBusy
+	}
+
+	return <-rq.done
+}
+
+// pnpGraceDev represents the device, that has disappeared from USB,
+// but may come back within the grace period (see the
+// reenumeration-grace configuration parameter)
+type pnpGraceDev struct {
+	dev   *Device       // Detached device
+	info  UsbDeviceInfo // Device info, to recognize it when it comes back
+	until time.Time     // Grace period expiration time
+}
+
+// pnpGraceMatch finds the device in the grace period, matching
+// the newly added device. Devices without serial number are
+// never matched, as they cannot be reliably identified
+func pnpGraceMatch(graceByAddr map[UsbAddr]pnpGraceDev,
+	desc UsbDeviceDesc) (UsbAddr, bool) {
+
+	if len(graceByAddr) == 0 {
+		return UsbAddr{}, false
+	}
+
+	info, err := desc.GetUsbDeviceInfo()
+	if err != nil || info.SerialNumber == "" {
+		return UsbAddr{}, false
+	}
+
+	for addr, grace := range graceByAddr {
+		if grace.info.Ident() == info.Ident() {
+			return addr, true
+		}
+	}
+
+	return UsbAddr{}, false
+}
+
+// pnpFindRq is the request to find device, sent to the
+// PnP manager
+type pnpFindRq struct {
+	filter *UsbDeviceFilter // Device to find
+	done   chan *DevQuery   // Found device, nil if not found
+}
+
+// pnpFindChan delivers find requests to the PnP manager
+var pnpFindChan = make(chan pnpFindRq)
+
+// PnPFind finds the device, served by PnP manager, matching
+// the filter, and returns its snapshot for queries
+func PnPFind(filter *UsbDeviceFilter) (*DevQuery, error) {
+	rq := pnpFindRq{filter: filter, done: make(chan *DevQuery, 1)}
+
+	select {
+	case pnpFindChan <- rq:
+	case <-time.After(DevShutdownTimeout):
+		return nil, ErrPnPBusy
+	}
+
+	dev := <-rq.done
+	if dev == nil {
+		return nil, ErrNoDevice
+	}
+
+	return dev, nil
+}
+
+// pnpMaintRq is the request to enable or disable maintenance
+// mode of the device, sent to the PnP manager
+type pnpMaintRq struct {
+	filter *UsbDeviceFilter // Device to switch
+	on     bool             // Maintenance mode on or off
+	done   chan error       // Completion status
+}
+
+// pnpMaintChan delivers maintenance requests to the PnP manager
+var pnpMaintChan = make(chan pnpMaintRq)
+
+// PnPMaintenance requests PnP manager to enable or disable the
+// maintenance mode of the device, matching the filter
+//
+// Maintenance mode is remembered by device identity, so it survives
+// device re-initialization (i.e., reset or re-plug), while ipp-usb
+// is running
+func PnPMaintenance(filter *UsbDeviceFilter, on bool) error {
+	rq := pnpMaintRq{filter: filter, on: on, done: make(chan error, 1)}
+
+	select {
+	case pnpMaintChan <- rq:
+	case <-time.After(DevShutdownTimeout):
+		return ErrPnPBusy
+	}
+
+	return <-rq.done
+}
+
 // pnpRetryTime returns time of next retry of failed device initialization
 func pnpRetryTime(err error) time.Time {
 	if err == ErrBlackListed || err == ErrUnusable {
@@ -41,27 +173,117 @@ func pnpRetryExpired(tm time.Time) bool {
 	return !time.Now().Before(tm)
 }
 
+// pnpFilter removes devices, not matching the filter, from the map of
+// device descriptors. Match results are cached in the matched map,
+// because matching may require device to be opened, to obtain its
+// UsbDeviceInfo with getinfo
+//
+// If UsbDeviceInfo cannot be obtained (i.e., device is busy or not
+// ready yet), device is removed, but result is not cached, so the
+// device will be checked again next time
+func pnpFilter(descs map[UsbAddr]UsbDeviceDesc, filter *UsbDeviceFilter,
+	matched map[UsbAddr]bool,
+	getinfo func(UsbDeviceDesc) (UsbDeviceInfo, error)) {
+
+	for addr := range matched {
+		if _, found := descs[addr]; !found {
+			delete(matched, addr)
+		}
+	}
+
+	for addr, desc := range descs {
+		match, found := matched[addr]
+		if !found {
+			var err error
+			match, err = pnpMatch(desc, filter, getinfo)
+			if err == nil {
+				matched[addr] = match
+			}
+		}
+
+		if !match {
+			delete(descs, addr)
+		}
+	}
+}
+
+// pnpMatch checks if device matches the filter. UsbDeviceInfo,
+// if needed for matching, is obtained with getinfo
+func pnpMatch(desc UsbDeviceDesc, filter *UsbDeviceFilter,
+	getinfo func(UsbDeviceDesc) (UsbDeviceInfo, error)) (bool, error) {
+
+	var info UsbDeviceInfo
+	if filter.Vendor != 0 {
+		var err error
+		info, err = getinfo(desc)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return filter.MatchInfo(desc.UsbAddr, info), nil
+}
+
 // PnPStart start PnP manager
 //
 // If exitWhenIdle is true, PnP manager will exit, when there is no more
 // devices to serve
-func PnPStart(exitWhenIdle bool) PnPExitReason {
+//
+// If filter is not nil, only the device it matches is served
+func PnPStart(exitWhenIdle bool, filter *UsbDeviceFilter) PnPExitReason {
 	devices := UsbAddrList{}
+	matched := make(map[UsbAddr]bool)
+	notFoundReported := false
 	devByAddr := make(map[UsbAddr]*Device)
 	retryByAddr := make(map[UsbAddr]time.Time)
+	graceByAddr := make(map[UsbAddr]pnpGraceDev)
+	maintByIdent := make(map[string]bool)
+	queued := []UsbAddr{}
 	sigChan := make(chan os.Signal, 1)
 	ticker := time.NewTicker(DevInitRetryInterval / 4)
 	tickerRunning := true
+	refreshDone := make(chan []*DevRefresh, 1)
+	refreshRunning := false
+	var refreshTick <-chan time.Time
 
 	signal.Notify(sigChan,
 		os.Signal(syscall.SIGINT),
 		os.Signal(syscall.SIGTERM),
 		os.Signal(syscall.SIGHUP))
 
+	// slotAvailable tells if one more device can be served,
+	// according to the max-devices limit. Devices, waiting
+	// for return after re-enumeration, occupy their slots
+	//
+	// Devices, scheduled for initialization, occupy their slots too
+	var inits []UsbAddr
+	slotAvailable := func() bool {
+		return Conf.UsbMaxDevices == 0 ||
+			uint(len(devByAddr)+len(graceByAddr)+len(inits)) <
+				Conf.UsbMaxDevices
+	}
+
+	// Start periodic refresh of DNS-SD services, if enabled
+	if Conf.DNSSdRefresh > 0 {
+		refresh := time.NewTicker(Conf.DNSSdRefresh)
+		defer refresh.Stop()
+		refreshTick = refresh.C
+	}
+
 	// Start control socket server
 	err := CtrlsockStart()
 	if err == nil {
 		defer CtrlsockStop()
+	} else {
+		Log.Error('!', "ctrlsock: %s", err)
+	}
+
+	// Start JSON API socket server, if enabled
+	err = CtrlapiStart()
+	if err == nil {
+		defer CtrlapiStop()
+	} else {
+		Log.Error('!', "ctrlapi: %s", err)
 	}
 
 	// Serve PnP events until terminated
@@ -69,6 +291,19 @@ loop:
 	for {
 		dev_descs, err := UsbGetIppOverUsbDeviceDescs()
 
+		if err == nil && filter != nil {
+			pnpFilter(dev_descs, filter, matched,
+				UsbDeviceDesc.GetUsbDeviceInfo)
+
+			switch {
+			case len(dev_descs) == 0 && !notFoundReported:
+				Log.Info('!', "PNP: device %s not found", filter)
+				notFoundReported = true
+			case len(dev_descs) != 0:
+				notFoundReported = false
+			}
+		}
+
 		if err == nil {
 			newdevices := UsbAddrList{}
 			for _, desc := range dev_descs {
@@ -78,65 +313,141 @@ loop:
 			added, removed := devices.Diff(newdevices)
 			devices = newdevices
 
+			// Handle removed devices. Note, removed devices are
+			// handled first, so device that was re-enumerated
+			// at the same address is recognized as returned
+			for _, addr := range removed {
+				Log.Debug('-', "PNP %s: removed", addr)
+				delete(retryByAddr, addr)
+				queued = pnpUnqueue(queued, addr)
+
+				dev, ok := devByAddr[addr]
+				if !ok {
+					StatusDel(addr)
+					continue
+				}
+
+				delete(devByAddr, addr)
+
+				if Conf.UsbReenumGrace == 0 {
+					StatusDel(addr)
+					dev.Close()
+					continue
+				}
+
+				Log.Debug(' ', "PNP %s: waiting %s for device to return",
+					addr, Conf.UsbReenumGrace)
+
+				dev.Detach()
+				graceByAddr[addr] = pnpGraceDev{
+					dev:   dev,
+					info:  dev.UsbTransport.UsbDeviceInfo(),
+					until: time.Now().Add(Conf.UsbReenumGrace),
+				}
+			}
+
 			// Handle added devices
 			for _, addr := range added {
 				Log.Debug('+', "PNP %s: added", addr)
-				dev, err := NewDevice(dev_descs[addr])
-				StatusSet(addr, dev_descs[addr], err)
 
-				if err == nil {
-					devByAddr[addr] = dev
-				} else {
+				if old, ok := pnpGraceMatch(graceByAddr,
+					dev_descs[addr]); ok {
+
+					grace := graceByAddr[old]
+					delete(graceByAddr, old)
+					StatusDel(old)
+
+					err := grace.dev.Reattach(dev_descs[addr])
+					if err == nil {
+						Log.Debug('+', "PNP %s: returned as %s",
+							old, addr)
+						devByAddr[addr] = grace.dev
+						StatusSet(addr, dev_descs[addr],
+							grace.dev, nil)
+						continue
+					}
+
 					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime(err)
+					grace.dev.Close()
 				}
-			}
 
-			// Handle removed devices
-			for _, addr := range removed {
-				Log.Debug('-', "PNP %s: removed", addr)
-				delete(retryByAddr, addr)
-				StatusDel(addr)
-
-				dev, ok := devByAddr[addr]
-				if ok {
-					dev.Close()
-					delete(devByAddr, addr)
+				// Devices beyond the max-devices limit are
+				// queued and served in the plug order, as
+				// slots become available
+				if len(queued) != 0 || !slotAvailable() {
+					Log.Info('!', "PNP %s: max-devices limit (%d) "+
+						"reached, device queued",
+						addr, Conf.UsbMaxDevices)
+					queued = append(queued, addr)
+					StatusSet(addr, dev_descs[addr], nil,
+						ErrMaxDevices)
+					continue
 				}
+
+				inits = append(inits, addr)
 			}
 
 			// Handle devices, waiting for retry
 			for addr, tm := range retryByAddr {
-				if !pnpRetryExpired(tm) {
+				if !pnpRetryExpired(tm) || !slotAvailable() {
 					continue
 				}
 
 				Log.Debug('+', "PNP %s: retry", addr)
-				dev, err := NewDevice(dev_descs[addr])
-				StatusSet(addr, dev_descs[addr], err)
+				delete(retryByAddr, addr)
+				inits = append(inits, addr)
+			}
+
+			// Handle queued devices
+			for len(queued) != 0 && slotAvailable() {
+				addr := queued[0]
+				queued = queued[1:]
+
+				Log.Debug('+', "PNP %s: dequeued", addr)
+				inits = append(inits, addr)
+			}
+
+			// Initialize scheduled devices
+			for i, res := range pnpInit(dev_descs, inits) {
+				addr := inits[i]
+				StatusSet(addr, dev_descs[addr], res.dev, res.err)
 
-				if err == nil {
-					devByAddr[addr] = dev
-					delete(retryByAddr, addr)
+				if res.err == nil {
+					devByAddr[addr] = res.dev
+					pnpMaintRestore(res.dev, maintByIdent)
 				} else {
-					Log.Error('!', "PNP %s: %s", addr, err)
-					retryByAddr[addr] = pnpRetryTime(err)
+					Log.Error('!', "PNP %s: %s", addr, res.err)
+					retryByAddr[addr] = pnpRetryTime(res.err)
 				}
 			}
+
+			inits = inits[:0]
+		}
+
+		// Handle expired grace periods
+		for addr, grace := range graceByAddr {
+			if pnpRetryExpired(grace.until) {
+				Log.Debug('-', "PNP %s: didn't return", addr)
+				StatusDel(addr)
+				grace.dev.Close()
+				delete(graceByAddr, addr)
+			}
 		}
 
 		// Handle exit when idle
-		if exitWhenIdle && len(devices) == 0 {
+		if exitWhenIdle && len(devices) == 0 && len(graceByAddr) == 0 {
 			Log.Info(' ', "No IPP-over-USB devices present, exiting")
 			return PnPIdle
 		}
 
 		// Update ticker
 		switch {
-		case tickerRunning && len(retryByAddr) == 0:
+		case tickerRunning && len(retryByAddr) == 0 &&
+			len(graceByAddr) == 0:
 			ticker.Stop()
 			tickerRunning = false
-		case !tickerRunning && len(retryByAddr) != 0:
+		case !tickerRunning &&
+			(len(retryByAddr) != 0 || len(graceByAddr) != 0):
 			ticker = time.NewTicker(DevInitRetryInterval / 4)
 			tickerRunning = true
 		}
@@ -145,7 +456,31 @@ loop:
 		select {
 		case <-UsbHotPlugChan:
 		case <-ticker.C:
+		case rq := <-pnpResetChan:
+			rq.done <- pnpReset(rq.filter, devByAddr, retryByAddr)
+		case rq := <-pnpFindChan:
+			var q *DevQuery
+			if _, dev := pnpFind(rq.filter, devByAddr); dev != nil {
+				q = dev.Query()
+			}
+			rq.done <- q
+		case rq := <-pnpMaintChan:
+			rq.done <- pnpMaintenance(rq.filter, rq.on, devByAddr,
+				maintByIdent)
+		case <-refreshTick:
+			if !refreshRunning && len(devByAddr) != 0 {
+				refreshRunning = true
+				pnpRefresh(devByAddr, refreshDone)
+			}
+		case results := <-refreshDone:
+			refreshRunning = false
+			pnpRefreshApply(devByAddr, results)
 		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				pnpReload(devByAddr, graceByAddr)
+				break
+			}
+
 			Log.Info(' ', "%s signal received, exiting", sig)
 			break loop
 		}
@@ -156,8 +491,21 @@ loop:
 		DevShutdownTimeout)
 	defer cancel()
 
+	// Wait for the refresh in progress. Its results are not
+	// needed anymore, but devices are not closed under its feet
+	if refreshRunning {
+		select {
+		case <-refreshDone:
+		case <-ctx.Done():
+		}
+	}
+
 	var done sync.WaitGroup
 
+	for _, grace := range graceByAddr {
+		grace.dev.Close()
+	}
+
 	for _, dev := range devByAddr {
 		done.Add(1)
 		go func(dev *Device) {
@@ -170,3 +518,189 @@ loop:
 	done.Wait()
 	return PnPTerm
 }
+
+// pnpReload reloads configuration and applies it to the
+// running devices. See ConfReload for details
+func pnpReload(devByAddr map[UsbAddr]*Device,
+	graceByAddr map[UsbAddr]pnpGraceDev) {
+
+	Log.Info(' ', "SIGHUP signal received, reloading configuration")
+
+	err := ConfReload()
+	if err != nil {
+		Log.Error('!', "conf: %s; configuration not changed", err)
+		return
+	}
+
+	Log.SetLevels(Conf.LogMain).SetSubsysLevels(Conf.LogSubsys)
+	Console.SetLevels(Conf.LogConsole).SetSubsysLevels(Conf.LogSubsys)
+
+	for _, dev := range devByAddr {
+		dev.Reload()
+	}
+
+	for _, grace := range graceByAddr {
+		grace.dev.Reload()
+	}
+}
+
+// pnpInitResult represents result of the device initialization
+type pnpInitResult struct {
+	dev *Device // The device, nil on error
+	err error   // Initialization error
+}
+
+// pnpInit initializes devices at the specified addresses and returns
+// results in the same order
+//
+// Up to Conf.UsbMaxInits devices are initialized concurrently, the
+// rest are waiting for their turn, so many devices, plugged at once
+// (i.e., powered up USB hub), don't overwhelm the USB controller
+func pnpInit(descs map[UsbAddr]UsbDeviceDesc,
+	addrs []UsbAddr) []pnpInitResult {
+
+	results := make([]pnpInitResult, len(addrs))
+	sem := make(chan struct{}, Conf.UsbMaxInits)
+
+	var done sync.WaitGroup
+	for i, addr := range addrs {
+		sem <- struct{}{}
+		done.Add(1)
+
+		go func(res *pnpInitResult, desc UsbDeviceDesc) {
+			defer func() {
+				<-sem
+				done.Done()
+			}()
+
+			res.dev, res.err = NewDevice(desc)
+		}(&results[i], descs[addr])
+	}
+
+	done.Wait()
+
+	return results
+}
+
+// pnpRefresh refreshes DNS-SD services of all devices, one by one,
+// and sends successfully completed refreshes to the done channel
+//
+// Devices snapshots are taken here, in the PnP manager goroutine, and
+// devices are queried in a separate goroutine, so PnP manager is not
+// blocked meanwhile. Results are applied by pnpRefreshApply
+func pnpRefresh(devByAddr map[UsbAddr]*Device,
+	done chan<- []*DevRefresh) {
+
+	refreshes := make([]*DevRefresh, 0, len(devByAddr))
+	for _, dev := range devByAddr {
+		rf, err := dev.RefreshBegin()
+		if err == nil {
+			refreshes = append(refreshes, rf)
+		}
+	}
+
+	go func() {
+		results := []*DevRefresh{}
+		for _, rf := range refreshes {
+			err := rf.Run()
+			switch err {
+			case nil:
+				results = append(results, rf)
+			case ErrUnchanged:
+			default:
+				rf.log.Error('!', "DNS-SD refresh: %s", err)
+			}
+		}
+
+		done <- results
+	}()
+}
+
+// pnpRefreshApply applies results of the DNS-SD services refresh.
+// Devices, closed or re-created while refreshing, are skipped
+func pnpRefreshApply(devByAddr map[UsbAddr]*Device, results []*DevRefresh) {
+	for _, rf := range results {
+		if devByAddr[rf.dev.UsbAddr] == rf.dev {
+			rf.dev.ApplyRefresh(rf)
+		}
+	}
+}
+
+// pnpUnqueue removes device from the queue of devices, waiting
+// for the max-devices slot
+func pnpUnqueue(queued []UsbAddr, addr UsbAddr) []UsbAddr {
+	for i := range queued {
+		if queued[i] == addr {
+			return append(queued[:i], queued[i+1:]...)
+		}
+	}
+
+	return queued
+}
+
+// pnpReset performs USB reset of the device, matching the filter,
+// and schedules its immediate re-initialization
+func pnpReset(filter *UsbDeviceFilter, devByAddr map[UsbAddr]*Device,
+	retryByAddr map[UsbAddr]time.Time) error {
+
+	addr, dev := pnpFind(filter, devByAddr)
+	if dev == nil {
+		return ErrNoDevice
+	}
+
+	Log.Info('!', "PNP %s: reset requested", addr)
+	dev.Reset()
+	delete(devByAddr, addr)
+	StatusDel(addr)
+
+	// Device will be initialized again by the retry
+	// logic. If device re-enumerates after reset, it
+	// will be handled as removed and added
+	retryByAddr[addr] = time.Now()
+	return nil
+}
+
+// pnpMaintenance enables or disables maintenance mode of the device,
+// matching the filter, and remembers it by the device identity
+func pnpMaintenance(filter *UsbDeviceFilter, on bool,
+	devByAddr map[UsbAddr]*Device, maintByIdent map[string]bool) error {
+
+	_, dev := pnpFind(filter, devByAddr)
+	if dev == nil {
+		return ErrNoDevice
+	}
+
+	ident := dev.UsbTransport.UsbDeviceInfo().Ident()
+	if on {
+		maintByIdent[ident] = true
+	} else {
+		delete(maintByIdent, ident)
+	}
+
+	dev.SetMaintenance(on)
+	return nil
+}
+
+// pnpMaintRestore restores maintenance mode of the newly
+// initialized device, if it was set before re-initialization
+func pnpMaintRestore(dev *Device, maintByIdent map[string]bool) {
+	if maintByIdent[dev.UsbTransport.UsbDeviceInfo().Ident()] {
+		dev.SetMaintenance(true)
+	}
+}
+
+// pnpFind finds the device, matching the filter
+//
+// Devices are matched against UsbDeviceInfo, obtained by
+// UsbTransport, so served devices are never reopened
+func pnpFind(filter *UsbDeviceFilter,
+	devByAddr map[UsbAddr]*Device) (UsbAddr, *Device) {
+
+	for addr, dev := range devByAddr {
+		if filter.MatchInfo(addr, dev.UsbTransport.UsbDeviceInfo()) {
+			return addr, dev
+		}
+	}
+
+	return UsbAddr{}, nil
+}
@@ -0,0 +1,127 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for PnP manager
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Test filtering of devices by VID:PID
+func TestPnPFilter(t *testing.T) {
+	addr1 := UsbAddr{Bus: 1, Address: 1}
+	addr2 := UsbAddr{Bus: 1, Address: 2}
+
+	filter := &UsbDeviceFilter{Vendor: 0x03f0, Product: 0x0001}
+
+	// Device 1 matches the filter, device 2 doesn't. Device 1
+	// cannot be opened first time
+	fail := true
+	calls := 0
+	getinfo := func(desc UsbDeviceDesc) (UsbDeviceInfo, error) {
+		calls++
+		switch {
+		case desc.UsbAddr == addr1 && fail:
+			return UsbDeviceInfo{}, errors.New("busy")
+		case desc.UsbAddr == addr1:
+			return UsbDeviceInfo{Vendor: 0x03f0, Product: 0x0001}, nil
+		}
+		return UsbDeviceInfo{Vendor: 0x03f0, Product: 0x0002}, nil
+	}
+
+	descs := func() map[UsbAddr]UsbDeviceDesc {
+		return map[UsbAddr]UsbDeviceDesc{
+			addr1: {UsbAddr: addr1},
+			addr2: {UsbAddr: addr2},
+		}
+	}
+
+	matched := make(map[UsbAddr]bool)
+
+	// Failed device is filtered out, but not cached
+	d := descs()
+	pnpFilter(d, filter, matched, getinfo)
+	if len(d) != 0 {
+		t.Errorf("open failed: expected no devices, got %v", d)
+	}
+
+	if _, found := matched[addr1]; found {
+		t.Errorf("open failed: match result cached")
+	}
+
+	if m, found := matched[addr2]; !found || m {
+		t.Errorf("non-matching device: expected cached false")
+	}
+
+	// Next time device is checked again and found
+	fail = false
+	calls = 0
+	d = descs()
+	pnpFilter(d, filter, matched, getinfo)
+	if _, found := d[addr1]; !found || len(d) != 1 {
+		t.Errorf("open succeeded: expected %s, got %v", addr1, d)
+	}
+
+	if calls != 1 {
+		t.Errorf("open succeeded: expected 1 device open, got %d",
+			calls)
+	}
+
+	// Then cached result is used
+	calls = 0
+	d = descs()
+	pnpFilter(d, filter, matched, getinfo)
+	if _, found := d[addr1]; !found || len(d) != 1 || calls != 0 {
+		t.Errorf("cached: got %v, %d device opens", d, calls)
+	}
+
+	// Disconnected devices are removed from cache
+	d = map[UsbAddr]UsbDeviceDesc{}
+	pnpFilter(d, filter, matched, getinfo)
+	if len(matched) != 0 {
+		t.Errorf("disconnected: cache not cleared: %v", matched)
+	}
+}
+
+// Test finding of served devices by the filter
+func TestPnPFind(t *testing.T) {
+	addr1 := UsbAddr{Bus: 1, Address: 1}
+	addr2 := UsbAddr{Bus: 1, Address: 2}
+
+	devByAddr := map[UsbAddr]*Device{
+		addr1: {UsbTransport: &UsbTransport{info: UsbDeviceInfo{
+			Vendor: 0x03f0, Product: 0x0001}}},
+		addr2: {UsbTransport: &UsbTransport{info: UsbDeviceInfo{
+			Vendor: 0x03f0, Product: 0x0002}}},
+	}
+
+	// Devices are matched by known UsbDeviceInfo, without
+	// the USB device descriptors
+	tests := []struct {
+		filter *UsbDeviceFilter
+		addr   UsbAddr
+		found  bool
+	}{
+		{&UsbDeviceFilter{Vendor: 0x03f0, Product: 0x0002}, addr2, true},
+		{&UsbDeviceFilter{Vendor: 0x03f0, Product: 0x0003}, UsbAddr{}, false},
+		{&UsbDeviceFilter{Addr: addr1}, addr1, true},
+	}
+
+	for _, test := range tests {
+		addr, dev := pnpFind(test.filter, devByAddr)
+		if (dev != nil) != test.found || addr != test.addr {
+			t.Errorf("%+v: expected %s (found=%v), got %s (found=%v)",
+				*test.filter, test.addr, test.found, addr, dev != nil)
+		}
+
+		if dev != nil && dev != devByAddr[addr] {
+			t.Errorf("%+v: device doesn't match address", *test.filter)
+		}
+	}
+}
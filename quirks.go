@@ -32,6 +32,17 @@ type Quirks struct {
 	ResetMethod      QuirksResetMethod // Device reset method
 	InitDelay        time.Duration     // Delay before 1st IPP-USB request
 	RequestDelay     time.Duration     // Delay between IPP-USB requests
+	ShortReadTimeout time.Duration     // Idle timeout of truncated response
+	KeepKernelDriver []int             // USB classes to keep kernel driver
+	ForceContentLen  bool              // Never send chunked request body
+	CaptureJobs      bool              // Capture print jobs for debugging
+	ExtraTxt         map[string]string // Extra DNS-SD TXT items
+	UsbAltSetting    QuirksUsbAlt      // USB alternate setting selection
+	UsbWriteRate     uint              // USB write rate limit, bytes/sec
+	AllowPaths       []string          // HTTP paths allowed for proxying
+	DenyPaths        []string          // HTTP paths denied for proxying
+	IppQueues        []string          // Paths of extra IPP print queues
+	Params           map[string]string // Parameters, as written in file
 	Index            int               // Incremented in order of loading
 }
 
@@ -66,15 +77,61 @@ func (m QuirksResetMethod) String() string {
 	return fmt.Sprintf("unknown (%d)", int(m))
 }
 
+// QuirksUsbAlt represents selection of the USB interface alternate
+// setting. Non-negative values represent the pinned alternate setting
+// number plus one, so zero value means "unset"
+type QuirksUsbAlt int
+
+// QuirksUsbAltUnset - alternate setting selection not specified
+// QuirksUsbAltAuto  - use all suitable alternate settings
+const (
+	QuirksUsbAltUnset QuirksUsbAlt = 0
+	QuirksUsbAltAuto  QuirksUsbAlt = -1
+)
+
+// Pinned returns the pinned alternate setting number, if any
+func (alt QuirksUsbAlt) Pinned() (int, bool) {
+	if alt > 0 {
+		return int(alt) - 1, true
+	}
+	return 0, false
+}
+
+// String returns textual representation of QuirksUsbAlt
+func (alt QuirksUsbAlt) String() string {
+	if n, ok := alt.Pinned(); ok {
+		return fmt.Sprintf("%d", n)
+	}
+
+	switch alt {
+	case QuirksUsbAltUnset:
+		return "unset"
+	case QuirksUsbAltAuto:
+		return "auto"
+	}
+
+	return fmt.Sprintf("unknown (%d)", int(alt))
+}
+
 // empty returns true, if Quirks are actually empty
 func (q *Quirks) empty() bool {
 	return !q.Blacklist &&
 		len(q.HttpHeaders) == 0 &&
+		len(q.ExtraTxt) == 0 &&
 		q.UsbMaxInterfaces == 0 &&
 		!q.DisableFax &&
 		q.ResetMethod == QuirksResetUnset &&
 		q.InitDelay == 0 &&
-		q.RequestDelay == 0
+		q.RequestDelay == 0 &&
+		q.ShortReadTimeout == 0 &&
+		q.KeepKernelDriver == nil &&
+		q.AllowPaths == nil &&
+		q.DenyPaths == nil &&
+		q.IppQueues == nil &&
+		q.UsbAltSetting == QuirksUsbAltUnset &&
+		q.UsbWriteRate == 0 &&
+		!q.ForceContentLen &&
+		!q.CaptureJobs
 }
 
 // QuirksSet represents collection of quirks
@@ -142,6 +199,8 @@ func (qset *QuirksSet) readFile(file string) error {
 				Origin:      fmt.Sprintf("%s:%d", rec.File, rec.Line),
 				Model:       rec.Section,
 				HttpHeaders: make(map[string]string),
+				ExtraTxt:    make(map[string]string),
+				Params:      make(map[string]string),
 				Index:       len(*qset),
 			}
 			qset.Add(q)
@@ -154,17 +213,30 @@ func (qset *QuirksSet) readFile(file string) error {
 		}
 
 		// Update Quirks data
+		q.Params[rec.Key] = rec.Value
+
 		if strings.HasPrefix(rec.Key, "http-") {
 			key := http.CanonicalHeaderKey(rec.Key[5:])
 			q.HttpHeaders[key] = rec.Value
 			continue
 		}
 
+		if strings.HasPrefix(rec.Key, "extra-txt-") {
+			q.ExtraTxt[rec.Key[10:]] = rec.Value
+			continue
+		}
+
 		switch rec.Key {
 		case "blacklist":
 			err = confLoadBinaryKey(&q.Blacklist, rec,
 				"false", "true")
 
+		case "usb-alt-setting":
+			err = confLoadQuirksUsbAltKey(&q.UsbAltSetting, rec)
+
+		case "usb-write-rate":
+			err = confLoadUintKey(&q.UsbWriteRate, rec)
+
 		case "usb-max-interfaces":
 			err = confLoadUintKeyRange(&q.UsbMaxInterfaces, rec,
 				1, math.MaxUint32)
@@ -181,6 +253,29 @@ func (qset *QuirksSet) readFile(file string) error {
 
 		case "request-delay":
 			err = confLoadDurationKey(&q.RequestDelay, rec)
+
+		case "short-read-timeout":
+			err = confLoadDurationKey(&q.ShortReadTimeout, rec)
+
+		case "force-content-length":
+			err = confLoadBinaryKey(&q.ForceContentLen, rec,
+				"false", "true")
+
+		case "capture-jobs":
+			err = confLoadBinaryKey(&q.CaptureJobs, rec,
+				"false", "true")
+
+		case "keep-kernel-driver":
+			err = confLoadUsbClassListKey(&q.KeepKernelDriver, rec)
+
+		case "allow-paths":
+			err = confLoadHTTPPathListKey(&q.AllowPaths, rec)
+
+		case "deny-paths":
+			err = confLoadHTTPPathListKey(&q.DenyPaths, rec)
+
+		case "ipp-queues":
+			err = confLoadHTTPPathListKey(&q.IppQueues, rec)
 		}
 	}
 
@@ -237,6 +332,7 @@ func (qset QuirksSet) ByModelName(model string) QuirksSet {
 
 	// Remove duplicates and empty entries
 	httpHeaderSeen := make(map[string]struct{})
+	extraTxtSeen := make(map[string]struct{})
 	out := 0
 	for in, q := range quirks {
 		// Note, here we avoid modification of the HttpHeaders
@@ -247,6 +343,7 @@ func (qset QuirksSet) ByModelName(model string) QuirksSet {
 		q2 := &Quirks{}
 		*q2 = *q
 		q2.HttpHeaders = make(map[string]string)
+		q2.ExtraTxt = make(map[string]string)
 
 		for name, value := range quirks[in].HttpHeaders {
 			if _, seen := httpHeaderSeen[name]; !seen {
@@ -255,6 +352,13 @@ func (qset QuirksSet) ByModelName(model string) QuirksSet {
 			}
 		}
 
+		for name, value := range quirks[in].ExtraTxt {
+			if _, seen := extraTxtSeen[name]; !seen {
+				extraTxtSeen[name] = struct{}{}
+				q2.ExtraTxt[name] = value
+			}
+		}
+
 		if !q2.empty() {
 			quirks[out] = q2
 			out++
@@ -334,3 +438,119 @@ func (qset QuirksSet) GetRequestDelay() time.Duration {
 
 	return 0
 }
+
+// GetShortReadTimeout returns effective ShortReadTimeout parameter
+func (qset QuirksSet) GetShortReadTimeout() time.Duration {
+	for _, q := range qset {
+		if q.ShortReadTimeout != 0 {
+			return q.ShortReadTimeout
+		}
+	}
+
+	return 0
+}
+
+// GetKeepKernelDriver returns effective KeepKernelDriver parameter
+func (qset QuirksSet) GetKeepKernelDriver() []int {
+	for _, q := range qset {
+		if q.KeepKernelDriver != nil {
+			return q.KeepKernelDriver
+		}
+	}
+
+	return nil
+}
+
+// GetAllowPaths returns effective AllowPaths parameter,
+// nil if all paths are allowed
+func (qset QuirksSet) GetAllowPaths() []string {
+	for _, q := range qset {
+		if q.AllowPaths != nil {
+			return q.AllowPaths
+		}
+	}
+
+	return nil
+}
+
+// GetDenyPaths returns effective DenyPaths parameter
+func (qset QuirksSet) GetDenyPaths() []string {
+	for _, q := range qset {
+		if q.DenyPaths != nil {
+			return q.DenyPaths
+		}
+	}
+
+	return nil
+}
+
+// GetIppQueues returns effective IppQueues parameter
+func (qset QuirksSet) GetIppQueues() []string {
+	for _, q := range qset {
+		if q.IppQueues != nil {
+			return q.IppQueues
+		}
+	}
+
+	return nil
+}
+
+// GetForceContentLength returns effective ForceContentLen parameter,
+// taking the whole set into consideration
+func (qset QuirksSet) GetForceContentLength() bool {
+	for _, q := range qset {
+		if q.ForceContentLen {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetCaptureJobs returns effective CaptureJobs parameter,
+// taking the whole set into consideration
+func (qset QuirksSet) GetCaptureJobs() bool {
+	for _, q := range qset {
+		if q.CaptureJobs {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetExtraTxt returns effective ExtraTxt parameter,
+// taking the whole set into consideration
+func (qset QuirksSet) GetExtraTxt() map[string]string {
+	extra := make(map[string]string)
+	for i := len(qset) - 1; i >= 0; i-- {
+		for name, value := range qset[i].ExtraTxt {
+			extra[name] = value
+		}
+	}
+
+	return extra
+}
+
+// GetUsbAltSetting returns effective UsbAltSetting parameter
+func (qset QuirksSet) GetUsbAltSetting() QuirksUsbAlt {
+	for _, q := range qset {
+		if q.UsbAltSetting != QuirksUsbAltUnset {
+			return q.UsbAltSetting
+		}
+	}
+
+	return QuirksUsbAltAuto
+}
+
+// GetUsbWriteRate returns effective UsbWriteRate parameter. If not
+// set by quirks, the global write-rate parameter is used
+func (qset QuirksSet) GetUsbWriteRate() uint {
+	for _, q := range qset {
+		if q.UsbWriteRate != 0 {
+			return q.UsbWriteRate
+		}
+	}
+
+	return Conf.UsbWriteRate
+}
@@ -0,0 +1,69 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Rate limiter for USB writes
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of some units (i.e., bytes or
+// connections) per second
+//
+// Idle time is not accumulated, so there are no bursts above
+// the limit
+type RateLimiter struct {
+	rate uint       // Units per second
+	lock sync.Mutex // Access lock
+	next time.Time  // When the next units may be consumed
+}
+
+// NewRateLimiter creates a new RateLimiter. If rate is 0,
+// nil is returned, meaning "unlimited"
+func NewRateLimiter(rate uint) *RateLimiter {
+	if rate == 0 {
+		return nil
+	}
+
+	return &RateLimiter{rate: rate}
+}
+
+// Chunk returns the maximum portion of data, that should be
+// passed to Wait at once. Data is sent by the 100 ms portions,
+// so the transfer is smooth
+func (rl *RateLimiter) Chunk() int {
+	chunk := int(rl.rate / 10)
+	if chunk < 512 {
+		chunk = 512
+	}
+	return chunk
+}
+
+// Wait waits until n units may be consumed. It returns the
+// time actually spent waiting
+func (rl *RateLimiter) Wait(n int) time.Duration {
+	rl.lock.Lock()
+
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(n) * time.Second /
+		time.Duration(rl.rate))
+
+	rl.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	return delay
+}
@@ -0,0 +1,54 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for rate limiter
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Test that RateLimiter keeps the data rate within limit
+func TestRateLimiter(t *testing.T) {
+	if rl := NewRateLimiter(0); rl != nil {
+		t.Errorf("rate 0: limiter must be nil")
+	}
+
+	const rate = 1024 * 1024
+	rl := NewRateLimiter(rate)
+
+	if chunk := rl.Chunk(); chunk != rate/10 {
+		t.Errorf("chunk: expected %d, got %d", rate/10, chunk)
+	}
+
+	if chunk := NewRateLimiter(100).Chunk(); chunk != 512 {
+		t.Errorf("chunk: expected %d, got %d", 512, chunk)
+	}
+
+	// The first chunk is sent immediately, the rest is paced
+	start := time.Now()
+	for sent := 0; sent < rate/2; sent += rl.Chunk() {
+		rl.Wait(rl.Chunk())
+	}
+	elapsed := time.Since(start)
+
+	min := time.Second/2 - time.Second/10 - 20*time.Millisecond
+	if elapsed < min {
+		t.Errorf("%d bytes sent in %s, rate exceeded", rate/2, elapsed)
+	}
+
+	// Idle time is not accumulated
+	time.Sleep(200 * time.Millisecond)
+	start = time.Now()
+	rl.Wait(rl.Chunk())
+	rl.Wait(rl.Chunk())
+	rl.Wait(rl.Chunk())
+	if elapsed = time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("burst after idle: 3 chunks sent in %s", elapsed)
+	}
+}
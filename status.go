@@ -10,18 +10,27 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
-	"net/http"
 	"sort"
+	"strings"
 	"sync"
+
+	"github.com/OpenPrinting/goipp"
 )
 
 // statusOfDevice represents a status of the particular device
 type statusOfDevice struct {
-	desc UsbDeviceDesc // Device descriptor
-	init error         // Initialization error, nil if none
+	desc    UsbDeviceDesc   // Device descriptor
+	info    UsbDeviceInfo   // Device info, zero if not available
+	init    error           // Initialization error, nil if none
+	ippinfo *IppPrinterInfo // Decoded IPP attributes, nil if none
+	iface   string          // Selected USB interface, "" if none
+	maint   bool            // Device is in maintenance mode
+	port    int             // HTTP port, 0 if none
+	name    string          // DNS-SD name, "" if none
+	svcs    DNSSdServices   // Published DNS-SD services, nil if none
 }
 
 var (
@@ -36,15 +45,7 @@ var (
 // StatusRetrieve connects to the running ipp-usb daemon, retrieves
 // its status and returns retrieved status as a printable text
 func StatusRetrieve() ([]byte, error) {
-	t := &http.Transport{
-		Dial: func(network, addr string) (net.Conn, error) {
-			return CtrlsockDial()
-		},
-	}
-
-	c := &http.Client{
-		Transport: t,
-	}
+	c := CtrlsockClient()
 
 	rsp, err := c.Get("http://localhost/status")
 	if err != nil {
@@ -53,7 +54,12 @@ func StatusRetrieve() ([]byte, error) {
 
 	defer rsp.Body.Close()
 
-	return ioutil.ReadAll(rsp.Body)
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err == nil && rsp.StatusCode/100 != 2 {
+		err = errors.New(strings.TrimSpace(string(data)))
+	}
+
+	return data, err
 }
 
 // Status format formats ipp-usb status as a text
@@ -69,16 +75,7 @@ func StatusFormat() []byte {
 	buf.WriteString("ipp-usb daemon: running\n")
 
 	// Sort devices by address
-	devs := make([]*statusOfDevice, len(statusTable))
-
-	i := 0
-	for _, status := range statusTable {
-		devs[i] = status
-	}
-
-	sort.Slice(devs, func(i, j int) bool {
-		return devs[i].desc.UsbAddr.Less(devs[j].desc.UsbAddr)
-	})
+	devs := statusSorted()
 
 	// Format per-device status
 	buf.WriteString("ipp-usb devices:")
@@ -88,7 +85,7 @@ func StatusFormat() []byte {
 		buf.WriteString("\n")
 		fmt.Fprintf(buf, " Num  Device              Vndr:Prod  Model\n")
 		for i, status := range devs {
-			info, _ := status.desc.GetUsbDeviceInfo()
+			info := status.info
 
 			fmt.Fprintf(buf, " %3d. %s  %4.4x:%.4x  %q\n",
 				i+1, status.desc.UsbAddr,
@@ -99,21 +96,202 @@ func StatusFormat() []byte {
 				s = devs[i].init.Error()
 			}
 
-			fmt.Fprintf(buf, "      status: %s", s)
+			if status.maint {
+				s += " (maintenance)"
+			}
+
+			fmt.Fprintf(buf, "      status: %s\n", s)
+
+			if status.iface != "" {
+				fmt.Fprintf(buf, "      interface: %s\n", status.iface)
+			}
+
+			if status.ippinfo != nil {
+				statusFormatIppInfo(buf, status.ippinfo)
+			}
 		}
 	}
 
 	return buf.Bytes()
 }
 
+// statusSorted returns all devices from the statusTable, sorted
+// by address. Must be called under the statusLock
+func statusSorted() []*statusOfDevice {
+	devs := make([]*statusOfDevice, 0, len(statusTable))
+	for _, status := range statusTable {
+		devs = append(devs, status)
+	}
+
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].desc.UsbAddr.Less(devs[j].desc.UsbAddr)
+	})
+
+	return devs
+}
+
+// statusFormatIppInfo formats decoded IPP printer attributes
+// as a part of the per-device status. Missed attributes are omitted
+func statusFormatIppInfo(buf *bytes.Buffer, ippinfo *IppPrinterInfo) {
+	statusFormatBool(buf, "borderless", ippinfo.Borderless)
+	statusFormatString(buf, "charge-info", ippinfo.ChargeInfo)
+	statusFormatInt(buf, "copies-max", ippinfo.CopiesMax)
+	statusFormatList(buf, "document-format-details", ippinfo.FormatDetails)
+	statusFormatList(buf, "finishings", ippinfo.Finishings)
+	statusFormatList(buf, "firmware", ippinfo.Firmware)
+	statusFormatList(buf, "print-quality", ippinfo.PrintQuality)
+	statusFormatList(buf, "print-scaling", ippinfo.PrintScaling)
+	statusFormatList(buf, "media-col", ippinfo.MediaCol)
+	statusFormatList(buf, "media-source", ippinfo.MediaSources)
+	statusFormatList(buf, "media-type", ippinfo.MediaTypes)
+	statusFormatList(buf, "job-creation-attributes", ippinfo.JobCreation)
+	statusFormatList(buf, "identify-actions", ippinfo.Identify)
+	statusFormatList(buf, "input-trays", statusInputTrays(ippinfo.InputTrays))
+	statusFormatInt(buf, "job-k-octets-max", ippinfo.JobKOctetsMax)
+	statusFormatInt(buf, "job-password-max", ippinfo.JobPasswordMax)
+	statusFormatList(buf, "job-mandatory-attributes", ippinfo.JobMandatory)
+	statusFormatList(buf, "job-password-encryption", ippinfo.JobPasswordEnc)
+	statusFormatList(buf, "job-password-repertoire", ippinfo.JobPasswordRep)
+	statusFormatList(buf, "jpeg-features", ippinfo.JpegFeatures)
+	statusFormatInt(buf, "jpeg-k-octets-max", ippinfo.JpegKOctetsMax)
+	statusFormatInt(buf, "jpeg-x-dimension-max", ippinfo.JpegXDimMax)
+	statusFormatInt(buf, "jpeg-y-dimension-max", ippinfo.JpegYDimMax)
+	statusFormatList(buf, "operations", statusOperations(ippinfo.Operations))
+	statusFormatList(buf, "organization", ippinfo.Organization)
+	statusFormatList(buf, "organizational-unit", ippinfo.OrgUnits)
+	statusFormatList(buf, "output-trays", ippinfo.OutputTrays)
+	statusFormatInt(buf, "pages-per-minute", ippinfo.PPM)
+	statusFormatInt(buf, "pages-per-minute-color", ippinfo.PPMColor)
+	statusFormatString(buf, "pdl-override", ippinfo.PDLOverride)
+	statusFormatString(buf, "uri-security", ippinfo.URISecurity)
+	statusFormatList(buf, "which-jobs", ippinfo.WhichJobs)
+}
+
+// statusOperations formats IPP operations for display
+func statusOperations(ops []goipp.Op) []string {
+	strs := make([]string, len(ops))
+	for i, op := range ops {
+		strs[i] = op.String()
+	}
+	return strs
+}
+
+// statusInputTrays formats input trays for display
+func statusInputTrays(trays []IppInputTray) []string {
+	strs := make([]string, len(trays))
+	for i := range trays {
+		strs[i] = trays[i].String()
+	}
+	return strs
+}
+
+// statusFormatBool formats a boolean value, represented as
+// "T" or "F", if it is not empty
+func statusFormatBool(buf *bytes.Buffer, name string, val string) {
+	switch val {
+	case "T":
+		fmt.Fprintf(buf, "      %s: yes\n", name)
+	case "F":
+		fmt.Fprintf(buf, "      %s: no\n", name)
+	}
+}
+
+// statusFormatInt formats an integer value, if it is not zero
+func statusFormatInt(buf *bytes.Buffer, name string, val int) {
+	if val != 0 {
+		fmt.Fprintf(buf, "      %s: %d\n", name, val)
+	}
+}
+
+// statusFormatString formats a string value, if it is not empty
+func statusFormatString(buf *bytes.Buffer, name string, val string) {
+	if val != "" {
+		fmt.Fprintf(buf, "      %s: %s\n", name, val)
+	}
+}
+
+// statusFormatList formats a list of values, if list is not empty
+func statusFormatList(buf *bytes.Buffer, name string, list []string) {
+	if len(list) != 0 {
+		fmt.Fprintf(buf, "      %s: %s\n", name, strings.Join(list, ","))
+	}
+}
+
+// statusFind finds device in the statusTable, matching the filter.
+// Cached device info is used, so devices are never opened. Must be
+// called under the statusLock
+func statusFind(filter *UsbDeviceFilter) *statusOfDevice {
+	for _, status := range statusSorted() {
+		if filter.MatchInfo(status.desc.UsbAddr, status.info) {
+			return status
+		}
+	}
+
+	return nil
+}
+
 // StatusSet adds device to the status table or updates status
 // of the already known device
-func StatusSet(addr UsbAddr, desc UsbDeviceDesc, init error) {
-	statusLock.Lock()
-	statusTable[addr] = &statusOfDevice{
+//
+// dev is nil if device initialization has failed
+//
+// Like Device methods, it must be called from the goroutine, that
+// owns the device. Device info is obtained here and cached, so status
+// requests touch neither Device nor USB
+func StatusSet(addr UsbAddr, desc UsbDeviceDesc, dev *Device, init error) {
+	status := &statusOfDevice{
 		desc: desc,
 		init: init,
 	}
+
+	if dev == nil {
+		status.info, _ = desc.GetUsbDeviceInfo()
+	} else {
+		status.info = dev.UsbTransport.UsbDeviceInfo()
+		status.ippinfo = dev.IppInfo
+		status.maint = dev.HTTPProxy.Maintenance()
+		status.port = dev.State.HTTPPort
+		status.name = dev.dnssdName
+		if dev.DNSSdPublisher != nil {
+			status.svcs = dev.DNSSdPublisher.Services
+		}
+		if i := dev.UsbTransport.SelectedInterface(); i >= 0 {
+			status.iface = dev.UsbTransport.InterfaceAddr(i).String()
+		}
+	}
+
+	statusLock.Lock()
+	statusTable[addr] = status
+	statusLock.Unlock()
+}
+
+// StatusSetMaintenance updates maintenance mode of the
+// already known device
+func StatusSetMaintenance(addr UsbAddr, on bool) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.maint = on
+	}
+	statusLock.Unlock()
+}
+
+// StatusSetServices updates published DNS-SD services of the
+// already known device
+func StatusSetServices(addr UsbAddr, services DNSSdServices) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.svcs = services
+	}
+	statusLock.Unlock()
+}
+
+// StatusSetIppInfo updates decoded IPP attributes of the
+// already known device
+func StatusSetIppInfo(addr UsbAddr, ippinfo *IppPrinterInfo) {
+	statusLock.Lock()
+	if status := statusTable[addr]; status != nil {
+		status.ippinfo = ippinfo
+	}
 	statusLock.Unlock()
 }
 
@@ -12,6 +12,7 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -106,6 +107,74 @@ func (list UsbAddrList) Diff(list2 UsbAddrList) (added, removed UsbAddrList) {
 	return
 }
 
+// UsbDeviceFilter selects a single device to be served (the
+// -device option). Device is selected either by VID:PID or by
+// bus number and device address
+type UsbDeviceFilter struct {
+	Vendor, Product uint16  // Vendor and Product IDs, if not zero
+	Addr            UsbAddr // Device address, if Vendor is zero
+}
+
+// ParseUsbDeviceFilter parses the device filter. Accepted
+// formats are "VVVV:PPPP" (hexadecimal vendor and product IDs,
+// as shown by lsusb) and "BUS/ADDR" (decimal bus number and
+// device address)
+func ParseUsbDeviceFilter(s string) (*UsbDeviceFilter, error) {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		vid, err1 := strconv.ParseUint(s[:i], 16, 16)
+		pid, err2 := strconv.ParseUint(s[i+1:], 16, 16)
+		if err1 == nil && err2 == nil && vid != 0 {
+			return &UsbDeviceFilter{
+				Vendor:  uint16(vid),
+				Product: uint16(pid),
+			}, nil
+		}
+	} else if i = strings.IndexByte(s, '/'); i >= 0 {
+		bus, err1 := strconv.ParseUint(s[:i], 10, 8)
+		addr, err2 := strconv.ParseUint(s[i+1:], 10, 8)
+		if err1 == nil && err2 == nil {
+			return &UsbDeviceFilter{
+				Addr: UsbAddr{int(bus), int(addr)},
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%q: invalid device, must be VID:PID or BUS/ADDR", s)
+}
+
+// String returns a human-readable representation of UsbDeviceFilter
+func (filter *UsbDeviceFilter) String() string {
+	if filter.Vendor != 0 {
+		return fmt.Sprintf("%4.4x:%.4x", filter.Vendor, filter.Product)
+	}
+	return filter.Addr.String()
+}
+
+// Match checks if device matches the filter
+//
+// Note, matching by VID:PID requires the device to be opened
+func (filter *UsbDeviceFilter) Match(desc UsbDeviceDesc) bool {
+	if filter.Vendor == 0 {
+		return desc.UsbAddr == filter.Addr
+	}
+
+	info, err := desc.GetUsbDeviceInfo()
+	return err == nil && filter.MatchInfo(desc.UsbAddr, info)
+}
+
+// MatchInfo tells if device with the specified address and
+// already known UsbDeviceInfo matches the filter. Unlike Match,
+// it never opens the device
+func (filter *UsbDeviceFilter) MatchInfo(addr UsbAddr,
+	info UsbDeviceInfo) bool {
+
+	if filter.Vendor == 0 {
+		return addr == filter.Addr
+	}
+
+	return info.Vendor == filter.Vendor && info.Product == filter.Product
+}
+
 // UsbIfAddr represents a full "address" of the USB interface
 type UsbIfAddr struct {
 	UsbAddr     // Device address
@@ -168,6 +237,21 @@ func (ifdesc UsbIfDesc) IsIppOverUsb() bool {
 		ifdesc.Proto == 4
 }
 
+// usbClassListString returns string representation of the
+// list of USB interface classes
+func usbClassListString(classes []int) string {
+	if len(classes) == 0 {
+		return "none"
+	}
+
+	s := make([]string, len(classes))
+	for i, class := range classes {
+		s[i] = strconv.Itoa(class)
+	}
+
+	return strings.Join(s, ", ")
+}
+
 // UsbDeviceInfo represents USB device information
 type UsbDeviceInfo struct {
 	// Fields, directly decoded from USB
@@ -284,6 +368,30 @@ func (info UsbDeviceInfo) UUID() string {
 		uuid[12], uuid[13], uuid[14], uuid[15])
 }
 
+// PseudoMAC generates a stable pseudo MAC address of the device,
+// for legacy clients that identify devices by MAC
+//
+// USB devices don't have MAC address, so it is derived from the
+// device identity, like UUID. The locally administered bit is set,
+// so it never clashes with a real MAC address
+func (info UsbDeviceInfo) PseudoMAC() string {
+	hash := sha1.New()
+
+	// Arbitrary namespace, different from UUID's one
+	const namespace = "4a9b1c3e-6f57-4d0a-b2e8-95c7d1a0f364"
+
+	hash.Write([]byte(namespace))
+	hash.Write([]byte(info.Ident()))
+	mac := hash.Sum(nil)
+
+	// Unicast, locally administered
+	mac[0] &^= 0x01
+	mac[0] |= 0x02
+
+	return fmt.Sprintf("%.2x:%.2x:%.2x:%.2x:%.2x:%.2x",
+		mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+}
+
 // Comment returns a short comment, describing a device
 func (info UsbDeviceInfo) Comment() string {
 	return info.MfgAndProduct + " serial=" + info.SerialNumber
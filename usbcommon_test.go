@@ -9,6 +9,8 @@
 package main
 
 import (
+	"fmt"
+	"regexp"
 	"testing"
 )
 
@@ -107,3 +109,62 @@ func TestUsbAddrListDiff(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// Test ParseUsbDeviceFilter
+func TestParseUsbDeviceFilter(t *testing.T) {
+	tests := []struct {
+		in  string
+		out *UsbDeviceFilter
+	}{
+		{"03f0:c511", &UsbDeviceFilter{Vendor: 0x03f0, Product: 0xc511}},
+		{"1/4", &UsbDeviceFilter{Addr: UsbAddr{1, 4}}},
+		{"001/004", &UsbDeviceFilter{Addr: UsbAddr{1, 4}}},
+		{"0000:0001", nil},
+		{"03f0:", nil},
+		{"1/", nil},
+		{"garbage", nil},
+	}
+
+	for _, test := range tests {
+		filter, err := ParseUsbDeviceFilter(test.in)
+		switch {
+		case test.out == nil && err == nil:
+			t.Errorf("%q: error expected", test.in)
+		case test.out != nil && err != nil:
+			t.Errorf("%q: %s", test.in, err)
+		case test.out != nil && *filter != *test.out:
+			t.Errorf("%q: expected %+v, got %+v",
+				test.in, *test.out, *filter)
+		}
+	}
+}
+
+// Test UsbDeviceInfo.PseudoMAC
+func TestUsbDeviceInfoPseudoMAC(t *testing.T) {
+	info := UsbDeviceInfo{
+		Vendor:        0x03f0,
+		Product:       0x0853,
+		SerialNumber:  "CN12345678",
+		MfgAndProduct: "HP OfficeJet Pro 8730",
+	}
+
+	mac := info.PseudoMAC()
+	if !regexp.MustCompile(`^([0-9a-f]{2}:){5}[0-9a-f]{2}$`).MatchString(mac) {
+		t.Fatalf("%q: invalid MAC syntax", mac)
+	}
+
+	var b0 int
+	fmt.Sscanf(mac[:2], "%x", &b0)
+	if b0&0x03 != 0x02 {
+		t.Errorf("%q: must be unicast, locally administered", mac)
+	}
+
+	if mac2 := info.PseudoMAC(); mac2 != mac {
+		t.Errorf("not deterministic: %q != %q", mac, mac2)
+	}
+
+	info.SerialNumber = "CN87654321"
+	if mac2 := info.PseudoMAC(); mac2 == mac {
+		t.Errorf("serial number doesn't affect pseudo MAC")
+	}
+}
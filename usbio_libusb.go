@@ -348,9 +348,13 @@ func UsbOpenDevice(desc UsbDeviceDesc) (*UsbDevHandle, error) {
 // Configure prepares the device for further work:
 //   - set proper USB configuration
 //   - detach kernel driver
-func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc) error {
+//
+// If keep callback is not nil, kernel driver is not detached
+// from interfaces, for which it returns true
+func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc,
+	keep func(UsbIfDesc) bool) error {
 	// Detach kernel driver
-	err := (*UsbDevHandle)(devhandle).detachKernelDriver()
+	err := (*UsbDevHandle)(devhandle).detachKernelDriver(keep)
 	if err != nil {
 		return err
 	}
@@ -370,19 +374,26 @@ func (devhandle *UsbDevHandle) Configure(desc UsbDeviceDesc) error {
 }
 
 // detachKernelDriver detaches kernel driver from all interfaces
-// of current configuration
-func (devhandle *UsbDevHandle) detachKernelDriver() error {
+// of current configuration, except those, for which keep callback
+// returns true
+func (devhandle *UsbDevHandle) detachKernelDriver(
+	keep func(UsbIfDesc) bool) error {
+
 	C.libusb_set_auto_detach_kernel_driver(
 		(*C.libusb_device_handle)(devhandle), 1)
 
-	ifnums, err := devhandle.currentInterfaces()
+	ifdescs, err := devhandle.currentInterfaces()
 	if err != nil {
 		return err
 	}
 
-	for _, ifnum := range ifnums {
+	for _, ifdesc := range ifdescs {
+		if keep != nil && keep(ifdesc) {
+			continue
+		}
+
 		rc := C.libusb_detach_kernel_driver(
-			(*C.libusb_device_handle)(devhandle), C.int(ifnum))
+			(*C.libusb_device_handle)(devhandle), C.int(ifdesc.IfNum))
 		if rc == C.LIBUSB_ERROR_NOT_FOUND {
 			rc = 0
 		}
@@ -395,8 +406,10 @@ func (devhandle *UsbDevHandle) detachKernelDriver() error {
 	return nil
 }
 
-// libusbCurrentInterfaces builds list of interfaces in current configuration
-func (devhandle *UsbDevHandle) currentInterfaces() ([]int, error) {
+// currentInterfaces builds list of interfaces in current configuration
+//
+// For each interface, its first alternate setting is returned
+func (devhandle *UsbDevHandle) currentInterfaces() ([]UsbIfDesc, error) {
 	dev := C.libusb_get_device((*C.libusb_device_handle)(devhandle))
 
 	// Obtain device descriptor
@@ -440,15 +453,22 @@ func (devhandle *UsbDevHandle) currentInterfaces() ([]int, error) {
 	ifcnt := conf.bNumInterfaces
 	ifaces := (*[256]C.libusb_interface_struct)(
 		unsafe.Pointer(conf._interface))[:ifcnt:ifcnt]
-	ifnumbers := make([]int, 0, ifcnt)
+	ifdescs := make([]UsbIfDesc, 0, ifcnt)
 
 	for _, iface := range ifaces {
 		alt := iface.altsetting
 
-		ifnumbers = append(ifnumbers, int(alt.bInterfaceNumber))
+		ifdescs = append(ifdescs, UsbIfDesc{
+			Config:   int(config),
+			IfNum:    int(alt.bInterfaceNumber),
+			Alt:      int(alt.bAlternateSetting),
+			Class:    int(alt.bInterfaceClass),
+			SubClass: int(alt.bInterfaceSubClass),
+			Proto:    int(alt.bInterfaceProtocol),
+		})
 	}
 
-	return ifnumbers, nil
+	return ifdescs, nil
 }
 
 // Close a device
@@ -20,6 +20,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -27,16 +28,28 @@ import (
 // UsbTransport implements HTTP transport functionality over USB
 type UsbTransport struct {
 	addr         UsbAddr       // Device address
+	desc         UsbDeviceDesc // Device descriptor
 	info         UsbDeviceInfo // USB device info
 	log          *Logger       // Device's own logger
+	usbLog       *LogMessage   // Its view for USB subsystem
 	dev          *UsbDevHandle // Underlying USB device
 	connPool     chan *usbConn // Pool of idle connections
 	connList     []*usbConn    // List of all connections
 	connReleased chan struct{} // Signalled when connection released
+	connDisabled int32         // Count of disabled conns, out of pool
+	connSelected int32         // Selected interface index, -1 if none
 	shutdown     chan struct{} // Closed by Shutdown()
 	connstate    *usbConnState // Connections state tracker
 	quirks       QuirksSet     // Device quirks
+	wrlimit      *RateLimiter  // USB write limiter, nil if none
 	deadline     time.Time     // Deadline for requests
+
+	// Idle handling; protected by idleLock
+	idleLock      sync.Mutex  // Protects idle state
+	idleTimer     *time.Timer // Idle timer, nil if disabled
+	idleActive    int         // Count of requests in progress
+	idleSuspended bool        // Device released due to inactivity
+	detached      bool        // Device disconnected, see Detach
 }
 
 // NewUsbTransport creates new http.RoundTripper backed by IPP-over-USB
@@ -50,9 +63,11 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 	// Create UsbTransport
 	transport := &UsbTransport{
 		addr:         desc.UsbAddr,
+		desc:         desc,
 		log:          NewLogger(),
 		dev:          dev,
 		connReleased: make(chan struct{}),
+		connSelected: -1,
 		shutdown:     make(chan struct{}),
 	}
 
@@ -65,13 +80,15 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 
 	transport.log.Cc(Console)
 	transport.log.ToDevFile(transport.info)
-	transport.log.SetLevels(Conf.LogDevice)
+	transport.log.SetLevels(Conf.LogDevice).SetSubsysLevels(Conf.LogSubsys)
+	transport.usbLog = transport.log.Subsys(LogSubsysUSB)
 
 	// Setup quirks
 	transport.quirks = Conf.Quirks.ByModelName(transport.info.MfgAndProduct)
+	transport.wrlimit = NewRateLimiter(transport.quirks.GetUsbWriteRate())
 
 	// Write device info to the log
-	log := transport.log.Begin().
+	log := transport.usbLog.Begin().
 		Nl(LogDebug).
 		Debug(' ', "===============================").
 		Info('+', "%s: added %s", transport.addr, transport.info.ProductName).
@@ -90,14 +107,32 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		log.Debug(' ', "    blacklist = %v", quirks.Blacklist)
 		log.Debug(' ', "    usb-max-interfaces = %v", quirks.UsbMaxInterfaces)
 		log.Debug(' ', "    disable-fax = %v", quirks.DisableFax)
+		log.Debug(' ', "    force-content-length = %v", quirks.ForceContentLen)
 		log.Debug(' ', "    init-delay = %s", quirks.InitDelay)
 		log.Debug(' ', "    request-delay = %s", quirks.RequestDelay)
+		if quirks.ShortReadTimeout != 0 {
+			log.Debug(' ', "    short-read-timeout = %s",
+				quirks.ShortReadTimeout)
+		}
+		if quirks.KeepKernelDriver != nil {
+			log.Debug(' ', "    keep-kernel-driver = %s",
+				usbClassListString(quirks.KeepKernelDriver))
+		}
 		if quirks.ResetMethod != QuirksResetUnset {
 			log.Debug(' ', "    init-reset = %s", quirks.ResetMethod)
 		}
+		if quirks.UsbAltSetting != QuirksUsbAltUnset {
+			log.Debug(' ', "    usb-alt-setting = %s", quirks.UsbAltSetting)
+		}
+		if quirks.UsbWriteRate != 0 {
+			log.Debug(' ', "    usb-write-rate = %d", quirks.UsbWriteRate)
+		}
 		for name, value := range quirks.HttpHeaders {
 			log.Debug(' ', "    http-%s = %q", strings.ToLower(name), value)
 		}
+		for name, value := range quirks.ExtraTxt {
+			log.Debug(' ', "    extra-txt-%s = %q", name, value)
+		}
 	}
 	log.Nl(LogDebug)
 
@@ -130,12 +165,12 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 
 	// Hard-reset the device, if needed
 	if transport.quirks.GetResetMethod() == QuirksResetHard {
-		transport.log.Debug(' ', "Doing USB HARD RESET")
+		transport.usbLog.Debug(' ', "Doing USB HARD RESET")
 		dev.Reset()
 	}
 
 	// Configure the device
-	err = dev.Configure(desc)
+	err = dev.Configure(desc, transport.keepKernelDriver)
 	if err != nil {
 		goto ERROR
 	}
@@ -146,7 +181,7 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		maxconn = math.MaxUint32
 	}
 
-	for i, ifaddr := range desc.IfAddrs {
+	for i, ifaddr := range transport.selectAltSettings() {
 		var conn *usbConn
 		conn, err = transport.openUsbConn(i, ifaddr, transport.quirks)
 		if err != nil {
@@ -168,6 +203,14 @@ func NewUsbTransport(desc UsbDeviceDesc) (*UsbTransport, error) {
 		transport.connPool <- conn
 	}
 
+	transport.dumpOwnership()
+
+	// Setup idle timer, if enabled
+	if Conf.UsbIdleTimeout > 0 {
+		transport.idleTimer = time.AfterFunc(Conf.UsbIdleTimeout,
+			transport.idleExpired)
+	}
+
 	return transport, nil
 
 	// Error: cleanup and exit
@@ -226,9 +269,111 @@ func (transport *UsbTransport) dumpUSBparams(log *LogMessage) {
 	}
 }
 
+// selectAltSettings returns IPP-over-USB interfaces to be used,
+// taking the usb-alt-setting quirk into account
+//
+// By default (auto), all IPP-over-USB alternate settings are used.
+// If alternate setting is pinned, only the pinned one is used for
+// interfaces that have it, other interfaces remain unaffected
+func (transport *UsbTransport) selectAltSettings() UsbIfAddrList {
+	pinned, ok := transport.quirks.GetUsbAltSetting().Pinned()
+	if !ok {
+		for _, ifaddr := range transport.desc.IfAddrs {
+			transport.usbLog.Debug(' ', "USB interface %d: alt %d (auto)",
+				ifaddr.Num, ifaddr.Alt)
+		}
+		return transport.desc.IfAddrs
+	}
+
+	// Find interfaces that have the pinned alt setting
+	hasPinned := make(map[int]bool)
+	for _, ifaddr := range transport.desc.IfAddrs {
+		if ifaddr.Alt == pinned {
+			hasPinned[ifaddr.Num] = true
+		}
+	}
+
+	var list UsbIfAddrList
+	for _, ifaddr := range transport.desc.IfAddrs {
+		switch {
+		case ifaddr.Alt == pinned:
+			transport.usbLog.Debug(' ', "USB interface %d: alt %d (pinned)",
+				ifaddr.Num, ifaddr.Alt)
+			list.Add(ifaddr)
+
+		case !hasPinned[ifaddr.Num]:
+			transport.usbLog.Info('!', "USB interface %d: "+
+				"no IPP-over-USB alt %d, using alt %d",
+				ifaddr.Num, pinned, ifaddr.Alt)
+			list.Add(ifaddr)
+		}
+	}
+
+	return list
+}
+
+// keepKernelDriver returns true, if kernel driver must not be
+// detached from the interface, due to the keep-kernel-driver quirk
+//
+// IPP-over-USB interfaces are always detached, as ipp-usb needs
+// to claim them
+func (transport *UsbTransport) keepKernelDriver(ifdesc UsbIfDesc) bool {
+	for _, ifaddr := range transport.desc.IfAddrs {
+		if ifaddr.Num == ifdesc.IfNum {
+			return false
+		}
+	}
+
+	for _, class := range transport.quirks.GetKeepKernelDriver() {
+		if class == ifdesc.Class {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dumpOwnership writes to the log who owns each interface
+// of the IPP-over-USB configuration: ipp-usb itself, kernel
+// driver or nobody (driver detached)
+func (transport *UsbTransport) dumpOwnership() {
+	claimed := make(map[int]bool)
+	for _, conn := range transport.connList {
+		claimed[conn.ifaddr.Num] = true
+	}
+
+	log := transport.usbLog.Begin()
+	defer log.Commit()
+
+	log.Debug(' ', "USB interfaces ownership:")
+
+	seen := make(map[int]bool)
+	for _, ifdesc := range transport.desc.IfDescs {
+		if ifdesc.Config != transport.desc.Config || seen[ifdesc.IfNum] {
+			continue
+		}
+
+		seen[ifdesc.IfNum] = true
+
+		owner := "none (kernel driver detached)"
+		switch {
+		case claimed[ifdesc.IfNum]:
+			owner = "ipp-usb"
+		case transport.keepKernelDriver(ifdesc):
+			owner = "kernel driver"
+		}
+
+		log.Debug(' ', "  Interface %-3d Class %-3d %s",
+			ifdesc.IfNum, ifdesc.Class, owner)
+	}
+
+	log.Nl(LogDebug)
+}
+
 // Get count of connections still in use
 func (transport *UsbTransport) connInUse() int {
-	return cap(transport.connPool) - len(transport.connPool)
+	return cap(transport.connPool) - len(transport.connPool) -
+		int(atomic.LoadInt32(&transport.connDisabled))
 }
 
 // SetDeadline sets the deadline for all requests, submitted
@@ -285,13 +430,13 @@ func (transport *UsbTransport) Shutdown(ctx context.Context) error {
 			break
 		}
 
-		transport.log.Info('-', "%s: shutdown: %d connections still in use",
+		transport.usbLog.Info('-', "%s: shutdown: %d connections still in use",
 			transport.addr, n)
 
 		select {
 		case <-transport.connReleased:
 		case <-ctx.Done():
-			transport.log.Error('-', "%s: %s: shutdown timeout expired",
+			transport.usbLog.Error('-', "%s: %s: shutdown timeout expired",
 				transport.addr, transport.info.ProductName)
 			return ctx.Err()
 		}
@@ -301,27 +446,245 @@ func (transport *UsbTransport) Shutdown(ctx context.Context) error {
 }
 
 // Close the transport
+//
+// Note, the device is accessed under the idleLock, so Close
+// is serialized with the idle timer and resume of the device
 func (transport *UsbTransport) Close(reset bool) {
+	// Disable idle handling. If device was released due to
+	// inactivity, it is already closed, and the closed shutdown
+	// channel prevents it from being resumed
+	if transport.idleDisable() {
+		transport.closeShutdownChan()
+		transport.usbLog.Info('-', "%s: removed %s",
+			transport.addr, transport.info.ProductName)
+		return
+	}
+
 	// Reset the device, if required
 	if transport.connInUse() > 0 || reset {
-		transport.log.Info('-', "%s: resetting %s",
+		transport.usbLog.Info('-', "%s: resetting %s",
 			transport.addr, transport.info.ProductName)
+		transport.idleLock.Lock()
 		transport.dev.Reset()
+		transport.idleLock.Unlock()
 	}
 
 	// Wait until all connections become inactive
 	transport.Shutdown(context.Background())
 
 	// Destroy all connections and close the USB device
+	transport.idleLock.Lock()
 	for _, conn := range transport.connList {
 		conn.destroy()
 	}
 
 	transport.dev.Close()
-	transport.log.Info('-', "%s: removed %s",
+	transport.idleLock.Unlock()
+
+	transport.usbLog.Info('-', "%s: removed %s",
 		transport.addr, transport.info.ProductName)
 }
 
+// idleBegin must be called at the beginning of each request. It
+// cancels the idle timer and, if device was released due to
+// inactivity, reopens the device
+//
+// If device cannot be reopened, ErrResume is returned, and the
+// device needs to be reset (see Watchdog)
+func (transport *UsbTransport) idleBegin() error {
+	transport.idleLock.Lock()
+	defer transport.idleLock.Unlock()
+
+	if transport.detached {
+		return ErrDetached
+	}
+
+	select {
+	case <-transport.shutdown:
+		return ErrShutdown
+	default:
+	}
+
+	if transport.idleTimer == nil {
+		return nil
+	}
+
+	transport.idleActive++
+	transport.idleTimer.Stop()
+
+	if !transport.idleSuspended {
+		return nil
+	}
+
+	err := transport.idleResumeLocked()
+	if err != nil {
+		transport.idleActive--
+		transport.idleTimer.Reset(Conf.UsbIdleTimeout)
+		return ErrResume
+	}
+
+	return nil
+}
+
+// idleEnd must be called at the end of each request, started
+// with idleBegin. If there is no more active requests, it
+// restarts the idle timer
+func (transport *UsbTransport) idleEnd() {
+	transport.idleLock.Lock()
+	defer transport.idleLock.Unlock()
+
+	if transport.idleTimer == nil {
+		return
+	}
+
+	transport.idleActive--
+	if transport.idleActive == 0 {
+		transport.idleTimer.Reset(Conf.UsbIdleTimeout)
+	}
+}
+
+// idleExpired is called by the idle timer. It releases the
+// USB device, if there is no active requests
+func (transport *UsbTransport) idleExpired() {
+	transport.idleLock.Lock()
+	defer transport.idleLock.Unlock()
+
+	if transport.idleTimer == nil || transport.idleActive != 0 ||
+		transport.idleSuspended {
+		return
+	}
+
+	transport.usbLog.Info(' ', "%s: idle for %s, releasing the device",
+		transport.addr, Conf.UsbIdleTimeout)
+
+	for _, conn := range transport.connList {
+		conn.destroy()
+	}
+
+	transport.dev.Close()
+	transport.idleSuspended = true
+}
+
+// idleResumeLocked reopens the device, previously released
+// due to inactivity. Must be called under idleLock
+func (transport *UsbTransport) idleResumeLocked() error {
+	transport.usbLog.Info(' ', "%s: resuming the device", transport.addr)
+
+	dev, err := UsbOpenDevice(transport.desc)
+	if err == nil {
+		err = dev.Configure(transport.desc, transport.keepKernelDriver)
+		if err != nil {
+			dev.Close()
+		}
+	}
+
+	if err != nil {
+		transport.usbLog.Error('!', "%s: resume: %s", transport.addr, err)
+		return err
+	}
+
+	transport.dev = dev
+
+	for i, conn := range transport.connList {
+		err = conn.reopen()
+		if err != nil {
+			for _, conn := range transport.connList[:i] {
+				conn.destroy()
+			}
+
+			dev.Close()
+			return err
+		}
+	}
+
+	transport.idleSuspended = false
+	return nil
+}
+
+// idleDisable disables idle handling. It returns true, if
+// device was released due to inactivity at the moment of call
+func (transport *UsbTransport) idleDisable() bool {
+	transport.idleLock.Lock()
+	defer transport.idleLock.Unlock()
+
+	if transport.idleTimer != nil {
+		transport.idleTimer.Stop()
+		transport.idleTimer = nil
+	}
+
+	return transport.idleSuspended
+}
+
+// Detach marks the transport as detached, when device has
+// disconnected from USB, but expected to come back soon (i.e., due
+// to re-enumeration). Requests to detached transport fail with
+// ErrDetached until Reattach is called
+func (transport *UsbTransport) Detach() {
+	transport.idleLock.Lock()
+	transport.detached = true
+	transport.idleLock.Unlock()
+
+	transport.usbLog.Info('-', "%s: detached %s",
+		transport.addr, transport.info.ProductName)
+}
+
+// Reattach connects detached transport to the device, that
+// came back under the new descriptor
+func (transport *UsbTransport) Reattach(desc UsbDeviceDesc) error {
+	// Wait until requests to the disconnected device fail
+	deadline := time.Now().Add(DevShutdownTimeout)
+	for transport.connInUse() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-transport.connReleased:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if n := transport.connInUse(); n > 0 {
+		return fmt.Errorf("%d connections still in use", n)
+	}
+
+	transport.idleLock.Lock()
+	defer transport.idleLock.Unlock()
+
+	transport.usbLog.Info('+', "%s: reattaching %s as %s",
+		transport.addr, transport.info.ProductName, desc.UsbAddr)
+
+	// Release the old device handle
+	if !transport.idleSuspended {
+		for _, conn := range transport.connList {
+			conn.destroy()
+		}
+
+		transport.dev.Close()
+		transport.idleSuspended = true
+	}
+
+	// Switch to the new address
+	transport.addr = desc.UsbAddr
+	transport.desc = desc
+	for _, conn := range transport.connList {
+		conn.ifaddr.UsbAddr = desc.UsbAddr
+	}
+
+	// If idle handling is enabled, device will be reopened
+	// by the next request. Otherwise, reopen it now
+	if transport.idleTimer == nil {
+		err := transport.idleResumeLocked()
+		if err != nil {
+			return err
+		}
+	}
+
+	transport.detached = false
+	return nil
+}
+
+// Addr returns USB address of the device
+func (transport *UsbTransport) Addr() UsbAddr {
+	return transport.addr
+}
+
 // Log returns device's own logger
 func (transport *UsbTransport) Log() *Logger {
 	return transport.log
@@ -351,9 +714,145 @@ func (transport *UsbTransport) RoundTrip(r *http.Request) (
 // provided as a separate parameter
 func (transport *UsbTransport) RoundTripWithSession(session int,
 	rq *http.Request) (*http.Response, error) {
+	return transport.roundTrip(session, -1, rq)
+}
+
+// RoundTripInterface executes a single HTTP transaction, using
+// the particular IPP-over-USB interface, identified by its index
+// in range [0...Interfaces())
+func (transport *UsbTransport) RoundTripInterface(index int,
+	rq *http.Request) (*http.Response, error) {
+	session := int(atomic.AddInt32(&httpSessionID, 1)-1) % 1000
+
+	return transport.roundTrip(session, index, rq)
+}
+
+// Interfaces returns count of IPP-over-USB interfaces, used
+// by the transport
+func (transport *UsbTransport) Interfaces() int {
+	return len(transport.connList)
+}
+
+// InterfaceAddr returns address of interface with the specified index
+func (transport *UsbTransport) InterfaceAddr(index int) UsbIfAddr {
+	return transport.connList[index].ifaddr
+}
+
+// SelectInterface records the interface, that was selected
+// as responsive
+func (transport *UsbTransport) SelectInterface(index int) {
+	atomic.StoreInt32(&transport.connSelected, int32(index))
+}
+
+// DisableInterface disables the interface, so it is not used
+// for further requests. Request in progress on the disabled
+// interface is allowed to complete. The selected interface
+// is never disabled
+func (transport *UsbTransport) DisableInterface(index int) {
+	if index == transport.SelectedInterface() {
+		return
+	}
+
+	conn := transport.connList[index]
+	if atomic.SwapInt32(&conn.disabled, 1) == 0 {
+		transport.usbLog.Info('!', "USB[%d]: interface disabled: %s",
+			conn.index, conn.ifaddr)
+	}
+}
+
+// SelectedInterface returns index of the interface, selected by
+// SelectInterface, or -1, if selection was not performed
+func (transport *UsbTransport) SelectedInterface() int {
+	return int(atomic.LoadInt32(&transport.connSelected))
+}
+
+// roundTrip does the actual work for RoundTripWithSession and
+// RoundTripInterface. If index is negative, any interface may be used
+func (transport *UsbTransport) roundTrip(session, index int,
+	rq *http.Request) (*http.Response, error) {
 
 	// Log the request
-	transport.log.HTTPRqParams(LogDebug, '>', session, rq)
+	transport.usbLog.HTTPRqParams(LogDebug, '>', session, rq)
+
+	// Reopen the device, if it was released due to inactivity
+	err := transport.idleBegin()
+	if err != nil {
+		transport.usbLog.HTTPError('!', session, "%s", err)
+		return nil, err
+	}
+
+	// Prepare outgoing request
+	outreq, err := transport.outRequest(session, rq)
+	if err != nil {
+		transport.idleEnd()
+		return nil, err
+	}
+
+	// Log request details
+	transport.usbLog.Begin().
+		HTTPRequest(LogTraceHTTP, '>', session, outreq).
+		Commit()
+
+	// Allocate USB connection
+	conn, err := transport.usbConnGet(rq.Context(), index)
+	if err != nil {
+		transport.idleEnd()
+		return nil, err
+	}
+
+	transport.usbLog.HTTPDebug(' ', session, "connection %d allocated", conn.index)
+
+	// Make an inter-request (or initial) delay, if needed
+	if delay := conn.delayUntil.Sub(time.Now()); delay > 0 {
+		transport.usbLog.HTTPDebug(' ', session, "Pausing for %s", delay)
+		time.Sleep(delay)
+	}
+
+	// Send request and receive a response
+	err = outreq.Write(conn)
+	if err != nil {
+		transport.usbLog.HTTPError('!', session, "%s", err)
+		conn.put()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(conn.reader, outreq)
+	if err != nil {
+		transport.usbLog.HTTPError('!', session, "%s", err)
+		conn.put()
+		return nil, err
+	}
+
+	// Wrap response body
+	resp.Body = &usbResponseBodyWrapper{
+		log:         transport.usbLog,
+		session:     session,
+		body:        resp.Body,
+		conn:        conn,
+		expected:    resp.ContentLength,
+		shortReadOK: conn.shortReadTimeout != 0,
+	}
+
+	// If body size is known and device is known to end
+	// responses prematurely, don't wait forever for the
+	// rest of the body
+	conn.shortReadOK = resp.ContentLength > 0 &&
+		conn.shortReadTimeout != 0
+
+	// Log the response
+	if resp != nil {
+		transport.usbLog.Begin().
+			HTTPRspStatus(LogDebug, '<', session, outreq, resp).
+			HTTPResponse(LogTraceHTTP, '<', session, resp).
+			Commit()
+	}
+
+	return resp, nil
+}
+
+// outRequest prepares outgoing request to be sent to the device
+func (transport *UsbTransport) outRequest(session int,
+	rq *http.Request) (*http.Request, error) {
 
 	// Prevent request from being canceled from outside
 	// We cannot do it on USB: closing USB connection
@@ -388,7 +887,7 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	// Wrap request body
 	if outreq.Body != nil {
 		outreq.Body = &usbRequestBodyWrapper{
-			log:     transport.log,
+			log:     transport.usbLog,
 			session: session,
 			body:    outreq.Body,
 		}
@@ -397,6 +896,25 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 	// Prepare to correctly handle HTTP transaction, in a case
 	// client drops request in a middle of reading body
 	switch {
+	case outreq.Body != nil && outreq.ContentLength != 0 &&
+		transport.quirks.GetForceContentLength():
+		// Device doesn't understand chunked encoding; read
+		// the entire body and send it with Content-Length
+		buf := &bytes.Buffer{}
+		_, err := io.Copy(buf, outreq.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		outreq.Body.Close()
+		outreq.Body = ioutil.NopCloser(buf)
+		outreq.ContentLength = int64(buf.Len())
+		outreq.TransferEncoding = nil
+
+		transport.usbLog.HTTPDebug('>', session,
+			"body buffered (%d bytes) to force Content-Length",
+			buf.Len())
+
 	case outreq.ContentLength <= 0:
 		// Nothing to do
 
@@ -411,77 +929,27 @@ func (transport *UsbTransport) RoundTripWithSession(session int,
 		outreq.Body.Close()
 		outreq.Body = ioutil.NopCloser(buf)
 
-		transport.log.HTTPDebug('>', session,
+		transport.usbLog.HTTPDebug('>', session,
 			"body is small (%d bytes), prefetched before sending",
 			buf.Len())
 
 	default:
 		// Force chunked encoding, so if client drops request,
 		// we still be able to correctly handle HTTP transaction
-		transport.log.HTTPDebug('>', session,
+		transport.usbLog.HTTPDebug('>', session,
 			"body is large (%d bytes), sending as chunked",
 			outreq.ContentLength)
 
 		outreq.ContentLength = -1
 	}
 
-	// Log request details
-	transport.log.Begin().
-		HTTPRequest(LogTraceHTTP, '>', session, outreq).
-		Commit()
-
-	// Allocate USB connection
-	conn, err := transport.usbConnGet(rq.Context())
-	if err != nil {
-		return nil, err
-	}
-
-	transport.log.HTTPDebug(' ', session, "connection %d allocated", conn.index)
-
-	// Make an inter-request (or initial) delay, if needed
-	if delay := conn.delayUntil.Sub(time.Now()); delay > 0 {
-		transport.log.HTTPDebug(' ', session, "Pausing for %s", delay)
-		time.Sleep(delay)
-	}
-
-	// Send request and receive a response
-	err = outreq.Write(conn)
-	if err != nil {
-		transport.log.HTTPError('!', session, "%s", err)
-		conn.put()
-		return nil, err
-	}
-
-	resp, err := http.ReadResponse(conn.reader, outreq)
-	if err != nil {
-		transport.log.HTTPError('!', session, "%s", err)
-		conn.put()
-		return nil, err
-	}
-
-	// Wrap response body
-	resp.Body = &usbResponseBodyWrapper{
-		log:     transport.log,
-		session: session,
-		body:    resp.Body,
-		conn:    conn,
-	}
-
-	// Log the response
-	if resp != nil {
-		transport.log.Begin().
-			HTTPRspStatus(LogDebug, '<', session, outreq, resp).
-			HTTPResponse(LogTraceHTTP, '<', session, resp).
-			Commit()
-	}
-
-	return resp, nil
+	return outreq, nil
 }
 
 // usbRequestBodyWrapper wraps http.Request.Body, adding
 // data path instrumentation
 type usbRequestBodyWrapper struct {
-	log     *Logger       // Device's logger
+	log     *LogMessage   // Device's logger
 	session int           // HTTP session, for logging
 	count   int           // Total count of received bytes
 	body    io.ReadCloser // Request.body
@@ -516,12 +984,14 @@ func (wrap *usbRequestBodyWrapper) Close() error {
 // usbResponseBodyWrapper wraps http.Response.Body and guarantees
 // that connection will be always drained before closed
 type usbResponseBodyWrapper struct {
-	log     *Logger       // Device's logger
-	session int           // HTTP session, for logging
-	body    io.ReadCloser // Response.body
-	conn    *usbConn      // Underlying USB connection
-	count   int           // Total count of received bytes
-	drained bool          // EOF or error has been seen
+	log         *LogMessage   // Device's logger
+	session     int           // HTTP session, for logging
+	body        io.ReadCloser // Response.body
+	conn        *usbConn      // Underlying USB connection
+	count       int           // Total count of received bytes
+	expected    int64         // Expected count of bytes, -1 if unknown
+	shortReadOK bool          // Truncated body is OK (quirk)
+	drained     bool          // EOF or error has been seen
 }
 
 // Read from usbResponseBodyWrapper
@@ -529,6 +999,17 @@ func (wrap *usbResponseBodyWrapper) Read(buf []byte) (int, error) {
 	n, err := wrap.body.Read(buf)
 	wrap.count += n
 
+	// Handle short read: device has ended response earlier
+	// that Content-Length says. If device is known to do so
+	// (see short-read-timeout quirk), consider it a buggy
+	// but complete response
+	if err == io.ErrUnexpectedEOF && wrap.shortReadOK {
+		wrap.log.HTTPError('!', wrap.session,
+			"response body: short read, expected %d got %d bytes",
+			wrap.expected, wrap.count)
+		err = io.EOF
+	}
+
 	if err != nil {
 		wrap.log.HTTPDebug('<', wrap.session,
 			"response body: got %d bytes; %s", wrap.count, err)
@@ -566,14 +1047,28 @@ func (wrap *usbResponseBodyWrapper) Close() error {
 
 // usbConn implements an USB connection
 type usbConn struct {
-	transport     *UsbTransport // Transport that owns the connection
-	index         int           // Connection index (for logging)
-	iface         *UsbInterface // Underlying interface
-	reader        *bufio.Reader // For http.ReadResponse
-	delayUntil    time.Time     // Delay till this time before next request
-	delayInterval time.Duration // Pause between requests
-	cntRecv       int           // Total bytes received
-	cntSent       int           // Total bytes sent
+	transport        *UsbTransport // Transport that owns the connection
+	index            int           // Connection index (for logging)
+	ifaddr           UsbIfAddr     // Interface address
+	iface            usbIface      // Underlying interface
+	reader           *bufio.Reader // For http.ReadResponse
+	delayUntil       time.Time     // Delay till this time before next request
+	delayInterval    time.Duration // Pause between requests
+	shortReadTimeout time.Duration // Idle timeout of truncated response
+	cntRecv          int           // Total bytes received
+	cntSent          int           // Total bytes sent
+	shortReadOK      bool          // Response may end prematurely
+	disabled         int32         // Non-zero, if connection is disabled
+}
+
+// usbIface represents the USB interface, used by usbConn.
+// It is implemented by *UsbInterface and may be substituted
+// in tests
+type usbIface interface {
+	Recv(data []byte, timeout time.Duration) (int, error)
+	Send(data []byte, timeout time.Duration) (int, error)
+	SoftReset() error
+	Close()
 }
 
 // Open usbConn
@@ -582,32 +1077,35 @@ func (transport *UsbTransport) openUsbConn(
 
 	dev := transport.dev
 
-	transport.log.Debug(' ', "USB[%d]: open: %s", index, ifaddr)
+	transport.usbLog.Debug(' ', "USB[%d]: open: %s", index, ifaddr)
 
 	// Initialize connection structure
 	conn := &usbConn{
-		transport:     transport,
-		index:         index,
-		delayUntil:    time.Now().Add(quirks.GetInitDelay()),
-		delayInterval: quirks.GetRequestDelay(),
+		transport:        transport,
+		index:            index,
+		ifaddr:           ifaddr,
+		delayUntil:       time.Now().Add(quirks.GetInitDelay()),
+		delayInterval:    quirks.GetRequestDelay(),
+		shortReadTimeout: quirks.GetShortReadTimeout(),
 	}
 
 	conn.reader = bufio.NewReader(conn)
 
 	// Obtain interface
-	var err error
-	conn.iface, err = dev.OpenUsbInterface(ifaddr)
+	iface, err := dev.OpenUsbInterface(ifaddr)
 	if err != nil {
 		goto ERROR
 	}
 
+	conn.iface = iface
+
 	// Soft-reset interface, if needed
 	if quirks.GetResetMethod() == QuirksResetSoft {
-		transport.log.Debug(' ', "USB[%d]: doing SOFT_RESET", index)
+		transport.usbLog.Debug(' ', "USB[%d]: doing SOFT_RESET", index)
 		err = conn.iface.SoftReset()
 		if err != nil {
 			// Don't treat it too seriously
-			transport.log.Info('?', "USB[%d]: SOFT_RESET: %s", index, err)
+			transport.usbLog.Info('?', "USB[%d]: SOFT_RESET: %s", index, err)
 		}
 	}
 
@@ -615,7 +1113,7 @@ func (transport *UsbTransport) openUsbConn(
 
 	// Error: cleanup and exit
 ERROR:
-	transport.log.Error('!', "USB[%d]: %s", index, err)
+	transport.usbLog.Error('!', "USB[%d]: %s", index, err)
 	if conn.iface != nil {
 		conn.iface.Close()
 	}
@@ -623,6 +1121,34 @@ ERROR:
 	return nil, err
 }
 
+// reopen reopens the connection's interface after the device
+// was reopened. The connection must not be in use
+func (conn *usbConn) reopen() error {
+	transport := conn.transport
+	quirks := transport.quirks
+
+	transport.usbLog.Debug(' ', "USB[%d]: reopen: %s", conn.index, conn.ifaddr)
+
+	iface, err := transport.dev.OpenUsbInterface(conn.ifaddr)
+	if err != nil {
+		transport.usbLog.Error('!', "USB[%d]: %s", conn.index, err)
+		return err
+	}
+
+	conn.iface = iface
+	conn.delayUntil = time.Now().Add(quirks.GetInitDelay())
+
+	if quirks.GetResetMethod() == QuirksResetSoft {
+		err = conn.iface.SoftReset()
+		if err != nil {
+			transport.usbLog.Info('?', "USB[%d]: SOFT_RESET: %s",
+				conn.index, err)
+		}
+	}
+
+	return nil
+}
+
 // Compute Recv/Send timeout
 func (conn *usbConn) timeout() (tm time.Duration, expored bool) {
 	deadline := conn.transport.deadline
@@ -656,6 +1182,7 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 	}
 
 	backoff := time.Millisecond * 100
+	idle := time.Duration(0)
 	for {
 		tm, expired := conn.timeout()
 		if expired {
@@ -665,24 +1192,35 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 		n, err := conn.iface.Recv(b, tm)
 		conn.cntRecv += n
 
-		conn.transport.log.Add(LogTraceHTTP, '<',
+		conn.transport.usbLog.Add(LogTraceHTTP, '<',
 			"USB[%d]: read: wanted %d got %d total %d",
 			conn.index, len(b), n, conn.cntRecv)
 
-		conn.transport.log.HexDump(LogTraceUSB, '<', b[:n])
+		conn.transport.usbLog.HexDump(LogTraceUSB, '<', b[:n])
 
 		if err != nil {
-			conn.transport.log.Error('!',
+			conn.transport.usbLog.Error('!',
 				"USB[%d]: recv: %s", conn.index, err)
 		}
 
 		if n != 0 || err != nil {
 			return n, err
 		}
-		conn.transport.log.Error('!',
+		conn.transport.usbLog.Error('!',
 			"USB[%d]: zero-size read", conn.index)
 
+		// Device may end the bulk transfer earlier that
+		// response body is complete (see short-read-timeout
+		// quirk). Don't wait forever
+		if conn.shortReadOK && idle >= conn.shortReadTimeout {
+			conn.transport.usbLog.Error('!',
+				"USB[%d]: no data for %s, assuming end of response",
+				conn.index, idle)
+			return 0, io.EOF
+		}
+
 		time.Sleep(backoff)
+		idle += backoff
 		backoff *= 2
 		if backoff > time.Millisecond*1000 {
 			backoff = time.Millisecond * 1000
@@ -691,7 +1229,38 @@ func (conn *usbConn) Read(b []byte) (int, error) {
 }
 
 // Write to USB
+//
+// If write rate is limited (see write-rate parameter and
+// usb-write-rate quirk), data is sent by small portions,
+// with pauses between them
 func (conn *usbConn) Write(b []byte) (int, error) {
+	wrlimit := conn.transport.wrlimit
+	if wrlimit == nil {
+		return conn.write(b)
+	}
+
+	sent := 0
+	for len(b) > 0 {
+		chunk := b
+		if max := wrlimit.Chunk(); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		wrlimit.Wait(len(chunk))
+		n, err := conn.write(chunk)
+		sent += n
+		b = b[n:]
+
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// write performs actual write to USB
+func (conn *usbConn) write(b []byte) (int, error) {
 	conn.transport.connstate.beginWrite(conn)
 	defer conn.transport.connstate.doneWrite(conn)
 
@@ -703,14 +1272,14 @@ func (conn *usbConn) Write(b []byte) (int, error) {
 	n, err := conn.iface.Send(b, tm)
 	conn.cntSent += n
 
-	conn.transport.log.Add(LogTraceHTTP, '>',
+	conn.transport.usbLog.Add(LogTraceHTTP, '>',
 		"USB[%d]: write: wanted %d sent %d total %d",
 		conn.index, len(b), n, conn.cntSent)
 
-	conn.transport.log.HexDump(LogTraceUSB, '>', b[:n])
+	conn.transport.usbLog.HexDump(LogTraceUSB, '>', b[:n])
 
 	if err != nil {
-		conn.transport.log.Error('!',
+		conn.transport.usbLog.Error('!',
 			"USB[%d]: send: %s", conn.index, err)
 	}
 
@@ -718,15 +1287,66 @@ func (conn *usbConn) Write(b []byte) (int, error) {
 }
 
 // Allocate a connection
-func (transport *UsbTransport) usbConnGet(ctx context.Context) (*usbConn, error) {
-	select {
-	case <-transport.shutdown:
-		return nil, ErrShutdown
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case conn := <-transport.connPool:
+//
+// If index is not negative, only connection with that index
+// is allocated, and other connections are returned to the pool
+func (transport *UsbTransport) usbConnGet(ctx context.Context,
+	index int) (*usbConn, error) {
+
+	if index >= 0 &&
+		atomic.LoadInt32(&transport.connList[index].disabled) != 0 {
+		return nil, fmt.Errorf("USB[%d]: interface disabled", index)
+	}
+
+	// Number of pooled connections we've looked at, while
+	// searching for the particular connection
+	skipped := 0
+
+	for {
+		var conn *usbConn
+		var wait <-chan time.Time
+
+		if index >= 0 && skipped >= cap(transport.connPool) {
+			// Connection is busy; wait for release
+			wait = time.After(100 * time.Millisecond)
+			skipped = 0
+		}
+
+		if wait == nil {
+			select {
+			case <-transport.shutdown:
+				return nil, ErrShutdown
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case conn = <-transport.connPool:
+			}
+		} else {
+			select {
+			case <-transport.shutdown:
+				return nil, ErrShutdown
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-transport.connReleased:
+			case <-wait:
+			}
+			continue
+		}
+
+		// Drop disabled connections
+		if atomic.LoadInt32(&conn.disabled) != 0 {
+			atomic.AddInt32(&transport.connDisabled, 1)
+			continue
+		}
+
+		// Skip not wanted connections
+		if index >= 0 && conn.index != index {
+			transport.connPool <- conn
+			skipped++
+			continue
+		}
+
 		transport.connstate.gotConn(conn)
-		transport.log.Debug(' ', "USB[%d]: connection allocated, %s",
+		transport.usbLog.Debug(' ', "USB[%d]: connection allocated, %s",
 			conn.index, transport.connstate)
 
 		return conn, nil
@@ -741,22 +1361,29 @@ func (conn *usbConn) put() {
 	conn.delayUntil = time.Now().Add(conn.delayInterval)
 	conn.cntRecv = 0
 	conn.cntSent = 0
+	conn.shortReadOK = false
 
 	transport.connstate.putConn(conn)
-	transport.log.Debug(' ', "USB[%d]: connection released, %s",
+	transport.usbLog.Debug(' ', "USB[%d]: connection released, %s",
 		conn.index, transport.connstate)
 
-	transport.connPool <- conn
+	if atomic.LoadInt32(&conn.disabled) != 0 {
+		atomic.AddInt32(&transport.connDisabled, 1)
+	} else {
+		transport.connPool <- conn
+	}
 
 	select {
 	case transport.connReleased <- struct{}{}:
 	default:
 	}
+
+	transport.idleEnd()
 }
 
 // Destroy USB connection
 func (conn *usbConn) destroy() {
-	conn.transport.log.Debug(' ', "USB[%d]: closed", conn.index)
+	conn.transport.usbLog.Debug(' ', "USB[%d]: closed", conn.index)
 	conn.iface.Close()
 }
 
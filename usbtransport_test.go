@@ -0,0 +1,307 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for USB transport
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the force-content-length quirk
+func TestUsbTransportForceContentLength(t *testing.T) {
+	tests := []struct {
+		size   int   // Body size
+		length int64 // Request ContentLength
+	}{
+		{100, -1},        // Small body, unknown length
+		{100000, -1},     // Large body, unknown length
+		{100000, 100000}, // Large body, known length
+	}
+
+	for _, force := range []bool{false, true} {
+		transport := &UsbTransport{
+			log:    NewLogger(),
+			quirks: QuirksSet{&Quirks{ForceContentLen: force}},
+		}
+		transport.usbLog = transport.log.Subsys(LogSubsysUSB)
+
+		for _, test := range tests {
+			body := strings.Repeat("x", test.size)
+			rq, _ := http.NewRequest("POST", "http://localhost/ipp/print",
+				ioutil.NopCloser(strings.NewReader(body)))
+			rq.ContentLength = test.length
+
+			outreq, err := transport.outRequest(0, rq)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			// Send request to the "device" and parse it there
+			buf := &bytes.Buffer{}
+			err = outreq.Write(buf)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			devrq, err := http.ReadRequest(bufio.NewReader(buf))
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			data, err := ioutil.ReadAll(devrq.Body)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+
+			if string(data) != body {
+				t.Errorf("size=%d force=%v: body mismatch",
+					test.size, force)
+			}
+
+			chunked := len(devrq.TransferEncoding) != 0
+			if force && chunked {
+				t.Errorf("size=%d: chunked encoding with quirk",
+					test.size)
+			}
+
+			if force && devrq.ContentLength != int64(test.size) {
+				t.Errorf("size=%d: Content-Length: expected %d, got %d",
+					test.size, test.size, devrq.ContentLength)
+			}
+
+			if !force && test.length < 0 && !chunked {
+				t.Errorf("size=%d: expected chunked encoding "+
+					"without quirk", test.size)
+			}
+		}
+	}
+}
+
+// Test handling of short reads of the response body
+func TestUsbTransportShortRead(t *testing.T) {
+	tests := []struct {
+		received int  // Actually received bytes
+		quirk    bool // short-read-timeout quirk is set
+		ok       bool // Should it be accepted as complete
+	}{
+		{100, false, true},
+		{100, true, true},
+		{80, false, false},
+		{80, true, true},
+		{10, true, true},
+	}
+
+	for _, test := range tests {
+		// Simulate device response, ended prematurely
+		data := "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n" +
+			strings.Repeat("x", test.received)
+
+		resp, err := http.ReadResponse(
+			bufio.NewReader(strings.NewReader(data)), nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		wrap := &usbResponseBodyWrapper{
+			log:         NewLogger().Subsys(LogSubsysUSB),
+			body:        resp.Body,
+			expected:    resp.ContentLength,
+			shortReadOK: test.quirk,
+		}
+
+		body, err := ioutil.ReadAll(wrap)
+		if len(body) != test.received {
+			t.Errorf("received=%d quirk=%v: got %d bytes",
+				test.received, test.quirk, len(body))
+		}
+
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("received=%d quirk=%v: unexpected error %s",
+				test.received, test.quirk, err)
+		case !test.ok && err != io.ErrUnexpectedEOF:
+			t.Errorf("received=%d quirk=%v: expected %s, got %v",
+				test.received, test.quirk, io.ErrUnexpectedEOF, err)
+		}
+
+		if !wrap.drained {
+			t.Errorf("received=%d quirk=%v: must be drained",
+				test.received, test.quirk)
+		}
+	}
+}
+
+// testUsbIface simulates USB interface of device, that
+// stops sending data after returning its portion
+type testUsbIface struct {
+	data  []byte // Data to be received
+	reads int    // Count of Recv calls
+}
+
+// Recv returns remaining data, then zero-size reads forever
+func (iface *testUsbIface) Recv(data []byte,
+	timeout time.Duration) (int, error) {
+	iface.reads++
+	n := copy(data, iface.data)
+	iface.data = iface.data[n:]
+	return n, nil
+}
+
+// Send consumes all data
+func (iface *testUsbIface) Send(data []byte,
+	timeout time.Duration) (int, error) {
+	return len(data), nil
+}
+
+// SoftReset does nothing
+func (iface *testUsbIface) SoftReset() error { return nil }
+
+// Close does nothing
+func (iface *testUsbIface) Close() {}
+
+// Test that usbConn.Read gives up waiting for the truncated
+// response body after the short-read-timeout
+func TestUsbConnShortRead(t *testing.T) {
+	transport := &UsbTransport{
+		log:       NewLogger(),
+		connstate: newUsbConnState(1),
+	}
+	transport.usbLog = transport.log.Subsys(LogSubsysUSB)
+
+	iface := &testUsbIface{data: []byte("xxxxx")}
+	conn := &usbConn{
+		transport:        transport,
+		iface:            iface,
+		shortReadTimeout: 250 * time.Millisecond,
+		shortReadOK:      true,
+	}
+
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if n != 5 || err != nil {
+		t.Fatalf("Read: expected 5, <nil>, got %d, %v", n, err)
+	}
+
+	// Device has stopped sending data: wait a bit, then EOF
+	start := time.Now()
+	n, err = conn.Read(buf)
+	elapsed := time.Since(start)
+
+	if n != 0 || err != io.EOF {
+		t.Errorf("Read: expected 0, EOF, got %d, %v", n, err)
+	}
+
+	if elapsed < conn.shortReadTimeout {
+		t.Errorf("Read: EOF after %s, expected at least %s",
+			elapsed, conn.shortReadTimeout)
+	}
+
+	if iface.reads < 3 {
+		t.Errorf("Read: device polled only %d times", iface.reads)
+	}
+}
+
+// Test Close of the transport, that has released the device
+// due to inactivity
+func TestUsbTransportIdleClose(t *testing.T) {
+	transport := &UsbTransport{
+		log:           NewLogger(),
+		shutdown:      make(chan struct{}),
+		idleSuspended: true,
+	}
+	transport.usbLog = transport.log.Subsys(LogSubsysUSB)
+	transport.idleTimer = time.AfterFunc(time.Hour, transport.idleExpired)
+
+	transport.Close(false)
+
+	// Closed device must never be resumed
+	if err := transport.idleBegin(); err != ErrShutdown {
+		t.Errorf("idleBegin: expected %s, got %v", ErrShutdown, err)
+	}
+
+	// Late idle timer must not touch the device
+	transport.idleExpired()
+	if transport.idleTimer != nil || !transport.idleSuspended {
+		t.Errorf("idle state changed after Close")
+	}
+}
+
+// Test allocation of the particular connection and disabling
+// of interfaces
+func TestUsbTransportInterfaceSelect(t *testing.T) {
+	transport := &UsbTransport{
+		log:          NewLogger(),
+		connReleased: make(chan struct{}),
+		shutdown:     make(chan struct{}),
+		connSelected: -1,
+	}
+	transport.usbLog = transport.log.Subsys(LogSubsysUSB)
+
+	const cnt = 3
+	transport.connPool = make(chan *usbConn, cnt)
+	transport.connstate = newUsbConnState(cnt)
+	for i := 0; i < cnt; i++ {
+		conn := &usbConn{transport: transport, index: i}
+		conn.reader = bufio.NewReader(conn)
+		transport.connList = append(transport.connList, conn)
+		transport.connPool <- conn
+	}
+
+	ctx := context.Background()
+
+	// Allocate the particular connection
+	conn, err := transport.usbConnGet(ctx, 2)
+	if err != nil || conn.index != 2 {
+		t.Fatalf("usbConnGet(2): got %v, %v", conn, err)
+	}
+
+	if n := transport.connInUse(); n != 1 {
+		t.Errorf("connInUse: expected 1, got %d", n)
+	}
+
+	// Disable busy and idle interfaces, select the remaining one
+	transport.SelectInterface(1)
+	transport.DisableInterface(0)
+	transport.DisableInterface(1)
+	transport.DisableInterface(2)
+	if transport.SelectedInterface() != 1 {
+		t.Errorf("SelectedInterface: expected 1, got %d",
+			transport.SelectedInterface())
+	}
+
+	conn.put()
+	if n := transport.connInUse(); n != 0 {
+		t.Errorf("connInUse: expected 0, got %d", n)
+	}
+
+	_, err = transport.usbConnGet(ctx, 0)
+	if err == nil {
+		t.Errorf("usbConnGet(0): disabled interface allocated")
+	}
+
+	// Only the selected interface must be allocated now
+	for i := 0; i < cnt; i++ {
+		conn, err = transport.usbConnGet(ctx, -1)
+		if err != nil || conn.index != 1 {
+			t.Fatalf("usbConnGet(-1): got %v, %v", conn, err)
+		}
+		conn.put()
+	}
+
+	if n := transport.connInUse(); n != 0 {
+		t.Errorf("connInUse: expected 0, got %d", n)
+	}
+}
@@ -0,0 +1,157 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Watchdog of persistent device failures
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Watchdog counts consecutive transport failures of the device,
+// and resets the device, when failures become persistent (i.e.,
+// device is half-dead)
+//
+// Failures are counted within the window, started by the first
+// failure of the streak. Any successful transaction breaks the
+// streak. See the watchdog-failures and watchdog-window parameters
+//
+// While the streak is in progress, device is periodically probed
+// (see SetProbe), so device that stopped responding is reset, even
+// if clients don't send requests anymore
+type Watchdog struct {
+	log      *LogMessage   // Device's logger
+	reset    func() error  // Resets the device
+	probe    func() error  // Liveness probe, nil if not set
+	interval time.Duration // Probe interval
+	lock     sync.Mutex    // Access lock
+	streak   int           // Count of consecutive failures
+	start    time.Time     // Time of the first failure in streak
+	timer    *time.Timer   // Pending probe, nil if none
+	closed   bool          // Watchdog is closed
+}
+
+// NewWatchdog creates a new Watchdog. The reset callback
+// is called from its own goroutine
+func NewWatchdog(log *LogMessage, reset func() error) *Watchdog {
+	return &Watchdog{
+		log:      log,
+		reset:    reset,
+		interval: WatchdogProbeInterval,
+	}
+}
+
+// SetProbe sets the liveness probe of the device. Probe error
+// counts as transaction failure, probe success breaks the streak.
+// The probe is called from its own goroutine
+func (wd *Watchdog) SetProbe(probe func() error) {
+	wd.lock.Lock()
+	wd.probe = probe
+	wd.lock.Unlock()
+}
+
+// Close stops probing of the device
+func (wd *Watchdog) Close() {
+	wd.lock.Lock()
+	wd.closed = true
+	if wd.timer != nil {
+		wd.timer.Stop()
+		wd.timer = nil
+	}
+	wd.lock.Unlock()
+}
+
+// Success reports successful transaction
+func (wd *Watchdog) Success() {
+	wd.lock.Lock()
+	wd.streak = 0
+	wd.lock.Unlock()
+}
+
+// Failure reports failed transaction. If watchdog decides
+// to reset the device, it returns true
+//
+// ErrResume means, device released due to inactivity cannot
+// be reopened, so it is reset immediately, even if watchdog
+// is disabled
+func (wd *Watchdog) Failure(err error) bool {
+	if err == ErrResume {
+		wd.log.Error('!', "watchdog: %s, resetting device", err)
+		wd.fire()
+		return true
+	}
+
+	limit := int(Conf.UsbWdFailures)
+	if limit == 0 {
+		return false
+	}
+
+	wd.lock.Lock()
+	now := time.Now()
+	if wd.streak == 0 ||
+		(Conf.UsbWdWindow > 0 && now.Sub(wd.start) > Conf.UsbWdWindow) {
+		wd.streak = 0
+		wd.start = now
+	}
+
+	wd.streak++
+	streak := wd.streak
+	elapsed := now.Sub(wd.start)
+	fire := streak >= limit
+	if fire {
+		wd.streak = 0
+	} else if wd.probe != nil && wd.timer == nil && !wd.closed {
+		wd.timer = time.AfterFunc(wd.interval, wd.runProbe)
+	}
+	wd.lock.Unlock()
+
+	wd.log.Debug(' ', "watchdog: failure %d of %d: %s", streak, limit, err)
+
+	if !fire {
+		return false
+	}
+
+	wd.log.Error('!', "watchdog: %d consecutive failures in %s, "+
+		"resetting device", streak, elapsed.Round(time.Millisecond))
+
+	wd.fire()
+
+	return true
+}
+
+// fire resets the device in background
+func (wd *Watchdog) fire() {
+	go func() {
+		err := wd.reset()
+		if err != nil {
+			wd.log.Error('!', "watchdog: reset: %s", err)
+		}
+	}()
+}
+
+// runProbe probes the device, if the streak of failures
+// is still in progress
+func (wd *Watchdog) runProbe() {
+	wd.lock.Lock()
+	wd.timer = nil
+	probe := wd.probe
+	skip := wd.closed || wd.streak == 0
+	wd.lock.Unlock()
+
+	if skip {
+		return
+	}
+
+	err := probe()
+	if err == nil {
+		wd.log.Debug(' ', "watchdog: device is alive")
+		wd.Success()
+	} else {
+		wd.Failure(err)
+	}
+}
@@ -0,0 +1,167 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Tests for device watchdog
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test watchdog triggering and streak reset
+func TestWatchdog(t *testing.T) {
+	saveFailures, saveWindow := Conf.UsbWdFailures, Conf.UsbWdWindow
+	defer func() {
+		Conf.UsbWdFailures, Conf.UsbWdWindow = saveFailures, saveWindow
+	}()
+
+	resets := make(chan struct{}, 10)
+	wd := NewWatchdog(NewLogger().Subsys(LogSubsysUSB), func() error {
+		resets <- struct{}{}
+		return nil
+	})
+	err := errors.New("I/O error")
+
+	// Disabled watchdog never fires
+	Conf.UsbWdFailures, Conf.UsbWdWindow = 0, time.Minute
+	for i := 0; i < 10; i++ {
+		if wd.Failure(err) {
+			t.Fatalf("disabled watchdog fired")
+		}
+	}
+
+	// Fires on Nth consecutive failure
+	Conf.UsbWdFailures = 3
+	if wd.Failure(err) || wd.Failure(err) {
+		t.Errorf("watchdog fired too early")
+	}
+	if !wd.Failure(err) {
+		t.Errorf("watchdog didn't fire after 3 failures")
+	}
+
+	select {
+	case <-resets:
+	case <-time.After(time.Second):
+		t.Errorf("reset callback not called")
+	}
+
+	// Success breaks the streak
+	wd.Failure(err)
+	wd.Failure(err)
+	wd.Success()
+	if wd.Failure(err) {
+		t.Errorf("watchdog fired after success")
+	}
+
+	// Expired window restarts the streak
+	wd.Success()
+	Conf.UsbWdWindow = time.Millisecond
+	wd.Failure(err)
+	wd.Failure(err)
+	time.Sleep(10 * time.Millisecond)
+	if wd.Failure(err) {
+		t.Errorf("watchdog fired after window expired")
+	}
+}
+
+// Test that failed resume of the device after idle
+// resets the device immediately
+func TestWatchdogResume(t *testing.T) {
+	saveFailures := Conf.UsbWdFailures
+	defer func() { Conf.UsbWdFailures = saveFailures }()
+
+	resets := make(chan struct{}, 10)
+	wd := NewWatchdog(NewLogger().Subsys(LogSubsysUSB), func() error {
+		resets <- struct{}{}
+		return nil
+	})
+
+	for _, limit := range []uint{0, 3} {
+		Conf.UsbWdFailures = limit
+		if !wd.Failure(ErrResume) {
+			t.Errorf("failures=%d: watchdog didn't fire", limit)
+		}
+
+		select {
+		case <-resets:
+		case <-time.After(time.Second):
+			t.Errorf("failures=%d: reset callback not called", limit)
+		}
+	}
+}
+
+// Test probing of the device while the streak is in progress
+func TestWatchdogProbe(t *testing.T) {
+	saveFailures, saveWindow := Conf.UsbWdFailures, Conf.UsbWdWindow
+	defer func() {
+		Conf.UsbWdFailures, Conf.UsbWdWindow = saveFailures, saveWindow
+	}()
+
+	Conf.UsbWdFailures, Conf.UsbWdWindow = 3, time.Minute
+
+	resets := make(chan struct{}, 10)
+	wd := NewWatchdog(NewLogger().Subsys(LogSubsysUSB), func() error {
+		resets <- struct{}{}
+		return nil
+	})
+	wd.interval = time.Millisecond
+
+	probes := make(chan struct{}, 10)
+	var probeErr error
+	wd.SetProbe(func() error {
+		probes <- struct{}{}
+		return probeErr
+	})
+
+	// Dead device is reset by probes, without more requests
+	probeErr = errors.New("I/O error")
+	wd.Failure(probeErr)
+
+	select {
+	case <-resets:
+	case <-time.After(time.Second):
+		t.Fatalf("device not reset by probes")
+	}
+
+	if n := len(probes); n != 2 {
+		t.Errorf("expected 2 probes, got %d", n)
+	}
+
+	// Alive device breaks the streak
+	for len(probes) != 0 {
+		<-probes
+	}
+
+	probeErr = nil
+	wd.Failure(errors.New("I/O error"))
+
+	select {
+	case <-probes:
+	case <-time.After(time.Second):
+		t.Fatalf("device not probed")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	wd.lock.Lock()
+	streak := wd.streak
+	wd.lock.Unlock()
+
+	if streak != 0 {
+		t.Errorf("streak not broken by successful probe")
+	}
+
+	// Closed watchdog doesn't probe
+	wd.Close()
+	wd.Failure(errors.New("I/O error"))
+	time.Sleep(10 * time.Millisecond)
+
+	if n := len(probes); n != 0 {
+		t.Errorf("closed watchdog: unexpected probes")
+	}
+}